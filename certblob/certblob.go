@@ -3,12 +3,16 @@
 package certblob
 
 import (
+	"crypto/sha1"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"sort"
+	"strings"
+	"unicode/utf16"
 
 	"github.com/namecoin/certinject/x509ext"
 )
@@ -29,6 +33,22 @@ const (
 
 const propReserved = 1
 
+// HashPropIDs lists the properties that Windows computes from the cert itself
+// (hashes and key identifiers).  They don't affect trust, so it's safe to
+// keep them when resetting a cert's properties, which saves Windows from
+// recomputing them.
+var HashPropIDs = []uint32{
+	CertSHA1HashPropID,
+	CertMD5HashPropID,
+	CertSignatureHashPropID,
+	CertKeyIdentifierPropID,
+	CertIssuerPublicKeyMD5HashPropID,
+	CertSubjectPublicKeyMD5HashPropID,
+	CertIssuerSerialNumberMD5HashPropID,
+	CertSubjectNameMD5HashPropID,
+	CertSha256HashPropID,
+}
+
 var (
 	ErrProperty             = errors.New("CryptoAPI blob property")
 	ErrPropertyBuild        = fmt.Errorf("error building: %w", ErrProperty)
@@ -38,6 +58,13 @@ var (
 )
 
 func (prop *Property) Marshal() ([]byte, error) {
+	return prop.MarshalAppend(nil)
+}
+
+// MarshalAppend appends the marshaled property to dst and returns the
+// extended buffer, like Marshal, but without allocating if dst has enough
+// capacity.
+func (prop *Property) MarshalAppend(dst []byte) ([]byte, error) {
 	if prop.Value == nil {
 		return nil, fmt.Errorf("nil: %w", ErrPropertyInvalidValue)
 	}
@@ -46,17 +73,13 @@ func (prop *Property) Marshal() ([]byte, error) {
 		return nil, fmt.Errorf("overflows uint32 size: %w", ErrPropertyInvalidValue)
 	}
 
-	result := make([]byte, 4+4+4)
-
 	// Marshal header
-	binary.LittleEndian.PutUint32(result[0:], prop.ID)
-	binary.LittleEndian.PutUint32(result[4:], propReserved)
-	binary.LittleEndian.PutUint32(result[8:], uint32(len(prop.Value)))
+	dst = binary.LittleEndian.AppendUint32(dst, prop.ID)
+	dst = binary.LittleEndian.AppendUint32(dst, propReserved)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(prop.Value)))
 
 	// Append value
-	result = append(result, prop.Value...)
-
-	return result, nil
+	return append(dst, prop.Value...), nil
 }
 
 func isContentPropID(propID uint32) bool {
@@ -72,6 +95,11 @@ func isContentPropID(propID uint32) bool {
 	return false
 }
 
+// BuildExtKeyUsage builds an extended key usage property listing the
+// template's ExtKeyUsage and UnknownExtKeyUsage.  This is the
+// CERT_ENHKEY_USAGE_PROP_ID (0x09) property that certmgr edits, which
+// restricts the cert's purposes in the OS without reissuing it; it takes
+// precedence over the cert's own EKU extension.
 func BuildExtKeyUsage(template *x509.Certificate) (*Property, error) {
 	value, err := x509ext.BuildExtKeyUsage(template)
 	if err != nil {
@@ -84,6 +112,133 @@ func BuildExtKeyUsage(template *x509.Certificate) (*Property, error) {
 	}, nil
 }
 
+// BuildEmptyExtKeyUsage builds an extended key usage property that lists no
+// purposes.  CryptoAPI treats such a cert as disabled for all purposes.
+func BuildEmptyExtKeyUsage() (*Property, error) {
+	value, err := asn1.Marshal([]asn1.ObjectIdentifier{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrPropertyBuild)
+	}
+
+	return &Property{
+		ID:    CertEnhkeyUsagePropID,
+		Value: value,
+	}, nil
+}
+
+// ParseExtKeyUsage is the inverse of BuildExtKeyUsage.  It returns the
+// usages known to crypto/x509 and the OIDs of any others separately, like
+// the ExtKeyUsage and UnknownExtKeyUsage fields of a certificate.  An empty
+// property (see BuildEmptyExtKeyUsage) yields no usages.
+func ParseExtKeyUsage(prop *Property) ([]x509.ExtKeyUsage, []asn1.ObjectIdentifier, error) {
+	if prop.ID != CertEnhkeyUsagePropID {
+		return nil, nil, fmt.Errorf("property %d isn't an extended key usage: %w", prop.ID, ErrPropertyParse)
+	}
+
+	template, err := x509ext.ParseExtKeyUsage(prop.Value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", err, ErrPropertyParse)
+	}
+
+	return template.ExtKeyUsage, template.UnknownExtKeyUsage, nil
+}
+
+// extKeyUsageLabels names the usages known to crypto/x509 the way certmgr
+// shows them.
+var extKeyUsageLabels = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            "Any Purpose",
+	x509.ExtKeyUsageServerAuth:                     "Server Authentication",
+	x509.ExtKeyUsageClientAuth:                     "Client Authentication",
+	x509.ExtKeyUsageCodeSigning:                    "Code Signing",
+	x509.ExtKeyUsageEmailProtection:                "Secure Email",
+	x509.ExtKeyUsageIPSECEndSystem:                 "IP security end system",
+	x509.ExtKeyUsageIPSECTunnel:                    "IP security tunnel termination",
+	x509.ExtKeyUsageIPSECUser:                      "IP security user",
+	x509.ExtKeyUsageTimeStamping:                   "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:                    "OCSP Signing",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "Microsoft Server Gated Crypto",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      "Netscape Server Gated Crypto",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "Microsoft Commercial Code Signing",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "Kernel Mode Code Signing",
+}
+
+// extKeyUsageOIDLabels names other usages that are common in Windows stores,
+// keyed by dotted OID.
+var extKeyUsageOIDLabels = map[string]string{
+	"1.3.6.1.4.1.311.10.3.1":  "Microsoft Trust List Signing",
+	"1.3.6.1.4.1.311.10.3.4":  "Encrypting File System",
+	"1.3.6.1.4.1.311.10.3.12": "Document Signing",
+	"1.3.6.1.4.1.311.20.2.2":  "Smart Card Logon",
+	"1.3.6.1.5.5.7.3.17":      "IKE intermediate",
+	"1.3.6.1.5.2.3.5":         "KDC Authentication",
+}
+
+// ExtKeyUsageLabel returns a human-readable name for the usage, or its
+// number if it's unknown.
+func ExtKeyUsageLabel(eku x509.ExtKeyUsage) string {
+	label, ok := extKeyUsageLabels[eku]
+	if !ok {
+		return fmt.Sprintf("unknown usage %d", eku)
+	}
+
+	return label
+}
+
+// ExtKeyUsageOIDLabel is like ExtKeyUsageLabel, for usages that crypto/x509
+// doesn't know.  Unknown OIDs are returned in dotted form.
+func ExtKeyUsageOIDLabel(oid asn1.ObjectIdentifier) string {
+	label, ok := extKeyUsageOIDLabels[oid.String()]
+	if !ok {
+		return oid.String()
+	}
+
+	return label
+}
+
+// BuildKeyIdentifier builds a key identifier property for the given cert.  If
+// the cert has a Subject Key Identifier extension, its value is used;
+// otherwise the key identifier is computed as the SHA-1 hash of the subject
+// public key, as per method (1) of RFC 5280 section 4.2.1.2.
+func BuildKeyIdentifier(cert *x509.Certificate) (*Property, error) {
+	if len(cert.SubjectKeyId) != 0 {
+		return &Property{
+			ID:    CertKeyIdentifierPropID,
+			Value: cert.SubjectKeyId,
+		}, nil
+	}
+
+	var spki struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+
+	_, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return nil, fmt.Errorf("%s: couldn't parse subject public key: %w", err, ErrPropertyBuild)
+	}
+
+	keyID := sha1.Sum(spki.PublicKey.Bytes) // #nosec G401
+
+	return &Property{
+		ID:    CertKeyIdentifierPropID,
+		Value: keyID[:],
+	}, nil
+}
+
+// ParseKeyIdentifier is the inverse of BuildKeyIdentifier.  It returns the
+// key identifier, which must not be empty.
+func ParseKeyIdentifier(prop *Property) ([]byte, error) {
+	if prop.ID != CertKeyIdentifierPropID {
+		return nil, fmt.Errorf("property %d isn't a key identifier: %w", prop.ID, ErrPropertyParse)
+	}
+
+	if len(prop.Value) == 0 {
+		return nil, fmt.Errorf("empty key identifier: %w", ErrPropertyParse)
+	}
+
+	return prop.Value, nil
+}
+
 func BuildNameConstraints(template *x509.Certificate) (*Property, error) {
 	value, err := x509ext.BuildNameConstraints(template)
 	if err != nil {
@@ -96,12 +251,104 @@ func BuildNameConstraints(template *x509.Certificate) (*Property, error) {
 	}, nil
 }
 
+// BuildFriendlyName builds a friendly name property.  CryptoAPI stores it as
+// a NUL-terminated UTF-16LE string.
+func BuildFriendlyName(name string) (*Property, error) {
+	return buildString(CertFriendlyNamePropID, "friendly name", name)
+}
+
+// ParseFriendlyName is the inverse of BuildFriendlyName.  A missing NUL
+// terminator is tolerated, since other tools may omit it.
+func ParseFriendlyName(prop *Property) (string, error) {
+	return parseString(prop, CertFriendlyNamePropID, "friendly name")
+}
+
+// BuildDescription builds a description property, which is shown in the
+// cert's details.  It's encoded like the friendly name.
+func BuildDescription(text string) (*Property, error) {
+	return buildString(CertDescriptionPropID, "description", text)
+}
+
+// ParseDescription is the inverse of BuildDescription.
+func ParseDescription(prop *Property) (string, error) {
+	return parseString(prop, CertDescriptionPropID, "description")
+}
+
+// buildString builds a property holding a NUL-terminated UTF-16LE string.
+func buildString(id uint32, what, text string) (*Property, error) {
+	if strings.ContainsRune(text, 0) {
+		return nil, fmt.Errorf("%s contains NUL: %w", what, ErrPropertyBuild)
+	}
+
+	encoded := utf16.Encode([]rune(text + "\x00"))
+
+	value := make([]byte, 2*len(encoded))
+	for i, unit := range encoded {
+		binary.LittleEndian.PutUint16(value[2*i:], unit)
+	}
+
+	return &Property{
+		ID:    id,
+		Value: value,
+	}, nil
+}
+
+// parseString is the inverse of buildString.
+func parseString(prop *Property, id uint32, what string) (string, error) {
+	if prop.ID != id {
+		return "", fmt.Errorf("property %d isn't a %s: %w", prop.ID, what, ErrPropertyParse)
+	}
+
+	if len(prop.Value)%2 != 0 {
+		return "", fmt.Errorf("odd UTF-16 length %d: %w", len(prop.Value), ErrPropertyParse)
+	}
+
+	units := make([]uint16, 0, len(prop.Value)/2)
+	for i := 0; i < len(prop.Value); i += 2 {
+		unit := binary.LittleEndian.Uint16(prop.Value[i:])
+		if unit == 0 {
+			break
+		}
+
+		units = append(units, unit)
+	}
+
+	return string(utf16.Decode(units)), nil
+}
+
+// ParseNameConstraints is the inverse of BuildNameConstraints.  The name
+// constraints are returned in the corresponding fields of a certificate
+// template.
+func ParseNameConstraints(prop *Property) (*x509.Certificate, error) {
+	if prop.ID != CertRootProgramNameConstraintsPropID {
+		return nil, fmt.Errorf("property %d isn't name constraints: %w", prop.ID, ErrPropertyParse)
+	}
+
+	template, err := x509ext.ParseNameConstraints(prop.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrPropertyParse)
+	}
+
+	return template, nil
+}
+
 type Blob map[uint32][]byte
 
 func (b Blob) SetProperty(prop *Property) {
 	b[prop.ID] = prop.Value
 }
 
+// DeleteProperty removes the property with the given ID, if present.
+func (b Blob) DeleteProperty(id uint32) {
+	delete(b, id)
+}
+
+// PropertyIDs returns the ID's of all properties in the blob, in the order
+// they're marshaled.
+func (b Blob) PropertyIDs() []uint32 {
+	return b.sortedIDs()
+}
+
 // We sort the ID's so that we get a deterministic Marshaling.
 func (b Blob) sortedIDs() []uint32 {
 	propIDs := make([]uint32, 0, len(b))
@@ -128,45 +375,48 @@ func (b Blob) sortedIDs() []uint32 {
 }
 
 func (b Blob) Marshal() ([]byte, error) {
+	return b.MarshalAppend([]byte{})
+}
+
+// MarshalAppend appends the marshaled blob to dst and returns the extended
+// buffer, like Marshal.  Reusing one buffer (e.g. dst[:0] of the previous
+// result) across many blobs avoids allocating for each of them.
+func (b Blob) MarshalAppend(dst []byte) ([]byte, error) {
 	propIDs := b.sortedIDs()
 
-	result := make([]byte, 0)
-
-	var (
-		singleProperty       Property
-		resultSingleProperty []byte
-		err                  error
-	)
+	var err error
 
 	// Iterate through the sorted ID's
 	for _, pid := range propIDs {
-		// Construct a Property
-		singleProperty = Property{ID: pid, Value: b[pid]}
+		// Construct a Property, and append its bytes to the result
+		singleProperty := Property{ID: pid, Value: b[pid]}
 
-		// Marshal the Property
-		resultSingleProperty, err = singleProperty.Marshal()
+		dst, err = singleProperty.MarshalAppend(dst)
 		if err != nil {
 			return nil, fmt.Errorf("ID %d: %w", pid, err)
 		}
-
-		// Append the Property's bytes to the result
-		result = append(result, resultSingleProperty...)
 	}
 
-	return result, nil
+	return dst, nil
 }
 
+// ParseBlob parses a serialized blob.  Parse errors wrap ErrPropertyParse,
+// and report the byte offset (from the start of data) at which parsing failed
+// and, once its header has been read that far, the ID of the property being
+// read.
 func ParseBlob(data []byte) (Blob, error) {
 	result := Blob{}
 
 	var (
 		prop    Property
 		propLen int
+		offset  int
 	)
 
 	for len(data) > 0 {
-		if len(data) < 12 {
-			return nil, fmt.Errorf("length inconsistent: %w", ErrPropertyParse)
+		if len(data) < 4 {
+			return nil, fmt.Errorf("offset %d: header truncated (%d of 12 bytes): %w", offset, len(data),
+				ErrPropertyParse)
 		}
 
 		prop = Property{}
@@ -174,18 +424,31 @@ func ParseBlob(data []byte) (Blob, error) {
 		// PropID is the first 4 bytes
 		prop.ID = binary.LittleEndian.Uint32(data[0:])
 
+		if len(data) < 12 {
+			return nil, fmt.Errorf("offset %d: property %d: header truncated (%d of 12 bytes): %w", offset,
+				prop.ID, len(data), ErrPropertyParse)
+		}
+
 		// Reserved value is the next 4 bytes
-		if binary.LittleEndian.Uint32(data[4:]) != propReserved {
-			return nil, fmt.Errorf("unexpected reserved field: %w", ErrPropertyParse)
+		if reserved := binary.LittleEndian.Uint32(data[4:]); reserved != propReserved {
+			return nil, fmt.Errorf("offset %d: property %d: unexpected reserved field %d: %w", offset+4,
+				prop.ID, reserved, ErrPropertyParse)
 		}
 
 		// Then the value size
 		propLen = int(binary.LittleEndian.Uint32(data[8:]))
 		data = data[12:]
+		offset += 12
+
+		if propLen > len(data) {
+			return nil, fmt.Errorf("offset %d: property %d: value truncated (%d of %d bytes): %w", offset,
+				prop.ID, len(data), propLen, ErrPropertyParse)
+		}
 
 		// And finally the value itself
 		prop.Value = data[:propLen]
 		data = data[propLen:]
+		offset += propLen
 
 		result.SetProperty(&prop)
 	}
@@ -0,0 +1,428 @@
+package certblob_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+func TestBuildEmptyExtKeyUsage(t *testing.T) {
+	prop, err := certblob.BuildEmptyExtKeyUsage()
+	if err != nil {
+		t.Fatalf("couldn't build empty EKU property: %v", err)
+	}
+
+	if prop.ID != certblob.CertEnhkeyUsagePropID {
+		t.Errorf("expected property ID %d, got %d", certblob.CertEnhkeyUsagePropID, prop.ID)
+	}
+
+	// An empty DER SEQUENCE.
+	if !bytes.Equal(prop.Value, []byte{0x30, 0x00}) {
+		t.Errorf("expected empty SEQUENCE, got %x", prop.Value)
+	}
+}
+
+func TestBuildExtKeyUsagePropID(t *testing.T) {
+	prop, err := certblob.BuildExtKeyUsage(&x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatalf("couldn't build EKU property: %v", err)
+	}
+
+	// CERT_ENHKEY_USAGE_PROP_ID, which overrides the cert's own EKU.
+	if prop.ID != 0x09 || certblob.CertEnhkeyUsagePropID != 0x09 {
+		t.Errorf("expected property ID 0x09, got %#x", prop.ID)
+	}
+
+	var oids []asn1.ObjectIdentifier
+
+	rest, err := asn1.Unmarshal(prop.Value, &oids)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("couldn't parse EKU property: %v", err)
+	}
+
+	serverAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	if len(oids) != 1 || !oids[0].Equal(serverAuth) {
+		t.Errorf("expected serverAuth, got %v", oids)
+	}
+}
+
+func TestBuildKeyIdentifierRoundTrip(t *testing.T) {
+	derBytes, err := os.ReadFile("../testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read test cert: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse test cert: %v", err)
+	}
+
+	prop, err := certblob.BuildKeyIdentifier(cert)
+	if err != nil {
+		t.Fatalf("couldn't build key identifier property: %v", err)
+	}
+
+	if len(cert.SubjectKeyId) != 0 && !bytes.Equal(prop.Value, cert.SubjectKeyId) {
+		t.Errorf("expected key identifier %x from SKI extension, got %x", cert.SubjectKeyId, prop.Value)
+	}
+
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+	blob.SetProperty(prop)
+
+	blobBytes, err := blob.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	parsed, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse blob: %v", err)
+	}
+
+	if !bytes.Equal(parsed[certblob.CertKeyIdentifierPropID], prop.Value) {
+		t.Errorf("key identifier didn't round-trip: got %x, expected %x",
+			parsed[certblob.CertKeyIdentifierPropID], prop.Value)
+	}
+}
+
+func TestBuildKeyIdentifierFromPublicKey(t *testing.T) {
+	derBytes, err := os.ReadFile("../testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read test cert: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse test cert: %v", err)
+	}
+
+	cert.SubjectKeyId = nil
+
+	prop, err := certblob.BuildKeyIdentifier(cert)
+	if err != nil {
+		t.Fatalf("couldn't build key identifier property: %v", err)
+	}
+
+	if len(prop.Value) != sha1.Size {
+		t.Errorf("expected a SHA-1 key identifier, got %x", prop.Value)
+	}
+}
+
+func TestParseBlobTruncated(t *testing.T) {
+	blobBytes, err := certblob.Blob{certblob.CertFriendlyNamePropID: []byte("Namecoin")}.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	_, err = certblob.ParseBlob(blobBytes[:len(blobBytes)-1])
+	if !errors.Is(err, certblob.ErrPropertyParse) {
+		t.Errorf("expected ErrPropertyParse for truncated blob, got: %v", err)
+	}
+}
+
+func TestParseBlobErrorOffset(t *testing.T) {
+	// Property 11 (8-byte value) at offset 0, then property 32 (4-byte
+	// value) at offset 20, for 36 bytes in total.
+	blobBytes, err := certblob.Blob{
+		certblob.CertFriendlyNamePropID: []byte("Namecoin"),
+		certblob.CertContentCertPropID:  {1, 2, 3, 4},
+	}.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	badReserved := append([]byte{}, blobBytes...)
+	badReserved[24] = 2
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"first header before ID", blobBytes[:2], "offset 0: header truncated"},
+		{"first header after ID", blobBytes[:8], "offset 0: property 11: header truncated"},
+		{"first value", blobBytes[:15], "offset 12: property 11: value truncated (3 of 8 bytes)"},
+		{"second header before ID", blobBytes[:22], "offset 20: header truncated"},
+		{"second value", blobBytes[:34], "offset 32: property 32: value truncated (2 of 4 bytes)"},
+		{"reserved field", badReserved, "offset 24: property 32: unexpected reserved field 2"},
+	}
+
+	for _, tc := range tests {
+		_, err := certblob.ParseBlob(tc.data)
+		if !errors.Is(err, certblob.ErrPropertyParse) {
+			t.Errorf("%s: expected ErrPropertyParse, got: %v", tc.name, err)
+
+			continue
+		}
+
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error containing %q, got: %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestParseExtKeyUsageRoundTrip(t *testing.T) {
+	smartCardLogon := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}
+	template := &x509.Certificate{
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageCodeSigning},
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{smartCardLogon},
+	}
+
+	prop, err := certblob.BuildExtKeyUsage(template)
+	if err != nil {
+		t.Fatalf("couldn't build EKU property: %v", err)
+	}
+
+	ekus, unknown, err := certblob.ParseExtKeyUsage(prop)
+	if err != nil {
+		t.Fatalf("couldn't parse EKU property: %v", err)
+	}
+
+	if !reflect.DeepEqual(ekus, template.ExtKeyUsage) {
+		t.Errorf("expected %v, got %v", template.ExtKeyUsage, ekus)
+	}
+
+	if len(unknown) != 1 || !unknown[0].Equal(smartCardLogon) {
+		t.Errorf("expected [%v], got %v", smartCardLogon, unknown)
+	}
+
+	labels := []string{certblob.ExtKeyUsageLabel(ekus[0]), certblob.ExtKeyUsageLabel(ekus[1]),
+		certblob.ExtKeyUsageOIDLabel(unknown[0])}
+	if !reflect.DeepEqual(labels, []string{"Server Authentication", "Code Signing", "Smart Card Logon"}) {
+		t.Errorf("unexpected labels %q", labels)
+	}
+
+	if label := certblob.ExtKeyUsageOIDLabel(asn1.ObjectIdentifier{1, 2, 3}); label != "1.2.3" {
+		t.Errorf("expected an unknown OID to be shown dotted, got %q", label)
+	}
+}
+
+func TestParseExtKeyUsageEmpty(t *testing.T) {
+	prop, err := certblob.BuildEmptyExtKeyUsage()
+	if err != nil {
+		t.Fatalf("couldn't build empty EKU property: %v", err)
+	}
+
+	ekus, unknown, err := certblob.ParseExtKeyUsage(prop)
+	if err != nil || len(ekus) != 0 || len(unknown) != 0 {
+		t.Errorf("expected no usages, got %v %v (err %v)", ekus, unknown, err)
+	}
+
+	_, _, err = certblob.ParseExtKeyUsage(&certblob.Property{
+		ID:    certblob.CertFriendlyNamePropID,
+		Value: []byte{0x30, 0x00},
+	})
+	if !errors.Is(err, certblob.ErrPropertyParse) {
+		t.Errorf("expected ErrPropertyParse for the wrong property, got %v", err)
+	}
+}
+
+func TestParseNameConstraintsRoundTrip(t *testing.T) {
+	_, ipNet, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("couldn't parse CIDR: %v", err)
+	}
+
+	template := &x509.Certificate{
+		PermittedDNSDomains: []string{"bit", "example.bit"},
+		ExcludedDNSDomains:  []string{"evil.bit"},
+		PermittedIPRanges:   []*net.IPNet{ipNet},
+	}
+
+	prop, err := certblob.BuildNameConstraints(template)
+	if err != nil {
+		t.Fatalf("couldn't build name constraints: %v", err)
+	}
+
+	parsed, err := certblob.ParseNameConstraints(prop)
+	if err != nil {
+		t.Fatalf("couldn't parse name constraints: %v", err)
+	}
+
+	if !reflect.DeepEqual(parsed.PermittedDNSDomains, template.PermittedDNSDomains) {
+		t.Errorf("permitted DNS: expected %v, got %v", template.PermittedDNSDomains, parsed.PermittedDNSDomains)
+	}
+
+	if !reflect.DeepEqual(parsed.ExcludedDNSDomains, template.ExcludedDNSDomains) {
+		t.Errorf("excluded DNS: expected %v, got %v", template.ExcludedDNSDomains, parsed.ExcludedDNSDomains)
+	}
+
+	if len(parsed.PermittedIPRanges) != 1 || parsed.PermittedIPRanges[0].String() != ipNet.String() {
+		t.Errorf("permitted IP: expected [%v], got %v", ipNet, parsed.PermittedIPRanges)
+	}
+}
+
+func TestParseNameConstraintsWrongProperty(t *testing.T) {
+	_, err := certblob.ParseNameConstraints(&certblob.Property{
+		ID:    certblob.CertFriendlyNamePropID,
+		Value: []byte("Namecoin"),
+	})
+	if !errors.Is(err, certblob.ErrPropertyParse) {
+		t.Errorf("expected ErrPropertyParse, got: %v", err)
+	}
+}
+
+func TestBuildFriendlyName(t *testing.T) {
+	prop, err := certblob.BuildFriendlyName("NC")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %v", err)
+	}
+
+	if prop.ID != certblob.CertFriendlyNamePropID {
+		t.Errorf("expected property ID %d, got %d", certblob.CertFriendlyNamePropID, prop.ID)
+	}
+
+	// UTF-16LE, NUL-terminated.
+	if !bytes.Equal(prop.Value, []byte{'N', 0, 'C', 0, 0, 0}) {
+		t.Errorf("unexpected friendly name value %x", prop.Value)
+	}
+
+	if _, err := certblob.BuildFriendlyName("N\x00C"); !errors.Is(err, certblob.ErrPropertyBuild) {
+		t.Errorf("expected ErrPropertyBuild for embedded NUL, got: %v", err)
+	}
+}
+
+func TestDescriptionRoundTrip(t *testing.T) {
+	prop, err := certblob.BuildDescription("Namecoin .bit TLD root, added by certinject")
+	if err != nil {
+		t.Fatalf("couldn't build description: %v", err)
+	}
+
+	if prop.ID != 0x0D {
+		t.Errorf("expected property ID 0x0D, got %#x", prop.ID)
+	}
+
+	blob := certblob.Blob{certblob.CertContentCertPropID: []byte{0x30, 0x00}}
+	blob.SetProperty(prop)
+
+	blobBytes, err := blob.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	parsed, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse blob: %v", err)
+	}
+
+	text, err := certblob.ParseDescription(&certblob.Property{
+		ID:    certblob.CertDescriptionPropID,
+		Value: parsed[certblob.CertDescriptionPropID],
+	})
+	if err != nil || text != "Namecoin .bit TLD root, added by certinject" {
+		t.Errorf("expected round trip, got %q (err %v)", text, err)
+	}
+
+	_, err = certblob.ParseDescription(&certblob.Property{ID: certblob.CertFriendlyNamePropID})
+	if !errors.Is(err, certblob.ErrPropertyParse) {
+		t.Errorf("expected ErrPropertyParse for the wrong property, got %v", err)
+	}
+}
+
+func TestParseFriendlyName(t *testing.T) {
+	prop, err := certblob.BuildFriendlyName("Namecoin ✓")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %v", err)
+	}
+
+	name, err := certblob.ParseFriendlyName(prop)
+	if err != nil || name != "Namecoin ✓" {
+		t.Errorf("expected round trip, got %q (err %v)", name, err)
+	}
+
+	// Without the NUL terminator.
+	prop.Value = prop.Value[:len(prop.Value)-2]
+
+	name, err = certblob.ParseFriendlyName(prop)
+	if err != nil || name != "Namecoin ✓" {
+		t.Errorf("expected unterminated name to parse, got %q (err %v)", name, err)
+	}
+}
+
+// testBlob returns a blob with the badssl.com cert and a few properties, as
+// injection would produce.
+func testBlob(tb testing.TB) certblob.Blob {
+	tb.Helper()
+
+	derBytes, err := os.ReadFile("../testdata/badssl.com.der.cert")
+	if err != nil {
+		tb.Fatalf("couldn't read cert: %v", err)
+	}
+
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+
+	for _, build := range []func() (*certblob.Property, error){
+		certblob.BuildEmptyExtKeyUsage,
+		func() (*certblob.Property, error) { return certblob.BuildFriendlyName("Namecoin") },
+		func() (*certblob.Property, error) { return certblob.BuildDescription("Injected by certinject") },
+	} {
+		prop, err := build()
+		if err != nil {
+			tb.Fatalf("couldn't build property: %v", err)
+		}
+
+		blob.SetProperty(prop)
+	}
+
+	return blob
+}
+
+func TestMarshalAppend(t *testing.T) {
+	blob := testBlob(t)
+
+	expected, err := blob.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	prefix := []byte("prefix")
+
+	got, err := blob.MarshalAppend(prefix)
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	if !bytes.Equal(got, append(prefix, expected...)) {
+		t.Error("MarshalAppend didn't append the same bytes as Marshal")
+	}
+}
+
+func BenchmarkBlobMarshal(b *testing.B) {
+	blob := testBlob(b)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := blob.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBlobMarshalAppend(b *testing.B) {
+	blob := testBlob(b)
+
+	var buf []byte
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		var err error
+
+		buf, err = blob.MarshalAppend(buf[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
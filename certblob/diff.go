@@ -0,0 +1,75 @@
+package certblob
+
+import (
+	"bytes"
+	"sort"
+)
+
+// DiffKind describes how a property differs between two blobs.
+type DiffKind int
+
+const (
+	DiffAdded DiffKind = iota
+	DiffRemoved
+	DiffChanged
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffChanged:
+		return "changed"
+	}
+
+	return "unknown"
+}
+
+// PropertyDiff is a single property that differs between two blobs.  Old is
+// nil for added properties, and New is nil for removed properties.
+type PropertyDiff struct {
+	ID   uint32
+	Old  []byte
+	New  []byte
+	Kind DiffKind
+}
+
+// DiffBlobs compares two blobs property-by-property, and returns the
+// properties that differ, sorted by ID.  Identical blobs yield an empty
+// result.
+func DiffBlobs(oldBlob, newBlob Blob) []PropertyDiff {
+	propIDs := make([]uint32, 0, len(oldBlob)+len(newBlob))
+	for id := range oldBlob {
+		propIDs = append(propIDs, id)
+	}
+
+	for id := range newBlob {
+		if _, ok := oldBlob[id]; !ok {
+			propIDs = append(propIDs, id)
+		}
+	}
+
+	sort.Slice(propIDs, func(idx1, idx2 int) bool {
+		return propIDs[idx1] < propIDs[idx2]
+	})
+
+	diffs := []PropertyDiff{}
+
+	for _, id := range propIDs {
+		oldValue, inOld := oldBlob[id]
+		newValue, inNew := newBlob[id]
+
+		switch {
+		case !inOld:
+			diffs = append(diffs, PropertyDiff{ID: id, New: newValue, Kind: DiffAdded})
+		case !inNew:
+			diffs = append(diffs, PropertyDiff{ID: id, Old: oldValue, Kind: DiffRemoved})
+		case !bytes.Equal(oldValue, newValue):
+			diffs = append(diffs, PropertyDiff{ID: id, Old: oldValue, New: newValue, Kind: DiffChanged})
+		}
+	}
+
+	return diffs
+}
@@ -0,0 +1,49 @@
+package certblob_test
+
+import (
+	"testing"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+func TestDiffBlobs(t *testing.T) {
+	oldBlob := certblob.Blob{
+		certblob.CertFriendlyNamePropID:  []byte("old"),
+		certblob.CertDescriptionPropID:   []byte("same"),
+		certblob.CertKeyIdentifierPropID: []byte{0x01},
+	}
+	newBlob := certblob.Blob{
+		certblob.CertFriendlyNamePropID: []byte("new"),
+		certblob.CertDescriptionPropID:  []byte("same"),
+		certblob.CertEnhkeyUsagePropID:  []byte{0x02},
+	}
+
+	diffs := certblob.DiffBlobs(oldBlob, newBlob)
+
+	expected := []struct {
+		id   uint32
+		kind certblob.DiffKind
+	}{
+		{certblob.CertEnhkeyUsagePropID, certblob.DiffAdded},
+		{certblob.CertFriendlyNamePropID, certblob.DiffChanged},
+		{certblob.CertKeyIdentifierPropID, certblob.DiffRemoved},
+	}
+
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d diffs, got %d: %+v", len(expected), len(diffs), diffs)
+	}
+
+	for i, e := range expected {
+		if diffs[i].ID != e.id || diffs[i].Kind != e.kind {
+			t.Errorf("diff %d: expected ID %d %s, got ID %d %s", i, e.id, e.kind, diffs[i].ID, diffs[i].Kind)
+		}
+	}
+
+	if diffs[1].Old == nil || diffs[1].New == nil || diffs[0].Old != nil || diffs[2].New != nil {
+		t.Errorf("unexpected Old/New values: %+v", diffs)
+	}
+
+	if len(certblob.DiffBlobs(oldBlob, oldBlob)) != 0 {
+		t.Error("expected no diffs between identical blobs")
+	}
+}
@@ -0,0 +1,284 @@
+package certblob_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// roundTrip stores prop in a blob alongside the test cert, marshals and
+// parses the blob, and returns the property as parsed.
+func roundTrip(t *testing.T, prop *certblob.Property) *certblob.Property {
+	t.Helper()
+
+	derBytes, err := os.ReadFile("../testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read test cert: %v", err)
+	}
+
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+	blob.SetProperty(prop)
+
+	blobBytes, err := blob.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	parsed, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse blob: %v", err)
+	}
+
+	value, ok := parsed[prop.ID]
+	if !ok {
+		t.Fatalf("property %d missing after round trip", prop.ID)
+	}
+
+	return &certblob.Property{ID: prop.ID, Value: value}
+}
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+
+	ipNets := []*net.IPNet{}
+
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("couldn't parse CIDR %s: %v", cidr, err)
+		}
+
+		ipNets = append(ipNets, ipNet)
+	}
+
+	return ipNets
+}
+
+func TestExtKeyUsageRoundTrip(t *testing.T) {
+	smartCardLogon := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}
+
+	tests := []struct {
+		name    string
+		ekus    []x509.ExtKeyUsage
+		unknown []asn1.ObjectIdentifier
+	}{
+		{"empty", nil, nil},
+		{"single", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, nil},
+		{"multiple", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageTimeStamping}, nil},
+		{"unknown only", nil, []asn1.ObjectIdentifier{smartCardLogon}},
+		{"known and unknown", []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			[]asn1.ObjectIdentifier{smartCardLogon, {1, 2, 3, 4}}},
+	}
+
+	for _, test := range tests {
+		var (
+			prop *certblob.Property
+			err  error
+		)
+
+		// An empty list has its own builder, since crypto/x509 omits an
+		// empty EKU extension.
+		if len(test.ekus) == 0 && len(test.unknown) == 0 {
+			prop, err = certblob.BuildEmptyExtKeyUsage()
+		} else {
+			prop, err = certblob.BuildExtKeyUsage(&x509.Certificate{
+				ExtKeyUsage:        test.ekus,
+				UnknownExtKeyUsage: test.unknown,
+			})
+		}
+
+		if err != nil {
+			t.Errorf("%s: couldn't build: %v", test.name, err)
+
+			continue
+		}
+
+		ekus, unknown, err := certblob.ParseExtKeyUsage(roundTrip(t, prop))
+		if err != nil {
+			t.Errorf("%s: couldn't parse: %v", test.name, err)
+
+			continue
+		}
+
+		if len(ekus) != len(test.ekus) || (len(ekus) != 0 && !reflect.DeepEqual(ekus, test.ekus)) {
+			t.Errorf("%s: expected usages %v, got %v", test.name, test.ekus, ekus)
+		}
+
+		if len(unknown) != len(test.unknown) {
+			t.Errorf("%s: expected unknown usages %v, got %v", test.name, test.unknown, unknown)
+
+			continue
+		}
+
+		for i := range unknown {
+			if !unknown[i].Equal(test.unknown[i]) {
+				t.Errorf("%s: expected unknown usages %v, got %v", test.name, test.unknown, unknown)
+			}
+		}
+	}
+}
+
+func TestNameConstraintsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+	}{
+		{"single DNS", &x509.Certificate{PermittedDNSDomains: []string{"bit"}}},
+		{"multiple DNS", &x509.Certificate{
+			PermittedDNSDomains: []string{"bit", "example.bit"},
+			ExcludedDNSDomains:  []string{"evil.bit", ".sub.example.bit"},
+		}},
+		// Internationalized domains are given in their ASCII (punycode) form.
+		{"IDN DNS", &x509.Certificate{PermittedDNSDomains: []string{"xn--bcher-kva.bit"}}},
+		{"IPv4", &x509.Certificate{PermittedIPRanges: mustParseCIDRs(t, "192.0.2.0/24")}},
+		{"IPv6", &x509.Certificate{ExcludedIPRanges: mustParseCIDRs(t, "2001:db8::/32")}},
+		{"mixed IP families", &x509.Certificate{
+			PermittedIPRanges: mustParseCIDRs(t, "192.0.2.0/24", "2001:db8:1::/48"),
+			ExcludedIPRanges:  mustParseCIDRs(t, "0.0.0.0/0", "::/0"),
+		}},
+		{"email", &x509.Certificate{
+			PermittedEmailAddresses: []string{"admin@example.bit", "example.bit"},
+			ExcludedEmailAddresses:  []string{".example.bit"},
+		}},
+		{"URI", &x509.Certificate{PermittedURIDomains: []string{"example.bit", ".bit"}}},
+	}
+
+	for _, test := range tests {
+		prop, err := certblob.BuildNameConstraints(test.template)
+		if err != nil {
+			t.Errorf("%s: couldn't build: %v", test.name, err)
+
+			continue
+		}
+
+		parsed, err := certblob.ParseNameConstraints(roundTrip(t, prop))
+		if err != nil {
+			t.Errorf("%s: couldn't parse: %v", test.name, err)
+
+			continue
+		}
+
+		for _, field := range []struct {
+			what             string
+			expected, actual interface{}
+		}{
+			{"permitted DNS", test.template.PermittedDNSDomains, parsed.PermittedDNSDomains},
+			{"excluded DNS", test.template.ExcludedDNSDomains, parsed.ExcludedDNSDomains},
+			{"permitted IP", ipNetStrings(test.template.PermittedIPRanges), ipNetStrings(parsed.PermittedIPRanges)},
+			{"excluded IP", ipNetStrings(test.template.ExcludedIPRanges), ipNetStrings(parsed.ExcludedIPRanges)},
+			{"permitted email", test.template.PermittedEmailAddresses, parsed.PermittedEmailAddresses},
+			{"excluded email", test.template.ExcludedEmailAddresses, parsed.ExcludedEmailAddresses},
+			{"permitted URI", test.template.PermittedURIDomains, parsed.PermittedURIDomains},
+			{"excluded URI", test.template.ExcludedURIDomains, parsed.ExcludedURIDomains},
+		} {
+			if reflect.ValueOf(field.expected).Len() == 0 && reflect.ValueOf(field.actual).Len() == 0 {
+				continue
+			}
+
+			if !reflect.DeepEqual(field.expected, field.actual) {
+				t.Errorf("%s: %s: expected %v, got %v", test.name, field.what, field.expected, field.actual)
+			}
+		}
+	}
+
+	// Constraints that can't be encoded are rejected rather than mangled.
+	for name, template := range map[string]*x509.Certificate{
+		"empty":        {},
+		"unicode DNS":  {PermittedDNSDomains: []string{"bücher.bit"}},
+		"unicode mail": {PermittedEmailAddresses: []string{"bücher.bit"}},
+	} {
+		if _, err := certblob.BuildNameConstraints(template); !errors.Is(err, certblob.ErrPropertyBuild) {
+			t.Errorf("%s: expected ErrPropertyBuild, got %v", name, err)
+		}
+	}
+}
+
+func ipNetStrings(ipNets []*net.IPNet) []string {
+	strs := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		strs = append(strs, ipNet.String())
+	}
+
+	return strs
+}
+
+func TestStringPropertiesRoundTrip(t *testing.T) {
+	builders := []struct {
+		what  string
+		build func(string) (*certblob.Property, error)
+		parse func(*certblob.Property) (string, error)
+	}{
+		{"friendly name", certblob.BuildFriendlyName, certblob.ParseFriendlyName},
+		{"description", certblob.BuildDescription, certblob.ParseDescription},
+	}
+
+	texts := map[string]string{
+		"empty":    "",
+		"single":   "N",
+		"multiple": "Namecoin TLD CA",
+		"non-BMP":  "Namecoin \U0001F511 root",
+		"long":     strings.Repeat("Namecoin ", 4096),
+	}
+
+	for _, builder := range builders {
+		for name, text := range texts {
+			prop, err := builder.build(text)
+			if err != nil {
+				t.Errorf("%s %s: couldn't build: %v", builder.what, name, err)
+
+				continue
+			}
+
+			parsed, err := builder.parse(roundTrip(t, prop))
+			if err != nil || parsed != text {
+				t.Errorf("%s %s: expected %.40q, got %.40q (err %v)", builder.what, name, text, parsed, err)
+			}
+		}
+	}
+}
+
+func TestKeyIdentifierRoundTrip(t *testing.T) {
+	derBytes, err := os.ReadFile("../testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read test cert: %v", err)
+	}
+
+	for _, fromSKI := range []bool{true, false} {
+		cert, err := x509.ParseCertificate(derBytes)
+		if err != nil {
+			t.Fatalf("couldn't parse test cert: %v", err)
+		}
+
+		if !fromSKI {
+			cert.SubjectKeyId = nil
+		}
+
+		prop, err := certblob.BuildKeyIdentifier(cert)
+		if err != nil {
+			t.Fatalf("couldn't build key identifier (from SKI %t): %v", fromSKI, err)
+		}
+
+		keyID, err := certblob.ParseKeyIdentifier(roundTrip(t, prop))
+		if err != nil || !bytes.Equal(keyID, prop.Value) {
+			t.Errorf("expected key identifier %x (from SKI %t), got %x (err %v)", prop.Value, fromSKI, keyID, err)
+		}
+	}
+
+	for name, prop := range map[string]*certblob.Property{
+		"empty":          {ID: certblob.CertKeyIdentifierPropID},
+		"wrong property": {ID: certblob.CertFriendlyNamePropID, Value: []byte{1}},
+	} {
+		if _, err := certblob.ParseKeyIdentifier(prop); !errors.Is(err, certblob.ErrPropertyParse) {
+			t.Errorf("%s: expected ErrPropertyParse, got %v", name, err)
+		}
+	}
+}
@@ -1,6 +1,17 @@
 package certinject
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/hlandau/xlog"
 	"gopkg.in/hlandau/easyconfig.v1/cflag"
 )
@@ -9,13 +20,135 @@ var (
 	log, logp        = xlog.New("ncdns.certinject")
 	flagGroup        = cflag.NewGroup(nil, "certstore")
 	nssFlag          = cflag.Bool(flagGroup, "nss", false, nssExplain)
-	certExpirePeriod = cflag.Int(flagGroup, "expire", 60*30, "Duration "+
-		"(in seconds) after which TLS certs will be removed from the "+
-		"trust store.  Making this smaller than the DNS TTL (default "+
-		"600) may cause TLS errors.")
+	certExpirePeriod = cflag.String(flagGroup, "expire", "30m", "Duration "+
+		"(e.g. 30m or 720h; a bare integer is a number of seconds) after "+
+		"which TLS certs will be removed from the trust store.  Making this "+
+		"smaller than the DNS TTL (default 600 seconds) may cause TLS errors.")
 )
 
+// certExpireDuration returns the -expire flag as a time.Duration.  Returned
+// errors wrap ErrInvalidStore if the flag can't be parsed.
+func certExpireDuration() (time.Duration, error) {
+	return parseExpirePeriod(certExpirePeriod.Value())
+}
+
+// parseExpirePeriod parses a Go duration string, or a bare integer number of
+// seconds, which is what the -expire flag used to take.
+func parseExpirePeriod(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		var seconds int64
+
+		seconds, err = strconv.ParseInt(value, 10, 64)
+		if err == nil && seconds <= math.MaxInt64/int64(time.Second) {
+			d = time.Duration(seconds) * time.Second
+		} else {
+			err = errors.New("not a duration or a number of seconds")
+		}
+	}
+
+	if err == nil && d < 0 {
+		err = errors.New("negative duration")
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid expire period %q: %w: %w", value, err, ErrInvalidStore)
+	}
+
+	return d, nil
+}
+
+// flagMu guards the flags against WithFlags while operations read them.
+// Since the flags are process-global, two goroutines injecting with different
+// settings would otherwise race, and a flag changed halfway through an
+// operation could make it behave inconsistently.
+var flagMu sync.RWMutex
+
+// WithFlags calls fn, which may change flags (e.g. with CfSetValue), while no
+// CryptoAPI operation is reading them.  Operations snapshot the flags they
+// need (including the logical stores, registry view, and magic tags) when
+// they start, so fn only waits for other operations to start.  Flags changed
+// without WithFlags aren't protected.
+func WithFlags(fn func()) {
+	flagMu.Lock()
+	defer flagMu.Unlock()
+
+	fn()
+}
+
 // SetLogLevel allows an application to set a log level.
 func SetLogLevel(level xlog.Severity) {
 	logp.SetSeverity(level)
 }
+
+// ProgressFunc is called by InjectCerts after each cert is processed.  done
+// is the number of certs processed so far (including this one), fingerprint
+// is the cert's uppercase hex SHA-1 fingerprint, and err is the cert's
+// injection error, if any.
+type ProgressFunc func(done, total int, fingerprint string, err error)
+
+// InjectCerts injects each of the given certs into all configured trust
+// stores, calling onProgress (if non-nil) after each cert.  A failed cert
+// doesn't stop the batch; the returned error joins all of the per-cert
+// errors.
+func InjectCerts(certs [][]byte, onProgress ProgressFunc) error {
+	errs := []error{}
+
+	for i, derBytes := range certs {
+		fingerprint, err := InjectCertResult(derBytes)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if onProgress != nil {
+			onProgress(i+1, len(certs), fingerprint, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// InjectCertResult is like InjectCertErr, but also returns the cert's
+// uppercase hex SHA-1 fingerprint, which identifies it in the trust stores
+// (e.g. for RemoveCert), so that callers don't need to compute it.  The
+// fingerprint is computed once, and used for injection as well.  It's
+// returned even if injection fails, and is empty if derBytes is nil.
+func InjectCertResult(derBytes []byte) (string, error) {
+	if derBytes == nil {
+		return "", InjectCertErr(nil)
+	}
+
+	fingerprint := fingerprintHexUpper(derBytes)
+
+	return fingerprint, injectCertFingerprint(derBytes, fingerprint)
+}
+
+// fingerprintHexUpper returns the SHA-1 fingerprint of the cert, in the
+// format shown by Windows and most cert viewers.
+func fingerprintHexUpper(derBytes []byte) string {
+	fingerprint := sha1.Sum(derBytes) // #nosec G401
+
+	return strings.ToUpper(hex.EncodeToString(fingerprint[:]))
+}
+
+// RunCleanup calls CleanCerts every interval until ctx is cancelled.
+func RunCleanup(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, CleanCerts)
+}
+
+// runEvery calls fn immediately, and then every interval until ctx is
+// cancelled.
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fn()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
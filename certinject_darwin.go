@@ -0,0 +1,41 @@
+package certinject
+
+// This package is used to add and remove certificates to the system trust
+// store.
+// Currently only supports macOS Keychain and NSS sqlite3 stores.
+
+// InjectCert injects the given cert into all configured trust stores.
+func InjectCert(derBytes []byte) {
+	if keychainFlag.Value() {
+		injectCertKeychain(derBytes)
+	}
+
+	if nssFlag.Value() {
+		injectCertNSS(derBytes)
+	}
+}
+
+// InjectCertErr is like InjectCert.  The trust stores supported on this
+// platform only log errors, so it always returns nil.
+func InjectCertErr(derBytes []byte) error {
+	InjectCert(derBytes)
+
+	return nil
+}
+
+// injectCertFingerprint is InjectCertErr.  The trust stores supported on this
+// platform don't identify certs by fingerprint.
+func injectCertFingerprint(derBytes []byte, _ string) error {
+	return InjectCertErr(derBytes)
+}
+
+// CleanCerts cleans expired certs from all configured trust stores.
+func CleanCerts() {
+	if keychainFlag.Value() {
+		cleanCertsKeychain()
+	}
+
+	if nssFlag.Value() {
+		cleanCertsNSS()
+	}
+}
@@ -0,0 +1,352 @@
+package certinject
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestRunEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+
+	runEvery(ctx, time.Millisecond, func() {
+		calls++
+		if calls == 3 {
+			cancel()
+		}
+	})
+
+	if calls != 3 {
+		t.Errorf("expected 3 calls before cancellation, got %d", calls)
+	}
+}
+
+func TestInjectPEMReader(t *testing.T) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})
+	badPEM := []byte("-----BEGIN CERTIFICATE-----\n!!!\n-----END CERTIFICATE-----\n")
+
+	// Text between blocks and other block types are skipped.
+	bundle := bytes.Join([][]byte{[]byte("# bundle\n"), certPEM, keyPEM, []byte("comment\n"), certPEM}, nil)
+
+	n, err := InjectPEMReader(bytes.NewReader(bundle))
+	if err != nil || n != 2 {
+		t.Errorf("expected 2 certs, got %d (err %v)", n, err)
+	}
+
+	// Indented blocks are accepted.
+	indented := strings.ReplaceAll(string(certPEM), "\n", "\n  ")
+
+	n, err = InjectPEMReader(strings.NewReader("  " + indented))
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 indented cert, got %d (err %v)", n, err)
+	}
+
+	// Errors report the certs injected so far.
+	n, err = InjectPEMReader(bytes.NewReader(bytes.Join([][]byte{certPEM, badPEM, certPEM}, nil)))
+	if !errors.Is(err, ErrBadCert) || n != 1 {
+		t.Errorf("expected ErrBadCert after 1 cert, got %d (err %v)", n, err)
+	}
+
+	n, err = InjectPEMReader(io.MultiReader(bytes.NewReader(certPEM), iotest.ErrReader(errors.New("read failed"))))
+	if !errors.Is(err, ErrCertRead) || n != 1 {
+		t.Errorf("expected ErrCertRead after 1 cert, got %d (err %v)", n, err)
+	}
+
+	// A line too long to buffer is malformed input, not a read error.
+	n, err = InjectPEMReader(strings.NewReader(strings.Repeat("A", 1<<20)))
+	if !errors.Is(err, ErrBadCert) || errors.Is(err, ErrCertRead) || n != 0 {
+		t.Errorf("expected only ErrBadCert for an overlong line, got %d (err %v)", n, err)
+	}
+
+	n, err = InjectPEMReader(strings.NewReader(""))
+	if err != nil || n != 0 {
+		t.Errorf("expected no certs from empty input, got %d (err %v)", n, err)
+	}
+}
+
+func TestInjectCertsProgress(t *testing.T) {
+	certs := [][]byte{[]byte("first"), []byte("second")}
+	fingerprints := []string{}
+
+	err := InjectCerts(certs, func(done, total int, fingerprint string, err error) {
+		if done != len(fingerprints)+1 || total != len(certs) {
+			t.Errorf("unexpected progress %d/%d", done, total)
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", fingerprint, err)
+		}
+
+		fingerprints = append(fingerprints, fingerprint)
+	})
+	if err != nil {
+		t.Fatalf("InjectCerts failed: %v", err)
+	}
+
+	if len(fingerprints) != 2 || fingerprints[0] != fingerprintHexUpper(certs[0]) {
+		t.Errorf("unexpected fingerprints: %v", fingerprints)
+	}
+
+	// A nil callback must be safe.
+	if err := InjectCerts(certs, nil); err != nil {
+		t.Errorf("InjectCerts with nil callback failed: %v", err)
+	}
+}
+
+func TestInjectCertResult(t *testing.T) {
+	derBytes := []byte("cert")
+
+	fingerprint, err := InjectCertResult(derBytes)
+	if err != nil {
+		t.Fatalf("InjectCertResult failed: %v", err)
+	}
+
+	if fingerprint != fingerprintHexUpper(derBytes) || fingerprint != strings.ToUpper(fingerprint) {
+		t.Errorf("unexpected fingerprint %s", fingerprint)
+	}
+
+	if fingerprint, _ := InjectCertResult(nil); fingerprint != "" {
+		t.Errorf("expected no fingerprint without a cert, got %s", fingerprint)
+	}
+}
+
+func TestInjectFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert.der":
+			w.Write([]byte("not really DER")) //nolint:errcheck
+		case "/huge":
+			w.Write([]byte(strings.Repeat("A", maxFetchBytes+1))) //nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	err := InjectFromURL(ctx, server.URL+"/cert.der")
+	if !errors.Is(err, ErrFetch) {
+		t.Errorf("expected plain HTTP to be refused, got %v", err)
+	}
+
+	if err := allowInsecureFetch.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set allow-insecure-fetch: %v", err)
+	}
+	defer allowInsecureFetch.CfSetValue(false) //nolint:errcheck
+
+	if err := InjectFromURL(ctx, server.URL+"/cert.der"); err != nil {
+		t.Errorf("expected fetch to succeed, got %v", err)
+	}
+
+	if err := InjectFromURL(ctx, server.URL+"/missing"); !errors.Is(err, ErrFetch) {
+		t.Errorf("expected ErrFetch for a 404, got %v", err)
+	}
+
+	if err := InjectFromURL(ctx, server.URL+"/huge"); !errors.Is(err, ErrFetch) {
+		t.Errorf("expected ErrFetch for an oversized response, got %v", err)
+	}
+}
+
+func TestInjectFromURLRedirect(t *testing.T) {
+	plainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("not really DER")) //nolint:errcheck
+	}))
+	defer plainServer.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert.der":
+			w.Write([]byte("not really DER")) //nolint:errcheck
+		case "/https":
+			http.Redirect(w, r, "/cert.der", http.StatusFound)
+		default:
+			http.Redirect(w, r, plainServer.URL+"/cert.der", http.StatusFound)
+		}
+	}))
+	defer tlsServer.Close()
+
+	transport := fetchClient.Transport
+	fetchClient.Transport = tlsServer.Client().Transport
+
+	defer func() { fetchClient.Transport = transport }()
+
+	ctx := context.Background()
+
+	if err := InjectFromURL(ctx, tlsServer.URL+"/https"); err != nil {
+		t.Errorf("expected a redirect to https to be followed, got %v", err)
+	}
+
+	err := InjectFromURL(ctx, tlsServer.URL+"/http")
+	if !errors.Is(err, ErrFetch) {
+		t.Errorf("expected a redirect to plain HTTP to be refused, got %v", err)
+	}
+
+	if err := allowInsecureFetch.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set allow-insecure-fetch: %v", err)
+	}
+	defer allowInsecureFetch.CfSetValue(false) //nolint:errcheck
+
+	if err := InjectFromURL(ctx, tlsServer.URL+"/http"); err != nil {
+		t.Errorf("expected a redirect to plain HTTP to be followed with -allow-insecure-fetch, got %v", err)
+	}
+}
+
+func TestReadCertFile(t *testing.T) {
+	derBytes, err := os.ReadFile("testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read DER cert: %v", err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})
+	dir := t.TempDir()
+
+	for name, contents := range map[string][]byte{
+		"cert.der":    derBytes,
+		"cert.pem":    pemBytes,
+		"withkey.pem": append(append([]byte{}, keyBytes...), pemBytes...),
+		"two.pem":     append(append([]byte{}, pemBytes...), pemBytes...),
+		"garbage.der": []byte("garbage"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0o600); err != nil {
+			t.Fatalf("couldn't write %s: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"cert.der", "cert.pem", "withkey.pem"} {
+		got, err := readCertFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, derBytes) {
+			t.Errorf("%s: unexpected result (err %v)", name, err)
+		}
+	}
+
+	for _, name := range []string{"two.pem", "garbage.der"} {
+		if _, err := readCertFile(filepath.Join(dir, name)); !errors.Is(err, ErrBadCert) {
+			t.Errorf("%s: expected ErrBadCert, got %v", name, err)
+		}
+	}
+
+	// A file that can't be read isn't a bad cert, so that the exit code tells
+	// them apart.
+	_, err = readCertFile(filepath.Join(dir, "missing.der"))
+	if !errors.Is(err, ErrCertRead) || errors.Is(err, ErrBadCert) {
+		t.Errorf("missing.der: expected ErrCertRead, got %v", err)
+	}
+}
+
+func TestDecodeCerts(t *testing.T) {
+	derBytes, err := os.ReadFile("testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read DER cert: %v", err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})
+
+	for name, test := range map[string]struct {
+		data  []byte
+		certs int
+	}{
+		"DER":          {derBytes, 1},
+		"PEM":          {pemBytes, 1},
+		"PEM bundle":   {append(append(append([]byte{}, pemBytes...), keyBytes...), pemBytes...), 2},
+		"PEM key only": {keyBytes, 0},
+	} {
+		certs, err := DecodeCerts(test.data)
+		if test.certs == 0 {
+			if !errors.Is(err, ErrBadCert) {
+				t.Errorf("%s: expected ErrBadCert, got %v", name, err)
+			}
+
+			continue
+		}
+
+		if err != nil || len(certs) != test.certs {
+			t.Errorf("%s: expected %d certs, got %d (err %v)", name, test.certs, len(certs), err)
+
+			continue
+		}
+
+		for _, cert := range certs {
+			if !bytes.Equal(cert, derBytes) {
+				t.Errorf("%s: unexpected cert", name)
+			}
+		}
+	}
+}
+
+func TestGenerateTestRoot(t *testing.T) {
+	derBytes, key, err := GenerateTestRoot("Namecoin Test Root", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't generate test root: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse test root: %v", err)
+	}
+
+	if !cert.IsCA || cert.Subject.CommonName != "Namecoin Test Root" || len(cert.PermittedDNSDomains) != 0 {
+		t.Errorf("unexpected test root: CA %t, CN %q, permitted %v", cert.IsCA, cert.Subject.CommonName,
+			cert.PermittedDNSDomains)
+	}
+
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		t.Errorf("expected test root to be self-signed: %v", err)
+	}
+
+	if lifetime := time.Until(cert.NotAfter); lifetime < 23*time.Hour || lifetime > 24*time.Hour {
+		t.Errorf("expected test root to expire in 24 hours, got %s", lifetime)
+	}
+
+	signer, ok := key.(*ecdsa.PrivateKey)
+	if !ok || !signer.PublicKey.Equal(cert.PublicKey) {
+		t.Errorf("expected the returned key to match the cert, got %T", key)
+	}
+
+	if _, _, err := GenerateTestRoot("Namecoin Test Root", 0); err == nil {
+		t.Error("expected error for zero TTL")
+	}
+}
+
+func TestParseExpirePeriod(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"30m", 30 * time.Minute},
+		{"720h", 720 * time.Hour},
+		{"1h30m", 90 * time.Minute},
+		// Bare integers are seconds, as before.
+		{"1800", 30 * time.Minute},
+		{"0", 0},
+	}
+
+	for _, test := range tests {
+		d, err := parseExpirePeriod(test.value)
+		if err != nil || d != test.expected {
+			t.Errorf("%q: expected %s, got %s (err %v)", test.value, test.expected, d, err)
+		}
+	}
+
+	for _, value := range []string{"", "30 minutes", "1.5", "-5", "-1h", "99999999999999999999"} {
+		if _, err := parseExpirePeriod(value); !errors.Is(err, ErrInvalidStore) {
+			t.Errorf("%q: expected ErrInvalidStore, got %v", value, err)
+		}
+	}
+}
@@ -7,3 +7,43 @@ var nssExplain = "Synchronize TLS certs to an NSS sqlite3 trust store?  " +
 	"up NUMS HPKP, or if you access the configured NSS sqlite3 " +
 	"trust store from browsers not based on Chromium, this is " +
 	"unsafe and should not be used."
+
+// This package is used to add and remove certificates to the system trust
+// store.
+// Currently only supports p11-kit / ca-certificates and NSS sqlite3 stores.
+
+// InjectCert injects the given cert into all configured trust stores.
+func InjectCert(derBytes []byte) {
+	if p11KitFlag.Value() {
+		injectCertP11Kit(derBytes)
+	}
+
+	if nssFlag.Value() {
+		injectCertNSS(derBytes)
+	}
+}
+
+// InjectCertErr is like InjectCert.  The trust stores supported on this
+// platform only log errors, so it always returns nil.
+func InjectCertErr(derBytes []byte) error {
+	InjectCert(derBytes)
+
+	return nil
+}
+
+// injectCertFingerprint is InjectCertErr.  The trust stores supported on this
+// platform don't identify certs by fingerprint.
+func injectCertFingerprint(derBytes []byte, _ string) error {
+	return InjectCertErr(derBytes)
+}
+
+// CleanCerts cleans expired certs from all configured trust stores.
+func CleanCerts() {
+	if p11KitFlag.Value() {
+		cleanCertsP11Kit()
+	}
+
+	if nssFlag.Value() {
+		cleanCertsNSS()
+	}
+}
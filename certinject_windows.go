@@ -13,13 +13,32 @@ var cryptoAPIFlag = cflag.Bool(flagGroup, "cryptoapi", false,
 
 // InjectCert injects the given cert into all configured trust stores.
 func InjectCert(derBytes []byte) {
+	err := InjectCertErr(derBytes)
+	if err != nil {
+		log.Errorf("Couldn't inject cert: %s", err)
+	}
+}
+
+// InjectCertErr is like InjectCert, but returns the CryptoAPI error (see
+// InjectCertCryptoAPI) instead of logging it.
+func InjectCertErr(derBytes []byte) error {
+	return injectCertFingerprint(derBytes, "")
+}
+
+// injectCertFingerprint is InjectCertErr, for callers that already computed
+// the cert's fingerprint; if it's empty, it's computed as needed.
+func injectCertFingerprint(derBytes []byte, fingerprint string) error {
+	var err error
+
 	if cryptoAPIFlag.Value() {
-		injectCertCryptoAPI(derBytes)
+		err = injectCertCryptoAPIFingerprint(derBytes, fingerprint)
 	}
 
 	if nssFlag.Value() {
 		injectCertNSS(derBytes)
 	}
+
+	return err
 }
 
 // CleanCerts cleans expired certs from all configured trust stores.
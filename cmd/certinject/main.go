@@ -1,11 +1,21 @@
 // Copyright 2020 Namecoin Developers GPLv3+
 
-// Command certinject injects certificates into all configured trust stores
+// Command certinject injects certificates into all configured trust stores.
+//
+// The exit code is 0 on success, 2 if the store configuration is invalid or
+// the store doesn't exist, 3 if access was denied, 4 if a registry write
+// failed, 5 if the certificate couldn't be decoded, and 1 for any other error.
 package main
 
 import (
-	"encoding/pem"
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/hlandau/dexlogconfig"
 	"github.com/hlandau/xlog"
@@ -15,12 +25,27 @@ import (
 	"github.com/namecoin/certinject"
 )
 
-var log, _ = xlog.New("certinject")
+var log, logp = xlog.New("certinject")
 
 func main() {
 	var (
 		flagGroup = cflag.NewGroup(nil, "certinject")
-		certflag  = cflag.String(flagGroup, "cert", "", "path to certificate to inject into trust store")
+		certflag  = cflag.String(flagGroup, "cert", "",
+			"path to DER or PEM certificate(s) to inject into trust store; may be a glob such as *.crt, "+
+				"or - to read from stdin")
+		remove = cflag.String(flagGroup, "remove", "",
+			"SHA-1 fingerprint of a certificate to remove from the configured CryptoAPI store instead of "+
+				"injecting, or - to read fingerprints from stdin, one per line")
+		touch = cflag.String(flagGroup, "touch", "",
+			"SHA-1 fingerprint of an injected certificate whose cleanup age to reset in the configured "+
+				"CryptoAPI store instead of injecting, or - to read fingerprints from stdin, one per line")
+		cleanupInterval = cflag.String(flagGroup, "cleanup-interval", "",
+			"if set, stay resident after injecting and clean expired certs from all configured "+
+				"trust stores every this duration (e.g. 1h), until interrupted")
+		quiet = cflag.Bool(flagGroup, "quiet", false,
+			"only log errors, e.g. for scripts")
+		verbose = cflag.Bool(flagGroup, "verbose", false,
+			"log every registry operation, property, and scanned certificate, for debugging")
 	)
 
 	// read config
@@ -30,36 +55,193 @@ func main() {
 	config.ParseFatal(nil)
 	dexlogconfig.Init()
 
-	var (
-		certbytes []byte
-		err       error
-	)
+	switch {
+	case quiet.Value() && verbose.Value():
+		log.Errorf("-certinject.quiet and -certinject.verbose can't be combined")
+		os.Exit(1)
+	case quiet.Value():
+		setLogLevel(xlog.SevError)
+	case verbose.Value():
+		setLogLevel(xlog.SevTrace)
+	}
+
+	interval, err := parseCleanupInterval(cleanupInterval.Value())
+	if err != nil {
+		log.Errore(err, "invalid -certinject.cleanup-interval")
+		os.Exit(certinject.ExitCode(err))
+	}
+
+	switch {
+	case remove.Value() != "":
+		err = runFingerprints(remove.Value(), os.Stdin, os.Stdout, certinject.RemoveCert, certinject.RemoveCertsFrom)
+	case touch.Value() != "":
+		err = runFingerprints(touch.Value(), os.Stdin, os.Stdout, certinject.TouchCert, certinject.TouchCertsFrom)
+	default:
+		err = run(certflag.Value())
+	}
+
+	if err != nil {
+		log.Errore(err, "error injecting certificates")
+		os.Exit(certinject.ExitCode(err))
+	}
+
+	if interval > 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		log.Debugf("cleaning expired certificates every %s...", interval)
+
+		runCleanup(ctx, interval)
+	}
+}
+
+// parseCleanupInterval parses the -cleanup-interval flag; an empty value
+// means no periodic cleanup.  Returned errors wrap certinject.ErrInvalidOption
+// if the value isn't a positive duration.
+func parseCleanupInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("%q isn't a positive duration: %w", value, certinject.ErrInvalidOption)
+	}
+
+	return interval, nil
+}
+
+// runCleanup cleans expired certs every interval until ctx is cancelled.  The
+// configured CryptoAPI store is cleaned with certinject.RunCleanupDaemon,
+// which logs each pass's deletions; if CryptoAPI isn't enabled or supported,
+// all configured trust stores are cleaned with certinject.RunCleanup instead.
+func runCleanup(ctx context.Context, interval time.Duration) {
+	store, err := certinject.ConfiguredStoreCryptoAPI()
+	if err != nil {
+		log.Debugf("not using the CryptoAPI cleanup daemon: %s", err)
+
+		certinject.RunCleanup(ctx, interval)
+
+		return
+	}
+
+	certinject.RunCleanupDaemon(ctx, store, interval)
+}
+
+// setLogLevel sets the log level of both this command and the certinject
+// package.
+func setLogLevel(level xlog.Severity) {
+	logp.SetSeverity(level)
+	certinject.SetLogLevel(level)
+}
+
+func run(cert string) error {
+	if cert == "" {
+		// Operations such as -certstore.capi.search-sha1 don't need a cert.
+		log.Debugf("injecting without a certificate...")
+
+		return certinject.InjectCertErr(nil)
+	}
+
+	certs, err := readCerts(cert, os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("injecting %d certificates...", len(certs))
+
+	injected := 0
+
+	err = certinject.InjectCerts(certs, func(done, total int, fingerprint string, err error) {
+		if err != nil {
+			log.Debugf("certificate %d/%d (%s) failed: %s", done, total, fingerprint, err)
+
+			return
+		}
+
+		injected++
+
+		log.Debugf("injected certificate %d/%d: %s", done, total, fingerprint)
+	})
+
+	log.Infof("injected %d of %d certificates from %q", injected, len(certs), cert)
+
+	return err
+}
+
+// runFingerprints removes or touches (depending on the functions passed) the
+// cert with the given fingerprint in the configured CryptoAPI store, or each
+// cert listed in stdin if it's "-", writing a result line for each to stdout.
+func runFingerprints(fingerprint string, stdin io.Reader, stdout io.Writer,
+	single func(certinject.Store, string) error, batch func(certinject.Store, io.Reader, io.Writer) error,
+) error {
+	store, err := certinject.ConfiguredStoreCryptoAPI()
+	if err != nil {
+		return err
+	}
+
+	if fingerprint == "-" {
+		log.Debugf("reading fingerprints from stdin")
+
+		return batch(store, stdin, stdout)
+	}
+
+	return single(store, fingerprint)
+}
+
+// maxStdinBytes limits how much is read from stdin, which is larger than any
+// sane cert bundle.
+const maxStdinBytes = 16 * 1024 * 1024
 
-	cert := certflag.Value()
-	if cert != "" {
-		log.Debugf("reading certificate: %q", cert)
+// readCerts reads the certificates from the files matching the given glob
+// pattern, or from stdin if it's "-".
+func readCerts(pattern string, stdin io.Reader) ([][]byte, error) {
+	if pattern == "-" {
+		log.Debugf("reading certificates from stdin")
 
-		certbytes, err = os.ReadFile(cert)
+		data, err := io.ReadAll(io.LimitReader(stdin, maxStdinBytes+1))
 		if err != nil {
-			log.Fatale(err, "error reading certificate")
+			return nil, fmt.Errorf("%w: error reading certificate from stdin: %w", err, certinject.ErrCertRead)
 		}
 
-		certpem, _ := pem.Decode(certbytes)
-		if certpem != nil {
-			log.Debugf("user provided PEM-encoded input file; checking type...")
+		if len(data) > maxStdinBytes {
+			return nil, fmt.Errorf("stdin is larger than %d bytes: %w", maxStdinBytes, certinject.ErrBadCert)
+		}
+
+		return certinject.DecodeCerts(data)
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid certificate pattern: %w", err, certinject.ErrBadCert)
+	}
 
-			if certpem.Type != "CERTIFICATE" {
-				log.Fatalf("PEM type was %s, expecting CERTIFICATE", certpem.Type)
-			}
+	if len(paths) == 0 {
+		// Not a glob (or nothing matched); let ReadFile report the error.
+		paths = []string{pattern}
+	}
 
-			log.Debugf("PEM file is a certificate; extracting DER bytes...")
+	certs := [][]byte{}
 
-			certbytes = certpem.Bytes
+	for _, path := range paths {
+		fileCerts, err := readCertFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
 		}
+
+		certs = append(certs, fileCerts...)
 	}
 
-	log.Debugf("injecting certificate...")
+	return certs, nil
+}
+
+func readCertFile(path string) ([][]byte, error) {
+	log.Debugf("reading certificate: %q", path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading certificate: %w", err, certinject.ErrCertRead)
+	}
 
-	certinject.InjectCert(certbytes)
-	log.Debugf("injected certificate: %q", cert)
+	return certinject.DecodeCerts(data)
 }
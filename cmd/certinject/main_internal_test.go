@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/namecoin/certinject"
+)
+
+func TestReadCerts(t *testing.T) {
+	derBytes, err := os.ReadFile("../../testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read DER cert: %v", err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})
+	dir := t.TempDir()
+
+	for name, contents := range map[string][]byte{
+		"a.der":   derBytes,
+		"b.crt":   append(append([]byte{}, pemBytes...), pemBytes...),
+		"key.pem": keyBytes,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0o600); err != nil {
+			t.Fatalf("couldn't write %s: %v", name, err)
+		}
+	}
+
+	for pattern, want := range map[string]int{
+		filepath.Join(dir, "*.crt"):   2,
+		filepath.Join(dir, "[ab].*"):  3,
+		filepath.Join(dir, "a.der"):   1,
+		filepath.Join(dir, "*.none"):  -1,
+		filepath.Join(dir, "key.pem"): -1,
+	} {
+		certs, err := readCerts(pattern, nil)
+		if want < 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", pattern)
+			}
+
+			continue
+		}
+
+		if err != nil || len(certs) != want {
+			t.Errorf("%s: expected %d certs, got %d (err %v)", pattern, want, len(certs), err)
+
+			continue
+		}
+
+		for _, cert := range certs {
+			if !bytes.Equal(cert, derBytes) {
+				t.Errorf("%s: unexpected cert", pattern)
+			}
+		}
+	}
+
+	if _, err := readCerts(filepath.Join(dir, "missing.der"), nil); !errors.Is(err, certinject.ErrCertRead) {
+		t.Errorf("expected ErrCertRead for a missing file, got %v", err)
+	}
+
+	if _, err := readCerts(filepath.Join(dir, "key.pem"), nil); !errors.Is(err, certinject.ErrBadCert) {
+		t.Errorf("expected ErrBadCert for a file without certs, got %v", err)
+	}
+}
+
+func TestReadCertsStdin(t *testing.T) {
+	derBytes, err := os.ReadFile("../../testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read DER cert: %v", err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	certs, err := readCerts("-", bytes.NewReader(append(append([]byte{}, pemBytes...), pemBytes...)))
+	if err != nil || len(certs) != 2 {
+		t.Errorf("expected 2 certs from stdin, got %d (err %v)", len(certs), err)
+	}
+
+	certs, err = readCerts("-", bytes.NewReader(derBytes))
+	if err != nil || len(certs) != 1 || !bytes.Equal(certs[0], derBytes) {
+		t.Errorf("expected the DER cert from stdin, got %d certs (err %v)", len(certs), err)
+	}
+
+	_, err = readCerts("-", strings.NewReader(strings.Repeat("A", maxStdinBytes+1)))
+	if !errors.Is(err, certinject.ErrBadCert) {
+		t.Errorf("expected ErrBadCert for oversized stdin, got %v", err)
+	}
+}
+
+func TestParseCleanupInterval(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":    0,
+		"90s": 90 * time.Second,
+		"1h":  time.Hour,
+	} {
+		interval, err := parseCleanupInterval(value)
+		if err != nil || interval != want {
+			t.Errorf("%q: expected %s, got %s (err %v)", value, want, interval, err)
+		}
+	}
+
+	for _, value := range []string{"0", "-1m", "60", "soon"} {
+		if _, err := parseCleanupInterval(value); !errors.Is(err, certinject.ErrInvalidOption) {
+			t.Errorf("%q: expected ErrInvalidOption, got %v", value, err)
+		}
+	}
+}
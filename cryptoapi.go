@@ -0,0 +1,248 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// This file holds the CryptoAPI types that don't depend on the registry, so
+// that cross-platform callers can use them; see cryptoapi_other.go.
+
+const (
+	// InjectMethodRegistry writes each cert's blob directly to the registry.
+	// It's the default, and supports every physical store.
+	InjectMethodRegistry = "registry"
+	// InjectMethodWin32API adds each cert via the CertOpenStore and
+	// CertAddCertificateContextToStore APIs of crypt32.dll, so that Windows
+	// serializes the blob itself.  The magic tag and other registry values
+	// are still written to the registry afterwards.
+	InjectMethodWin32API = "win32api"
+)
+
+// Policies for DedupCert and the -dedup flag.
+const (
+	// DedupKeepSystem keeps the system physical store's copy of a cert, and
+	// removes the current-user copy.
+	DedupKeepSystem = "keep-system"
+	// DedupKeepUser keeps the current-user physical store's copy of a cert,
+	// and removes the system copy.
+	DedupKeepUser = "keep-user"
+)
+
+// checkDedupPolicy returns an error wrapping ErrInvalidOption if policy isn't
+// empty (no deduplication), DedupKeepSystem, or DedupKeepUser.
+func checkDedupPolicy(policy string) error {
+	switch policy {
+	case "", DedupKeepSystem, DedupKeepUser:
+		return nil
+	default:
+		return fmt.Errorf("unknown dedup policy %q, want %s or %s: %w", policy, DedupKeepSystem, DedupKeepUser,
+			ErrInvalidOption)
+	}
+}
+
+// InjectOptions configures InjectWithOptions.  Each field corresponds to one
+// or more of the capi.* flags, which document them in more detail; unlike the
+// flags, an InjectOptions value isn't shared between callers, so concurrent
+// injections can use different settings.
+type InjectOptions struct {
+	// Store is the physical store to inject into.
+	Store Store
+	// LogicalStores lists the logical stores to inject into.  If empty, the
+	// Root logical store is used.
+	LogicalStores []string
+
+	// Reset deletes any existing properties of the cert before applying
+	// new ones.  ResetKeepHashes keeps certblob.HashPropIDs when resetting.
+	Reset           bool
+	ResetKeepHashes bool
+
+	// ExtKeyUsages sets the extended key usage property, if non-empty.
+	// NoExtKeyUsage sets an empty one instead, which disables the cert for
+	// all purposes; the two can't be combined.
+	ExtKeyUsages  []x509.ExtKeyUsage
+	NoExtKeyUsage bool
+
+	// NameConstraints sets the name constraints property from the name
+	// constraints fields of the template, if any are set.  If
+	// NameConstraintsFromCert is set, the cert's own name constraints are
+	// used for the fields that aren't set in NameConstraints.  If
+	// NameConstraintsMerge is set, the existing property's name constraints
+	// are kept as well.
+	NameConstraints         *x509.Certificate
+	NameConstraintsFromCert bool
+	NameConstraintsMerge    bool
+
+	// SetKeyIdentifier is auto (the default if empty), true, or false.
+	SetKeyIdentifier string
+	// SecureACL restricts the ACL of the cert's registry key whenever it's
+	// written, so that only administrators can modify it.
+	SecureACL bool
+	// SkipExisting leaves certs alone that are already in the store without
+	// the MagicName tag (e.g. because they ship with Windows), so that the
+	// set of tagged certs stays limited to the ones Windows wouldn't trust
+	// otherwise.  If MagicName is empty, every existing cert is left alone.
+	SkipExisting bool
+	// AllowLeafInRoot allows injecting certs that aren't CA certs into the
+	// Root, AuthRoot, and CA logical stores.
+	AllowLeafInRoot bool
+	// VerifyChain is warn, fail, or empty to skip the chain check.
+	VerifyChain string
+	// FriendlyName sets the friendly name property, if non-empty.  If empty,
+	// any existing friendly name is kept unless Reset is set.
+	FriendlyName string
+	// Description sets the description property, like FriendlyName.
+	Description string
+	// RawProperties are set after all other properties.
+	RawProperties []*certblob.Property
+
+	// MagicName and MagicData set a magic tag, if MagicName is non-empty.
+	MagicName string
+	MagicData int
+	// Certs carrying the SkipMagicName and SkipMagicData magic tag are left
+	// alone, if SkipMagicName is non-empty.
+	SkipMagicName string
+	SkipMagicData int
+
+	// ExpiresAt, if non-zero, is recorded in the cert's registry key, and
+	// takes precedence over the key's last modified time when cleanup
+	// decides whether a cert with the expirable magic tag has expired.  If
+	// it's zero, an expiry time recorded by an earlier injection is removed.
+	ExpiresAt time.Time
+
+	// MetaSource, if non-empty, identifies where the cert came from (e.g. a
+	// URL) in a metadata record stored alongside the magic tag, which also
+	// records the certinject version and injection time.  If empty, any
+	// existing record is removed when the cert is rewritten.
+	MetaSource string
+
+	// MaxBlobBytes limits the size of existing Blob registry values that are
+	// parsed.  Zero means 4 MiB.
+	MaxBlobBytes int
+
+	// BlobValueName is the registry value that the cert's blob is read from
+	// and written to.  Empty means "Blob", which is the only name that
+	// Windows reads; others are for tooling and testing.
+	BlobValueName string
+
+	// Method is how certs are written: "registry" (the default if empty)
+	// writes the blob to the registry directly, and "win32api" adds the cert
+	// via the CryptoAPI store functions.  See InjectMethodRegistry and
+	// InjectMethodWin32API.
+	Method string
+
+	// watch is only set by the flag-driven path; see applyMagic.
+	watch bool
+	// allCerts and searchSHA1 are only set by the flag-driven path, which
+	// then doesn't need the cert's DER; see injectCertOnceCryptoAPI.
+	allCerts   bool
+	searchSHA1 string
+	// dedup is the -dedup policy, which the flag-driven path applies after
+	// injecting; see DedupCert.
+	dedup string
+	// registryView is the -registry-view access flag, which only the
+	// flag-driven path sets; otherwise the native view is used.  See
+	// registryViewAccess.
+	registryView uint32
+	// fingerprint is the cert's fingerprint, if the caller already computed
+	// it (see InjectCertResult); otherwise it's computed from the DER.
+	fingerprint string
+}
+
+// CleanResult summarizes a cleanup pass over a store.
+type CleanResult struct {
+	// Scanned is the number of certs in the store.
+	Scanned int
+	// Expired is the number of expired certs found, whether or not they
+	// were deleted.
+	Expired int
+	// Deleted is the number of expired certs that were deleted, and
+	// DeletedFingerprints lists their registry subkey names.
+	Deleted             int
+	DeletedFingerprints []string
+	// Excluded is the number of expired certs that weren't deleted because
+	// they're listed in the -clean-exclude-file flag's file.
+	Excluded int
+	// Errored is the number of certs that couldn't be checked or deleted.
+	Errored int
+}
+
+// CertInfo describes a certificate found in a CryptoAPI store.
+type CertInfo struct {
+	// Fingerprint is the uppercase hex SHA-1 fingerprint, which is also the
+	// name of the cert's registry subkey.
+	Fingerprint string
+	Blob        certblob.Blob
+	// ModTime is the last modified time of the cert's registry subkey.
+	ModTime time.Time
+	// NotBefore and NotAfter are the cert's validity period, or zero if it
+	// can't be determined.
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Meta is the cert's metadata record (see InjectOptions.MetaSource), or
+	// nil if it has none.
+	Meta *InjectMeta
+}
+
+// InjectMeta is the metadata record of an injected cert.
+type InjectMeta struct {
+	// InjectorVersion is the version of certinject that injected the cert.
+	InjectorVersion string
+	// InjectedAt is when the cert was last written.
+	InjectedAt time.Time
+	// Source identifies where the cert came from.
+	Source string
+}
+
+// Location is a place where FindCert found a cert.
+type Location struct {
+	// PhysicalStore is the name of the physical store, as accepted by the
+	// -physical-store flag.
+	PhysicalStore string
+	LogicalStore  string
+	// Injected is true if the cert carries the magic tag set by the
+	// -set-magic-name and -set-magic-data flags.
+	Injected bool
+}
+
+// InjectError describes how far injecting a cert into a logical store got
+// before it failed, so that partial states can be understood.  It's returned
+// (wrapped) for failures after the cert's properties started being edited;
+// earlier failures don't change anything.  errors.Is and errors.As see
+// through it to Err.
+type InjectError struct {
+	// Fingerprint is the uppercase hex SHA-1 fingerprint of the cert.
+	Fingerprint string
+	// StoreKey is the registry key of the logical store.
+	StoreKey string
+	// Properties lists the IDs of the properties that were added, changed,
+	// or removed in memory before the failure, sorted.
+	Properties []uint32
+	// BlobWritten is true if the edited blob reached the registry, i.e. only
+	// a later step (such as setting the ACL) failed.
+	BlobWritten bool
+	Err         error
+}
+
+func (e *InjectError) Error() string {
+	properties := make([]string, 0, len(e.Properties))
+	for _, id := range e.Properties {
+		properties = append(properties, strconv.FormatUint(uint64(id), 10))
+	}
+
+	if len(properties) == 0 {
+		properties = append(properties, "none")
+	}
+
+	return fmt.Sprintf("%s: couldn't inject into %s (properties built: %s; blob written: %t): %s", e.Fingerprint,
+		e.StoreKey, strings.Join(properties, ", "), e.BlobWritten, e.Err)
+}
+
+func (e *InjectError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,363 @@
+package certinject
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// storeBackupHeader starts every store backup, so that other files aren't
+// mistaken for one.
+const storeBackupHeader = "certinject store backup v1\n"
+
+// A store backup consists of storeBackupHeader followed by one record per
+// cert, until EOF.  Each record is the cert's subkey name, a uint16 count of
+// values, and for each value its name, a uint32 registry type, and a uint32
+// length followed by the data.  Names are a uint16 length followed by the
+// UTF-8 name.  All integers are little-endian.
+
+// backupCert is a cert's registry key, as stored in a backup.
+type backupCert struct {
+	name   string
+	values []backupValue
+}
+
+// backupValue is a registry value of a cert, as stored in a backup.
+type backupValue struct {
+	name    string
+	valType uint32
+	data    []byte
+}
+
+// BackupStore writes every cert in the store to w, including certs that
+// weren't injected by certinject, so that the store can be put back with
+// RestoreStore, e.g. if cleanup removed too much.  All registry values of
+// each cert's key are included, not just the Blob, so magic tags and
+// injection times are preserved.  The format is a simple length-prefixed
+// stream; see storeBackupHeader.
+//
+// Returned errors wrap ErrInvalidStore if the -logical-store flag lists
+// several logical stores, ErrStoreOpen if the store can't be opened,
+// ErrEnumerateCerts if the certs in it can't be listed, ErrBlobRead if a
+// cert's values can't be read, and ErrBackupWrite if w fails.
+func BackupStore(store Store, w io.Writer) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	subKeyNames, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
+
+	bw := bufio.NewWriter(w)
+
+	_, err = bw.WriteString(storeBackupHeader)
+	if err != nil {
+		return fmt.Errorf("%w: %w", err, ErrBackupWrite)
+	}
+
+	record := &bytes.Buffer{}
+
+	for i, subKeyName := range subKeyNames {
+		logScanProgress(store.LogicalKey(flags.logicalStores[0]), subKeyName, i+1, len(subKeyNames))
+
+		values, err := readCertValues(certStoreKey, subKeyName)
+		if err != nil {
+			return fmt.Errorf("%s: %w", displayFingerprint(subKeyName), err)
+		}
+
+		record.Reset()
+		encodeBackupCert(record, backupCert{name: subKeyName, values: values})
+
+		_, err = bw.Write(record.Bytes())
+		if err != nil {
+			return fmt.Errorf("%w: %w", err, ErrBackupWrite)
+		}
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("%w: %w", err, ErrBackupWrite)
+	}
+
+	log.Infof("Backed up %d certs from %s", len(subKeyNames), store)
+
+	return nil
+}
+
+// readCertValues reads all registry values of the cert's key.
+func readCertValues(certStoreKey regKey, subKeyName string) ([]backupValue, error) {
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrBlobRead)
+	}
+	defer certKey.Close()
+
+	names, err := certKey.ReadValueNames(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: couldn't list registry values: %w", err, ErrBlobRead)
+	}
+
+	values := make([]backupValue, 0, len(names))
+
+	for _, name := range names {
+		size, _, err := certKey.GetValue(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: couldn't query %s registry value: %w", err, name, ErrBlobRead)
+		}
+
+		var (
+			data    []byte
+			valType uint32
+		)
+
+		for {
+			err = checkBlobSize(size, maxRegistryValueBytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s registry value: %w", name, err)
+			}
+
+			data = make([]byte, size)
+
+			// If the value grew between the two reads, GetValue reports its
+			// new size, which we check again.
+			size, valType, err = certKey.GetValue(name, data)
+			if !errors.Is(err, registry.ErrShortBuffer) {
+				break
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: couldn't read %s registry value: %w", err, name, ErrBlobRead)
+		}
+
+		values = append(values, backupValue{name: name, valType: valType, data: data[:size]})
+	}
+
+	return values, nil
+}
+
+// encodeBackupCert appends the record for cert to buf.
+func encodeBackupCert(buf *bytes.Buffer, cert backupCert) {
+	encodeBackupName(buf, cert.name)
+	_ = binary.Write(buf, binary.LittleEndian, uint16(len(cert.values)))
+
+	for _, value := range cert.values {
+		encodeBackupName(buf, value.name)
+		_ = binary.Write(buf, binary.LittleEndian, value.valType)
+		_ = binary.Write(buf, binary.LittleEndian, uint32(len(value.data)))
+		buf.Write(value.data)
+	}
+}
+
+func encodeBackupName(buf *bytes.Buffer, name string) {
+	_ = binary.Write(buf, binary.LittleEndian, uint16(len(name)))
+	buf.WriteString(name)
+}
+
+// RestoreStore writes the certs in a backup made by BackupStore back into
+// the store.  Each cert's registry values are restored exactly, with their
+// registry types, and values that the cert has gained since the backup are
+// deleted.  Certs in the store that aren't in the backup are left alone.  The
+// whole backup is read and checked before anything is written, so a
+// truncated or corrupt backup doesn't modify the store.
+//
+// Returned errors wrap ErrBackupFormat if the backup is malformed,
+// ErrInvalidStore if the -logical-store flag lists several logical stores,
+// and ErrStoreOpen if the store can't be opened; the errors for each cert that
+// can't be written wrap ErrRegistryWrite and are joined.
+func RestoreStore(store Store, r io.Reader) error {
+	certs, err := readStoreBackup(r)
+	if err != nil {
+		return err
+	}
+
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	errs := []error{}
+
+	for _, cert := range certs {
+		err = restoreCert(certStoreKey, cert)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", displayFingerprint(cert.name), err))
+		}
+	}
+
+	log.Infof("Restored %d of %d certs into %s", len(certs)-len(errs), len(certs), store)
+
+	return errors.Join(errs...)
+}
+
+// restoreCert recreates the cert's registry key with exactly the backed up
+// values.
+func restoreCert(certStoreKey regKey, cert backupCert) error {
+	certKey, _, err := reg.CreateKey(certStoreKey, cert.name, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't create registry key for certificate: %w", err, ErrRegistryWrite)
+	}
+	defer certKey.Close()
+
+	backedUp := map[string]bool{}
+
+	for _, value := range cert.values {
+		backedUp[value.name] = true
+
+		err = certKey.SetValue(value.name, value.valType, value.data)
+		if err != nil {
+			return fmt.Errorf("%w: couldn't set %s registry value for certificate: %w", err, value.name,
+				ErrRegistryWrite)
+		}
+	}
+
+	names, err := certKey.ReadValueNames(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: couldn't list registry values: %w", err, ErrRegistryWrite)
+	}
+
+	for _, name := range names {
+		if backedUp[name] {
+			continue
+		}
+
+		err = certKey.DeleteValue(name)
+		if err != nil {
+			return fmt.Errorf("%w: couldn't delete %s registry value: %w", err, name, ErrRegistryWrite)
+		}
+	}
+
+	return nil
+}
+
+// readStoreBackup reads and checks a whole backup made by BackupStore.
+func readStoreBackup(r io.Reader) ([]backupCert, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(storeBackupHeader))
+
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header) != storeBackupHeader {
+		return nil, fmt.Errorf("missing backup header: %w", ErrBackupFormat)
+	}
+
+	certs := []backupCert{}
+
+	for {
+		// EOF is only expected between records.
+		if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+			return certs, nil
+		}
+
+		cert, err := readBackupCert(br)
+		if err != nil {
+			return nil, fmt.Errorf("cert %d: %w", len(certs), err)
+		}
+
+		certs = append(certs, cert)
+	}
+}
+
+// readBackupCert reads a single record of a backup.
+func readBackupCert(r io.Reader) (backupCert, error) {
+	name, err := readBackupName(r)
+	if err != nil {
+		return backupCert{}, err
+	}
+
+	if name == "" || strings.Contains(name, `\`) {
+		return backupCert{}, fmt.Errorf("invalid cert key name %q: %w", name, ErrBackupFormat)
+	}
+
+	var count uint16
+
+	err = binary.Read(r, binary.LittleEndian, &count)
+	if err != nil {
+		return backupCert{}, fmt.Errorf("%w: %s: truncated value count: %w", err, name, ErrBackupFormat)
+	}
+
+	cert := backupCert{name: name, values: make([]backupValue, 0, count)}
+
+	for i := uint16(0); i < count; i++ {
+		value, err := readBackupValue(r)
+		if err != nil {
+			return backupCert{}, fmt.Errorf("%s: %w", name, err)
+		}
+
+		cert.values = append(cert.values, value)
+	}
+
+	return cert, nil
+}
+
+func readBackupValue(r io.Reader) (backupValue, error) {
+	name, err := readBackupName(r)
+	if err != nil {
+		return backupValue{}, err
+	}
+
+	var header struct {
+		ValType uint32
+		Size    uint32
+	}
+
+	err = binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return backupValue{}, fmt.Errorf("%w: %s: truncated value header: %w", err, name, ErrBackupFormat)
+	}
+
+	// Check the size before allocating, so that a corrupt backup doesn't
+	// cause a huge allocation.
+	if header.Size > maxRegistryValueBytes {
+		return backupValue{}, fmt.Errorf("%s: %d-byte value exceeds limit of %d bytes: %w", name, header.Size,
+			maxRegistryValueBytes, ErrBackupFormat)
+	}
+
+	data := make([]byte, header.Size)
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return backupValue{}, fmt.Errorf("%w: %s: truncated value: %w", err, name, ErrBackupFormat)
+	}
+
+	return backupValue{name: name, valType: header.ValType, data: data}, nil
+}
+
+func readBackupName(r io.Reader) (string, error) {
+	var size uint16
+
+	err := binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return "", fmt.Errorf("%w: truncated name length: %w", err, ErrBackupFormat)
+	}
+
+	name := make([]byte, size)
+
+	_, err = io.ReadFull(r, name)
+	if err != nil {
+		return "", fmt.Errorf("%w: truncated name: %w", err, ErrBackupFormat)
+	}
+
+	return string(name), nil
+}
@@ -0,0 +1,339 @@
+package certinject
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+var (
+	// oidSignedData is the PKCS#7 signedData content type, which wraps a
+	// CTL.
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	// oidCTL is szOID_CTL, the content type of a certificate trust list.
+	oidCTL = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 1}
+)
+
+// pkcs7ContentInfo is the outer structure of a CTL.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+// pkcs7SignedData is the prefix of a PKCS#7 SignedData structure, up to the
+// type of its encapsulated content.
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"optional,explicit,tag:0"`
+	}
+	Rest []asn1.RawValue `asn1:"optional"`
+}
+
+// checkCTL returns ErrBadCert unless ctlDER is a PKCS#7 SignedData structure
+// whose content is a certificate trust list.  The signature isn't checked;
+// that's up to Windows.
+func checkCTL(ctlDER []byte) error {
+	contentInfo := pkcs7ContentInfo{}
+
+	rest, err := asn1.Unmarshal(ctlDER, &contentInfo)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't parse CTL: %w", err, ErrBadCert)
+	}
+
+	if len(rest) != 0 {
+		return fmt.Errorf("trailing data after CTL: %w", ErrBadCert)
+	}
+
+	if !contentInfo.ContentType.Equal(oidSignedData) {
+		return fmt.Errorf("CTL has content type %s instead of signedData: %w", contentInfo.ContentType,
+			ErrBadCert)
+	}
+
+	signedData := pkcs7SignedData{}
+
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't parse CTL signed data: %w", err, ErrBadCert)
+	}
+
+	if !signedData.EncapContentInfo.ContentType.Equal(oidCTL) {
+		return fmt.Errorf("signed data has content type %s instead of a CTL: %w",
+			signedData.EncapContentInfo.ContentType, ErrBadCert)
+	}
+
+	return nil
+}
+
+// ctlStoreKey returns the registry key of the CTLs of the given logical
+// store, which is a sibling of its Certificates key.  Returned errors wrap
+// ErrInvalidStore if the store's certs aren't in a Certificates key.
+func ctlStoreKey(store Store, logical string) (string, error) {
+	return ctlKeyOf(store.LogicalKey(logical))
+}
+
+// ctlKeyOf is like ctlStoreKey, for the registry key of a logical store's
+// Certificates key.
+func ctlKeyOf(certStoreKey string) (string, error) {
+	prefix, ok := strings.CutSuffix(certStoreKey, `\Certificates`)
+	if !ok {
+		return "", fmt.Errorf("store %s has no CTLs key: %w", certStoreKey, ErrInvalidStore)
+	}
+
+	return prefix + `\CTLs`, nil
+}
+
+// InjectCTL injects a certificate trust list (a signed bundle of trusted
+// certs) into the CTLs key of each of the logical stores configured by the
+// -logical-store flag, tagging it with the magic tag set by the
+// -set-magic-name flag, like InjectCertCryptoAPI.  Like certs, CTLs are
+// identified by their SHA-1 fingerprint.  Watch mode isn't supported, and no
+// properties other than the magic tag are applied.
+//
+// Returned errors wrap ErrBadCert if ctlDER isn't a CTL, ErrStoreOpen if a
+// store can't be opened, and ErrRegistryWrite if the CTL can't be written.
+func InjectCTL(ctlDER []byte) error {
+	if len(ctlDER) == 0 {
+		return ErrNoCert
+	}
+
+	err := checkCTL(ctlDER)
+	if err != nil {
+		return err
+	}
+
+	flagMu.RLock()
+	defer flagMu.RUnlock()
+
+	store, err := cryptoAPIInjectStoreLocked()
+	if err != nil {
+		return err
+	}
+
+	flags, err := snapshotStoreFlagsLocked()
+	if err != nil {
+		return err
+	}
+
+	opts := InjectOptions{
+		MagicName:     injectMagicName(),
+		MagicData:     flags.magicData,
+		SkipMagicName: flags.skipMagicName,
+		SkipMagicData: flags.skipMagicData,
+		registryView:  flags.registryView,
+	}
+
+	return injectCTL(ctlDER, store, flags.logicalStores, &opts)
+}
+
+// injectCTL writes the CTL into each logical store, combining the errors.
+func injectCTL(ctlDER []byte, store Store, logicalStores []string, opts *InjectOptions) error {
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(ctlDER)
+	blob := certblob.Blob{certblob.CertContentCTLPropID: ctlDER}
+	errs := []error{}
+
+	for _, logical := range logicalStores {
+		err := injectSingleCTL(blob, fingerprintHexUpper, store, logical, opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logical store %s: %w", logical, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func injectSingleCTL(blob certblob.Blob, fingerprintHexUpper string, store Store, logical string,
+	opts *InjectOptions,
+) error {
+	storeKey, err := ctlStoreKey(store, logical)
+	if err != nil {
+		return err
+	}
+
+	// Unlike the Certificates key, the CTLs key usually doesn't exist until
+	// a CTL is added.
+	ctlKey, _, err := reg.CreateKey(reg.Root(store.Base, opts.registryView), storeKey, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't create CTL store: %w", err, ErrStoreOpen)
+	}
+	ctlKey.Close()
+
+	return writeBlobCryptoAPI(blob, fingerprintHexUpper, store.Base, storeKey, opts)
+}
+
+// ListInjectedCTLs returns the fingerprints of the CTLs in the store's CTLs
+// keys (for each of the logical stores configured by the -logical-store flag)
+// that carry the magic tag set by the -set-magic-name and -set-magic-data
+// flags, sorted and without duplicates.  A logical store without a CTLs key
+// has no CTLs.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set,
+// ErrInvalidStore if the store has no CTLs key, ErrStoreOpen if a CTLs key
+// can't be opened, and ErrEnumerateCerts if the CTLs can't be listed.
+func ListInjectedCTLs(store Store) ([]string, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.magicName == "" {
+		return nil, ErrNoMagic
+	}
+
+	seen := map[string]bool{}
+	injected := []string{}
+
+	for _, logical := range flags.logicalStores {
+		storeKey, err := ctlStoreKey(store, logical)
+		if err != nil {
+			return nil, err
+		}
+
+		ctls, err := listInjectedCTLsAt(store.Base, storeKey, &flags)
+		if err != nil {
+			return nil, fmt.Errorf("logical store %s: %w", logical, err)
+		}
+
+		for _, fingerprintHex := range ctls {
+			if !seen[fingerprintHex] {
+				seen[fingerprintHex] = true
+				injected = append(injected, fingerprintHex)
+			}
+		}
+	}
+
+	sort.Strings(injected)
+
+	return injected, nil
+}
+
+// listInjectedCTLsAt returns the fingerprints of the CTLs tagged with the
+// magic tag of flags in the given CTLs key, which may not exist.
+func listInjectedCTLsAt(registryBase registry.Key, storeKey string, flags *storeFlags) ([]string, error) {
+	ctlStore, err := reg.OpenKey(reg.Root(registryBase, flags.registryView), storeKey, registry.ENUMERATE_SUB_KEYS)
+	if errors.Is(err, registry.ErrNotExist) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't open CTL store: %w", err, ErrStoreOpen)
+	}
+	defer ctlStore.Close()
+
+	subKeys, err := readSubKeyNames(ctlStore)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't list CTLs: %w", err, ErrEnumerateCerts)
+	}
+
+	injected := []string{}
+
+	for _, subKeyName := range subKeys {
+		ctlKey, err := reg.OpenKey(ctlStore, subKeyName, registry.QUERY_VALUE)
+		if err != nil {
+			// The CTL may have been removed since we listed it.
+			continue
+		}
+
+		if hasMagic(ctlKey, flags.magicName, flags.magicData) {
+			injected = append(injected, subKeyName)
+		}
+
+		ctlKey.Close()
+	}
+
+	return injected, nil
+}
+
+// RemoveCTL deletes the CTL with the given fingerprint from the store's CTLs
+// keys (for each of the logical stores configured by the -logical-store flag),
+// if it carries the magic tag set by the -set-magic-name and -set-magic-data
+// flags.  CTLs without the tag (e.g. ones that Windows manages) are refused.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set,
+// ErrInvalidStore if the store has no CTLs key, ErrStoreOpen if a CTLs key
+// can't be opened, ErrCertNotFound if the CTL isn't present in any of the
+// logical stores or lacks the magic tag, and ErrRegistryWrite if it can't be
+// deleted.
+func RemoveCTL(store Store, fingerprintHex string) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	if flags.magicName == "" {
+		return ErrNoMagic
+	}
+
+	fingerprintHex = normalizeFingerprintCryptoAPI(fingerprintHex)
+
+	found := false
+	errs := []error{}
+
+	for _, logical := range flags.logicalStores {
+		storeKey, err := ctlStoreKey(store, logical)
+		if err != nil {
+			return err
+		}
+
+		ok, err := removeInjectedCTL(store.Base, storeKey, fingerprintHex, &flags)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logical store %s: %w", logical, err))
+		}
+
+		found = found || ok
+	}
+
+	if !found {
+		return fmt.Errorf("%s: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeInjectedCTL deletes the CTL from the given CTLs key if it carries the
+// magic tag of flags.  It returns false if the CTL (or the CTLs key) doesn't
+// exist.
+func removeInjectedCTL(registryBase registry.Key, storeKey, fingerprintHex string, flags *storeFlags) (bool, error) {
+	ctlStore, err := reg.OpenKey(reg.Root(registryBase, flags.registryView), storeKey, registry.ALL_ACCESS)
+	if errors.Is(err, registry.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't open CTL store: %w", err, ErrStoreOpen)
+	}
+	defer ctlStore.Close()
+
+	ctlKey, err := reg.OpenKey(ctlStore, fingerprintHex, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't open CTL %s: %w", err, displayFingerprint(fingerprintHex),
+			ErrStoreOpen)
+	}
+
+	ours := hasMagic(ctlKey, flags.magicName, flags.magicData)
+	ctlKey.Close()
+
+	if !ours {
+		return true, fmt.Errorf("%s lacks magic tag: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	err = reg.DeleteKey(ctlStore, fingerprintHex)
+	if err != nil {
+		return true, fmt.Errorf("%w: couldn't delete CTL %s: %w", err, displayFingerprint(fingerprintHex),
+			ErrRegistryWrite)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,107 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// The physical stores that DedupCert reconciles.  They're the scopes that
+// certinject injects into by default (see -auto-user-fallback), and Windows
+// merges both into the current user's view of each logical store.
+const (
+	dedupUserStore   = "current-user"
+	dedupSystemStore = "system"
+)
+
+// DedupCert looks for the cert with the given fingerprint (SHA-1 hex, in any
+// case, optionally separated by colons or spaces) in both the current-user
+// and system physical stores, for each of the logical stores configured by
+// the -logical-store flag.  Where both have a copy, the copy in the scope
+// that the policy (DedupKeepSystem or DedupKeepUser) doesn't keep is removed,
+// so that the cert isn't trusted twice with conflicting properties.  Only
+// copies carrying the magic tag set by the -set-magic-name flag are removed;
+// other duplicates are only logged.  It returns the locations of the removed
+// copies.
+//
+// Returned errors wrap ErrInvalidStore if the policy is unknown, and are
+// otherwise the same as for FindCert and RemoveCert.
+func DedupCert(fingerprintHex, policy string) ([]Location, error) {
+	var keep, drop string
+
+	switch policy {
+	case DedupKeepSystem:
+		keep, drop = dedupSystemStore, dedupUserStore
+	case DedupKeepUser:
+		keep, drop = dedupUserStore, dedupSystemStore
+	default:
+		return nil, fmt.Errorf("unknown dedup policy %q, want %s or %s: %w", policy, DedupKeepSystem,
+			DedupKeepUser, ErrInvalidStore)
+	}
+
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprintHexUpper := normalizeFingerprintCryptoAPI(fingerprintHex)
+
+	locations, err := findCert(fingerprintHexUpper, &flags)
+	errs := []error{err}
+
+	kept := map[string]bool{}
+
+	for _, location := range locations {
+		if location.PhysicalStore == keep {
+			kept[location.LogicalStore] = true
+		}
+	}
+
+	removed := []Location{}
+
+	for _, location := range locations {
+		if location.PhysicalStore != drop || !kept[location.LogicalStore] {
+			continue
+		}
+
+		if !location.Injected {
+			log.Warnf("%s is in both the %s and %s %s stores, but the %s copy wasn't injected by us; leaving it",
+				displayFingerprint(fingerprintHexUpper), keep, drop, location.LogicalStore, drop)
+
+			continue
+		}
+
+		err := dedupRemove(location, fingerprintHexUpper, flags.registryView)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", drop, location.LogicalStore, err))
+
+			continue
+		}
+
+		log.Infof("Removed duplicate %s from the %s %s store, keeping the %s copy",
+			displayFingerprint(fingerprintHexUpper), drop, location.LogicalStore, keep)
+
+		removed = append(removed, location)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// dedupRemove deletes the cert from the location's store, in the given
+// registry view.
+func dedupRemove(location Location, fingerprintHexUpper string, view uint32) error {
+	store, err := cryptoAPINameToStore(location.PhysicalStore)
+	if err != nil {
+		return err
+	}
+
+	certStoreKey, err := reg.OpenKey(reg.Root(store.Base, view), store.LogicalKey(location.LogicalStore),
+		registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer certStoreKey.Close()
+
+	return removeCertAt(certStoreKey, fingerprintHexUpper)
+}
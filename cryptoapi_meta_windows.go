@@ -0,0 +1,177 @@
+package certinject
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime/debug"
+	"time"
+)
+
+// metaValueName is the REG_BINARY registry value in which the metadata
+// record of an injected cert is stored, if InjectOptions.MetaSource is set.
+// CryptoAPI ignores it.  The magic tag is still set, so that certs are
+// detected the same way with or without a record.
+const metaValueName = "NamecoinMeta"
+
+// metaRecordVersion is the first byte of a metadata record.  A record is this
+// byte, the injection time as a uint64 of seconds since the Unix epoch, and
+// the injector version and source, each a uint16 length followed by UTF-8.
+// All integers are little-endian.
+const metaRecordVersion = 1
+
+// errMetaRecord means a metadata record is malformed.  It's only logged,
+// since a bad record doesn't affect the cert.
+var errMetaRecord = errors.New("malformed metadata record")
+
+// modulePath is this module's import path, used to find its version.
+const modulePath = "github.com/namecoin/certinject"
+
+// injectorVersion returns the version of this module, as recorded in
+// metadata records.
+func injectorVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+
+	return "(unknown)"
+}
+
+// encodeInjectMeta returns the metadata record for meta.
+func encodeInjectMeta(meta InjectMeta) []byte {
+	buf := &bytes.Buffer{}
+
+	buf.WriteByte(metaRecordVersion)
+	_ = binary.Write(buf, binary.LittleEndian, unixSeconds(meta.InjectedAt))
+
+	for _, field := range []string{meta.InjectorVersion, meta.Source} {
+		if len(field) > 0xffff {
+			field = field[:0xffff]
+		}
+
+		_ = binary.Write(buf, binary.LittleEndian, uint16(len(field)))
+		buf.WriteString(field)
+	}
+
+	return buf.Bytes()
+}
+
+// decodeInjectMeta parses a metadata record.
+func decodeInjectMeta(data []byte) (InjectMeta, error) {
+	r := bytes.NewReader(data)
+
+	var header struct {
+		Version    uint8
+		InjectedAt uint64
+	}
+
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return InjectMeta{}, fmt.Errorf("%w: truncated header: %w", err, errMetaRecord)
+	}
+
+	if header.InjectedAt > math.MaxInt64 {
+		return InjectMeta{}, fmt.Errorf("injection time out of range: %w", errMetaRecord)
+	}
+
+	if header.Version != metaRecordVersion {
+		return InjectMeta{}, fmt.Errorf("unknown record version %d: %w", header.Version, errMetaRecord)
+	}
+
+	fields := make([]string, 2)
+
+	for i := range fields {
+		var size uint16
+
+		err = binary.Read(r, binary.LittleEndian, &size)
+		if err != nil {
+			return InjectMeta{}, fmt.Errorf("%w: truncated field length: %w", err, errMetaRecord)
+		}
+
+		field := make([]byte, size)
+
+		_, err = io.ReadFull(r, field)
+		if err != nil {
+			return InjectMeta{}, fmt.Errorf("%w: truncated field: %w", err, errMetaRecord)
+		}
+
+		fields[i] = string(field)
+	}
+
+	return InjectMeta{
+		InjectorVersion: fields[0],
+		InjectedAt:      time.Unix(int64(header.InjectedAt), 0),
+		Source:          fields[1],
+	}, nil
+}
+
+// readInjectMeta reads the cert's metadata record, or returns nil if it has
+// none or it's malformed.
+func readInjectMeta(certKey regKey, subKeyName string) *InjectMeta {
+	data, _, err := certKey.GetBinaryValue(metaValueName)
+	if err != nil {
+		return nil
+	}
+
+	meta, err := decodeInjectMeta(data)
+	if err != nil {
+		log.Debugf("Ignoring %s value of %s: %s", metaValueName, displayFingerprint(subKeyName), err)
+
+		return nil
+	}
+
+	return &meta
+}
+
+// metaUnchanged returns true if the cert's metadata record already matches
+// opts, ignoring the injection time, so that re-injecting an unchanged cert
+// doesn't rewrite it.
+func metaUnchanged(certKey regKey, opts *InjectOptions) bool {
+	data, _, err := certKey.GetBinaryValue(metaValueName)
+	if opts.MetaSource == "" || err != nil {
+		return opts.MetaSource == "" && err != nil
+	}
+
+	meta, err := decodeInjectMeta(data)
+
+	return err == nil && meta.Source == opts.MetaSource && meta.InjectorVersion == injectorVersion()
+}
+
+// applyInjectMeta writes the cert's metadata record if opts.MetaSource is
+// set, and otherwise deletes any old record, since its injection time would
+// be stale.
+func applyInjectMeta(certKey regKey, opts *InjectOptions) error {
+	if opts.MetaSource == "" {
+		_ = certKey.DeleteValue(metaValueName)
+
+		return nil
+	}
+
+	record := encodeInjectMeta(InjectMeta{
+		InjectorVersion: injectorVersion(),
+		InjectedAt:      time.Now(),
+		Source:          opts.MetaSource,
+	})
+
+	err := certKey.SetBinaryValue(metaValueName, record)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't set %s registry value for certificate: %w", err, metaValueName,
+			ErrRegistryWrite)
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// defaultMaxBlobBytes is the default for the -max-blob-bytes flag and the
+// MaxBlobBytes option.
+const defaultMaxBlobBytes = 4 * 1024 * 1024
+
+func (opts *InjectOptions) maxBlobBytes() int {
+	if opts.MaxBlobBytes == 0 {
+		return defaultMaxBlobBytes
+	}
+
+	return opts.MaxBlobBytes
+}
+
+// blobValueName is the registry value in which Windows reads a cert's blob,
+// and the default for the BlobValueName option.
+const blobValueName = "Blob"
+
+func (opts *InjectOptions) blobValueName() string {
+	if opts.BlobValueName == "" {
+		return blobValueName
+	}
+
+	return opts.BlobValueName
+}
+
+// InjectWithOptions injects the given cert into each of the logical stores
+// configured by opts concurrently, combining the errors.  Unlike
+// InjectCertCryptoAPI, it doesn't read any flags, and doesn't support watch
+// mode.
+//
+// Returned errors are the same as for InjectCertCryptoAPI, and also wrap
+// ErrNoCert if derBytes is nil.
+func InjectWithOptions(derBytes []byte, opts InjectOptions) error {
+	if derBytes == nil {
+		return ErrNoCert
+	}
+
+	if opts.Store.Physical == "" {
+		return fmt.Errorf("no physical store specified: %w", ErrInvalidStore)
+	}
+
+	if len(opts.LogicalStores) == 0 {
+		opts.LogicalStores = []string{"Root"}
+	}
+
+	opts.watch = false
+
+	warnUnknownLogicalStores(opts.LogicalStores)
+
+	err := checkStoreKeys(opts.Store, opts.LogicalStores)
+	if err != nil {
+		return err
+	}
+
+	err = opts.checkMethod()
+	if err != nil {
+		return err
+	}
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	return forEachLogicalStore(opts.LogicalStores, func(logical string) error {
+		return injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, opts.Store.Base,
+			opts.Store.LogicalKey(logical), &opts)
+	})
+}
+
+// SetPropertiesPreserving edits the properties of a cert that's already in
+// each of the logical stores configured by opts within store, such as a root
+// that shipped with Windows, according to opts.  opts.Store must be left
+// empty or set to store.  The existing blob is read and written back with the
+// changes applied, so the cert's DER isn't needed.  The magic tag is only set
+// if opts.MagicName is set; leaving it empty modifies the cert without
+// claiming it for cleanup.
+//
+// Returned errors wrap ErrCertNotFound if the cert isn't present, and
+// ErrInvalidOption if opts.Store is a different store, and are otherwise the
+// same as for InjectWithOptions.
+func SetPropertiesPreserving(store Store, fingerprintHex string, opts InjectOptions) error {
+	if opts.Store != (Store{}) && opts.Store != store {
+		return fmt.Errorf("opts.Store (%s) differs from the store argument (%s): %w", opts.Store, store,
+			ErrInvalidOption)
+	}
+
+	opts.Store = store
+
+	if len(opts.LogicalStores) == 0 {
+		opts.LogicalStores = []string{"Root"}
+	}
+
+	opts.watch = false
+
+	err := opts.checkMethod()
+	if err != nil {
+		return err
+	}
+
+	fingerprintHexUpper := normalizeFingerprintCryptoAPI(fingerprintHex)
+	errs := []error{}
+
+	for _, logical := range opts.LogicalStores {
+		storeKey := store.LogicalKey(logical)
+
+		certKey, ok, err := openCertKeyAt(store.Base, opts.registryView, storeKey+`\`+fingerprintHexUpper)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logical store %s: %w", logical, err))
+
+			continue
+		}
+
+		if !ok {
+			errs = append(errs, fmt.Errorf("logical store %s: %s: %w", logical,
+				displayFingerprint(fingerprintHexUpper), ErrCertNotFound))
+
+			continue
+		}
+
+		certKey.Close()
+
+		err = injectSingleCertCryptoAPI(nil, fingerprintHexUpper, store.Base, storeKey, &opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logical store %s: %w", logical, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// InjectWithExpiry is like InjectCertCryptoAPI, but refuses certs that have
+// already expired, and records an explicit expiry time ttl from now, or the
+// cert's NotAfter if that's earlier (see InjectOptions.ExpiresAt), so that
+// cleanup doesn't depend on the registry key's last modified time.  Cleanup
+// still only removes certs that carry the expirable magic tag.  Watch mode
+// isn't supported.
+//
+// Returned errors wrap ErrInvalidOption if ttl isn't positive, ErrBadCert if
+// the cert can't be parsed, and ErrCertExpired if it has expired, and are
+// otherwise the same as for InjectWithOptions.
+func InjectWithExpiry(derBytes []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("expiry TTL %s isn't positive: %w", ttl, ErrInvalidOption)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't parse cert: %w", err, ErrBadCert)
+	}
+
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("%s expired at %s: %w", displayFingerprint(fingerprintHexUpperCryptoAPI(derBytes)),
+			cert.NotAfter.UTC().Format(time.RFC3339), ErrCertExpired)
+	}
+
+	store, err := cryptoAPIInjectStore()
+	if err != nil {
+		return err
+	}
+
+	opts, err := injectOptionsFromFlags()
+	if err != nil {
+		return err
+	}
+
+	opts.Store = store
+
+	opts.ExpiresAt = now.Add(ttl)
+	if opts.ExpiresAt.After(cert.NotAfter) {
+		opts.ExpiresAt = cert.NotAfter
+	}
+
+	return InjectWithOptions(derBytes, opts)
+}
+
+// BuildBlob builds the blob that InjectWithOptions would write for the cert
+// into a store that doesn't contain it yet, without touching the registry.
+// The key identifier property is built as if injecting into the first of
+// opts.LogicalStores.
+//
+// Returned errors wrap ErrNoCert if derBytes is nil, ErrInvalidOption if the
+// options are invalid, ErrEditBlob if the cert can't be parsed, and
+// ErrPropertyMarshal if a property can't be built.
+func BuildBlob(derBytes []byte, opts InjectOptions) (certblob.Blob, error) {
+	if derBytes == nil {
+		return nil, ErrNoCert
+	}
+
+	logical := "Root"
+	if len(opts.LogicalStores) != 0 {
+		logical = opts.LogicalStores[0]
+	}
+
+	// Only the logical store part of the key matters here, so a Store isn't
+	// required.
+	storeKey := logical + `\Certificates`
+	if opts.Store.Physical != "" {
+		storeKey = opts.Store.LogicalKey(logical)
+	}
+
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+
+	err := editBlob(blob, storeKey, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+// injectOptionsFromFlags builds InjectOptions from the capi.* flags.  The
+// Store field is left for the caller to fill in, since choosing it may
+// involve probing the registry (see cryptoAPIInjectStore).  The flags are
+// read while holding flagMu, so the options are a consistent snapshot even if
+// WithFlags is called concurrently.  Returned errors wrap ErrInvalidStore if
+// the -registry-view flag is invalid, and ErrInvalidOption if the
+// -raw-properties flag or a name constraint flag is malformed or the
+// -fingerprint-format or -dedup flag is unknown.
+func injectOptionsFromFlags() (InjectOptions, error) {
+	flagMu.RLock()
+	defer flagMu.RUnlock()
+
+	return injectOptionsFromFlagsLocked()
+}
+
+// injectOptionsFromFlagsLocked is like injectOptionsFromFlags, for callers
+// that already hold flagMu.
+func injectOptionsFromFlagsLocked() (InjectOptions, error) {
+	if err := snapshotLogFlagsLocked(); err != nil {
+		return InjectOptions{}, err
+	}
+
+	nameConstraints, err := nameConstraintsFlagsTemplate()
+	if err != nil {
+		return InjectOptions{}, err
+	}
+
+	rawProps, err := parseRawProperties(rawProperties.Value())
+	if err != nil {
+		return InjectOptions{}, err
+	}
+
+	err = checkDedupPolicy(dedup.Value())
+	if err != nil {
+		return InjectOptions{}, err
+	}
+
+	view, err := registryViewAccess()
+	if err != nil {
+		return InjectOptions{}, err
+	}
+
+	return InjectOptions{
+		LogicalStores:           logicalStoreNames(),
+		Reset:                   cryptoAPIFlagReset.Value(),
+		ResetKeepHashes:         cryptoAPIFlagResetKeepHashes.Value(),
+		ExtKeyUsages:            buildEKUList(),
+		NoExtKeyUsage:           ekuNone.Value(),
+		NameConstraints:         nameConstraints,
+		NameConstraintsFromCert: nameConstraintsFromCert.Value(),
+		NameConstraintsMerge:    nameConstraintsMerge.Value(),
+		SetKeyIdentifier:        setSKI.Value(),
+		SecureACL:               secureACL.Value(),
+		SkipExisting:            skipExisting.Value() && !force.Value(),
+		AllowLeafInRoot:         allowLeafInRoot.Value(),
+		VerifyChain:             verifyChain.Value(),
+		FriendlyName:            friendlyName.Value(),
+		Description:             description.Value(),
+		RawProperties:           rawProps,
+		MagicName:               injectMagicName(),
+		MagicData:               setMagicData.Value(),
+		SkipMagicName:           skipMagicName.Value(),
+		SkipMagicData:           skipMagicData.Value(),
+		MetaSource:              metaSource.Value(),
+		MaxBlobBytes:            maxBlobBytes.Value(),
+		watch:                   watch.Value(),
+		allCerts:                allCerts.Value(),
+		searchSHA1:              searchSHA1.Value(),
+		Method:                  injectMethod.Value(),
+		dedup:                   dedup.Value(),
+		registryView:            view,
+	}, nil
+}
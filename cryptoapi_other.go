@@ -0,0 +1,269 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// The CryptoAPI functions only work on Windows.  These stubs let
+// cross-platform programs compile everywhere; they return
+// ErrUnsupportedPlatform at runtime.
+
+// Store is used to generate a registry key to open a certificate store in the
+// Windows Registry.  On other platforms, Base is an opaque registry handle.
+type Store struct {
+	Base     uintptr
+	Physical string
+	Logical  string // may contain a %s, in which it would be replaced by the -logical-store flag
+}
+
+// String returns a human readable string (only useful for debug logs).
+func (s Store) String() string {
+	return s.Key()
+}
+
+// Key generates the registry key for use in opening the store.  The Root
+// logical store is used, since the -logical-store flag only exists on
+// Windows.
+func (s Store) Key() string {
+	return s.LogicalKey("Root")
+}
+
+// LogicalKey generates the registry key for use in opening the specified
+// logical store.
+func (s Store) LogicalKey(logical string) string {
+	return fmt.Sprintf(`%s\`+s.Logical, s.Physical, logical)
+}
+
+// RegisterStore returns ErrUnsupportedPlatform.
+func RegisterStore(_ string, _ Store) error {
+	return ErrUnsupportedPlatform
+}
+
+// CheckStoreAccess returns ErrUnsupportedPlatform.
+func CheckStoreAccess(_ Store) error {
+	return ErrUnsupportedPlatform
+}
+
+// SelfTest returns ErrUnsupportedPlatform.
+func SelfTest(_ Store) error {
+	return ErrUnsupportedPlatform
+}
+
+// InjectCertCryptoAPI returns ErrUnsupportedPlatform.
+func InjectCertCryptoAPI(_ []byte) error {
+	return ErrUnsupportedPlatform
+}
+
+// InjectWithOptions returns ErrUnsupportedPlatform.
+func InjectWithOptions(_ []byte, _ InjectOptions) error {
+	return ErrUnsupportedPlatform
+}
+
+// InjectWithProfile returns ErrUnsupportedPlatform.
+func InjectWithProfile(_ []byte, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// InjectWithExpiry returns ErrUnsupportedPlatform.
+func InjectWithExpiry(_ []byte, _ time.Duration) error {
+	return ErrUnsupportedPlatform
+}
+
+// InjectPKCS12 returns ErrUnsupportedPlatform.
+func InjectPKCS12(_ []byte, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// InjectCTL returns ErrUnsupportedPlatform.
+func InjectCTL(_ []byte) error {
+	return ErrUnsupportedPlatform
+}
+
+// ListInjectedCTLs returns ErrUnsupportedPlatform.
+func ListInjectedCTLs(_ Store) ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// RemoveCTL returns ErrUnsupportedPlatform.
+func RemoveCTL(_ Store, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// InjectRawBlob returns ErrUnsupportedPlatform.
+func InjectRawBlob(_ Store, _ string, _ certblob.Blob) error {
+	return ErrUnsupportedPlatform
+}
+
+// SetPropertiesPreserving returns ErrUnsupportedPlatform.
+func SetPropertiesPreserving(_ Store, _ string, _ InjectOptions) error {
+	return ErrUnsupportedPlatform
+}
+
+// BuildBlob returns ErrUnsupportedPlatform.
+func BuildBlob(_ []byte, _ InjectOptions) (certblob.Blob, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// EvaluateTrust returns ErrUnsupportedPlatform.
+func EvaluateTrust(_ []byte, _ x509.ExtKeyUsage) (bool, string, error) {
+	return false, "", ErrUnsupportedPlatform
+}
+
+// VerifyInjected returns ErrUnsupportedPlatform.
+func VerifyInjected(_ Store, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// VerifyInjectedNameConstraints returns ErrUnsupportedPlatform.
+func VerifyInjectedNameConstraints(_ Store, _ string, _ *x509.Certificate, _ bool) error {
+	return ErrUnsupportedPlatform
+}
+
+// VerifyInjectedFile returns ErrUnsupportedPlatform.
+func VerifyInjectedFile(_ Store, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// IsInjected returns ErrUnsupportedPlatform.
+func IsInjected(_ Store, _ []byte) (bool, error) {
+	return false, ErrUnsupportedPlatform
+}
+
+// IsNamecoinInjected returns ErrUnsupportedPlatform.
+func IsNamecoinInjected(_ Store, _ []byte) (bool, error) {
+	return false, ErrUnsupportedPlatform
+}
+
+// FindCert returns ErrUnsupportedPlatform.
+func FindCert(_ string) ([]Location, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// DedupCert returns ErrUnsupportedPlatform.
+func DedupCert(_, _ string) ([]Location, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// CountInjected returns ErrUnsupportedPlatform.
+func CountInjected(_ Store) (int, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+// ListInjectedCerts returns ErrUnsupportedPlatform.
+func ListInjectedCerts(_ Store) ([]CertInfo, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// ListInjectedCertsWin32API returns ErrUnsupportedPlatform.
+func ListInjectedCertsWin32API(_ Store) ([]CertInfo, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// DiffStores returns ErrUnsupportedPlatform.
+func DiffStores(_, _ Store) ([]string, []string, error) {
+	return nil, nil, ErrUnsupportedPlatform
+}
+
+// CleanCertsCryptoAPI returns ErrUnsupportedPlatform.
+func CleanCertsCryptoAPI() error {
+	return ErrUnsupportedPlatform
+}
+
+// CleanCertsResult returns ErrUnsupportedPlatform.
+func CleanCertsResult(_ Store) (CleanResult, error) {
+	return CleanResult{}, ErrUnsupportedPlatform
+}
+
+// CleanAllStores returns ErrUnsupportedPlatform.
+func CleanAllStores(_ time.Duration) error {
+	return ErrUnsupportedPlatform
+}
+
+// CleanInjectedBefore returns ErrUnsupportedPlatform.
+func CleanInjectedBefore(_ Store, _ time.Time) ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// RunCleanupDaemon logs ErrUnsupportedPlatform and returns immediately.
+func RunCleanupDaemon(_ context.Context, _ Store, _ time.Duration) {
+	log.Errorf("Couldn't clean certs: %s", ErrUnsupportedPlatform)
+}
+
+// ConfiguredStoreCryptoAPI returns ErrUnsupportedPlatform.
+func ConfiguredStoreCryptoAPI() (Store, error) {
+	return Store{}, ErrUnsupportedPlatform
+}
+
+// RenewExpired returns ErrUnsupportedPlatform.
+func RenewExpired(_ Store, _ func(old CertInfo) ([]byte, bool)) error {
+	return ErrUnsupportedPlatform
+}
+
+// PurgeAllInjected returns ErrUnsupportedPlatform.
+func PurgeAllInjected() ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// TouchCert returns ErrUnsupportedPlatform.
+func TouchCert(_ Store, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// TouchCertsFrom returns ErrUnsupportedPlatform.
+func TouchCertsFrom(_ Store, _ io.Reader, _ io.Writer) error {
+	return ErrUnsupportedPlatform
+}
+
+// MigrateMagic returns ErrUnsupportedPlatform.
+func MigrateMagic(_ Store, _ string, _ uint32) ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// RemoveCert returns ErrUnsupportedPlatform.
+func RemoveCert(_ Store, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// RemoveCertsFrom returns ErrUnsupportedPlatform.
+func RemoveCertsFrom(_ Store, _ io.Reader, _ io.Writer) error {
+	return ErrUnsupportedPlatform
+}
+
+// RemoveCertFile returns ErrUnsupportedPlatform.
+func RemoveCertFile(_ Store, _ string) error {
+	return ErrUnsupportedPlatform
+}
+
+// RemoveCerts returns ErrUnsupportedPlatform.
+func RemoveCerts(_ Store, _ []string) ([]string, []string, error) {
+	return nil, nil, ErrUnsupportedPlatform
+}
+
+// SyncWithSource returns ErrUnsupportedPlatform.
+func SyncWithSource(_ Store, _ func() ([][]byte, error)) ([]string, []string, []string, error) {
+	return nil, nil, nil, ErrUnsupportedPlatform
+}
+
+// BackupStore returns ErrUnsupportedPlatform.
+func BackupStore(_ Store, _ io.Writer) error {
+	return ErrUnsupportedPlatform
+}
+
+// RestoreStore returns ErrUnsupportedPlatform.
+func RestoreStore(_ Store, _ io.Reader) error {
+	return ErrUnsupportedPlatform
+}
+
+// RepairStore returns ErrUnsupportedPlatform.
+func RepairStore(_ Store) ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCryptoAPIUnsupported(t *testing.T) {
+	store := Store{Physical: `SOFTWARE\Microsoft\SystemCertificates`, Logical: `%s\Certificates`}
+
+	if err := InjectWithOptions([]byte("cert"), InjectOptions{Store: store}); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("expected ErrUnsupportedPlatform from InjectWithOptions, got %v", err)
+	}
+
+	if _, err := ListInjectedCerts(store); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("expected ErrUnsupportedPlatform from ListInjectedCerts, got %v", err)
+	}
+
+	if store.Key() != `SOFTWARE\Microsoft\SystemCertificates\Root\Certificates` {
+		t.Errorf("unexpected store key %s", store.Key())
+	}
+}
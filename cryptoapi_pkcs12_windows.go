@@ -0,0 +1,76 @@
+package certinject
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// InjectPKCS12 decodes a PKCS#12 (.pfx) file and injects the certs it
+// contains into the CryptoAPI physical store configured by flags, using the
+// other configured options.  Each cert goes to the logical store that suits
+// it: self-signed CA certs to Root, other CA certs to CA, and end-entity certs
+// to My.  The private key isn't imported; the end-entity cert is injected
+// without a link to it.  Watch mode isn't supported.
+//
+// Returned errors wrap ErrPKCS12Password if the password is wrong, ErrBadCert
+// if the file can't be decoded, and are otherwise the same as for
+// InjectWithOptions.
+func InjectPKCS12(pfxBytes []byte, password string) error {
+	store, err := cryptoAPIInjectStore()
+	if err != nil {
+		return err
+	}
+
+	opts, err := injectOptionsFromFlags()
+	if err != nil {
+		return err
+	}
+
+	opts.Store = store
+
+	return injectPKCS12(pfxBytes, password, opts)
+}
+
+func injectPKCS12(pfxBytes []byte, password string, opts InjectOptions) error {
+	_, leaf, caCerts, err := pkcs12.DecodeChain(pfxBytes, password)
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		return fmt.Errorf("%w: %w", err, ErrPKCS12Password)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: couldn't decode PKCS#12: %w", err, ErrBadCert)
+	}
+
+	log.Debugf("Not importing the private key of %s", displayFingerprint(fingerprintHexUpperCryptoAPI(leaf.Raw)))
+
+	errs := []error{}
+
+	for _, cert := range append([]*x509.Certificate{leaf}, caCerts...) {
+		opts.LogicalStores = []string{pkcs12LogicalStore(cert)}
+
+		err := InjectWithOptions(cert.Raw, opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", displayFingerprint(fingerprintHexUpperCryptoAPI(cert.Raw)), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// pkcs12LogicalStore returns the logical store that suits a cert from a
+// PKCS#12 file.
+func pkcs12LogicalStore(cert *x509.Certificate) string {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return "My"
+	}
+
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+		return "Root"
+	}
+
+	return "CA"
+}
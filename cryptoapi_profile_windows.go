@@ -0,0 +1,227 @@
+package certinject
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// injectProfile is the JSON document read by InjectWithProfile.  Each field
+// corresponds to an InjectOptions field (or the -physical-store flag), and
+// EKUs and name constraints are written like the eku.* and nc.* flags.
+type injectProfile struct {
+	PhysicalStore           string                 `json:"physicalStore"`
+	LogicalStores           []string               `json:"logicalStores"`
+	Reset                   bool                   `json:"reset"`
+	ResetKeepHashes         bool                   `json:"resetKeepHashes"`
+	ExtKeyUsages            []string               `json:"extKeyUsages"`
+	NoExtKeyUsage           bool                   `json:"noExtKeyUsage"`
+	NameConstraints         profileNameConstraints `json:"nameConstraints"`
+	NameConstraintsFromCert bool                   `json:"nameConstraintsFromCert"`
+	NameConstraintsMerge    bool                   `json:"nameConstraintsMerge"`
+	SetKeyIdentifier        string                 `json:"setKeyIdentifier"`
+	SecureACL               bool                   `json:"secureACL"`
+	SkipExisting            bool                   `json:"skipExisting"`
+	AllowLeafInRoot         bool                   `json:"allowLeafInRoot"`
+	VerifyChain             string                 `json:"verifyChain"`
+	FriendlyName            string                 `json:"friendlyName"`
+	Description             string                 `json:"description"`
+	MetaSource              string                 `json:"metaSource"`
+	Method                  string                 `json:"method"`
+}
+
+// profileNameConstraints lists the name constraints of a profile.  Unlike the
+// nc.* flags, several DNS and URI domains can be given.
+type profileNameConstraints struct {
+	PermittedDNS   []string `json:"permittedDNS"`
+	ExcludedDNS    []string `json:"excludedDNS"`
+	PermittedIP    []string `json:"permittedIP"`
+	ExcludedIP     []string `json:"excludedIP"`
+	PermittedEmail []string `json:"permittedEmail"`
+	ExcludedEmail  []string `json:"excludedEmail"`
+	PermittedURI   []string `json:"permittedURI"`
+	ExcludedURI    []string `json:"excludedURI"`
+}
+
+// ekuNames maps the names of the eku.* flags to the usages they enable.
+var ekuNames = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server":           x509.ExtKeyUsageServerAuth,
+	"client":           x509.ExtKeyUsageClientAuth,
+	"code":             x509.ExtKeyUsageCodeSigning,
+	"email":            x509.ExtKeyUsageEmailProtection,
+	"ipsec-end-system": x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec-tunnel":     x509.ExtKeyUsageIPSECTunnel,
+	"ipsec-user":       x509.ExtKeyUsageIPSECUser,
+	"time":             x509.ExtKeyUsageTimeStamping,
+	"ocsp":             x509.ExtKeyUsageOCSPSigning,
+	"ms-code-com":      x509.ExtKeyUsageMicrosoftCommercialCodeSigning,
+	"ms-code-kernel":   x509.ExtKeyUsageMicrosoftKernelCodeSigning,
+}
+
+// InjectWithProfile is like InjectWithOptions, with the options read from the
+// JSON profile at profilePath instead of the capi.* property flags, so that
+// complex deployments don't need long command lines.  For example:
+//
+//	{
+//	  "physicalStore": "system",
+//	  "logicalStores": ["Root"],
+//	  "extKeyUsages": ["server"],
+//	  "nameConstraints": {"permittedDNS": ["bit"]},
+//	  "friendlyName": "Namecoin TLD CA"
+//	}
+//
+// Fields that aren't set take their zero value, not the corresponding flag's
+// value; only the magic tags and the -max-blob-bytes and -registry-view flags
+// still come from flags.  If physicalStore isn't set, the store configured by flags is used.
+//
+// Returned errors wrap ErrProfile if the profile can't be read or is invalid
+// (including unknown fields), and are otherwise the same as for
+// InjectWithOptions.
+func InjectWithProfile(derBytes []byte, profilePath string) error {
+	profile, err := readInjectProfile(profilePath)
+	if err != nil {
+		return err
+	}
+
+	opts, err := profile.injectOptions()
+	if err != nil {
+		return fmt.Errorf("%s: %w", profilePath, err)
+	}
+
+	if profile.PhysicalStore != "" {
+		opts.Store, err = cryptoAPINameToStore(profile.PhysicalStore)
+	} else {
+		opts.Store, err = cryptoAPIInjectStore()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return InjectWithOptions(derBytes, opts)
+}
+
+// readInjectProfile reads and decodes the profile at path, rejecting unknown
+// fields and trailing data.
+func readInjectProfile(path string) (*injectProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't read profile: %w", err, ErrProfile)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	profile := &injectProfile{}
+
+	err = decoder.Decode(profile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't parse profile %s: %w", err, path, ErrProfile)
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("trailing data after profile %s: %w", path, ErrProfile)
+	}
+
+	return profile, nil
+}
+
+// injectOptions converts the profile to InjectOptions, except for the Store.
+// Returned errors also wrap ErrInvalidStore if the -registry-view flag is
+// invalid.
+func (p *injectProfile) injectOptions() (InjectOptions, error) {
+	flagMu.RLock()
+	flags, err := snapshotStoreFlagsLocked()
+	magicName := injectMagicName()
+	flagMu.RUnlock()
+
+	if err != nil {
+		return InjectOptions{}, err
+	}
+
+	ekus := []x509.ExtKeyUsage{}
+
+	for _, name := range p.ExtKeyUsages {
+		eku, ok := ekuNames[name]
+		if !ok {
+			return InjectOptions{}, fmt.Errorf("unknown extended key usage %q: %w", name, ErrProfile)
+		}
+
+		ekus = append(ekus, eku)
+	}
+
+	nameConstraints, err := p.NameConstraints.template()
+	if err != nil {
+		return InjectOptions{}, fmt.Errorf("%w: invalid name constraints: %w", err, ErrProfile)
+	}
+
+	return InjectOptions{
+		LogicalStores:           p.LogicalStores,
+		Reset:                   p.Reset,
+		ResetKeepHashes:         p.ResetKeepHashes,
+		ExtKeyUsages:            ekus,
+		NoExtKeyUsage:           p.NoExtKeyUsage,
+		NameConstraints:         nameConstraints,
+		NameConstraintsFromCert: p.NameConstraintsFromCert,
+		NameConstraintsMerge:    p.NameConstraintsMerge,
+		SetKeyIdentifier:        p.SetKeyIdentifier,
+		SecureACL:               p.SecureACL,
+		SkipExisting:            p.SkipExisting,
+		AllowLeafInRoot:         p.AllowLeafInRoot,
+		VerifyChain:             p.VerifyChain,
+		FriendlyName:            p.FriendlyName,
+		Description:             p.Description,
+		MetaSource:              p.MetaSource,
+		Method:                  p.Method,
+		MagicName:               magicName,
+		MagicData:               flags.magicData,
+		SkipMagicName:           flags.skipMagicName,
+		SkipMagicData:           flags.skipMagicData,
+		MaxBlobBytes:            flags.maxBlobBytes,
+		registryView:            flags.registryView,
+	}, nil
+}
+
+// template returns a template with the profile's name constraints, or nil if
+// none are set, like nameConstraintsFlagsTemplate.
+func (nc *profileNameConstraints) template() (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		PermittedDNSDomains: nc.PermittedDNS,
+		ExcludedDNSDomains:  nc.ExcludedDNS,
+		PermittedURIDomains: nc.PermittedURI,
+		ExcludedURIDomains:  nc.ExcludedURI,
+	}
+	valid := false
+
+	err := setNameConstraintsIPRanges(&template.PermittedIPRanges, strings.Join(nc.PermittedIP, ","), &valid)
+	if err != nil {
+		return nil, fmt.Errorf("permitted: %w", err)
+	}
+
+	err = setNameConstraintsIPRanges(&template.ExcludedIPRanges, strings.Join(nc.ExcludedIP, ","), &valid)
+	if err != nil {
+		return nil, fmt.Errorf("excluded: %w", err)
+	}
+
+	err = setNameConstraintsEmails(&template.PermittedEmailAddresses, strings.Join(nc.PermittedEmail, ","), &valid)
+	if err != nil {
+		return nil, fmt.Errorf("permitted: %w", err)
+	}
+
+	err = setNameConstraintsEmails(&template.ExcludedEmailAddresses, strings.Join(nc.ExcludedEmail, ","), &valid)
+	if err != nil {
+		return nil, fmt.Errorf("excluded: %w", err)
+	}
+
+	if !hasNameConstraints(template) {
+		return nil, nil
+	}
+
+	return template, nil
+}
@@ -0,0 +1,140 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// selfTestLogicalStore is the logical store that SelfTest injects into.
+const selfTestLogicalStore = "Root"
+
+// SelfTest checks that certs can be injected into and removed from the store,
+// without leaving anything behind: it generates an ephemeral self-signed CA
+// cert (valid for an hour, and name-constrained to the .invalid TLD so that
+// it can't vouch for any real site while it's present), injects it into the
+// store's Root logical store, verifies that it's present and intact, removes
+// it, and verifies that it's gone.  Each step's result is logged.  If
+// injection succeeds, removal is attempted even if verification fails.
+//
+// Returned errors wrap ErrSelfTest, and join the errors of the failed steps.
+func SelfTest(store Store) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return selfTestResult("configure", err)
+	}
+
+	derBytes, err := selfTestCert()
+	if err != nil {
+		return selfTestResult("generate", fmt.Errorf("%w: couldn't generate cert: %w", err, ErrSelfTest))
+	}
+
+	selfTestResult("generate", nil)
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	storeKey := store.LogicalKey(selfTestLogicalStore)
+
+	err = InjectWithOptions(derBytes, InjectOptions{
+		Store:         store,
+		LogicalStores: []string{selfTestLogicalStore},
+		MaxBlobBytes:  flags.maxBlobBytes,
+		registryView:  flags.registryView,
+	})
+	if err != nil {
+		return selfTestResult("inject", err)
+	}
+
+	selfTestResult("inject", nil)
+
+	errs := []error{
+		selfTestResult("verify", selfTestVerify(store.Base, storeKey, fingerprintHexUpper, &flags)),
+	}
+
+	err = selfTestResult("remove", selfTestRemove(store.Base, storeKey, fingerprintHexUpper, &flags))
+	if err != nil {
+		errs = append(errs, err)
+
+		return errors.Join(errs...)
+	}
+
+	errs = append(errs, selfTestResult("verify removal", selfTestVerifyRemoved(store.Base, storeKey,
+		fingerprintHexUpper, &flags)))
+
+	return errors.Join(errs...)
+}
+
+// selfTestResult logs the result of a SelfTest step, and returns err wrapped
+// with the step's name (and ErrSelfTest), or nil if it passed.
+func selfTestResult(step string, err error) error {
+	if err == nil {
+		log.Infof("Self-test: %s: pass", step)
+
+		return nil
+	}
+
+	log.Errorf("Self-test: %s: FAIL: %s", step, err)
+
+	if !errors.Is(err, ErrSelfTest) {
+		err = fmt.Errorf("%w: %w", err, ErrSelfTest)
+	}
+
+	return fmt.Errorf("%s: %w", step, err)
+}
+
+// selfTestCert generates the ephemeral cert used by SelfTest.
+func selfTestCert() ([]byte, error) {
+	derBytes, _, err := generateTestRoot("certinject self-test (safe to delete)", time.Hour, []string{"invalid"})
+
+	return derBytes, err
+}
+
+// selfTestVerify checks that the injected cert is present and intact.
+func selfTestVerify(registryBase registry.Key, storeKey, fingerprintHexUpper string, flags *storeFlags) error {
+	certKey, ok, err := openCertKeyAt(registryBase, flags.registryView, storeKey+`\`+fingerprintHexUpper)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("%s: %w", displayFingerprint(fingerprintHexUpper), ErrCertNotFound)
+	}
+	defer certKey.Close()
+
+	blob, err := readBlobValue(certKey, flags.maxBlobBytes)
+	if err != nil {
+		return err
+	}
+
+	return checkBlobFingerprint(blob, fingerprintHexUpper)
+}
+
+// selfTestRemove deletes the injected cert.
+func selfTestRemove(registryBase registry.Key, storeKey, fingerprintHexUpper string, flags *storeFlags) error {
+	certStoreKey, err := reg.OpenKey(reg.Root(registryBase, flags.registryView), storeKey, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer certStoreKey.Close()
+
+	return removeCertAt(certStoreKey, fingerprintHexUpper)
+}
+
+// selfTestVerifyRemoved checks that the removed cert is gone.
+func selfTestVerifyRemoved(registryBase registry.Key, storeKey, fingerprintHexUpper string,
+	flags *storeFlags,
+) error {
+	certKey, ok, err := openCertKeyAt(registryBase, flags.registryView, storeKey+`\`+fingerprintHexUpper)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		certKey.Close()
+
+		return fmt.Errorf("%s: cert still present after removal", displayFingerprint(fingerprintHexUpper))
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package certinject
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// SyncWithSource reconciles the certs carrying the magic tag set by the
+// -set-magic-name and -set-magic-data flags in the store (for the first
+// logical store configured by the -logical-store flag) with the DER certs
+// returned by source, which is treated as authoritative.  Certs in the source
+// that aren't injected yet are injected, injected certs whose blob differs
+// from what injection would write (e.g. because the configured properties
+// changed) are re-injected, and injected certs that the source no longer
+// lists are removed.  Certs are matched by fingerprint, and the other options
+// are taken from the capi.* flags.  Certs are always tagged, even if the
+// -no-magic flag is set, since untagged certs couldn't be reconciled.
+//
+// It returns the fingerprints that were added, updated, and removed, each
+// sorted.  If source fails, the store isn't touched.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set, and
+// ErrSourceFetch if source fails; otherwise, they're the same as for
+// ListInjectedCerts, and the errors for each cert that couldn't be injected
+// or removed are joined.
+func SyncWithSource(store Store, source func() ([][]byte, error)) ([]string, []string, []string, error) {
+	flagMu.RLock()
+
+	flags, err := snapshotStoreFlagsLocked()
+	if err != nil {
+		flagMu.RUnlock()
+
+		return nil, nil, nil, err
+	}
+
+	opts, err := injectOptionsFromFlagsLocked()
+	flagMu.RUnlock()
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if flags.magicName == "" {
+		return nil, nil, nil, ErrNoMagic
+	}
+
+	sourceCerts, err := source()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %w", err, ErrSourceFetch)
+	}
+
+	opts.Store = store
+	opts.MagicName = flags.magicName
+	opts.watch = false
+
+	injected, err := listInjectedCerts(store, &flags)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, info := range injected {
+		existing[info.Fingerprint] = true
+	}
+
+	added := []string{}
+	updated := []string{}
+	errs := []error{}
+	inSource := map[string]bool{}
+
+	for _, derBytes := range sourceCerts {
+		fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+		if inSource[fingerprintHexUpper] {
+			continue
+		}
+
+		inSource[fingerprintHexUpper] = true
+
+		oldBlobBytes := storedBlobBytes(store, fingerprintHexUpper, &flags)
+
+		err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, store.Base,
+			store.LogicalKey(flags.logicalStores[0]), &opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", displayFingerprint(fingerprintHexUpper), err))
+
+			continue
+		}
+
+		switch {
+		case !existing[fingerprintHexUpper]:
+			added = append(added, fingerprintHexUpper)
+		case !bytes.Equal(oldBlobBytes, storedBlobBytes(store, fingerprintHexUpper, &flags)):
+			updated = append(updated, fingerprintHexUpper)
+		}
+	}
+
+	stale := []string{}
+
+	for fingerprintHexUpper := range existing {
+		if !inSource[fingerprintHexUpper] {
+			stale = append(stale, fingerprintHexUpper)
+		}
+	}
+
+	sort.Strings(stale)
+
+	removed := []string{}
+
+	if len(stale) != 0 {
+		var removeErr error
+
+		removed, _, removeErr = removeCerts(store, stale, &flags)
+		errs = append(errs, removeErr)
+	}
+
+	sort.Strings(added)
+	sort.Strings(updated)
+
+	return added, updated, removed, errors.Join(errs...)
+}
+
+// storedBlobBytes returns the raw Blob value of the cert in the store, or nil
+// if it can't be read.
+func storedBlobBytes(store Store, fingerprintHexUpper string, flags *storeFlags) []byte {
+	certKey, ok, err := openCertKey(store, fingerprintHexUpper, flags)
+	if !ok || err != nil {
+		return nil
+	}
+	defer certKey.Close()
+
+	blobBytes, _, err := certKey.GetBinaryValue(blobValueName)
+	if err != nil {
+		return nil
+	}
+
+	return blobBytes
+}
@@ -0,0 +1,129 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ekuOIDs maps the extended key usages that EvaluateTrust supports to their
+// dotted OIDs, as CertGetCertificateChain expects them.
+var ekuOIDs = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageServerAuth:                     "1.3.6.1.5.5.7.3.1",
+	x509.ExtKeyUsageClientAuth:                     "1.3.6.1.5.5.7.3.2",
+	x509.ExtKeyUsageCodeSigning:                    "1.3.6.1.5.5.7.3.3",
+	x509.ExtKeyUsageEmailProtection:                "1.3.6.1.5.5.7.3.4",
+	x509.ExtKeyUsageIPSECEndSystem:                 "1.3.6.1.5.5.7.3.5",
+	x509.ExtKeyUsageIPSECTunnel:                    "1.3.6.1.5.5.7.3.6",
+	x509.ExtKeyUsageIPSECUser:                      "1.3.6.1.5.5.7.3.7",
+	x509.ExtKeyUsageTimeStamping:                   "1.3.6.1.5.5.7.3.8",
+	x509.ExtKeyUsageOCSPSigning:                    "1.3.6.1.5.5.7.3.9",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "1.3.6.1.4.1.311.2.1.22",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "1.3.6.1.4.1.311.61.1.1",
+}
+
+// trustStatusReasons describes the CERT_TRUST_* error bits that are most
+// likely to explain why an injected cert isn't trusted, in the order they're
+// reported.
+var trustStatusReasons = []struct {
+	bit    uint32
+	reason string
+}{
+	{windows.CERT_TRUST_IS_EXPLICIT_DISTRUST, "explicitly distrusted (e.g. in the Disallowed store)"},
+	{windows.CERT_TRUST_IS_UNTRUSTED_ROOT, "chains to an untrusted root"},
+	{windows.CERT_TRUST_IS_PARTIAL_CHAIN, "doesn't chain to a root"},
+	{windows.CERT_TRUST_IS_NOT_VALID_FOR_USAGE, "not valid for the requested usage"},
+	{windows.CERT_TRUST_IS_NOT_TIME_VALID, "expired or not yet valid"},
+	{windows.CERT_TRUST_IS_REVOKED, "revoked"},
+	{windows.CERT_TRUST_IS_NOT_SIGNATURE_VALID, "invalid signature"},
+	{windows.CERT_TRUST_INVALID_BASIC_CONSTRAINTS, "invalid basic constraints"},
+	{windows.CERT_TRUST_INVALID_NAME_CONSTRAINTS, "invalid name constraints"},
+	{windows.CERT_TRUST_HAS_NOT_PERMITTED_NAME_CONSTRAINT, "name not permitted by name constraints"},
+	{windows.CERT_TRUST_HAS_EXCLUDED_NAME_CONSTRAINT, "name excluded by name constraints"},
+	{windows.CERT_TRUST_HAS_NOT_SUPPORTED_NAME_CONSTRAINT, "unsupported name constraint"},
+	{windows.CERT_TRUST_HAS_NOT_DEFINED_NAME_CONSTRAINT, "name constraint not defined for a name type"},
+}
+
+// trustStatusReason describes the CERT_TRUST_* error bits in errorStatus, or
+// returns "" if none of the bits are recognized.
+func trustStatusReason(errorStatus uint32) string {
+	reasons := []string{}
+
+	for _, r := range trustStatusReasons {
+		if errorStatus&r.bit != 0 {
+			reasons = append(reasons, r.reason)
+		}
+	}
+
+	return strings.Join(reasons, "; ")
+}
+
+// EvaluateTrust asks the Windows chain engine whether the given cert chains
+// to a trusted root for the given purpose.  Unlike IsInjected, this reflects
+// the OS's actual decision, including any EKU or name constraints properties
+// we injected and any Disallowed entries.  Pass x509.ExtKeyUsageAny to
+// evaluate trust for any purpose.  Revocation isn't checked.
+//
+// If the cert isn't trusted, reason explains why.  Returned errors wrap
+// ErrBadCert if the cert can't be decoded, ErrInvalidOption if the purpose
+// isn't supported, and ErrChainVerify if the chain engine fails.
+func EvaluateTrust(derBytes []byte, purpose x509.ExtKeyUsage) (bool, string, error) {
+	if len(derBytes) == 0 {
+		return false, "", ErrNoCert
+	}
+
+	oid, ok := ekuOIDs[purpose]
+	if !ok && purpose != x509.ExtKeyUsageAny {
+		return false, "", fmt.Errorf("unsupported purpose %d: %w", purpose, ErrInvalidOption)
+	}
+
+	certContext, err := windows.CertCreateCertificateContext(
+		windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, &derBytes[0], uint32(len(derBytes)))
+	if err != nil {
+		return false, "", fmt.Errorf("%w: couldn't decode cert: %w", err, ErrBadCert)
+	}
+	defer windows.CertFreeCertificateContext(certContext) //nolint:errcheck
+
+	para := windows.CertChainPara{}
+	para.Size = uint32(unsafe.Sizeof(para))
+	para.RequestedUsage.Type = windows.USAGE_MATCH_TYPE_AND
+
+	if purpose != x509.ExtKeyUsageAny {
+		oidBytes := append([]byte(oid), 0)
+		oidPtr := &oidBytes[0]
+		para.RequestedUsage.Usage.Length = 1
+		para.RequestedUsage.Usage.UsageIdentifiers = &oidPtr
+	}
+
+	var chainContext *windows.CertChainContext
+
+	err = windows.CertGetCertificateChain(0, certContext, nil, 0, &para, 0, 0, &chainContext)
+	if err != nil {
+		return false, "", fmt.Errorf("%w: couldn't build chain: %w", err, ErrChainVerify)
+	}
+	defer windows.CertFreeCertificateChain(chainContext)
+
+	if reason := trustStatusReason(chainContext.TrustStatus.ErrorStatus); reason != "" {
+		return false, reason, nil
+	}
+
+	policyPara := windows.CertChainPolicyPara{}
+	policyPara.Size = uint32(unsafe.Sizeof(policyPara))
+	status := windows.CertChainPolicyStatus{}
+	status.Size = uint32(unsafe.Sizeof(status))
+
+	err = windows.CertVerifyCertificateChainPolicy(windows.CERT_CHAIN_POLICY_BASE, chainContext, &policyPara,
+		&status)
+	if err != nil {
+		return false, "", fmt.Errorf("%w: couldn't verify chain policy: %w", err, ErrChainVerify)
+	}
+
+	if status.Error != 0 {
+		return false, windows.Errno(status.Error).Error(), nil
+	}
+
+	return true, "", nil
+}
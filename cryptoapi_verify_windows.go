@@ -0,0 +1,330 @@
+package certinject
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// VerifyInjected checks that the cert with the given fingerprint (SHA-1 hex,
+// in any case, optionally separated by colons or spaces) is present in the
+// store and intact: its blob must parse, contain the cert, and the cert's
+// SHA-1 must match the subkey name.  If the -set-magic-name flag is set, the
+// magic tag must also be present.
+//
+// Returned errors wrap ErrStoreOpen if the store can't be opened,
+// ErrCertNotFound if the cert isn't present (or lacks the magic tag),
+// ErrBlobRead if the blob can't be read, and ErrCorruptCert if the blob
+// doesn't match the subkey name.
+func VerifyInjected(store Store, fingerprintHex string) error {
+	_, err := verifyInjectedBlob(store, normalizeFingerprintCryptoAPI(fingerprintHex))
+
+	return err
+}
+
+// VerifyInjectedNameConstraints is like VerifyInjected, but additionally
+// parses back the cert's name constraints property and checks that it
+// contains the name constraints of nameConstraints (a template, as for
+// InjectOptions.NameConstraints).  For each kind of name that's set in
+// nameConstraints, the property must contain exactly those names, or, if
+// merged is true (as for InjectOptions.NameConstraintsMerge), at least
+// those names.  Returned errors also wrap ErrNameConstraintsMismatch if the
+// name constraints property doesn't match.
+func VerifyInjectedNameConstraints(store Store, fingerprintHex string, nameConstraints *x509.Certificate,
+	merged bool,
+) error {
+	fingerprintHex = normalizeFingerprintCryptoAPI(fingerprintHex)
+
+	blob, err := verifyInjectedBlob(store, fingerprintHex)
+	if err != nil {
+		return err
+	}
+
+	return checkBlobNameConstraints(blob, fingerprintHex, nameConstraints, merged)
+}
+
+// verifyInjectedBlob implements VerifyInjected for a normalized fingerprint,
+// returning the cert's blob.
+func verifyInjectedBlob(store Store, fingerprintHex string) (certblob.Blob, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil, err
+	}
+	defer certStoreKey.Close()
+
+	certKey, err := reg.OpenKey(certStoreKey, fingerprintHex, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrBlobRead)
+	}
+	defer certKey.Close()
+
+	if flags.magicName != "" && !hasMagic(certKey, flags.magicName, flags.magicData) {
+		return nil, fmt.Errorf("%s: magic tag missing: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	blob, err := readBlobValue(certKey, flags.maxBlobBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkBlobFingerprint(blob, fingerprintHex)
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+// VerifyInjectedFile is like VerifyInjected, for the cert in the DER or PEM
+// file at path, so that callers don't need to compute its fingerprint.  The
+// file must contain exactly one cert.  Returned errors also wrap ErrCertRead
+// if the file can't be read, and ErrBadCert if it can't be decoded.
+func VerifyInjectedFile(store Store, path string) error {
+	derBytes, err := readCertFile(path)
+	if err != nil {
+		return err
+	}
+
+	return VerifyInjected(store, fingerprintHexUpperCryptoAPI(derBytes))
+}
+
+// IsInjected reports whether the given cert is present in the store,
+// regardless of magic tags (it may have been added by Windows or another
+// tool).  Returned errors wrap ErrStoreOpen if the cert's registry key exists
+// but can't be opened.
+func IsInjected(store Store, derBytes []byte) (bool, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return false, err
+	}
+
+	certKey, ok, err := openCertKey(store, fingerprintHexUpperCryptoAPI(derBytes), &flags)
+	if !ok || err != nil {
+		return false, err
+	}
+	defer certKey.Close()
+
+	return true, nil
+}
+
+// IsNamecoinInjected is like IsInjected, but additionally requires the magic
+// tag set by the -set-magic-name and -set-magic-data flags.  Returned errors
+// also wrap ErrNoMagic if the -set-magic-name flag isn't set.
+func IsNamecoinInjected(store Store, derBytes []byte) (bool, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return false, err
+	}
+
+	if flags.magicName == "" {
+		return false, ErrNoMagic
+	}
+
+	certKey, ok, err := openCertKey(store, fingerprintHexUpperCryptoAPI(derBytes), &flags)
+	if !ok || err != nil {
+		return false, err
+	}
+	defer certKey.Close()
+
+	return hasMagic(certKey, flags.magicName, flags.magicData), nil
+}
+
+// openCertKey opens the cert's registry key for reading, in the logical store
+// and registry view of flags.  If the store or the cert doesn't exist, it
+// returns false and no error.
+func openCertKey(store Store, fingerprintHexUpper string, flags *storeFlags) (regKey, bool, error) {
+	path, err := certKeyPath(store, fingerprintHexUpper, flags.logicalStores)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return openCertKeyAt(store.Base, flags.registryView, path)
+}
+
+// openCertKeyAt is like openCertKey, for a cert key path relative to
+// registryBase, in the given registry view.
+func openCertKeyAt(registryBase registry.Key, view uint32, path string) (regKey, bool, error) {
+	certKey, err := reg.OpenKey(reg.Root(registryBase, view), path, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrStoreOpen)
+	}
+
+	return certKey, true, nil
+}
+
+// FindCert returns every known physical store that contains the cert with the
+// given fingerprint (SHA-1 hex, in any case, optionally separated by colons
+// or spaces), in each of the logical stores configured by the -logical-store
+// flag, e.g. to find out why a cert is still trusted.  Stores that don't
+// exist or can't be opened due to lack of privileges are skipped; errors from
+// the other stores are combined.
+func FindCert(fingerprintHex string) ([]Location, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	return findCert(normalizeFingerprintCryptoAPI(fingerprintHex), &flags)
+}
+
+// findCert implements FindCert for a normalized fingerprint, in the logical
+// stores and registry view of flags.
+func findCert(fingerprintHexUpper string, flags *storeFlags) ([]Location, error) {
+	locations := []Location{}
+	errs := []error{}
+
+	for _, name := range cryptoAPIStoreNames() {
+		store, err := cryptoAPINameToStore(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+
+			continue
+		}
+
+		for _, logical := range flags.logicalStores {
+			certKey, ok, err := openCertKeyAt(store.Base, flags.registryView,
+				store.LogicalKey(logical)+`\`+fingerprintHexUpper)
+			if err != nil {
+				if err := skipUnavailableStore(name+" "+logical, err); err != nil {
+					errs = append(errs, err)
+				}
+
+				continue
+			}
+
+			if !ok {
+				continue
+			}
+
+			injected := flags.magicName != "" && hasMagic(certKey, flags.magicName, flags.magicData)
+			certKey.Close()
+
+			locations = append(locations, Location{
+				PhysicalStore: name,
+				LogicalStore:  logical,
+				Injected:      injected,
+			})
+		}
+	}
+
+	return locations, errors.Join(errs...)
+}
+
+// certKeyPath returns the registry path of the cert's key in the only one of
+// the logical stores, relative to the store's base; see singleKey.
+func certKeyPath(store Store, fingerprintHexUpper string, logicalStores []string) (string, error) {
+	storeKey, err := store.singleKey(logicalStores)
+	if err != nil {
+		return "", err
+	}
+
+	return storeKey + `\` + fingerprintHexUpper, nil
+}
+
+// checkBlobFingerprint returns ErrCorruptCert if the blob lacks the cert
+// content, or if the cert's SHA-1 doesn't match the subkey name.  Windows
+// mishandles such certs, which can result from manual edits or swapped blobs.
+func checkBlobFingerprint(blob certblob.Blob, subKeyName string) error {
+	derBytes, ok := blob[certblob.CertContentCertPropID]
+	if !ok {
+		return fmt.Errorf("%s: blob has no cert content: %w", displayFingerprint(subKeyName), ErrCorruptCert)
+	}
+
+	actual := fingerprintHexUpperCryptoAPI(derBytes)
+	if actual != subKeyName {
+		return fmt.Errorf("%s: blob contains cert %s: %w",
+			displayFingerprint(subKeyName), displayFingerprint(actual), ErrCorruptCert)
+	}
+
+	return nil
+}
+
+// checkBlobNameConstraints parses back the blob's name constraints property
+// and compares it to the requested name constraints, so that encoding bugs
+// that would make Windows ignore the property are caught.  Only the kinds of
+// names that are set in requested are compared; others may have come from
+// the cert or a merge.  If merged is true, the property may contain
+// additional names of those kinds.
+func checkBlobNameConstraints(blob certblob.Blob, subKeyName string, requested *x509.Certificate,
+	merged bool,
+) error {
+	if !hasNameConstraints(requested) {
+		return nil
+	}
+
+	value, ok := blob[certblob.CertRootProgramNameConstraintsPropID]
+	if !ok {
+		return fmt.Errorf("%s: name constraints property missing: %w", displayFingerprint(subKeyName),
+			ErrNameConstraintsMismatch)
+	}
+
+	actual, err := certblob.ParseNameConstraints(&certblob.Property{
+		ID:    certblob.CertRootProgramNameConstraintsPropID,
+		Value: value,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", displayFingerprint(subKeyName), err, ErrNameConstraintsMismatch)
+	}
+
+	fields := []struct {
+		what              string
+		requested, actual []string
+	}{
+		{"permitted DNS domains", requested.PermittedDNSDomains, actual.PermittedDNSDomains},
+		{"excluded DNS domains", requested.ExcludedDNSDomains, actual.ExcludedDNSDomains},
+		{"permitted IP ranges", ipNetStrings(requested.PermittedIPRanges), ipNetStrings(actual.PermittedIPRanges)},
+		{"excluded IP ranges", ipNetStrings(requested.ExcludedIPRanges), ipNetStrings(actual.ExcludedIPRanges)},
+		{"permitted email addresses", requested.PermittedEmailAddresses, actual.PermittedEmailAddresses},
+		{"excluded email addresses", requested.ExcludedEmailAddresses, actual.ExcludedEmailAddresses},
+		{"permitted URI domains", requested.PermittedURIDomains, actual.PermittedURIDomains},
+		{"excluded URI domains", requested.ExcludedURIDomains, actual.ExcludedURIDomains},
+	}
+
+	errs := []error{}
+
+	for _, field := range fields {
+		if len(field.requested) == 0 {
+			continue
+		}
+
+		// Merging only adds names, so the requested ones must be a
+		// subset; otherwise they must be the only ones.
+		extra := mergeNameConstraintsStrings(field.requested, field.actual)[len(field.requested):]
+		missing := mergeNameConstraintsStrings(field.actual, field.requested)[len(field.actual):]
+
+		if len(missing) != 0 || (!merged && len(extra) != 0) {
+			errs = append(errs, fmt.Errorf("%s: %s: requested %v, got %v: %w", displayFingerprint(subKeyName),
+				field.what, field.requested, field.actual, ErrNameConstraintsMismatch))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ipNetStrings returns the CIDR strings of the given IP ranges.
+func ipNetStrings(ipNets []*net.IPNet) []string {
+	result := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		result = append(result, ipNet.String())
+	}
+
+	return result
+}
@@ -0,0 +1,427 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/certblob"
+)
+
+// win32StoreLocations maps the physical stores that the Win32 API can open by
+// name to their CERT_SYSTEM_STORE_* location.
+var win32StoreLocations = map[string]uint32{
+	"current-user":              windows.CERT_SYSTEM_STORE_CURRENT_USER,
+	"current-user-group-policy": windows.CERT_SYSTEM_STORE_CURRENT_USER_GROUP_POLICY,
+	"system":                    windows.CERT_SYSTEM_STORE_LOCAL_MACHINE,
+	"enterprise":                windows.CERT_SYSTEM_STORE_LOCAL_MACHINE_ENTERPRISE,
+	"group-policy":              windows.CERT_SYSTEM_STORE_LOCAL_MACHINE_GROUP_POLICY,
+}
+
+// win32MergedStores maps the CERT_SYSTEM_STORE_* locations whose view merges
+// other physical stores to those stores' names, in the order they're searched
+// for a tagged copy of a cert after the location's own physical store.  The
+// other locations only show their own physical store.
+var win32MergedStores = map[uint32][]string{
+	windows.CERT_SYSTEM_STORE_CURRENT_USER:  {"current-user-group-policy", "system", "group-policy", "enterprise"},
+	windows.CERT_SYSTEM_STORE_LOCAL_MACHINE: {"group-policy", "enterprise"},
+}
+
+// win32ContextPropIDs lists the properties whose Win32 form isn't a
+// CRYPT_DATA_BLOB (key provider handles and info, key contexts, the key spec,
+// and the date stamp), so they can't be copied from a blob with
+// CertSetCertificateContextProperty.  Trust anchors don't have them.
+var win32ContextPropIDs = map[uint32]bool{
+	1:  true, // CERT_KEY_PROV_HANDLE_PROP_ID
+	2:  true, // CERT_KEY_PROV_INFO_PROP_ID
+	5:  true, // CERT_KEY_CONTEXT_PROP_ID
+	6:  true, // CERT_KEY_SPEC_PROP_ID
+	27: true, // CERT_DATE_STAMP_PROP_ID
+}
+
+var procCertSetCertificateContextProperty = windows.NewLazySystemDLL("crypt32.dll").
+	NewProc("CertSetCertificateContextProperty")
+
+// checkMethod returns an error wrapping ErrInvalidStore if opts.Method isn't
+// a known injection method, or can't be combined with the other options.
+func (opts *InjectOptions) checkMethod() error {
+	switch opts.Method {
+	case "", InjectMethodRegistry:
+		return nil
+	case InjectMethodWin32API:
+	default:
+		return fmt.Errorf("unknown injection method %q, want %s or %s: %w", opts.Method,
+			InjectMethodRegistry, InjectMethodWin32API, ErrInvalidStore)
+	}
+
+	// Windows rewrites the cert's key on every add, which would wake the
+	// watcher again.
+	if opts.watch {
+		return fmt.Errorf("watch mode isn't supported with the %s injection method: %w",
+			InjectMethodWin32API, ErrInvalidStore)
+	}
+
+	if opts.blobValueName() != blobValueName {
+		return fmt.Errorf("the %s injection method always writes the %s registry value, not %s: %w",
+			InjectMethodWin32API, blobValueName, opts.BlobValueName, ErrInvalidStore)
+	}
+
+	// The Win32 API always adds the cert in the native view, so the magic
+	// tag would be written to a different cert key.
+	if opts.registryView != 0 {
+		return fmt.Errorf("the %s injection method only supports the native registry view: %w",
+			InjectMethodWin32API, ErrInvalidStore)
+	}
+
+	return nil
+}
+
+// win32StoreLocation returns the CERT_SYSTEM_STORE_* location and logical
+// store name under which the Win32 API opens the store with the given
+// registry key.  Only the built-in physical stores can be opened this way;
+// other stores (e.g. with -user-sid or -app-package) return an error wrapping
+// ErrInvalidStore.
+func win32StoreLocation(registryBase registry.Key, storeKey string) (uint32, string, error) {
+	logical := logicalStoreOfKey(storeKey)
+
+	cryptoAPIStoresMu.RLock()
+	defer cryptoAPIStoresMu.RUnlock()
+
+	for name, location := range win32StoreLocations {
+		store, ok := cryptoAPIStores[name]
+		if ok && store.Base == registryBase && store.LogicalKey(logical) == storeKey {
+			return location, logical, nil
+		}
+	}
+
+	return 0, "", fmt.Errorf("%s\\%s isn't a physical store supported by the %s injection method: %w",
+		rootKeyName(registryBase), storeKey, InjectMethodWin32API, ErrInvalidStore)
+}
+
+// writeBlobWin32API is like writeBlobStatusCryptoAPI, but adds the cert via the
+// Win32 API instead of writing its blob to the registry.  Unlike the registry
+// method, the cert is rewritten even if it's unchanged, since Windows may
+// serialize the blob differently from certblob.
+func writeBlobWin32API(blob certblob.Blob, fingerprintHexUpper string,
+	registryBase registry.Key, storeKey string, opts *InjectOptions,
+) (bool, error) {
+	location, logical, err := win32StoreLocation(registryBase, storeKey)
+	if err != nil {
+		return false, err
+	}
+
+	blobBytes, err := blob.Marshal()
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't marshal cert blob: %w", err, ErrPropertyMarshal)
+	}
+
+	certPath := storeKey + `\` + fingerprintHexUpper
+
+	// Check for magic value indicating we should skip this cert
+	if opts.SkipMagicName != "" {
+		certKey, ok, err := openCertKeyAt(registryBase, opts.registryView, certPath)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			skip := hasMagic(certKey, opts.SkipMagicName, opts.SkipMagicData)
+			certKey.Close()
+
+			if skip {
+				return false, nil
+			}
+		}
+	}
+
+	err = addCertWin32API(blob, location, logical)
+	if err != nil {
+		return false, err
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registryBase, opts.registryView), certPath, registry.ALL_ACCESS)
+	if err != nil {
+		return true, fmt.Errorf("%w: couldn't open registry key of added certificate: %w", err, ErrRegistryWrite)
+	}
+	defer certKey.Close()
+
+	err = applyTagValues(certKey, blobBytes, opts)
+	if err != nil {
+		return true, err
+	}
+
+	if opts.SecureACL {
+		err = certKey.SetDACL(secureACLSDDL)
+		if err != nil {
+			return true, fmt.Errorf("%w: couldn't set ACL of certificate registry key: %w", err, ErrRegistryWrite)
+		}
+	}
+
+	logInjectedCert(blob, fingerprintHexUpper, registryBase, storeKey)
+
+	return true, nil
+}
+
+// addCertWin32API is addCertToSystemStoreWin32API, except in tests, which
+// mustn't write to the real system stores.
+var addCertWin32API = addCertToSystemStoreWin32API
+
+// addCertToSystemStoreWin32API adds the blob's cert to the given system
+// store; see addCertToStoreWin32API.
+func addCertToSystemStoreWin32API(blob certblob.Blob, location uint32, logical string) error {
+	logicalPtr, err := windows.UTF16PtrFromString(logical)
+	if err != nil {
+		return fmt.Errorf("%w: invalid logical store name %q: %w", err, logical, ErrInvalidStore)
+	}
+
+	store, err := windows.CertOpenStore(windows.CERT_STORE_PROV_SYSTEM_W, 0, 0,
+		location|windows.CERT_STORE_OPEN_EXISTING_FLAG, uintptr(unsafe.Pointer(logicalPtr)))
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer windows.CertCloseStore(store, 0) //nolint:errcheck
+
+	return addCertToStoreWin32API(store, blob)
+}
+
+// addCertToStoreWin32API adds the blob's cert to the open store, replacing
+// any existing copy, with every property of the blob that the Win32 API can
+// set.
+func addCertToStoreWin32API(store windows.Handle, blob certblob.Blob) error {
+	derBytes := blob[certblob.CertContentCertPropID]
+	if len(derBytes) == 0 {
+		return ErrNoCert
+	}
+
+	certContext, err := windows.CertCreateCertificateContext(
+		windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, &derBytes[0], uint32(len(derBytes)))
+	if err != nil {
+		return fmt.Errorf("%w: couldn't decode cert: %w", err, ErrBadCert)
+	}
+	defer windows.CertFreeCertificateContext(certContext) //nolint:errcheck
+
+	// Windows derives these from the cert.
+	derived := map[uint32]bool{certblob.CertContentCertPropID: true}
+	for _, id := range certblob.HashPropIDs {
+		derived[id] = true
+	}
+
+	for _, id := range blob.PropertyIDs() {
+		if derived[id] {
+			continue
+		}
+
+		if win32ContextPropIDs[id] {
+			log.Warnf("Not copying property %d, which the %s injection method can't set", id,
+				InjectMethodWin32API)
+
+			continue
+		}
+
+		err = setCertPropertyWin32API(certContext, id, blob[id])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = windows.CertAddCertificateContextToStore(store, certContext, windows.CERT_STORE_ADD_REPLACE_EXISTING, nil)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't add certificate to store: %w", err, ErrRegistryWrite)
+	}
+
+	return nil
+}
+
+// setCertPropertyWin32API sets a property of a cert context, which is copied
+// to the store when the context is added.
+func setCertPropertyWin32API(certContext *windows.CertContext, id uint32, value []byte) error {
+	data := windows.CryptDataBlob{Size: uint32(len(value))}
+	if len(value) != 0 {
+		data.Data = &value[0]
+	}
+
+	ok, _, err := procCertSetCertificateContextProperty.Call(uintptr(unsafe.Pointer(certContext)), uintptr(id), 0,
+		uintptr(unsafe.Pointer(&data)))
+	if ok == 0 {
+		return fmt.Errorf("%w: couldn't set property %d: %w", err, id, ErrPropertyMarshal)
+	}
+
+	return nil
+}
+
+// ListInjectedCertsWin32API is like ListInjectedCerts, but asks Windows which
+// certs are in each of the logical stores configured by the -logical-store
+// flag, instead of enumerating the store's registry key, so that certs which
+// Windows merges into the store's view from other physical stores (e.g. the
+// system store's certs in the current user's view) are listed too, matching
+// what applications see.  Each cert's magic tag, blob, and other values are
+// read from the first merged physical store that has a tagged copy, starting
+// with the given one.  A cert in several logical stores is listed once.  Only
+// the built-in physical stores are supported.
+//
+// Returned errors wrap ErrInvalidStore if the store isn't a built-in physical
+// store, and are otherwise the same as for ListInjectedCerts.
+func ListInjectedCertsWin32API(store Store) ([]CertInfo, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.magicName == "" {
+		return nil, ErrNoMagic
+	}
+
+	certs := []CertInfo{}
+	seen := map[string]bool{}
+	errs := []error{}
+
+	for _, logical := range flags.logicalStores {
+		location, _, err := win32StoreLocation(store.Base, store.LogicalKey(logical))
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprints, err := enumFingerprintsWin32API(location, logical)
+		if err != nil {
+			return nil, fmt.Errorf("logical store %s: %w", logical, err)
+		}
+
+		logicalCerts, err := readInjectedCertsAnyStore(store, location, logical, fingerprints, &flags)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logical store %s: %w", logical, err))
+		}
+
+		for _, info := range logicalCerts {
+			if !seen[info.Fingerprint] {
+				seen[info.Fingerprint] = true
+				certs = append(certs, info)
+			}
+		}
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].Fingerprint < certs[j].Fingerprint
+	})
+
+	return certs, errors.Join(errs...)
+}
+
+// enumFingerprintsWin32API returns the fingerprints of the certs that Windows
+// reports in the given system store, without duplicates.
+func enumFingerprintsWin32API(location uint32, logical string) ([]string, error) {
+	logicalPtr, err := windows.UTF16PtrFromString(logical)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid logical store name %q: %w", err, logical, ErrInvalidStore)
+	}
+
+	store, err := windows.CertOpenStore(windows.CERT_STORE_PROV_SYSTEM_W, 0, 0,
+		location|windows.CERT_STORE_OPEN_EXISTING_FLAG|windows.CERT_STORE_READONLY_FLAG,
+		uintptr(unsafe.Pointer(logicalPtr)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer windows.CertCloseStore(store, 0) //nolint:errcheck
+
+	return enumFingerprintsInStoreWin32API(store)
+}
+
+// enumFingerprintsInStoreWin32API returns the fingerprints of the certs in
+// the open store, without duplicates.
+func enumFingerprintsInStoreWin32API(store windows.Handle) ([]string, error) {
+	fingerprints := []string{}
+	seen := map[string]bool{}
+
+	var (
+		certContext *windows.CertContext
+		err         error
+	)
+
+	for {
+		// Each call frees the previous context, and the last one returns
+		// nil, so nothing is left to free.
+		certContext, err = windows.CertEnumCertificatesInStore(store, certContext)
+		if errors.Is(err, windows.Errno(windows.CRYPT_E_NOT_FOUND)) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+		}
+
+		derBytes := unsafe.Slice(certContext.EncodedCert, certContext.Length)
+
+		fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+		if !seen[fingerprintHexUpper] {
+			seen[fingerprintHexUpper] = true
+			fingerprints = append(fingerprints, fingerprintHexUpper)
+		}
+	}
+
+	return fingerprints, nil
+}
+
+// readInjectedCertsAnyStore reads the certs with the given fingerprints that
+// carry the magic tag of flags in the given logical store of first, or
+// otherwise of any other physical store that Windows merges into location's
+// view (see win32MergedStores).  Physical stores that can't be opened are
+// skipped.
+func readInjectedCertsAnyStore(first Store, location uint32, logical string, fingerprints []string,
+	flags *storeFlags,
+) ([]CertInfo, error) {
+	stores := []Store{first}
+
+	for _, name := range win32MergedStores[location] {
+		store, err := cryptoAPINameToStore(name)
+		if err == nil && store != first {
+			stores = append(stores, store)
+		}
+	}
+
+	storeKeys := []regKey{}
+
+	defer func() {
+		for _, certStoreKey := range storeKeys {
+			certStoreKey.Close()
+		}
+	}()
+
+	for _, store := range stores {
+		certStoreKey, err := reg.OpenKey(reg.Root(store.Base, flags.registryView), store.LogicalKey(logical),
+			registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			log.Debugf("Skipping %s\\%s: %s", rootKeyName(store.Base), store.LogicalKey(logical), err)
+
+			continue
+		}
+
+		storeKeys = append(storeKeys, certStoreKey)
+	}
+
+	certs := []CertInfo{}
+	errs := []error{}
+
+	for i, fingerprintHexUpper := range fingerprints {
+		logScanProgress(first.LogicalKey(logical), fingerprintHexUpper, i+1, len(fingerprints))
+
+		for _, certStoreKey := range storeKeys {
+			info, ok, err := readInjectedCert(certStoreKey, fingerprintHexUpper, flags)
+			if err != nil {
+				errs = append(errs, err)
+
+				break
+			}
+
+			if ok {
+				certs = append(certs, info)
+
+				break
+			}
+		}
+	}
+
+	return certs, errors.Join(errs...)
+}
@@ -1,32 +1,48 @@
 package certinject
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	// #nosec G505
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf16"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"gopkg.in/hlandau/easyconfig.v1/cflag"
 
 	"github.com/namecoin/certinject/certblob"
-	"github.com/namecoin/certinject/regwait"
 )
 
 var (
 	cryptoAPIFlagGroup            = cflag.NewGroup(flagGroup, "capi")
 	cryptoAPIFlagLogicalStoreName = cflag.String(cryptoAPIFlagGroup, "logical-store", "Root",
-		"Name of CryptoAPI logical store to inject certificate into. Consider: AuthRoot, Root, Trust, CA, My, Disallowed")
+		"Name of CryptoAPI logical store to inject certificate into, or a comma-separated list of them. "+
+			"Consider: AuthRoot, Root, Trust, CA, My, Disallowed, TrustedPeople, TrustedPublisher, TrustedDevices")
 	cryptoAPIFlagPhysicalStoreName = cflag.String(cryptoAPIFlagGroup, "physical-store", "system",
-		"Scope of CryptoAPI certificate store. Valid choices: current-user, system, enterprise, group-policy")
+		"Scope of CryptoAPI certificate store. Valid choices: current-user, current-user-group-policy, "+
+			"system, enterprise, group-policy, service (requires -service-name)")
 	cryptoAPIFlagReset = cflag.Bool(cryptoAPIFlagGroup, "reset", false,
 		"Delete any existing properties of this certificate before applying any new ones")
+	cryptoAPIFlagResetKeepHashes = cflag.Bool(cryptoAPIFlagGroup, "reset-keep-hashes", false,
+		"When used with -reset, keep the hash and key identifier properties "+
+			"that Windows computes from the certificate")
 	searchSHA1 = cflag.String(cryptoAPIFlagGroup, "search-sha1", "",
 		"Search the store for an existing certificate with this SHA1 hash "+
 			"(uppercase hex) instead of loading a certificate from a file")
@@ -34,6 +50,27 @@ var (
 		"Apply operations to all certificates in the specified store")
 	watch = cflag.Bool(cryptoAPIFlagGroup, "watch", false,
 		"Continuously re-apply operations whenever the specified store updates")
+	verifyChain = cflag.String(cryptoAPIFlagGroup, "verify-chain", "",
+		"When injecting into the CA logical store, check that the cert chains "+
+			"to a cert in the Root logical store of the same physical store. "+
+			"Valid choices: warn, fail (or empty to skip the check)")
+	skipExisting = cflag.Bool(cryptoAPIFlagGroup, "skip-existing", false,
+		"Don't inject certificates that are already in the store without the "+
+			"-set-magic-name tag (e.g. because they ship with Windows), so that "+
+			"the tagged set only contains certificates Windows wouldn't otherwise "+
+			"trust; overridden by -force")
+	force = cflag.Bool(cryptoAPIFlagGroup, "force", false,
+		"Inject certificates even if -skip-existing would skip them")
+	allowLeafInRoot = cflag.Bool(cryptoAPIFlagGroup, "allow-leaf-in-root", false,
+		"Allow injecting certs that aren't CA certs (e.g. self-signed end-entity "+
+			"certs) into the Root, AuthRoot, and CA logical stores")
+	setSKI = cflag.String(cryptoAPIFlagGroup, "set-ski", "auto",
+		"Set the key identifier property from the certificate's Subject Key "+
+			"Identifier (or its public key if it has none). Valid choices: "+
+			"auto (only in the Root, AuthRoot and CA logical stores), true, false")
+	ekuNone = cflag.Bool(cryptoAPIFlagGroup, "eku-none", false,
+		"Set an empty extended key usage property, which disables the "+
+			"certificate for all purposes; can't be combined with eku.* flags")
 	ekuFlagGroup = cflag.NewGroup(cryptoAPIFlagGroup, "eku")
 	ekuAny       = cflag.Bool(ekuFlagGroup, "any", false, "Any purpose")
 	ekuServer    = cflag.Bool(ekuFlagGroup, "server", false,
@@ -58,19 +95,28 @@ var (
 		"Microsoft commercial code signing")
 	ekuMSCodeKernel = cflag.Bool(ekuFlagGroup, "ms-code-kernel", false,
 		"Microsoft kernel-mode code signing")
+	nameConstraintsFromCert = cflag.Bool(cryptoAPIFlagGroup, "nc-from-cert", false,
+		"Build the name constraints property from the name constraints "+
+			"extension of the certificate itself; nc.* flags override the "+
+			"corresponding fields")
+	nameConstraintsMerge = cflag.Bool(cryptoAPIFlagGroup, "nc-merge", false,
+		"Merge the name constraints built from the nc.* flags into the "+
+			"existing name constraints property, instead of replacing it")
 	nameConstraintsFlagGroup    = cflag.NewGroup(cryptoAPIFlagGroup, "nc")
 	nameConstraintsPermittedDNS = cflag.String(nameConstraintsFlagGroup,
 		"permitted-dns", "", "Permitted DNS domain")
 	nameConstraintsExcludedDNS = cflag.String(nameConstraintsFlagGroup,
 		"excluded-dns", "", "Excluded DNS domain")
 	nameConstraintsPermittedIP = cflag.String(nameConstraintsFlagGroup,
-		"permitted-ip", "", "Permitted IP range")
+		"permitted-ip", "", "Permitted IP ranges (comma-separated CIDRs or bare IPs; IPv4 and IPv6 may be mixed)")
 	nameConstraintsExcludedIP = cflag.String(nameConstraintsFlagGroup,
-		"excluded-ip", "", "Excluded IP range")
+		"excluded-ip", "", "Excluded IP ranges (comma-separated CIDRs or bare IPs; IPv4 and IPv6 may be mixed)")
 	nameConstraintsPermittedEmail = cflag.String(nameConstraintsFlagGroup,
-		"permitted-email", "", "Permitted email address")
+		"permitted-email", "", "Permitted email addresses (comma-separated; each a full address, "+
+			"or a domain or @domain for all addresses at that domain)")
 	nameConstraintsExcludedEmail = cflag.String(nameConstraintsFlagGroup,
-		"excluded-email", "", "Excluded email address")
+		"excluded-email", "", "Excluded email addresses (comma-separated; each a full address, "+
+			"or a domain or @domain for all addresses at that domain)")
 	nameConstraintsPermittedURI = cflag.String(nameConstraintsFlagGroup,
 		"permitted-uri", "", "Permitted URI domain")
 	nameConstraintsExcludedURI = cflag.String(nameConstraintsFlagGroup,
@@ -79,6 +125,15 @@ var (
 		"Set a magic tag with this name")
 	setMagicData = cflag.Int(cryptoAPIFlagGroup, "set-magic-data", 1,
 		"Set a magic tag with this data")
+	secureACL = cflag.Bool(cryptoAPIFlagGroup, "secure-acl", false,
+		"When writing a certificate's registry key, restrict its ACL to full "+
+			"control for Administrators and SYSTEM and read-only for Users, so "+
+			"that non-administrators can't tamper with it; requires permission "+
+			"to change the key's ACL")
+	noMagic = cflag.Bool(cryptoAPIFlagGroup, "no-magic", false,
+		"Don't set the -set-magic-name tag on injected certificates, for callers "+
+			"that manage their lifecycle themselves; such certificates are invisible "+
+			"to listing, cleanup, and purging")
 	skipMagicName = cflag.String(cryptoAPIFlagGroup, "skip-magic-name", "",
 		"Don't touch certificates with this magic tag name")
 	skipMagicData = cflag.Int(cryptoAPIFlagGroup, "skip-magic-data", 1,
@@ -90,31 +145,232 @@ var (
 	expirableMagicData = cflag.Int(cryptoAPIFlagGroup, "expirable-magic-data",
 		1, "Remove certificates with this magic tag data if they are too old "+
 			"(see -certstore.expire flag)")
-)
-
-var (
-	ErrInjectCerts          = errors.New("error injecting certs")
-	ErrEnumerateCerts       = fmt.Errorf("error enumerating certs: %w", ErrInjectCerts)
-	ErrInvalidPhysicalStore = fmt.Errorf("invalid choice for physical store "+
-		"(consider current-user, system, enterprise, group-policy): %w",
-		ErrEnumerateCerts)
-	ErrGetInitialBlob = fmt.Errorf("error getting initial blob: %w", ErrInjectCerts)
-	ErrEditBlob       = fmt.Errorf("error editing blob: %w", ErrInjectCerts)
-	ErrSetMagic       = fmt.Errorf("error setting magic tag: %w", ErrInjectCerts)
+	cleanExcludeFile = cflag.String(cryptoAPIFlagGroup, "clean-exclude-file", "",
+		"Path to a file of fingerprints (one per line; blank lines and lines "+
+			"starting with # are ignored) of certificates that cleanup must "+
+			"never remove, even if they're expired")
+	friendlyName = cflag.String(cryptoAPIFlagGroup, "friendly-name", "",
+		"Set the friendly name shown for the certificate in certmgr; if empty, any existing "+
+			"friendly name is kept unless capi.reset is set")
+	description = cflag.String(cryptoAPIFlagGroup, "description", "",
+		"Set the description shown in the certificate's details, e.g. why it was "+
+			"injected; if empty, any existing description is kept unless capi.reset is set")
+	rawProperties = cflag.String(cryptoAPIFlagGroup, "raw-property", "",
+		"Set arbitrary properties, as comma-separated propid:hexbytes pairs "+
+			"(e.g. 11:4e00430000 for a friendly name); applied after all "+
+			"other properties")
+	autoUserFallback = cflag.Bool(cryptoAPIFlagGroup, "auto-user-fallback", false,
+		"If the system physical store can't be written due to lack of "+
+			"Administrator privileges, inject into the current-user physical "+
+			"store instead")
+	userSID = cflag.String(cryptoAPIFlagGroup, "user-sid", "",
+		"Use the registry hive of the user with this SID (e.g. a service "+
+			"account) instead of the current user's; only valid with the "+
+			"current-user and current-user-group-policy physical stores")
+	appPackage = cflag.String(cryptoAPIFlagGroup, "app-package", "",
+		"AppContainer SID (S-1-15-2-...) of a packaged (e.g. Windows Store) app "+
+			"whose package-scoped certificate store to use instead of the "+
+			"user's; only valid with the current-user and "+
+			"current-user-group-policy physical stores")
+	serviceName = cflag.String(cryptoAPIFlagGroup, "service-name", "",
+		"Name of the Windows service whose certificate store to use with the "+
+			"service physical store, i.e. HKLM\\SOFTWARE\\Microsoft\\Cryptography\\"+
+			"Services\\<name>\\SystemCertificates\\<logical>\\Certificates")
+	checkStoreAccess = cflag.Bool(cryptoAPIFlagGroup, "check", false,
+		"Only check that the specified store can be opened for writing, "+
+			"without injecting anything")
+	selfTest = cflag.Bool(cryptoAPIFlagGroup, "selftest", false,
+		"Only inject an ephemeral self-signed certificate into the current-user "+
+			"Root logical store, verify it, and remove it again, reporting each "+
+			"step, to diagnose permissions and registry access")
+	dedup = cflag.String(cryptoAPIFlagGroup, "dedup", "",
+		"After injecting, remove our copy of the certificate from the current-user "+
+			"or system physical store if both have it: keep-system or keep-user; "+
+			"empty disables deduplication")
+	metaSource = cflag.String(cryptoAPIFlagGroup, "meta-source", "",
+		"Record a NamecoinMeta registry value with the certinject version, "+
+			"injection time, and this source identifier (e.g. the URL the "+
+			"certificate came from); empty records no metadata")
+	injectMethod = cflag.String(cryptoAPIFlagGroup, "method", InjectMethodRegistry,
+		"How to write injected certificates: registry (write the blob to the "+
+			"registry directly) or win32api (add it via the CryptoAPI store functions, "+
+			"then write the magic tag to the registry, and list certs as Windows "+
+			"sees them); win32api only supports the built-in physical stores in the "+
+			"native registry view, and not watch mode")
+	registryView = cflag.String(cryptoAPIFlagGroup, "registry-view", "native",
+		"Registry view to use on 64-bit Windows: native, 32, or 64; "+
+			"32-bit applications may read a different view than this process writes")
+	fingerprintFormat = cflag.String(cryptoAPIFlagGroup, "fingerprint-format", "bare",
+		"Format of fingerprints in log and error messages: bare (uppercase hex), "+
+			"colon (AB:CD:...), or space (AB CD ...); registry keys always use bare")
+	purgeDryRun = cflag.Bool(cryptoAPIFlagGroup, "purge-dry-run", false,
+		"Log the certificates that would be removed by PurgeAllInjected "+
+			"instead of removing them")
+	maxBlobBytes = cflag.Int(cryptoAPIFlagGroup, "max-blob-bytes", defaultMaxBlobBytes,
+		"Refuse to parse an existing Blob registry value larger than this "+
+			"many bytes")
+	progressInterval = cflag.Int(cryptoAPIFlagGroup, "progress-interval", defaultProgressInterval,
+		"When listing or cleaning a store, log progress every this many "+
+			"certificates; 0 disables progress logging")
+	timeout = cflag.String(cryptoAPIFlagGroup, "timeout", "",
+		"Give up on injection or cleanup if it doesn't finish within this "+
+			"duration (e.g. 30s or 2m), e.g. because a remote hive hangs; "+
+			"empty or 0 means no timeout.  Not applied in watch mode")
 )
 
 // cryptoAPIStores consists of every implemented store.
 // When adding a new one, the `%s` variable is optional.
 // If `%s` exists in the Logical string, it is replaced with the value of
-// the -logical-store flag.
+// the -logical-store flag.  Use RegisterStore to add stores at runtime.
 var cryptoAPIStores = map[string]Store{
-	"current-user": {registry.CURRENT_USER, `SOFTWARE\Microsoft\SystemCertificates`, `%s\Certificates`},
-	"system":       {registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\SystemCertificates`, `%s\Certificates`},
-	"enterprise":   {registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\EnterpriseCertificates`, `%s\Certificates`},
-	"group-policy": {registry.LOCAL_MACHINE, `SOFTWARE\Policies\Microsoft\SystemCertificates`, `%s\Certificates`},
+	"current-user":              {registry.CURRENT_USER, `SOFTWARE\Microsoft\SystemCertificates`, `%s\Certificates`},
+	"current-user-group-policy": {registry.CURRENT_USER, `SOFTWARE\Policies\Microsoft\SystemCertificates`, `%s\Certificates`},
+	"system":                    {registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\SystemCertificates`, `%s\Certificates`},
+	"enterprise":                {registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\EnterpriseCertificates`, `%s\Certificates`},
+	"group-policy":              {registry.LOCAL_MACHINE, `SOFTWARE\Policies\Microsoft\SystemCertificates`, `%s\Certificates`},
+}
+
+// serviceStoreName is the physical store name that selects the store of the
+// service named by the -service-name flag.  It isn't in cryptoAPIStores, since
+// its path depends on the service, so operations on every known physical
+// store skip it.
+const serviceStoreName = "service"
+
+// maxServiceNameLen is the longest service name that Windows allows.
+const maxServiceNameLen = 256
+
+// cryptoAPIStoresMu guards cryptoAPIStores against RegisterStore.
+var cryptoAPIStoresMu sync.RWMutex
+
+// cryptoAPILogicalStores lists the logical stores that Windows is known to
+// use.  Other names are allowed (e.g. for experiments), but produce a warning
+// in case they're typos.
+var cryptoAPILogicalStores = []string{
+	"AuthRoot",
+	"CA",
+	"ClientAuthIssuer",
+	"Disallowed",
+	"My",
+	"Root",
+	"SmartCardRoot",
+	"Trust",
+	"TrustedDevices",
+	"TrustedPeople",
+	"TrustedPublisher",
+}
+
+// RegisterStore adds a physical store that can then be selected with the
+// -physical-store flag, e.g. for experimental store paths.  The name must not
+// already be in use, and the store's Physical and Logical paths must be valid
+// registry paths.  Returned errors wrap ErrInvalidStore.
+func RegisterStore(name string, store Store) error {
+	if !validRegistryPath(store.Physical) || !validRegistryPath(store.Logical) {
+		return fmt.Errorf("store %q has an invalid registry path %s: %w", name, store, ErrInvalidStore)
+	}
+
+	cryptoAPIStoresMu.Lock()
+	defer cryptoAPIStoresMu.Unlock()
+
+	if _, ok := cryptoAPIStores[name]; ok || name == serviceStoreName {
+		return fmt.Errorf("store %q is already registered: %w", name, ErrInvalidStore)
+	}
+
+	cryptoAPIStores[name] = store
+
+	return nil
+}
+
+// cryptoAPIStoreNames returns the names of all stores, sorted.
+func cryptoAPIStoreNames() []string {
+	cryptoAPIStoresMu.RLock()
+	defer cryptoAPIStoresMu.RUnlock()
+
+	names := make([]string, 0, len(cryptoAPIStores))
+	for name := range cryptoAPIStores {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// validRegistryPath returns true if path is a syntactically valid relative
+// registry key path: backslash-separated, non-empty names of at most 255
+// characters, without control characters.
+func validRegistryPath(path string) bool {
+	if path == "" {
+		return false
+	}
+
+	for _, name := range strings.Split(path, `\`) {
+		if name == "" || len(name) > maxRegistryKeyNameLen {
+			return false
+		}
+
+		for _, r := range name {
+			if r < 0x20 || r == 0x7f {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// maxRegistryKeyPathLen is the longest registry key path, in UTF-16 code
+// units, that the native registry API can represent: it counts a path's
+// length in bytes in a 16-bit field.  The hive's own prefix (e.g.
+// \REGISTRY\USER\<SID>) also counts, so this is an upper bound.
+const maxRegistryKeyPathLen = 32767
+
+// maxRegistryKeyNameLen is the longest name of a single registry key.
+const maxRegistryKeyNameLen = 255
+
+// checkStoreKeys returns an error wrapping ErrInvalidStore if the registry
+// key of any of the store's logical stores is too long for the registry, so
+// that exotic store configurations fail with a clear message rather than an
+// opaque error from opening the key.  There's no extended-length form of
+// registry paths (unlike the \\?\ prefix for files), so such stores can't be
+// used at all.
+func checkStoreKeys(store Store, logicalStores []string) error {
+	for _, logical := range logicalStores {
+		key := store.LogicalKey(logical)
+
+		for _, name := range strings.Split(key, `\`) {
+			if n := len(utf16.Encode([]rune(name))); n > maxRegistryKeyNameLen {
+				return fmt.Errorf("registry key name %.40q... of logical store %.40q... is %d characters long, "+
+					"over the limit of %d: %w", name, logical, n, maxRegistryKeyNameLen, ErrInvalidStore)
+			}
+		}
+
+		if n := len(utf16.Encode([]rune(key))); n > maxRegistryKeyPathLen {
+			return fmt.Errorf("registry key path of store %.80q... is %d characters long, over the limit of %d: %w",
+				key, n, maxRegistryKeyPathLen, ErrInvalidStore)
+		}
+	}
+
+	return nil
+}
+
+// isKnownLogicalStore returns true if name is listed in
+// cryptoAPILogicalStores (case-insensitively, like the registry).
+func isKnownLogicalStore(name string) bool {
+	for _, known := range cryptoAPILogicalStores {
+		if strings.EqualFold(name, known) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Store is used to generate a registry key to open a certificate store in the Windows Registry.
+//
+// Injection, CheckStoreAccess, cleanup, ListInjectedCertsWin32API, and the CTL
+// functions act on every logical store listed by the -logical-store flag.  The
+// other functions that take a Store act on a single logical store, and return
+// an error wrapping ErrInvalidStore if the flag lists several.
 type Store struct {
 	Base     registry.Key
 	Physical string
@@ -123,526 +379,3769 @@ type Store struct {
 
 // String returns a human readable string (only useful for debug logs).
 func (s Store) String() string {
-	return fmt.Sprintf(`%s\%s\`+s.Logical, s.Base, s.Physical, cryptoAPIFlagLogicalStoreName.Value())
+	return fmt.Sprintf(`%v\%s`, s.Base, s.Key())
 }
 
-// Key generates the registry key for use in opening the store.
+// Key generates the registry key for use in opening the store.  If the
+// -logical-store flag lists several logical stores, only the first one's key
+// is returned, so operations on a single store key use singleKey instead,
+// which rejects that.  Keys that are too long for the registry are rejected
+// before injecting; see checkStoreKeys.
 func (s Store) Key() string {
-	return fmt.Sprintf(`%s\`+s.Logical, s.Physical, cryptoAPIFlagLogicalStoreName.Value())
+	return s.LogicalKey(logicalStoreNames()[0])
 }
 
-// cryptoAPINameToStore returns a Store for the specified name.  Returns an
-// error if the specified name is invalid.
-func cryptoAPINameToStore(name string) (Store, error) {
-	store, ok := cryptoAPIStores[name]
-	if !ok {
-		return Store{}, ErrInvalidPhysicalStore
+// singleKey is like Key, for the given logical stores (see storeFlags), but
+// returns an error wrapping ErrInvalidStore if there are several, rather than
+// ignoring all but the first.
+func (s Store) singleKey(logicalStores []string) (string, error) {
+	if len(logicalStores) > 1 {
+		return "", fmt.Errorf("operation supports only one logical store, got %d (%s): %w", len(logicalStores),
+			strings.Join(logicalStores, ", "), ErrInvalidStore)
 	}
 
-	return store, nil
+	return s.LogicalKey(logicalStores[0]), nil
 }
 
-func allFingerprintsInStore(registryBase registry.Key, storeKey string) ([]string, error) {
-	// Open up the cert store.
-	certStoreKey, err := registry.OpenKey(registryBase, storeKey, registry.ENUMERATE_SUB_KEYS)
+// openSingleStore opens the registry key of the store's only logical store
+// (see singleKey), in the registry view of flags, with the given access.
+// Returned errors wrap ErrInvalidStore if several logical stores are
+// configured, and ErrStoreOpen if the key can't be opened.
+func openSingleStore(store Store, flags *storeFlags, access uint32) (regKey, error) {
+	storeKey, err := store.singleKey(flags.logicalStores)
 	if err != nil {
-		return nil, fmt.Errorf("%s: couldn't open cert store: %w", err, ErrEnumerateCerts)
+		return nil, err
 	}
-	defer certStoreKey.Close()
 
-	fingerprintHexUpperList, err := certStoreKey.ReadSubKeyNames(0)
+	certStoreKey, err := reg.OpenKey(reg.Root(store.Base, flags.registryView), storeKey, access)
 	if err != nil {
-		return nil, fmt.Errorf("%s: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+		return nil, fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
 	}
 
-	return fingerprintHexUpperList, nil
+	return certStoreKey, nil
 }
 
-func readInputBlob(derBytes []byte, registryBase registry.Key, path string) (certblob.Blob, error) {
-	if cryptoAPIFlagReset.Value() && derBytes != nil {
-		// We already know the cert preimage, and we're excluding any
-		// properties, so no need to check the registry.
-		return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
-	}
+// LogicalKey generates the registry key for use in opening the specified
+// logical store.
+func (s Store) LogicalKey(logical string) string {
+	return fmt.Sprintf(`%s\`+s.Logical, s.Physical, logical)
+}
 
-	// We need to look up either the cert preimage or the properties via
-	// the registry.
+// logicalStoreNames returns the logical stores listed in the -logical-store
+// flag, for callers that hold flagMu.  It always returns at least one entry.
+func logicalStoreNames() []string {
+	names := []string{}
 
-	// Open up the cert key.
-	certKey, err := registry.OpenKey(registryBase, path, registry.QUERY_VALUE)
-	if err != nil && derBytes != nil {
-		// We can't read the blob, but we do already know the cert
-		// preimage, so create a default blob based on that preimage.
-		return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
+	for _, name := range strings.Split(cryptoAPIFlagLogicalStoreName.Value(), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
 	}
-	defer certKey.Close()
 
-	inputBlobBytes, _, err := certKey.GetBinaryValue("Blob")
-	if err != nil {
-		return nil, fmt.Errorf("%s: couldn't read blob value: %w", err, ErrGetInitialBlob)
+	if len(names) == 0 {
+		return []string{cryptoAPIFlagLogicalStoreName.Value()}
 	}
 
-	blob, err := certblob.ParseBlob(inputBlobBytes)
+	return names
+}
+
+// storeFlags are the flags that locate and recognize injected certs: the
+// logical stores and registry view to open, the magic tags, and the blob size
+// limit.  Operations on injected certs snapshot them when they start (see
+// snapshotStoreFlags) and pass them down, so that WithFlags can't change them
+// halfway through.
+type storeFlags struct {
+	logicalStores []string
+	// registryView is an access flag; see registryViewAccess.
+	registryView uint32
+
+	// magicName and magicData are the magic tag set by the -set-magic-name
+	// and -set-magic-data flags.  Unlike InjectOptions.MagicName, magicName
+	// ignores the -no-magic flag; see injectMagicName.
+	magicName string
+	magicData int
+
+	skipMagicName string
+	skipMagicData int
+
+	maxBlobBytes int
+}
+
+// snapshotStoreFlags snapshots the storeFlags while holding flagMu.  Returned
+// errors wrap ErrInvalidStore if the -registry-view flag is invalid.
+func snapshotStoreFlags() (storeFlags, error) {
+	flagMu.RLock()
+	defer flagMu.RUnlock()
+
+	return snapshotStoreFlagsLocked()
+}
+
+// snapshotStoreFlagsLocked is like snapshotStoreFlags, for callers that
+// already hold flagMu.
+func snapshotStoreFlagsLocked() (storeFlags, error) {
+	view, err := registryViewAccess()
 	if err != nil {
-		return nil, fmt.Errorf("%s: couldn't parse blob: %w", err, ErrGetInitialBlob)
+		return storeFlags{}, err
 	}
 
-	return blob, nil
+	return storeFlags{
+		logicalStores: logicalStoreNames(),
+		registryView:  view,
+		magicName:     setMagicName.Value(),
+		magicData:     setMagicData.Value(),
+		skipMagicName: skipMagicName.Value(),
+		skipMagicData: skipMagicData.Value(),
+		maxBlobBytes:  maxBlobBytes.Value(),
+	}, nil
 }
 
-func injectCertCryptoAPI(derBytes []byte) {
-	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
-	if err != nil {
-		log.Errorf("error: %s", err.Error())
+// cryptoAPINameToStore returns a Store for the specified name.  Returns an
+// error if the specified name is invalid.
+func cryptoAPINameToStore(name string) (Store, error) {
+	if name == serviceStoreName {
+		return serviceStore(serviceName.Value())
+	}
 
-		return
+	cryptoAPIStoresMu.RLock()
+	defer cryptoAPIStoresMu.RUnlock()
+
+	store, ok := cryptoAPIStores[name]
+	if !ok {
+		return Store{}, ErrInvalidPhysicalStore
 	}
 
-	registryBase := store.Base
-	storeKey := store.Key()
+	return store, nil
+}
+
+// cryptoAPIFlagStore returns the Store specified by the -physical-store flag,
+// redirected to the hive of the -user-sid flag if it's set.
+func cryptoAPIFlagStore() (Store, error) {
+	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+	if err != nil {
+		return Store{}, err
+	}
 
-	var storeNotifyKey registry.Key
+	if serviceName.Value() != "" && cryptoAPIFlagPhysicalStoreName.Value() != serviceStoreName {
+		return Store{}, fmt.Errorf("service name can only be used with the %s physical store: %w",
+			serviceStoreName, ErrInvalidStore)
+	}
 
-	if watch.Value() {
-		// Open up the cert store.
-		storeNotifyKey, err = registry.OpenKey(registryBase, storeKey, registry.NOTIFY)
+	if appPackage.Value() != "" {
+		store, err = appPackageStore(store, appPackage.Value())
 		if err != nil {
-			log.Errorf("%s: couldn't open cert store: %w", err, ErrEnumerateCerts)
+			return Store{}, err
+		}
+	}
 
-			return
+	if userSID.Value() != "" {
+		store, err = userSIDStore(store, userSID.Value())
+		if err != nil {
+			return Store{}, err
 		}
-		defer storeNotifyKey.Close()
 	}
 
-	injectCertLoopCryptoAPI(derBytes, registryBase, storeKey, storeNotifyKey)
+	err = checkStoreKeys(store, logicalStoreNames())
+	if err != nil {
+		return Store{}, err
+	}
+
+	return store, nil
 }
 
-func injectCertLoopCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string, storeNotifyKey registry.Key) {
-	ready := false
+// serviceStore returns the store of the named Windows service, i.e.
+// HKEY_LOCAL_MACHINE\SOFTWARE\Microsoft\Cryptography\Services\<name>\SystemCertificates.
+// Returned errors wrap ErrInvalidStore if the name is empty or isn't a valid
+// service name.
+func serviceStore(name string) (Store, error) {
+	if name == "" {
+		return Store{}, fmt.Errorf("the %s physical store requires a service name: %w", serviceStoreName,
+			ErrInvalidStore)
+	}
 
-	for {
-		injectCertOnceCryptoAPI(derBytes, registryBase, storeKey)
+	if len(name) > maxServiceNameLen || strings.ContainsAny(name, `/\`) || !validRegistryPath(name) {
+		return Store{}, fmt.Errorf("invalid service name %q: %w", name, ErrInvalidStore)
+	}
 
-		if !watch.Value() {
-			break
-		}
+	return Store{
+		registry.LOCAL_MACHINE,
+		`SOFTWARE\Microsoft\Cryptography\Services\` + name + `\SystemCertificates`,
+		`%s\Certificates`,
+	}, nil
+}
 
-		// As per Windows API docs, the first call to RegNotifyChangeKeyValue
-		// behaves differently from subsequent calls.  The first call waits for
-		// an event that occurred after the call was made; all subsequent calls
-		// wait for an event that occurred after the previous reported event.
-		// The first call does NOT report events that occurred between the
-		// opening of the key and the first call, which is what would be sane.
-		// Thus, we have a race condition, where if an event happens between
-		// opening the key and the first call, that event will be dropped.
-		// Thus, as a stupid workaround, we set up a goroutine to reapply any
-		// requested cert store operations ~3 seconds after the first call, so
-		// that if the race condition was hit, it will be automatically fixed
-		// after ~3 seconds.  I know this is stupid.  Blame Microsoft, not me.
-		if !ready {
-			go func() {
-				time.Sleep(3 * time.Second)
-				injectCertOnceCryptoAPI(derBytes, registryBase, storeKey)
+// sidPattern matches the string form of a Windows security identifier.
+var sidPattern = regexp.MustCompile(`^S-1-[0-9]+(-[0-9]+)+$`)
 
-				log.Info("Registry is ready")
+// userSIDStore redirects a current-user store to the hive of the user with
+// the given SID under HKEY_USERS.  Returned errors wrap ErrInvalidStore if the
+// SID is malformed or the store isn't a current-user store, ErrStoreNotFound
+// if the user's hive isn't loaded (e.g. the user isn't logged on), and
+// ErrStoreOpen if the hive can't be opened.
+func userSIDStore(store Store, sid string) (Store, error) {
+	if !sidPattern.MatchString(sid) {
+		return Store{}, fmt.Errorf("malformed user SID %q: %w", sid, ErrInvalidStore)
+	}
 
-				ready = true
-			}()
-		}
+	if store.Base != registry.CURRENT_USER {
+		return Store{}, fmt.Errorf("user SID can only be used with current-user stores, not %s: %w",
+			store, ErrInvalidStore)
+	}
 
-		log.Info("Waiting for registry change...")
+	// Users' hives aren't redirected by WOW64, so the view doesn't matter.
+	hiveKey, err := reg.OpenKey(reg.Root(registry.USERS, 0), sid, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return Store{}, fmt.Errorf("%w: hive of user %s isn't loaded: %w", err, sid, ErrStoreNotFound)
+	}
 
-		err := regwait.WaitChange(storeNotifyKey, true, regwait.Subkey|regwait.Value)
-		if err != nil {
-			log.Errorf("%s: couldn't watch cert store", err)
-		}
+	if err != nil {
+		return Store{}, fmt.Errorf("%w: couldn't open hive of user %s: %w", err, sid, ErrStoreOpen)
 	}
-}
 
-func injectCertOnceCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string) {
-	fingerprintHexUpperList := []string{}
+	hiveKey.Close()
 
-	var err error
+	return Store{registry.USERS, sid + `\` + store.Physical, store.Logical}, nil
+}
 
-	if allCerts.Value() {
-		derBytes = nil
+// appContainerSIDPattern matches the string form of an AppContainer (package)
+// SID, which has exactly 7 subauthorities after S-1-15-2.
+var appContainerSIDPattern = regexp.MustCompile(`^S-1-15-2(-[0-9]+){7}$`)
 
-		fingerprintHexUpperList, err = allFingerprintsInStore(registryBase, storeKey)
-		if err != nil {
-			log.Errorf("Couldn't enumerate certificates in store: %s", err)
+// appContainerStorageKey is the key under the user's hive to which the
+// registry writes of AppContainer processes are redirected, one subkey per
+// AppContainer SID.
+const appContainerStorageKey = `SOFTWARE\Classes\Local Settings\Software\Microsoft\Windows\CurrentVersion\` +
+	`AppContainer\Storage`
 
-			return
-		}
+// appPackageStore redirects a current-user store to the private registry
+// storage of the AppContainer with the given SID, which is where packaged
+// apps read their per-package certificate stores.  The AppContainer's
+// storage only exists once the package has been installed for the user.
+// Returned errors wrap ErrInvalidStore if the SID isn't an AppContainer SID
+// or the store isn't a current-user store.
+func appPackageStore(store Store, sid string) (Store, error) {
+	if !appContainerSIDPattern.MatchString(sid) {
+		return Store{}, fmt.Errorf("malformed AppContainer SID %q: %w", sid, ErrInvalidStore)
 	}
 
-	if len(fingerprintHexUpperList) == 0 && searchSHA1.Value() != "" {
-		fingerprintHexUpperList = append(fingerprintHexUpperList, searchSHA1.Value())
+	if store.Base != registry.CURRENT_USER {
+		return Store{}, fmt.Errorf("app package can only be used with current-user stores, not %s: %w",
+			store, ErrInvalidStore)
 	}
 
-	if len(fingerprintHexUpperList) == 0 {
-		if derBytes == nil {
-			log.Errorf("No cert specified")
+	return Store{
+		store.Base,
+		appContainerStorageKey + `\` + sid + `\` + store.Physical,
+		store.Logical,
+	}, nil
+}
+
+// subKeyBatchSize is how many subkey names are read from the registry at a
+// time, so that huge stores don't need one giant allocation.
+const subKeyBatchSize = 256
 
-			return
+// readSubKeyNames reads all subkey names of key in batches.  If the key changes
+// between batches, a name can shift into the next batch; such duplicates are
+// only returned once.
+func readSubKeyNames(key regKey) ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for start := uint32(0); ; start += subKeyBatchSize {
+		batch, err := key.ReadSubKeyNamesAt(start, subKeyBatchSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
 		}
 
-		// Windows CryptoAPI uses the SHA-1 fingerprint to identify a cert.
-		// This is probably a Bad Thing (TM) since SHA-1 is weak.
-		// However, that's Microsoft's problem to fix, not ours.
-		fingerprint := sha1.Sum(derBytes) // #nosec G401
+		for _, name := range batch {
+			if seen[strings.ToLower(name)] {
+				continue
+			}
 
-		// Windows CryptoAPI uses a hex string to represent the fingerprint.
-		fingerprintHex := hex.EncodeToString(fingerprint[:])
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
 
-		// Windows CryptoAPI uses uppercase hex strings
-		fingerprintHexUpperList = append(fingerprintHexUpperList, strings.ToUpper(fingerprintHex))
+		if err != nil || len(batch) < subKeyBatchSize {
+			return names, nil
+		}
 	}
+}
 
-	for _, fingerprintHexUpper := range fingerprintHexUpperList {
-		injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registryBase, storeKey)
+// logScanProgress logs how many of the store's certs have been scanned, every
+// -progress-interval certs, so that operations on huge stores don't appear to
+// hang.  Each cert is also logged at trace level.
+func logScanProgress(storeKey, subKeyName string, scanned, total int) {
+	log.Tracef("Scanning %s (%d/%d) in %s", displayFingerprint(subKeyName), scanned, total, storeKey)
+
+	if scanProgressDue(scanned, loggedFlags().progressInterval) {
+		log.Infof("Scanned %d/%d certs in %s", scanned, total, storeKey)
 	}
 }
 
-func injectSingleCertCryptoAPI(derBytes []byte, fingerprintHexUpper string,
-	registryBase registry.Key, storeKey string,
-) {
-	// Construct the input Blob
-	blob, err := readInputBlob(derBytes, registryBase, storeKey+`\`+fingerprintHexUpper)
-	if err != nil {
-		log.Errorf("Couldn't read input blob: %s", err)
+// scanProgressDue returns true if progress should be logged after scanning
+// the given number of certs.
+func scanProgressDue(scanned, interval int) bool {
+	return interval > 0 && scanned%interval == 0
+}
 
-		return
+func allFingerprintsInStore(registryBase registry.Key, view uint32, storeKey string) ([]string, error) {
+	// Open up the cert store.
+	certStoreKey, err := reg.OpenKey(reg.Root(registryBase, view), storeKey, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
 	}
+	defer certStoreKey.Close()
 
-	err = editBlob(blob)
+	fingerprintHexUpperList, err := readSubKeyNames(certStoreKey)
 	if err != nil {
-		log.Errorf("Couldn't edit blob: %s", err)
+		return nil, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
 
-		return
+	return fingerprintHexUpperList, nil
+}
+
+func readInputBlob(derBytes []byte, registryBase registry.Key, path string,
+	opts *InjectOptions,
+) (certblob.Blob, error) {
+	if opts.Reset && !opts.ResetKeepHashes && derBytes != nil {
+		// We already know the cert preimage, and we're excluding any
+		// properties, so no need to check the registry.
+		return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
 	}
 
-	// Marshal the Blob
-	blobBytes, err := blob.Marshal()
+	// We need to look up either the cert preimage or the properties via
+	// the registry.
+
+	// Open up the cert key.
+	certKey, err := reg.OpenKey(reg.Root(registryBase, opts.registryView), path, registry.QUERY_VALUE)
 	if err != nil {
-		log.Errorf("Couldn't marshal cert blob: %s", err)
+		if derBytes != nil {
+			// We can't read the blob, but we do already know the cert
+			// preimage, so create a default blob based on that preimage.
+			return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
+		}
 
-		return
+		return nil, fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrGetInitialBlob)
 	}
+	defer certKey.Close()
 
-	// Open up the cert store.
-	certStoreKey, err := registry.OpenKey(registryBase, storeKey, registry.ALL_ACCESS)
+	blob, err := readNamedBlobValue(certKey, opts.blobValueName(), opts.maxBlobBytes())
 	if err != nil {
-		log.Errorf("Couldn't open cert store: %s", err)
+		switch {
+		case derBytes == nil:
+			return nil, fmt.Errorf("%s: %w", path, err)
+		case opts.Reset:
+			// We were only going to keep the hashes anyway.
+			return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
+		case errors.Is(err, registry.ErrNotExist), errors.Is(err, certblob.ErrPropertyParse):
+			// A previous run was probably interrupted after creating the
+			// cert key but before writing a valid blob.  Windows ignores
+			// such certs, so complete the write.
+			log.Warnf("Repairing half-written cert %s: %s", path, err)
 
-		return
+			return certblob.Blob{certblob.CertContentCertPropID: derBytes}, nil
+		default:
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
 	}
-	defer certStoreKey.Close()
 
-	// Create the registry key in which we will store the cert.
-	// The 2nd result of CreateKey is openedExisting, which tells us if the cert already existed.
-	// This doesn't matter to us.  If true, the "last modified" metadata won't update,
-	// but we delete and recreate the magic value inside it as a workaround.
-	certKey, _, err := registry.CreateKey(certStoreKey, fingerprintHexUpper, registry.ALL_ACCESS)
-	if err != nil {
-		log.Errorf("Couldn't create registry key for certificate: %s", err)
+	if derBytes != nil && blob[certblob.CertContentCertPropID] == nil {
+		log.Warnf("Repairing cert %s: blob has no cert content", path)
 
-		return
+		blob[certblob.CertContentCertPropID] = derBytes
 	}
-	defer certKey.Close()
 
-	// Check for magic value indicating we should skip this cert
-	shouldSkip, _, err := certKey.GetIntegerValue(skipMagicName.Value())
-	if err == nil && shouldSkip == uint64(skipMagicData.Value()) {
-		// Magic value detected.  Skip.
-		return
+	if opts.Reset {
+		resetBlob(blob, opts.ResetKeepHashes)
 	}
 
-	applyRegistryValues(certKey, blobBytes)
+	return blob, nil
 }
 
-func applyRegistryValues(certKey registry.Key, blobBytes []byte) {
-	var err error
+// resetBlob deletes every property except the cert content and, if
+// keepHashes is set, certblob.HashPropIDs.
+func resetBlob(blob certblob.Blob, keepHashes bool) {
+	keep := map[uint32]bool{certblob.CertContentCertPropID: true}
 
-	if setMagicName.Value() != "" {
-		err = applyMagic(certKey)
-		if err != nil {
-			log.Errorf("Couldn't set magic registry value for certificate: %s", err)
+	if keepHashes {
+		for _, id := range certblob.HashPropIDs {
+			keep[id] = true
+		}
+	}
 
-			return
+	for _, id := range blob.PropertyIDs() {
+		if !keep[id] {
+			blob.DeleteProperty(id)
 		}
 	}
+}
 
-	// Create the registry value which holds the certificate.
-	err = certKey.SetBinaryValue("Blob", blobBytes)
-	if err != nil {
-		log.Errorf("Couldn't set blob registry value for certificate: %s", err)
+// readBlobValue reads and parses the Blob value of an open cert key.  The
+// value is normally REG_BINARY, but some Windows versions store it with other
+// types (e.g. REG_NONE), so any type is accepted as long as it parses.  Values
+// larger than maxBytes are rejected.
+func readBlobValue(certKey regKey, maxBytes int) (certblob.Blob, error) {
+	return readNamedBlobValue(certKey, blobValueName, maxBytes)
+}
 
-		return
+// readNamedBlobValue is like readBlobValue, for a blob stored in the named
+// registry value.
+func readNamedBlobValue(certKey regKey, name string, maxBytes int) (certblob.Blob, error) {
+	// Query the size of the value before reading it, so that a huge or
+	// corrupt value doesn't cause a large allocation.
+	inputBlobSize, _, err := certKey.GetValue(name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't query blob value: %w", err, ErrGetInitialBlob)
 	}
-}
 
-// Add an extra registry value that serves as a "magic tag".  This will be
-// ignored by CryptoAPI, but can be recognized by software that knows to look
-// for it.  Example uses:
-//
-//   - Indicating that a certificate is a Namecoin dehydrated certificate, and
-//     should be deleted once it reaches a certain age to avoid leaving browsing
-//     history in the registry.
-//   - Indicating that a certificate is a Namecoin root certificate, and should
-//     be exempt from a Namecoin name constraint exclusion that is applied to all
-//     other root CA's.
-func applyMagic(certKey registry.Key) error {
-	// To satisfy the first example use case, we have to delete it before we
-	// create it, so that we make sure that the "last modified" metadata gets
-	// updated.  If an error occurs during deletion, we ignore it, since it
-	// probably just means it wasn't there already.  In watch mode, we don't do
-	// this, since it would cause an infinite loop.
-	if !watch.Value() {
-		_ = certKey.DeleteValue(setMagicName.Value())
+	var (
+		inputBlobBytes []byte
+		valType        uint32
+	)
+
+	for {
+		err = checkBlobSize(inputBlobSize, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		inputBlobBytes = make([]byte, inputBlobSize)
+
+		// If the value grew between the two reads, GetValue reports its new
+		// size, which we check again.
+		inputBlobSize, valType, err = certKey.GetValue(name, inputBlobBytes)
+		if !errors.Is(err, registry.ErrShortBuffer) {
+			break
+		}
 	}
 
-	err := certKey.SetDWordValue(setMagicName.Value(), uint32(setMagicData.Value()))
 	if err != nil {
-		return fmt.Errorf("%s: couldn't apply magic '%s'='%d': %w", err,
-			setMagicName.Value(), uint32(setMagicData.Value()), ErrSetMagic)
+		return nil, fmt.Errorf("%w: couldn't read blob value: %w", err, ErrGetInitialBlob)
 	}
 
-	return nil
-}
+	if valType != registry.BINARY {
+		log.Debugf("%s value has registry type %d instead of REG_BINARY", name, valType)
+	}
 
-func editBlob(blob certblob.Blob) error {
-	err := editBlobEKU(blob)
+	blob, err := certblob.ParseBlob(inputBlobBytes[:inputBlobSize])
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: couldn't parse %d-byte blob: %w", err, inputBlobSize, ErrGetInitialBlob)
 	}
 
-	err = editBlobNameConstraints(blob)
-	if err != nil {
-		return err
+	return blob, nil
+}
+
+// checkBlobSize returns an error if a Blob registry value of the given size
+// exceeds maxBytes.
+func checkBlobSize(size, maxBytes int) error {
+	if size > maxBytes {
+		return fmt.Errorf("%d bytes exceeds limit of %d bytes: %w", size,
+			maxBytes, ErrBlobTooLarge)
 	}
 
 	return nil
 }
 
-func editBlobEKU(blob certblob.Blob) error {
-	ekus := buildEKUList()
+// isElevated returns true if the current process token is elevated (i.e. the
+// process has Administrator privileges).
+func isElevated() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+// cryptoAPIInjectStore returns the Store specified by the -physical-store
+// flag, falling back to the current-user store if the -auto-user-fallback
+// flag is set and the system store denies write access.  The flags are read
+// while holding flagMu.
+func cryptoAPIInjectStore() (Store, error) {
+	flagMu.RLock()
+	defer flagMu.RUnlock()
 
-	if len(ekus) == 0 {
-		return nil
+	return cryptoAPIInjectStoreLocked()
+}
+
+// cryptoAPIInjectStoreLocked is like cryptoAPIInjectStore, for callers that
+// already hold flagMu.
+func cryptoAPIInjectStoreLocked() (Store, error) {
+	physical := cryptoAPIFlagPhysicalStoreName.Value()
+
+	store, err := cryptoAPIFlagStore()
+	if err != nil {
+		return Store{}, err
 	}
 
-	ekuTemplate := x509.Certificate{
-		ExtKeyUsage: ekus,
+	if !autoUserFallback.Value() || physical != "system" {
+		return store, nil
 	}
 
-	ekuProperty, err := certblob.BuildExtKeyUsage(&ekuTemplate)
+	flags, err := snapshotStoreFlagsLocked()
 	if err != nil {
-		return fmt.Errorf("%s: couldn't marshal extended key usage property: %w", err, ErrEditBlob)
+		return Store{}, err
 	}
 
-	blob.SetProperty(ekuProperty)
+	err = checkLogicalStoresAccess(store, &flags)
+	if !errors.Is(err, ErrStoreAccessDenied) {
+		// Either we can write, or some other error that the injection will
+		// report.
+		return store, nil
+	}
 
-	return nil
+	log.Warnf("Access denied to system store (elevated: %t); falling back to current-user store", isElevated())
+
+	return cryptoAPINameToStore("current-user")
 }
 
-func buildEKUList() []x509.ExtKeyUsage {
-	ekus := []x509.ExtKeyUsage{}
+// CheckStoreAccess checks whether the specified store can be opened for
+// writing, in each logical store listed by the -logical-store flag, without
+// writing anything.  Returned errors wrap ErrInvalidStore if the
+// -registry-view flag is invalid, ErrStoreAccessDenied if access was denied,
+// ErrStoreNotFound if the store doesn't exist, and ErrStoreOpen otherwise.
+func CheckStoreAccess(store Store) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	return checkLogicalStoresAccess(store, &flags)
+}
+
+// checkLogicalStoresAccess implements CheckStoreAccess for the logical stores
+// and registry view of flags.
+func checkLogicalStoresAccess(store Store, flags *storeFlags) error {
+	for _, logical := range flags.logicalStores {
+		storeKey, err := reg.OpenKey(reg.Root(store.Base, flags.registryView), store.LogicalKey(logical),
+			registry.ALL_ACCESS)
+		if err != nil {
+			path := fmt.Sprintf(`%s\%s`, rootKeyName(store.Base), store.LogicalKey(logical))
+
+			switch {
+			case errors.Is(err, windows.ERROR_ACCESS_DENIED):
+				return fmt.Errorf("%w: couldn't open cert store %s: %w", err, path, ErrStoreAccessDenied)
+			case errors.Is(err, registry.ErrNotExist):
+				return fmt.Errorf("%w: couldn't open cert store %s: %w", err, path, ErrStoreNotFound)
+			default:
+				return fmt.Errorf("%w: couldn't open cert store %s: %w", err, path, ErrStoreOpen)
+			}
+		}
+
+		storeKey.Close()
+	}
+
+	return nil
+}
+
+// InjectCertCryptoAPI injects the given cert into the CryptoAPI store(s)
+// configured by flags.  If several logical stores are configured, the cert is
+// injected into each of them concurrently (see forEachLogicalStore), and the
+// errors are combined.  In watch mode, only a single logical store is
+// supported, and it only returns if the store can't be watched; errors from
+// individual passes are logged instead.  The flags are turned into
+// InjectOptions when it starts, so changing them with WithFlags doesn't
+// affect an injection that's already running; library users that need
+// different settings per call should use InjectWithOptions instead.
+//
+// Returned errors wrap ErrInvalidStore if the configured store is invalid,
+// ErrStoreOpen if the store can't be opened, ErrEnumerateCerts if the certs in
+// the store can't be listed, ErrBlobRead if an existing blob can't be read,
+// ErrPropertyMarshal if a property can't be built, and ErrRegistryWrite if the
+// cert can't be written to the registry.  Failures while building properties
+// or writing the cert are wrapped in an *InjectError, which reports how far
+// injection got; use errors.As to get it.  If the -capi.check flag is set, it
+// only checks the store's accessibility; see CheckStoreAccess.  If the
+// -capi.selftest flag is set, it only runs SelfTest on the current-user
+// physical store.  Outside watch mode, returned errors wrap ErrTimeout if the
+// -capi.timeout flag is set and injection doesn't finish in time; see
+// withTimeout.
+func InjectCertCryptoAPI(derBytes []byte) error {
+	return injectCertCryptoAPIFingerprint(derBytes, "")
+}
+
+// injectCertCryptoAPIFingerprint is InjectCertCryptoAPI, for callers that
+// already computed the cert's fingerprint; if it's empty, it's computed as
+// needed.
+func injectCertCryptoAPIFingerprint(derBytes []byte, fingerprintHexUpper string) error {
+	flagMu.RLock()
+	watching := watch.Value()
+	flagMu.RUnlock()
+
+	if watching {
+		// Watch mode runs until it fails, so it can't have a deadline.
+		return injectCertCryptoAPI(derBytes, fingerprintHexUpper)
+	}
+
+	return withTimeout(func() error {
+		return injectCertCryptoAPI(derBytes, fingerprintHexUpper)
+	})
+}
+
+// injectCertCryptoAPI injects the cert as configured by flags.  The flags are
+// snapshotted at entry while holding flagMu, so that WithFlags can't change
+// them halfway through.
+func injectCertCryptoAPI(derBytes []byte, fingerprintHexUpper string) error {
+	flagMu.RLock()
+
+	if selfTest.Value() {
+		flagMu.RUnlock()
+
+		store, err := cryptoAPINameToStore("current-user")
+		if err != nil {
+			return err
+		}
+
+		return SelfTest(store)
+	}
+
+	checkOnly := checkStoreAccess.Value()
+
+	store, err := cryptoAPIInjectStoreLocked()
+	if err != nil {
+		flagMu.RUnlock()
+
+		return err
+	}
+
+	opts, err := injectOptionsFromFlagsLocked()
+	flagMu.RUnlock()
+
+	if checkOnly {
+		return CheckStoreAccess(store)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	opts.Store = store
+	opts.fingerprint = fingerprintHexUpper
+
+	warnUnknownLogicalStores(opts.LogicalStores)
+
+	err = checkStoreKeys(store, opts.LogicalStores)
+	if err != nil {
+		return err
+	}
+
+	if opts.watch && len(opts.LogicalStores) > 1 {
+		return fmt.Errorf("watch mode supports only one logical store, got %d: %w",
+			len(opts.LogicalStores), ErrInvalidStore)
+	}
+
+	err = opts.checkMethod()
+	if err != nil {
+		return err
+	}
+
+	err = forEachLogicalStore(opts.LogicalStores, func(logical string) error {
+		return injectCertStoreCryptoAPI(derBytes, store.Base, store.LogicalKey(logical), &opts)
+	})
+	if err != nil || opts.dedup == "" || derBytes == nil {
+		return err
+	}
+
+	_, err = DedupCert(opts.certFingerprint(derBytes), opts.dedup)
+
+	return err
+}
+
+// logicalStoreConcurrency is how many logical stores forEachLogicalStore
+// works on at once.  It's small, since a cert is rarely injected into more
+// than a handful of logical stores.
+const logicalStoreConcurrency = 4
+
+// forEachLogicalStore calls fn for each of the logical stores concurrently,
+// since their registry keys are independent, and joins the errors in the
+// order of logicalStores.  A failure in one logical store doesn't stop the
+// others.  The Root logical store is done first, though, since the CA logical
+// store's chain check reads it (see checkChainCryptoAPI).
+func forEachLogicalStore(logicalStores []string, fn func(logical string) error) error {
+	errs := make([]error, len(logicalStores))
+	sem := make(chan struct{}, logicalStoreConcurrency)
+
+	run := func(i int, logical string) {
+		err := fn(logical)
+		if err != nil {
+			errs[i] = fmt.Errorf("logical store %s: %w", logical, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for i, logical := range logicalStores {
+		if strings.EqualFold(logical, "Root") {
+			run(i, logical)
+		}
+	}
+
+	for i, logical := range logicalStores {
+		if strings.EqualFold(logical, "Root") {
+			continue
+		}
+
+		wg.Add(1)
+
+		sem <- struct{}{}
+
+		go func(i int, logical string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			run(i, logical)
+		}(i, logical)
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// warnUnknownLogicalStores warns about logical stores that aren't listed in
+// cryptoAPILogicalStores, in case they're typos.
+func warnUnknownLogicalStores(logicalStores []string) {
+	for _, logical := range logicalStores {
+		if !isKnownLogicalStore(logical) {
+			log.Warnf("Unknown logical store %q; consider: %s", logical, strings.Join(cryptoAPILogicalStores, ", "))
+		}
+	}
+}
+
+func injectCertStoreCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string,
+	opts *InjectOptions,
+) error {
+	var (
+		storeNotifyKey regKey
+		err            error
+	)
+
+	if opts.watch {
+		// Open up the cert store, in the configured registry view.
+		storeNotifyKey, err = reg.OpenKey(reg.Root(registryBase, opts.registryView), storeKey, registry.NOTIFY)
+		if err != nil {
+			return fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+		}
+		defer storeNotifyKey.Close()
+	}
+
+	return injectCertLoopCryptoAPI(derBytes, registryBase, storeKey, storeNotifyKey, opts)
+}
+
+func injectCertLoopCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string,
+	storeNotifyKey regKey, opts *InjectOptions,
+) error {
+	ready := false
+
+	for {
+		err := injectCertOnceCryptoAPI(derBytes, registryBase, storeKey, opts)
+
+		if !opts.watch {
+			return err
+		}
+
+		if err != nil {
+			log.Errorf("Couldn't inject cert: %s", err)
+		}
+
+		// As per Windows API docs, the first call to RegNotifyChangeKeyValue
+		// behaves differently from subsequent calls.  The first call waits for
+		// an event that occurred after the call was made; all subsequent calls
+		// wait for an event that occurred after the previous reported event.
+		// The first call does NOT report events that occurred between the
+		// opening of the key and the first call, which is what would be sane.
+		// Thus, we have a race condition, where if an event happens between
+		// opening the key and the first call, that event will be dropped.
+		// Thus, as a stupid workaround, we set up a goroutine to reapply any
+		// requested cert store operations ~3 seconds after the first call, so
+		// that if the race condition was hit, it will be automatically fixed
+		// after ~3 seconds.  I know this is stupid.  Blame Microsoft, not me.
+		if !ready {
+			go func() {
+				time.Sleep(3 * time.Second)
+
+				err := injectCertOnceCryptoAPI(derBytes, registryBase, storeKey, opts)
+				if err != nil {
+					log.Errorf("Couldn't inject cert: %s", err)
+				}
+
+				log.Info("Registry is ready")
+
+				ready = true
+			}()
+		}
+
+		log.Info("Waiting for registry change...")
+
+		err = waitRegChange(storeNotifyKey)
+		if err != nil {
+			log.Errorf("%s: couldn't watch cert store", err)
+		}
+	}
+}
+
+func injectCertOnceCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string,
+	opts *InjectOptions,
+) error {
+	fingerprintHexUpperList := []string{}
+
+	var err error
+
+	if opts.allCerts {
+		derBytes = nil
+
+		fingerprintHexUpperList, err = allFingerprintsInStore(registryBase, opts.registryView, storeKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(fingerprintHexUpperList) == 0 && opts.searchSHA1 != "" {
+		fingerprintHexUpperList = append(fingerprintHexUpperList, normalizeFingerprintCryptoAPI(opts.searchSHA1))
+	}
+
+	if len(fingerprintHexUpperList) == 0 {
+		if derBytes == nil {
+			return ErrNoCert
+		}
+
+		fingerprintHexUpperList = append(fingerprintHexUpperList, opts.certFingerprint(derBytes))
+	}
+
+	errs := []error{}
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registryBase, storeKey, opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", displayFingerprint(fingerprintHexUpper), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// certFingerprint returns the fingerprint of the cert being injected, reusing
+// the one the caller computed, if any.
+func (opts *InjectOptions) certFingerprint(derBytes []byte) string {
+	if opts.fingerprint != "" {
+		return opts.fingerprint
+	}
+
+	return fingerprintHexUpperCryptoAPI(derBytes)
+}
+
+// fingerprintHexUpperCryptoAPI returns the registry subkey name that
+// CryptoAPI uses for the given cert.
+func fingerprintHexUpperCryptoAPI(derBytes []byte) string {
+	// Windows CryptoAPI uses the SHA-1 fingerprint to identify a cert.
+	// This is probably a Bad Thing (TM) since SHA-1 is weak.
+	// However, that's Microsoft's problem to fix, not ours.
+	fingerprint := sha1.Sum(derBytes) // #nosec G401
+
+	// Windows CryptoAPI uses a hex string to represent the fingerprint.
+	fingerprintHex := hex.EncodeToString(fingerprint[:])
+
+	// Windows CryptoAPI uses uppercase hex strings
+	return strings.ToUpper(fingerprintHex)
+}
+
+// defaultProgressInterval is the default for the -progress-interval flag.
+const defaultProgressInterval = 1000
+
+// logFlags holds the flags that format log and error messages.  Messages are
+// logged throughout injection and cleanup, long after their other flags were
+// snapshotted, so these are snapshotted along with them rather than read
+// without flagMu.
+type logFlags struct {
+	fingerprintFormat string
+	progressInterval  int
+}
+
+// currentLogFlags is the latest snapshot of the log flags, or nil if no
+// operation has taken one yet.
+var currentLogFlags atomic.Pointer[logFlags]
+
+// snapshotLogFlagsLocked snapshots the log flags for the operation that's
+// starting, for callers that hold flagMu.  Returned errors wrap
+// ErrInvalidOption if the -fingerprint-format flag is unknown.
+func snapshotLogFlagsLocked() error {
+	format := fingerprintFormat.Value()
+
+	switch format {
+	case "bare", "colon", "space":
+	default:
+		return fmt.Errorf("unknown fingerprint format %q: %w", format, ErrInvalidOption)
+	}
+
+	currentLogFlags.Store(&logFlags{
+		fingerprintFormat: format,
+		progressInterval:  progressInterval.Value(),
+	})
+
+	return nil
+}
+
+// loggedFlags returns the latest snapshot of the log flags, or their defaults
+// if there's none.
+func loggedFlags() logFlags {
+	if flags := currentLogFlags.Load(); flags != nil {
+		return *flags
+	}
+
+	return logFlags{fingerprintFormat: "bare", progressInterval: defaultProgressInterval}
+}
+
+// displayFingerprint formats a bare uppercase hex fingerprint for log and
+// error messages, as configured by the -fingerprint-format flag.  Strings
+// that aren't SHA-1 fingerprints (e.g. non-canonical subkey names) are left
+// alone.
+func displayFingerprint(fingerprintHexUpper string) string {
+	var sep string
+
+	switch loggedFlags().fingerprintFormat {
+	case "colon":
+		sep = ":"
+	case "space":
+		sep = " "
+	default:
+		return fingerprintHexUpper
+	}
+
+	if len(fingerprintHexUpper) != 2*sha1.Size {
+		return fingerprintHexUpper
+	}
+
+	if _, err := hex.DecodeString(fingerprintHexUpper); err != nil {
+		return fingerprintHexUpper
+	}
+
+	pairs := make([]string, 0, sha1.Size)
+	for i := 0; i < len(fingerprintHexUpper); i += 2 {
+		pairs = append(pairs, fingerprintHexUpper[i:i+2])
+	}
+
+	return strings.Join(pairs, sep)
+}
+
+// normalizeFingerprintCryptoAPI converts a user-supplied SHA-1 fingerprint to
+// the uppercase hex form used for registry subkey names.  Colons, spaces, and
+// the invisible left-to-right mark that the Windows certificate UI prepends
+// to copied thumbprints are removed.
+func normalizeFingerprintCryptoAPI(fingerprintHex string) string {
+	fingerprintHex = strings.NewReplacer(":", "", " ", "", "\u200e", "").Replace(fingerprintHex)
+
+	return strings.ToUpper(fingerprintHex)
+}
+
+func injectSingleCertCryptoAPI(derBytes []byte, fingerprintHexUpper string,
+	registryBase registry.Key, storeKey string, opts *InjectOptions,
+) error {
+	// Certs that are edited in place (e.g. in all-certs mode) are meant to
+	// already exist.
+	if derBytes != nil && opts.SkipExisting {
+		skip, err := isForeignCertCryptoAPI(registryBase, storeKey, fingerprintHexUpper, opts)
+		if err != nil {
+			return err
+		}
+
+		if skip {
+			log.Infof("Skipping %s: already in %s\\%s without our magic tag, e.g. shipped with Windows",
+				displayFingerprint(fingerprintHexUpper), rootKeyName(registryBase), storeKey)
+
+			return nil
+		}
+	}
+
+	// Construct the input Blob
+	blob, err := readInputBlob(derBytes, registryBase, storeKey+`\`+fingerprintHexUpper, opts)
+	if err != nil {
+		return err
+	}
+
+	// Certs that are already in the store (e.g. in all-certs mode) are
+	// edited as-is.
+	if derBytes != nil {
+		err = checkSuitabilityCryptoAPI(derBytes, storeKey, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkChainCryptoAPI(blob[certblob.CertContentCertPropID], registryBase, storeKey, opts)
+	if err != nil {
+		return err
+	}
+
+	// Remember the properties as read, so that a failure can report how far
+	// editing got.
+	original := make(certblob.Blob, len(blob))
+	for id, value := range blob {
+		original[id] = value
+	}
+
+	err = editBlob(blob, storeKey, opts)
+	if err != nil {
+		return newInjectError(fingerprintHexUpper, storeKey, original, blob, false, err)
+	}
+
+	var written bool
+
+	if opts.Method == InjectMethodWin32API {
+		written, err = writeBlobWin32API(blob, fingerprintHexUpper, registryBase, storeKey, opts)
+	} else {
+		written, err = writeBlobStatusCryptoAPI(blob, fingerprintHexUpper, registryBase, storeKey, opts)
+	}
+
+	if err != nil {
+		return newInjectError(fingerprintHexUpper, storeKey, original, blob, written, err)
+	}
+
+	return nil
+}
+
+// newInjectError returns an InjectError for a failure after original was
+// edited into blob.
+func newInjectError(fingerprintHexUpper, storeKey string, original, blob certblob.Blob, written bool,
+	err error,
+) error {
+	properties := []uint32{}
+	for _, diff := range certblob.DiffBlobs(original, blob) {
+		properties = append(properties, diff.ID)
+	}
+
+	return &InjectError{
+		Fingerprint: fingerprintHexUpper,
+		StoreKey:    storeKey,
+		Properties:  properties,
+		BlobWritten: written,
+		Err:         err,
+	}
+}
+
+// isForeignCertCryptoAPI reports whether the cert is already in the store
+// without the opts.MagicName tag.
+func isForeignCertCryptoAPI(registryBase registry.Key, storeKey, fingerprintHexUpper string,
+	opts *InjectOptions,
+) (bool, error) {
+	certKey, ok, err := openCertKeyAt(registryBase, opts.registryView, storeKey+`\`+fingerprintHexUpper)
+	if !ok || err != nil {
+		return false, err
+	}
+	defer certKey.Close()
+
+	return opts.MagicName == "" || !hasMagic(certKey, opts.MagicName, opts.MagicData), nil
+}
+
+// InjectRawBlob writes a caller-constructed blob into the store as the cert
+// with the given fingerprint (uppercase hex SHA-1), without deriving anything
+// from the cert: neither the fingerprint nor the blob's properties are checked
+// or edited.  The magic tag set by the -set-magic-name flag is applied (unless
+// the -no-magic flag is set), and certs carrying the -skip-magic-name tag are
+// left alone.
+//
+// Returned errors wrap ErrPropertyMarshal if the blob can't be marshaled,
+// ErrBlobTooLargeToWrite if it's too large for a registry value, ErrStoreOpen
+// if the store can't be opened, and ErrRegistryWrite if the cert can't be
+// written to the registry.
+func InjectRawBlob(store Store, fingerprintHex string, blob certblob.Blob) error {
+	flagMu.RLock()
+	flags, err := snapshotStoreFlagsLocked()
+	magicName := injectMagicName()
+	flagMu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	opts := InjectOptions{
+		MagicName:     magicName,
+		MagicData:     flags.magicData,
+		SkipMagicName: flags.skipMagicName,
+		SkipMagicData: flags.skipMagicData,
+		registryView:  flags.registryView,
+	}
+
+	storeKey, err := store.singleKey(flags.logicalStores)
+	if err != nil {
+		return err
+	}
+
+	return writeBlobCryptoAPI(blob, normalizeFingerprintCryptoAPI(fingerprintHex), store.Base, storeKey, &opts)
+}
+
+// secureACLSDDL is the protected DACL applied by -secure-acl: full control
+// for Administrators and SYSTEM, and read-only for Users.  See also
+// defaultACLSDDL.
+const secureACLSDDL = "D:P(A;;KA;;;BA)(A;;KA;;;SY)(A;;KR;;;BU)"
+
+// maxRegistryValueBytes is the documented size limit of a registry value in
+// the standard hive format.  (Windows 95/98/Me allowed only 16,300 bytes, but
+// those aren't supported.)
+const maxRegistryValueBytes = 1024 * 1024
+
+// blobBufPool holds buffers for marshaling blobs, so that injecting a large
+// bundle doesn't allocate a fresh one for every cert.  The registry copies
+// the value when it's written, so the buffer can be reused afterwards.
+var blobBufPool = sync.Pool{
+	New: func() any {
+		return new([]byte)
+	},
+}
+
+// writeBlobCryptoAPI is the registry-write path shared by all injection
+// functions.
+func writeBlobCryptoAPI(blob certblob.Blob, fingerprintHexUpper string,
+	registryBase registry.Key, storeKey string, opts *InjectOptions,
+) error {
+	_, err := writeBlobStatusCryptoAPI(blob, fingerprintHexUpper, registryBase, storeKey, opts)
+
+	return err
+}
+
+// writeBlobStatusCryptoAPI is like writeBlobCryptoAPI, and also returns
+// whether the blob reached the registry, even if a later step failed.
+func writeBlobStatusCryptoAPI(blob certblob.Blob, fingerprintHexUpper string,
+	registryBase registry.Key, storeKey string, opts *InjectOptions,
+) (bool, error) {
+	blobBuf, _ := blobBufPool.Get().(*[]byte)
+	defer blobBufPool.Put(blobBuf)
+
+	// Marshal the Blob
+	blobBytes, err := blob.MarshalAppend((*blobBuf)[:0])
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't marshal cert blob: %w", err, ErrPropertyMarshal)
+	}
+
+	*blobBuf = blobBytes
+
+	// Check the size up front, since the registry's own error for an
+	// oversized value doesn't say what's wrong.
+	if len(blobBytes) > maxRegistryValueBytes {
+		return false, fmt.Errorf("couldn't write cert blob to the registry: %d bytes exceeds limit of %d bytes: %w",
+			len(blobBytes), maxRegistryValueBytes, ErrBlobTooLargeToWrite)
+	}
+
+	// Open up the cert store.
+	certStoreKey, err := reg.OpenKey(reg.Root(registryBase, opts.registryView), storeKey, registry.ALL_ACCESS)
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer certStoreKey.Close()
+
+	// Create the registry key in which we will store the cert.
+	// The 2nd result of CreateKey is openedExisting, which tells us if the cert already existed.
+	// This doesn't matter to us.  If true, the "last modified" metadata won't update,
+	// but we delete and recreate the magic value inside it if anything changed.
+	certKey, _, err := reg.CreateKey(certStoreKey, fingerprintHexUpper, registry.ALL_ACCESS)
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't create registry key for certificate: %w", err, ErrRegistryWrite)
+	}
+	defer certKey.Close()
+
+	// Check for magic value indicating we should skip this cert
+	if opts.SkipMagicName != "" && hasMagic(certKey, opts.SkipMagicName, opts.SkipMagicData) {
+		// Magic value detected.  Skip.
+		return false, nil
+	}
+
+	// Set the ACL even if the values are unchanged, so that re-injecting a
+	// cert with SecureACL secures it.
+	if opts.SecureACL {
+		err = certKey.SetDACL(secureACLSDDL)
+		if err != nil {
+			return false, fmt.Errorf("%w: couldn't set ACL of certificate registry key: %w", err, ErrRegistryWrite)
+		}
+	}
+
+	if registryValuesUnchanged(certKey, blobBytes, opts) {
+		// Nothing to do; leave the "last modified" metadata alone so that
+		// a no-op run really is a no-op.
+		return false, nil
+	}
+
+	err = applyRegistryValues(certKey, blobBytes, opts)
+	if err != nil {
+		return false, err
+	}
+
+	logInjectedCert(blob, fingerprintHexUpper, registryBase, storeKey)
+
+	return true, nil
+}
+
+// logInjectedCert logs an audit record of a cert that was just written to the
+// registry.
+func logInjectedCert(blob certblob.Blob, fingerprintHexUpper string, registryBase registry.Key, storeKey string) {
+	for _, id := range blob.PropertyIDs() {
+		log.Tracef("%s: property %d is %d bytes", displayFingerprint(fingerprintHexUpper), id, len(blob[id]))
+	}
+
+	cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
+	if err != nil {
+		log.Debugf("Couldn't parse injected cert %s for logging: %s", displayFingerprint(fingerprintHexUpper), err)
+		log.Infof("Injected %s into %s\\%s", displayFingerprint(fingerprintHexUpper), rootKeyName(registryBase),
+			storeKey)
+
+		return
+	}
+
+	log.Infof("Injected %s into %s\\%s: subject %q, issuer %q, serial %s, expires %s",
+		displayFingerprint(fingerprintHexUpper), rootKeyName(registryBase), storeKey, cert.Subject.CommonName,
+		cert.Issuer.CommonName, cert.SerialNumber.Text(16), cert.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// checkSuitabilityCryptoAPI refuses to inject a cert that isn't a CA cert
+// into a logical store whose certs are trusted as issuers, unless the
+// AllowLeafInRoot option is set.  This is almost always a mistake, and
+// trusts the cert's key to issue certs for any name.
+func checkSuitabilityCryptoAPI(derBytes []byte, storeKey string, opts *InjectOptions) error {
+	logical := logicalStoreOfKey(storeKey)
+
+	switch strings.ToLower(logical) {
+	case "root", "authroot", "ca":
+	default:
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't parse cert: %w", err, ErrBadCert)
+	}
+
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return nil
+	}
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	if !opts.AllowLeafInRoot {
+		return fmt.Errorf("%s isn't a CA cert; refusing to inject it into the %s logical store "+
+			"(consider capi.allow-leaf-in-root): %w",
+			displayFingerprint(fingerprintHexUpper), logical, ErrUnsuitableCert)
+	}
+
+	log.Warnf("INJECTING NON-CA CERT %s (subject %q) INTO THE %s LOGICAL STORE; ITS KEY WILL BE TRUSTED "+
+		"TO ISSUE CERTS", displayFingerprint(fingerprintHexUpper), cert.Subject.CommonName, logical)
+
+	return nil
+}
+
+// checkChainCryptoAPI implements the VerifyChain option.  It only applies
+// when injecting into the CA logical store.
+func checkChainCryptoAPI(derBytes []byte, registryBase registry.Key, storeKey string,
+	opts *InjectOptions,
+) error {
+	switch opts.VerifyChain {
+	case "":
+		return nil
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("invalid choice for capi.verify-chain %q (consider warn, fail): %w",
+			opts.VerifyChain, ErrInvalidOption)
+	}
+
+	if !strings.EqualFold(logicalStoreOfKey(storeKey), "CA") {
+		return nil
+	}
+
+	err := verifyChainToRootStore(derBytes, registryBase, opts.registryView, siblingStoreKey(storeKey, "Root"),
+		opts.maxBlobBytes())
+	if err != nil && opts.VerifyChain == "warn" {
+		log.Warnf("%s", err)
+
+		return nil
+	}
+
+	return err
+}
+
+// verifyChainToRootStore returns an error wrapping ErrChainVerify if the cert
+// doesn't chain to any cert in the specified Root store, in the given registry
+// view.  Blobs larger than maxBlobBytes are skipped.
+func verifyChainToRootStore(derBytes []byte, registryBase registry.Key, view uint32, rootStoreKey string,
+	maxBlobBytes int,
+) error {
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't parse cert: %w", err, ErrBadCert)
+	}
+
+	roots, err := storeCertPool(registryBase, view, rootStoreKey, maxBlobBytes)
+	if err != nil {
+		return err
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s doesn't chain to the Root store: %w", err,
+			fingerprintHexUpperCryptoAPI(derBytes), ErrChainVerify)
+	}
+
+	return nil
+}
+
+// storeCertPool returns a pool of all parseable certs in the specified store,
+// in the given registry view.  A missing store yields an empty pool.
+func storeCertPool(registryBase registry.Key, view uint32, storeKey string, maxBlobBytes int,
+) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	fingerprintHexUpperList, err := allFingerprintsInStore(registryBase, view, storeKey)
+	if errors.Is(err, registry.ErrNotExist) {
+		return pool, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fingerprintHexUpper := range fingerprintHexUpperList {
+		certKey, err := reg.OpenKey(reg.Root(registryBase, view), storeKey+`\`+fingerprintHexUpper,
+			registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+
+		blob, err := readBlobValue(certKey, maxBlobBytes)
+		certKey.Close()
+
+		if err != nil {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
+		if err != nil {
+			continue
+		}
+
+		pool.AddCert(cert)
+	}
+
+	return pool, nil
+}
+
+// registryValuesUnchanged returns true if the cert key already holds exactly
+// the blob and magic tag that applyRegistryValues would write.
+func registryValuesUnchanged(certKey regKey, blobBytes []byte, opts *InjectOptions) bool {
+	oldBlobBytes, _, err := certKey.GetBinaryValue(opts.blobValueName())
+	if err != nil || !bytes.Equal(oldBlobBytes, blobBytes) {
+		return false
+	}
+
+	for name, value := range timeValues(blobBytes, opts) {
+		old, _, err := certKey.GetIntegerValue(name)
+		if err != nil || old != value {
+			return false
+		}
+	}
+
+	if opts.ExpiresAt.IsZero() {
+		if _, ok := readTimeValue(certKey, expiryValueName); ok {
+			return false
+		}
+	}
+
+	if !metaUnchanged(certKey, opts) {
+		return false
+	}
+
+	if opts.MagicName == "" {
+		return true
+	}
+
+	return hasMagic(certKey, opts.MagicName, opts.MagicData)
+}
+
+// injectMagicName returns the magic tag name to set on injected certs: the
+// -set-magic-name flag, or "" if the -no-magic flag is set.  Only injection
+// honors -no-magic; listing, cleanup, and purging still look for the
+// -set-magic-name tag, so certs injected with -no-magic are invisible to them.
+// Callers must hold flagMu.
+func injectMagicName() string {
+	if noMagic.Value() {
+		return ""
+	}
+
+	return setMagicName.Value()
+}
+
+// hasMagic returns true if the cert key carries a magic tag with the given
+// name and data.
+func hasMagic(certKey regKey, name string, data int) bool {
+	magic, _, err := certKey.GetIntegerValue(name)
+
+	return err == nil && magic == uint64(data)
+}
+
+func applyRegistryValues(certKey regKey, blobBytes []byte, opts *InjectOptions) error {
+	err := applyTagValues(certKey, blobBytes, opts)
+	if err != nil {
+		return err
+	}
+
+	// Create the registry value which holds the certificate.
+	err = certKey.SetBinaryValue(opts.blobValueName(), blobBytes)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't set %s registry value for certificate: %w", err, opts.blobValueName(),
+			ErrRegistryWrite)
+	}
+
+	return nil
+}
+
+// applyTagValues writes the registry values that certinject keeps alongside
+// the blob: the magic tag, the time values, and the metadata record.
+func applyTagValues(certKey regKey, blobBytes []byte, opts *InjectOptions) error {
+	var err error
+
+	if opts.MagicName != "" {
+		err = applyMagic(certKey, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, value := range timeValues(blobBytes, opts) {
+		err = certKey.SetQWordValue(name, value)
+		if err != nil {
+			return fmt.Errorf("%w: couldn't set %s registry value for certificate: %w", err, name,
+				ErrRegistryWrite)
+		}
+	}
+
+	// An earlier injection's expiry time no longer applies.
+	if opts.ExpiresAt.IsZero() {
+		err = certKey.DeleteValue(expiryValueName)
+		if err != nil && !errors.Is(err, registry.ErrNotExist) {
+			return fmt.Errorf("%w: couldn't delete %s registry value for certificate: %w", err, expiryValueName,
+				ErrRegistryWrite)
+		}
+	}
+
+	return applyInjectMeta(certKey, opts)
+}
+
+// Add an extra registry value that serves as a "magic tag".  This will be
+// ignored by CryptoAPI, but can be recognized by software that knows to look
+// for it.  Example uses:
+//
+//   - Indicating that a certificate is a Namecoin dehydrated certificate, and
+//     should be deleted once it reaches a certain age to avoid leaving browsing
+//     history in the registry.
+//   - Indicating that a certificate is a Namecoin root certificate, and should
+//     be exempt from a Namecoin name constraint exclusion that is applied to all
+//     other root CA's.
+func applyMagic(certKey regKey, opts *InjectOptions) error {
+	// We delete it before we create it, so that the "last modified" metadata
+	// gets updated, which is what TouchCert relies on.  Injection only gets
+	// here if the blob or magic tag actually changed (see
+	// registryValuesUnchanged), so re-injecting an unchanged cert no longer
+	// refreshes its age.  If an error occurs during deletion, we ignore it,
+	// since it probably just means it wasn't there already.  In watch mode, we
+	// don't do this, since it would cause an infinite loop.
+	if !opts.watch {
+		_ = certKey.DeleteValue(opts.MagicName)
+	}
+
+	err := certKey.SetDWordValue(opts.MagicName, uint32(opts.MagicData))
+	if err != nil {
+		return fmt.Errorf("%w: couldn't apply magic '%s'='%d': %w", err,
+			opts.MagicName, uint32(opts.MagicData), ErrSetMagic)
+	}
+
+	return nil
+}
+
+func editBlob(blob certblob.Blob, storeKey string, opts *InjectOptions) error {
+	err := editBlobEKU(blob, opts)
+	if err != nil {
+		return err
+	}
+
+	err = editBlobNameConstraints(blob, opts)
+	if err != nil {
+		return err
+	}
+
+	err = editBlobKeyIdentifier(blob, storeKey, opts)
+	if err != nil {
+		return err
+	}
+
+	err = editBlobFriendlyName(blob, opts)
+	if err != nil {
+		return err
+	}
+
+	err = editBlobDescription(blob, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, prop := range opts.RawProperties {
+		blob.SetProperty(prop)
+	}
+
+	return nil
+}
+
+// editBlobFriendlyName sets the friendly name property if one was specified.
+// Otherwise, any existing friendly name (e.g. set by the user in certmgr) is
+// kept; it's only cleared by a reset.
+func editBlobFriendlyName(blob certblob.Blob, opts *InjectOptions) error {
+	return editBlobString(blob, opts.FriendlyName, certblob.CertFriendlyNamePropID, "friendly name",
+		certblob.BuildFriendlyName, certblob.ParseFriendlyName)
+}
+
+// editBlobDescription is like editBlobFriendlyName, for the description
+// property.
+func editBlobDescription(blob certblob.Blob, opts *InjectOptions) error {
+	return editBlobString(blob, opts.Description, certblob.CertDescriptionPropID, "description",
+		certblob.BuildDescription, certblob.ParseDescription)
+}
+
+// editBlobString sets a string property to text if it's non-empty, and
+// otherwise keeps any existing value.
+func editBlobString(blob certblob.Blob, text string, id uint32, what string,
+	build func(string) (*certblob.Property, error), parse func(*certblob.Property) (string, error),
+) error {
+	if text == "" {
+		existing, ok := blob[id]
+		if ok {
+			existingText, err := parse(&certblob.Property{ID: id, Value: existing})
+			if err == nil {
+				log.Debugf("Keeping existing %s %q", what, existingText)
+			}
+		}
+
+		return nil
+	}
+
+	prop, err := build(text)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't marshal %s property: %w", err, what, ErrPropertyMarshal)
+	}
+
+	blob.SetProperty(prop)
+
+	return nil
+}
+
+func editBlobKeyIdentifier(blob certblob.Blob, storeKey string, opts *InjectOptions) error {
+	switch opts.SetKeyIdentifier {
+	case "false":
+		return nil
+	case "auto", "":
+		if !isCAStoreKey(storeKey) {
+			return nil
+		}
+	case "true":
+	default:
+		return fmt.Errorf("invalid choice for capi.set-ski %q (consider auto, true, false): %w",
+			opts.SetKeyIdentifier, ErrInvalidOption)
+	}
+
+	cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
+	if err != nil {
+		return fmt.Errorf("%w: couldn't parse cert for key identifier: %w", err, ErrEditBlob)
+	}
+
+	keyIdentifierProperty, err := certblob.BuildKeyIdentifier(cert)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't marshal key identifier property: %w", err, ErrPropertyMarshal)
+	}
+
+	blob.SetProperty(keyIdentifierProperty)
+
+	return nil
+}
+
+// isCAStoreKey returns true if storeKey is the key of a logical store that
+// holds CA certs (Root, AuthRoot or CA).
+func isCAStoreKey(storeKey string) bool {
+	logical := logicalStoreOfKey(storeKey)
+
+	return strings.EqualFold(logical, "Root") || strings.EqualFold(logical, "AuthRoot") ||
+		strings.EqualFold(logical, "CA")
+}
+
+// logicalStoreOfKey returns the logical store name within a store key of the
+// form ...\<logical>\Certificates, or "" if storeKey doesn't have that form.
+func logicalStoreOfKey(storeKey string) string {
+	parts := strings.Split(storeKey, `\`)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[len(parts)-2]
+}
+
+// siblingStoreKey returns the key of the given logical store in the same
+// physical store as storeKey.
+func siblingStoreKey(storeKey, logical string) string {
+	parts := strings.Split(storeKey, `\`)
+	if len(parts) < 2 {
+		return storeKey
+	}
+
+	parts[len(parts)-2] = logical
+
+	return strings.Join(parts, `\`)
+}
+
+// parseRawProperties parses a comma-separated list of propid:hexbytes pairs.
+// The propid may be decimal or 0x-prefixed hex.  Returned errors wrap
+// ErrInvalidOption if val is malformed.
+func parseRawProperties(val string) ([]*certblob.Property, error) {
+	props := []*certblob.Property{}
+
+	if val == "" {
+		return props, nil
+	}
+
+	for _, pair := range strings.Split(val, ",") {
+		idString, valueHex, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("raw property %q is not propid:hexbytes: %w", pair, ErrInvalidOption)
+		}
+
+		id, err := strconv.ParseUint(idString, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: raw property %q has invalid propid: %w", err, pair, ErrInvalidOption)
+		}
+
+		value, err := hex.DecodeString(valueHex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: raw property %q has invalid hex: %w", err, pair, ErrInvalidOption)
+		}
+
+		props = append(props, &certblob.Property{ID: uint32(id), Value: value})
+	}
+
+	return props, nil
+}
+
+func editBlobEKU(blob certblob.Blob, opts *InjectOptions) error {
+	ekus := opts.ExtKeyUsages
+
+	if opts.NoExtKeyUsage {
+		if len(ekus) != 0 {
+			return fmt.Errorf("capi.eku-none can't be combined with eku.* flags: %w", ErrInvalidOption)
+		}
+
+		ekuProperty, err := certblob.BuildEmptyExtKeyUsage()
+		if err != nil {
+			return fmt.Errorf("%w: couldn't marshal extended key usage property: %w", err, ErrPropertyMarshal)
+		}
+
+		blob.SetProperty(ekuProperty)
+
+		return nil
+	}
+
+	if len(ekus) == 0 {
+		return nil
+	}
+
+	ekuTemplate := x509.Certificate{
+		ExtKeyUsage: ekus,
+	}
+
+	ekuProperty, err := certblob.BuildExtKeyUsage(&ekuTemplate)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't marshal extended key usage property: %w", err, ErrPropertyMarshal)
+	}
+
+	blob.SetProperty(ekuProperty)
+
+	return nil
+}
+
+func buildEKUList() []x509.ExtKeyUsage {
+	ekus := []x509.ExtKeyUsage{}
+
+	appendToEKUList(&ekus, ekuAny.Value(), x509.ExtKeyUsageAny)
+	appendToEKUList(&ekus, ekuServer.Value(), x509.ExtKeyUsageServerAuth)
+	appendToEKUList(&ekus, ekuClient.Value(), x509.ExtKeyUsageClientAuth)
+	appendToEKUList(&ekus, ekuCode.Value(), x509.ExtKeyUsageCodeSigning)
+	appendToEKUList(&ekus, ekuEmail.Value(), x509.ExtKeyUsageEmailProtection)
+	appendToEKUList(&ekus, ekuIPSECEndSystem.Value(), x509.ExtKeyUsageIPSECEndSystem)
+	appendToEKUList(&ekus, ekuIPSECTunnel.Value(), x509.ExtKeyUsageIPSECTunnel)
+	appendToEKUList(&ekus, ekuIPSECUser.Value(), x509.ExtKeyUsageIPSECUser)
+	appendToEKUList(&ekus, ekuTime.Value(), x509.ExtKeyUsageTimeStamping)
+	appendToEKUList(&ekus, ekuOCSP.Value(), x509.ExtKeyUsageOCSPSigning)
+	appendToEKUList(&ekus, ekuMSCodeCom.Value(), x509.ExtKeyUsageMicrosoftCommercialCodeSigning)
+	appendToEKUList(&ekus, ekuMSCodeKernel.Value(), x509.ExtKeyUsageMicrosoftKernelCodeSigning)
+
+	return ekus
+}
+
+func appendToEKUList(ekus *[]x509.ExtKeyUsage, enable bool, usage x509.ExtKeyUsage) {
+	if enable {
+		*ekus = append(*ekus, usage)
+	}
+}
+
+func editBlobNameConstraints(blob certblob.Blob, opts *InjectOptions) error {
+	nameConstraintsTemplate := opts.NameConstraints
+
+	if opts.NameConstraintsFromCert {
+		cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
+		if err != nil {
+			return fmt.Errorf("%w: couldn't parse cert for name constraints: %w", err, ErrEditBlob)
+		}
+
+		nameConstraintsTemplate = overlayNameConstraints(cert, nameConstraintsTemplate)
+	}
+
+	if hasNameConstraints(nameConstraintsTemplate) {
+		// Work on a copy, since merging and building the property both
+		// modify the template.
+		nameConstraintsTemplate = overlayNameConstraints(nameConstraintsTemplate, nil)
+
+		if opts.NameConstraintsMerge {
+			err := mergeExistingNameConstraints(blob, nameConstraintsTemplate)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, ipNet := range mismatchedIPFamilies(nameConstraintsTemplate) {
+			log.Warnf("Excluded IP range %s has no effect, since no %s range is permitted; "+
+				"did you mean to permit or exclude a range of the other family?", ipNet, ipFamily(ipNet))
+		}
+
+		nameConstraintsProperty, err := certblob.BuildNameConstraints(nameConstraintsTemplate)
+		if err != nil {
+			return fmt.Errorf("%w: couldn't marshal name constraints property: %w", err, ErrPropertyMarshal)
+		}
+
+		blob.SetProperty(nameConstraintsProperty)
+	}
+
+	return nil
+}
+
+// mergeExistingNameConstraints adds the blob's existing name constraints (if
+// any) to the template, skipping duplicates.
+func mergeExistingNameConstraints(blob certblob.Blob, template *x509.Certificate) error {
+	existingValue, ok := blob[certblob.CertRootProgramNameConstraintsPropID]
+	if !ok {
+		return nil
+	}
+
+	existing, err := certblob.ParseNameConstraints(&certblob.Property{
+		ID:    certblob.CertRootProgramNameConstraintsPropID,
+		Value: existingValue,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: couldn't parse existing name constraints: %w", err, ErrEditBlob)
+	}
+
+	template.PermittedDNSDomains = mergeNameConstraintsStrings(existing.PermittedDNSDomains,
+		template.PermittedDNSDomains)
+	template.ExcludedDNSDomains = mergeNameConstraintsStrings(existing.ExcludedDNSDomains,
+		template.ExcludedDNSDomains)
+	template.PermittedIPRanges = mergeNameConstraintsIPRanges(existing.PermittedIPRanges,
+		template.PermittedIPRanges)
+	template.ExcludedIPRanges = mergeNameConstraintsIPRanges(existing.ExcludedIPRanges,
+		template.ExcludedIPRanges)
+	template.PermittedEmailAddresses = mergeNameConstraintsStrings(existing.PermittedEmailAddresses,
+		template.PermittedEmailAddresses)
+	template.ExcludedEmailAddresses = mergeNameConstraintsStrings(existing.ExcludedEmailAddresses,
+		template.ExcludedEmailAddresses)
+	template.PermittedURIDomains = mergeNameConstraintsStrings(existing.PermittedURIDomains,
+		template.PermittedURIDomains)
+	template.ExcludedURIDomains = mergeNameConstraintsStrings(existing.ExcludedURIDomains,
+		template.ExcludedURIDomains)
+
+	return nil
+}
+
+func mergeNameConstraintsStrings(existing, added []string) []string {
+	result := append([]string{}, existing...)
+
+	for _, a := range added {
+		duplicate := false
+
+		for _, e := range existing {
+			if strings.EqualFold(a, e) {
+				duplicate = true
+
+				break
+			}
+		}
+
+		if !duplicate {
+			result = append(result, a)
+		}
+	}
+
+	return result
+}
+
+func mergeNameConstraintsIPRanges(existing, added []*net.IPNet) []*net.IPNet {
+	result := append([]*net.IPNet{}, existing...)
+
+	for _, a := range added {
+		duplicate := false
+
+		for _, e := range existing {
+			if a.String() == e.String() {
+				duplicate = true
+
+				break
+			}
+		}
+
+		if !duplicate {
+			result = append(result, a)
+		}
+	}
+
+	return result
+}
+
+// nameConstraintsFlagsTemplate builds a template from the nc.* flags, or
+// returns nil if none of them are set.
+func nameConstraintsFlagsTemplate() (*x509.Certificate, error) {
+	nameConstraintsValid := false
+	nameConstraintsTemplate := x509.Certificate{}
+
+	setNameConstraintsStrings(
+		&nameConstraintsTemplate.PermittedDNSDomains,
+		nameConstraintsPermittedDNS.Value(), &nameConstraintsValid)
+
+	setNameConstraintsStrings(
+		&nameConstraintsTemplate.ExcludedDNSDomains,
+		nameConstraintsExcludedDNS.Value(), &nameConstraintsValid)
+
+	err := setNameConstraintsIPRanges(
+		&nameConstraintsTemplate.PermittedIPRanges,
+		nameConstraintsPermittedIP.Value(), &nameConstraintsValid)
+	if err != nil {
+		return nil, fmt.Errorf("permitted: %w", err)
+	}
+
+	err = setNameConstraintsIPRanges(
+		&nameConstraintsTemplate.ExcludedIPRanges,
+		nameConstraintsExcludedIP.Value(), &nameConstraintsValid)
+	if err != nil {
+		return nil, fmt.Errorf("excluded: %w", err)
+	}
+
+	err = setNameConstraintsEmails(
+		&nameConstraintsTemplate.PermittedEmailAddresses,
+		nameConstraintsPermittedEmail.Value(), &nameConstraintsValid)
+	if err != nil {
+		return nil, fmt.Errorf("permitted: %w", err)
+	}
+
+	err = setNameConstraintsEmails(
+		&nameConstraintsTemplate.ExcludedEmailAddresses,
+		nameConstraintsExcludedEmail.Value(), &nameConstraintsValid)
+	if err != nil {
+		return nil, fmt.Errorf("excluded: %w", err)
+	}
+
+	setNameConstraintsStrings(
+		&nameConstraintsTemplate.PermittedURIDomains,
+		nameConstraintsPermittedURI.Value(), &nameConstraintsValid)
+
+	setNameConstraintsStrings(
+		&nameConstraintsTemplate.ExcludedURIDomains,
+		nameConstraintsExcludedURI.Value(), &nameConstraintsValid)
+
+	if !nameConstraintsValid {
+		return nil, nil
+	}
+
+	return &nameConstraintsTemplate, nil
+}
+
+// overlayNameConstraints returns a new template with the name constraints of
+// base, where each field that is set in overrides replaces the corresponding
+// field.  Either argument may be nil.
+func overlayNameConstraints(base, overrides *x509.Certificate) *x509.Certificate {
+	result := &x509.Certificate{}
+
+	if base != nil {
+		result.PermittedDNSDomains = base.PermittedDNSDomains
+		result.ExcludedDNSDomains = base.ExcludedDNSDomains
+		result.PermittedIPRanges = base.PermittedIPRanges
+		result.ExcludedIPRanges = base.ExcludedIPRanges
+		result.PermittedEmailAddresses = base.PermittedEmailAddresses
+		result.ExcludedEmailAddresses = base.ExcludedEmailAddresses
+		result.PermittedURIDomains = base.PermittedURIDomains
+		result.ExcludedURIDomains = base.ExcludedURIDomains
+	}
+
+	if overrides == nil {
+		return result
+	}
+
+	overlayNameConstraintsStrings(&result.PermittedDNSDomains, overrides.PermittedDNSDomains)
+	overlayNameConstraintsStrings(&result.ExcludedDNSDomains, overrides.ExcludedDNSDomains)
+
+	if len(overrides.PermittedIPRanges) != 0 {
+		result.PermittedIPRanges = overrides.PermittedIPRanges
+	}
+
+	if len(overrides.ExcludedIPRanges) != 0 {
+		result.ExcludedIPRanges = overrides.ExcludedIPRanges
+	}
+
+	overlayNameConstraintsStrings(&result.PermittedEmailAddresses, overrides.PermittedEmailAddresses)
+	overlayNameConstraintsStrings(&result.ExcludedEmailAddresses, overrides.ExcludedEmailAddresses)
+	overlayNameConstraintsStrings(&result.PermittedURIDomains, overrides.PermittedURIDomains)
+	overlayNameConstraintsStrings(&result.ExcludedURIDomains, overrides.ExcludedURIDomains)
+
+	return result
+}
+
+func overlayNameConstraintsStrings(ncs *[]string, overrides []string) {
+	if len(overrides) != 0 {
+		*ncs = overrides
+	}
+}
+
+// hasNameConstraints returns true if any name constraints field of template
+// is set.
+func hasNameConstraints(template *x509.Certificate) bool {
+	if template == nil {
+		return false
+	}
+
+	return len(template.PermittedDNSDomains) != 0 || len(template.ExcludedDNSDomains) != 0 ||
+		len(template.PermittedIPRanges) != 0 || len(template.ExcludedIPRanges) != 0 ||
+		len(template.PermittedEmailAddresses) != 0 || len(template.ExcludedEmailAddresses) != 0 ||
+		len(template.PermittedURIDomains) != 0 || len(template.ExcludedURIDomains) != 0
+}
+
+func setNameConstraintsStrings(ncs *[]string, val string, valid *bool) {
+	if val != "" {
+		*ncs = []string{val}
+		*valid = true
+	}
+}
+
+func setNameConstraintsIPRanges(ncs *[]*net.IPNet, val string, valid *bool) error {
+	if val != "" {
+		ipNets, err := parseIPRanges(val)
+		if err != nil {
+			return err
+		}
+
+		*ncs = ipNets
+		*valid = true
+	}
+
+	return nil
+}
+
+func setNameConstraintsEmails(ncs *[]string, val string, valid *bool) error {
+	if val != "" {
+		emails, err := parseEmailConstraints(val)
+		if err != nil {
+			return err
+		}
+
+		*ncs = emails
+		*valid = true
+	}
+
+	return nil
+}
+
+// parseEmailConstraints parses a comma-separated list of email constraints
+// into the forms defined by RFC 5280: a full address constrains that mailbox,
+// a domain constrains all mailboxes at that host, and a domain with a leading
+// period constrains all mailboxes in its subdomains.  The @domain form that
+// users often write is converted to the bare domain, since RFC 5280 doesn't
+// allow an empty local part.  Domains are lowercased.  Returned errors wrap
+// ErrInvalidOption if a constraint is malformed.
+func parseEmailConstraints(val string) ([]string, error) {
+	emails := []string{}
+
+	for _, email := range strings.Split(val, ",") {
+		email = strings.TrimSpace(email)
+
+		local, domain, hasLocal := strings.Cut(email, "@")
+		if !hasLocal {
+			domain = local
+			local = ""
+		}
+
+		subdomains := !hasLocal && strings.HasPrefix(domain, ".")
+		if subdomains {
+			domain = domain[1:]
+		}
+
+		domain = strings.ToLower(domain)
+
+		if !validEmailDomain(domain) || strings.ContainsAny(local, " \t\"<>@") {
+			return nil, fmt.Errorf("%q: invalid email constraint: %w", email, ErrInvalidOption)
+		}
+
+		switch {
+		case local != "":
+			emails = append(emails, local+"@"+domain)
+		case subdomains:
+			emails = append(emails, "."+domain)
+		default:
+			emails = append(emails, domain)
+		}
+	}
+
+	return emails, nil
+}
+
+// validEmailDomain returns true if domain is a non-empty sequence of
+// period-separated labels of letters, digits and hyphens.
+func validEmailDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// parseIPRanges parses a comma-separated list of IP ranges.  Each range is
+// either CIDR notation or a bare IP, which is treated as a single host (/32
+// for IPv4, /128 for IPv6).  Returned errors wrap ErrInvalidOption if a range
+// can't be parsed.
+func parseIPRanges(val string) ([]*net.IPNet, error) {
+	ipNets := []*net.IPNet{}
+
+	for _, ipRange := range strings.Split(val, ",") {
+		ipRange = strings.TrimSpace(ipRange)
+
+		if !strings.Contains(ipRange, "/") {
+			ip := net.ParseIP(ipRange)
+			if ip == nil {
+				return nil, fmt.Errorf("%q: couldn't parse IP: %w", ipRange, ErrInvalidOption)
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't parse IP CIDR: %w", err, ErrInvalidOption)
+		}
+
+		ipNets = append(ipNets, ipNet)
+	}
+
+	return ipNets, nil
+}
+
+// mismatchedIPFamilies returns the excluded IP ranges of template whose
+// address family has no permitted range.  If any range is permitted, all
+// addresses of the other family are already rejected, so such exclusions
+// have no effect, and usually mean that the wrong family was given.
+func mismatchedIPFamilies(template *x509.Certificate) []*net.IPNet {
+	if len(template.PermittedIPRanges) == 0 {
+		return nil
+	}
+
+	permitted := map[string]bool{}
+	for _, ipNet := range template.PermittedIPRanges {
+		permitted[ipFamily(ipNet)] = true
+	}
+
+	mismatched := []*net.IPNet{}
+
+	for _, ipNet := range template.ExcludedIPRanges {
+		if !permitted[ipFamily(ipNet)] {
+			mismatched = append(mismatched, ipNet)
+		}
+	}
+
+	return mismatched
+}
+
+// ipFamily returns "IPv4" or "IPv6", depending on the length of the range's
+// mask.
+func ipFamily(ipNet *net.IPNet) string {
+	if len(ipNet.Mask) == net.IPv4len {
+		return "IPv4"
+	}
+
+	return "IPv6"
+}
+
+// CleanCertsCryptoAPI removes expired certs (and CTLs injected by InjectCTL)
+// from the CryptoAPI store configured by flags.  The flags are read when it
+// starts, so changing them with WithFlags doesn't affect a cleanup that's
+// already running.
+//
+// Returned errors wrap ErrInvalidStore if the configured store or the -expire
+// flag is invalid, ErrStoreOpen if the store can't be opened,
+// ErrEnumerateCerts if the certs in the store can't be listed or checked,
+// ErrRegistryWrite if an expired cert can't be deleted, and ErrTimeout if the
+// -capi.timeout flag is set and cleanup doesn't finish in time.
+func CleanCertsCryptoAPI() error {
+	flagMu.RLock()
+
+	store, err := cryptoAPIFlagStore()
+	if err != nil {
+		flagMu.RUnlock()
+
+		return err
+	}
+
+	opts, err := cleanOptionsFromFlagsLocked()
+	flagMu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	return withTimeout(func() error {
+		_, err := cleanStoreCryptoAPI(store, &opts)
+
+		return err
+	})
+}
+
+// timeoutDuration returns the -timeout flag as a time.Duration, or 0 if
+// there's no timeout.  Returned errors wrap ErrInvalidOption if the flag
+// can't be parsed.
+func timeoutDuration() (time.Duration, error) {
+	flagMu.RLock()
+	value := timeout.Value()
+	flagMu.RUnlock()
+
+	if value == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: %w", value, ErrInvalidOption)
+	}
+
+	return d, nil
+}
+
+// withTimeout calls fn, giving up with ErrTimeout if it doesn't return within
+// the -timeout flag's duration.  Registry calls can't be cancelled, so on
+// timeout fn keeps running in a leaked goroutine until the hung call returns
+// (if ever), and its result is discarded.  Since fn may still write to the
+// registry after ErrTimeout is returned, callers should treat the store's
+// state as unknown.
+func withTimeout(fn func() error) error {
+	d, err := timeoutDuration()
+	if err != nil {
+		return err
+	}
+
+	if d == 0 {
+		return fn()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	// Buffered, so that a leaked goroutine can still finish.
+	result := make(chan error, 1)
+
+	go func() {
+		result <- fn()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("gave up after %s: %w", d, ErrTimeout)
+	}
+}
+
+// CleanAllStores is like CleanCertsCryptoAPI, but cleans every known physical
+// store concurrently, and uses maxAge instead of the -expire flag.  Stores that
+// don't exist or can't be opened due to lack of privileges are logged and
+// skipped; errors from the other stores are combined.
+func CleanAllStores(maxAge time.Duration) error {
+	flagMu.RLock()
+	opts, err := cleanOptionsWithMaxAgeLocked(maxAge)
+	flagMu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	names := cryptoAPIStoreNames()
+
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+
+	for i, name := range names {
+		wg.Add(1)
+
+		go func(i int, name string) {
+			defer wg.Done()
+
+			store, err := cryptoAPINameToStore(name)
+			if err == nil {
+				_, err = cleanStoreCryptoAPI(store, &opts)
+			}
+
+			errs[i] = skipUnavailableStore(name, err)
+		}(i, name)
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// skipUnavailableStore logs and drops err if it means that the named store
+// doesn't exist or can't be opened due to lack of privileges.  Other errors
+// are returned with the store name added.
+func skipUnavailableStore(name string, err error) error {
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrStoreOpen) && errors.Is(err, windows.ERROR_ACCESS_DENIED):
+		log.Warnf("Skipping %s store: access denied", name)
+	case errors.Is(err, ErrStoreOpen) && errors.Is(err, registry.ErrNotExist):
+		log.Debugf("Skipping %s store: not found", name)
+	default:
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+// PurgeAllInjected removes every cert (and CTL) that carries the magic tag
+// set by the -set-magic-name and -set-magic-data flags from every known
+// logical store of every known physical store, regardless of age, e.g. for
+// uninstallation.  It returns the fingerprints of the removed certs.  If the
+// -purge-dry-run flag is set, the certs are only logged and returned, not
+// removed.  Stores that don't exist or can't be opened due to lack of
+// privileges are skipped; errors from the other stores are combined.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set, and
+// are otherwise the same as for CleanCertsCryptoAPI.
+func PurgeAllInjected() ([]string, error) {
+	flagMu.RLock()
+	flags, err := snapshotStoreFlagsLocked()
+	dryRun := purgeDryRun.Value()
+	flagMu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.magicName == "" {
+		return nil, ErrNoMagic
+	}
+
+	removed := []string{}
+	errs := []error{}
+
+	for _, name := range cryptoAPIStoreNames() {
+		store, err := cryptoAPINameToStore(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+
+			continue
+		}
+
+		for _, logical := range cryptoAPILogicalStores {
+			storeKeys := []string{store.LogicalKey(logical)}
+
+			// Injected CTLs are purged as well.
+			if ctlKey, err := ctlKeyOf(storeKeys[0]); err == nil {
+				storeKeys = append(storeKeys, ctlKey)
+			}
+
+			for _, storeKey := range storeKeys {
+				storeRemoved, err := purgeStoreCryptoAPI(store.Base, storeKey, &flags, dryRun)
+				removed = append(removed, storeRemoved...)
+
+				err = skipUnavailableStore(name+" "+logical, err)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// purgeStoreCryptoAPI removes every cert carrying the magic tag of flags from
+// the store, and returns their fingerprints.  If dryRun is set, nothing is
+// removed.
+func purgeStoreCryptoAPI(registryBase registry.Key, storeKey string, flags *storeFlags,
+	dryRun bool,
+) ([]string, error) {
+	access := uint32(registry.ALL_ACCESS)
+	if dryRun {
+		access = registry.ENUMERATE_SUB_KEYS
+	}
+
+	certStoreKey, err := reg.OpenKey(reg.Root(registryBase, flags.registryView), storeKey, access)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer certStoreKey.Close()
+
+	subKeys, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
+
+	removed := []string{}
+	errs := []error{}
+
+	for i, subKeyName := range subKeys {
+		logScanProgress(storeKey, subKeyName, i+1, len(subKeys))
+
+		certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
+		if err != nil {
+			// The cert may have been removed since we listed it.
+			continue
+		}
+
+		injected := hasMagic(certKey, flags.magicName, flags.magicData)
+		certKey.Close()
+
+		if !injected {
+			continue
+		}
+
+		if dryRun {
+			log.Infof("Would remove %s from %s", displayFingerprint(subKeyName), storeKey)
+
+			removed = append(removed, subKeyName)
+
+			continue
+		}
+
+		err = reg.DeleteKey(certStoreKey, subKeyName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: couldn't delete cert %s: %w",
+				err, displayFingerprint(subKeyName), ErrRegistryWrite))
+
+			continue
+		}
+
+		removed = append(removed, subKeyName)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// CleanCertsResult is like CleanCertsCryptoAPI, but cleans the given store
+// and reports what it did.  The result is valid even if an error is
+// returned.
+func CleanCertsResult(store Store) (CleanResult, error) {
+	flagMu.RLock()
+	opts, err := cleanOptionsFromFlagsLocked()
+	flagMu.RUnlock()
+
+	if err != nil {
+		return CleanResult{}, err
+	}
+
+	return cleanStoreCryptoAPI(store, &opts)
+}
+
+// cleanOptions are the flags that cleanup reads, snapshotted while holding
+// flagMu before it starts, so that cleanup doesn't read flags while it runs
+// (possibly in a goroutine that withTimeout gave up on).
+type cleanOptions struct {
+	// storeFlags are the logical stores to clean and the registry view to
+	// open them in.
+	storeFlags
+
+	// maxAge is how old an expirable cert's registry key may get; see the
+	// -expire flag.
+	maxAge time.Duration
+
+	// excluded is the set of fingerprints listed in the -clean-exclude-file
+	// flag's file.
+	excluded map[string]bool
+
+	// expirableMagicName and expirableMagicData are the expirable magic tag.
+	// An empty name disables cleanup.
+	expirableMagicName string
+	expirableMagicData int
+}
+
+// cleanOptionsFromFlagsLocked builds cleanOptions from the flags, for callers
+// that hold flagMu.  Returned errors wrap ErrInvalidStore if the -expire or
+// -registry-view flag is invalid, ErrInvalidOption if the -fingerprint-format
+// flag is unknown, and ErrCleanExcludeFile if the exclude file can't be read.
+func cleanOptionsFromFlagsLocked() (cleanOptions, error) {
+	maxAge, err := certExpireDuration()
+	if err != nil {
+		return cleanOptions{}, err
+	}
+
+	return cleanOptionsWithMaxAgeLocked(maxAge)
+}
+
+// cleanOptionsWithMaxAgeLocked is like cleanOptionsFromFlagsLocked, but uses
+// maxAge instead of the -expire flag.
+func cleanOptionsWithMaxAgeLocked(maxAge time.Duration) (cleanOptions, error) {
+	if err := snapshotLogFlagsLocked(); err != nil {
+		return cleanOptions{}, err
+	}
+
+	flags, err := snapshotStoreFlagsLocked()
+	if err != nil {
+		return cleanOptions{}, err
+	}
+
+	excluded, err := readCleanExcludeFile(cleanExcludeFile.Value())
+	if err != nil {
+		return cleanOptions{}, err
+	}
+
+	return cleanOptions{
+		storeFlags:         flags,
+		maxAge:             maxAge,
+		excluded:           excluded,
+		expirableMagicName: expirableMagicName.Value(),
+		expirableMagicData: expirableMagicData.Value(),
+	}, nil
+}
+
+// cleanStoreCryptoAPI removes expired certs from each of the store's logical
+// stores, except excluded ones.  Expired CTLs injected by InjectCTL are
+// removed as well, and counted in the result like certs.
+func cleanStoreCryptoAPI(store Store, opts *cleanOptions) (CleanResult, error) {
+	result := CleanResult{DeletedFingerprints: []string{}}
+	errs := []error{}
+
+	for _, logical := range opts.logicalStores {
+		storeKey := store.LogicalKey(logical)
+
+		errs = append(errs, cleanKeyCryptoAPI(store.Base, storeKey, opts, &result))
+
+		// Stores without a Certificates key have no CTLs.
+		if ctlKey, err := ctlKeyOf(storeKey); err == nil {
+			err = cleanKeyCryptoAPI(store.Base, ctlKey, opts, &result)
+
+			// The CTLs key usually doesn't exist.
+			if !errors.Is(err, ErrStoreOpen) || !errors.Is(err, registry.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// cleanKeyCryptoAPI implements cleanStoreCryptoAPI for a single registry key
+// containing certs or CTLs, adding to result.
+func cleanKeyCryptoAPI(registryBase registry.Key, storeKey string, opts *cleanOptions, result *CleanResult) error {
+	// Open up the cert store.
+	certStoreKey, err := reg.OpenKey(reg.Root(registryBase, opts.registryView), storeKey, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer certStoreKey.Close()
+
+	// get all subkey names in the cert store
+	subKeys, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
+
+	errs := []error{}
+
+	// for all certs in the cert store
+	for i, subKeyName := range subKeys {
+		result.Scanned++
+
+		logScanProgress(storeKey, subKeyName, i+1, len(subKeys))
+
+		// Check if the cert is expired
+		expired, err := checkCertExpired(certStoreKey, subKeyName, opts)
+		if err != nil {
+			result.Errored++
+
+			return fmt.Errorf("%w: couldn't check if cert is expired: %w", err, ErrEnumerateCerts)
+		}
+
+		if !expired {
+			continue
+		}
+
+		result.Expired++
+
+		if opts.excluded[normalizeFingerprintCryptoAPI(subKeyName)] {
+			log.Debugf("Keeping expired cert %s: it's excluded from cleanup", displayFingerprint(subKeyName))
+
+			result.Excluded++
+
+			continue
+		}
+
+		// delete the cert since it's expired
+		if err := deleteExpirableCert(certStoreKey, subKeyName, opts); err != nil {
+			result.Errored++
+			errs = append(errs, err)
+
+			continue
+		}
+
+		result.Deleted++
+		result.DeletedFingerprints = append(result.DeletedFingerprints, subKeyName)
+	}
+
+	return errors.Join(errs...)
+}
+
+// readCleanExcludeFile reads the set of normalized fingerprints listed in the
+// file at path, one per line (in any case, optionally separated by colons or
+// spaces).  Blank lines and lines starting with # are ignored.  If path is
+// empty, the set is empty.  Returned errors wrap ErrCleanExcludeFile if the
+// file can't be read or contains something other than a fingerprint.
+func readCleanExcludeFile(path string) (map[string]bool, error) {
+	excluded := map[string]bool{}
+
+	if path == "" {
+		return excluded, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", err, ErrCleanExcludeFile)
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fingerprintHexUpper := normalizeFingerprintCryptoAPI(line)
+		if !isFingerprintHex(fingerprintHexUpper) {
+			return nil, fmt.Errorf("%s:%d: %q isn't a SHA-1 fingerprint: %w", path, i+1, line,
+				ErrCleanExcludeFile)
+		}
+
+		excluded[fingerprintHexUpper] = true
+	}
+
+	return excluded, nil
+}
+
+// checkCertExpired is checkCertExpiredCryptoAPI, except in tests of the
+// deletion safeguard.
+var checkCertExpired = checkCertExpiredCryptoAPI
+
+// deleteExpirableCert deletes the cert, but only after re-reading its
+// expirable magic tag, so that cleanup can never delete a cert that isn't
+// ours, whatever the expiry check decided.
+func deleteExpirableCert(certStoreKey regKey, subKeyName string, opts *cleanOptions) error {
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open expired cert %s: %w",
+			err, displayFingerprint(subKeyName), ErrEnumerateCerts)
+	}
+
+	ours := opts.expirableMagicName != "" &&
+		hasMagic(certKey, opts.expirableMagicName, opts.expirableMagicData)
+	meta := readInjectMeta(certKey, subKeyName)
+	certKey.Close()
+
+	if !ours {
+		log.Errorf("Refusing to delete %s: it lacks the expirable magic tag", displayFingerprint(subKeyName))
+
+		return fmt.Errorf("%s: refusing to delete: %w", displayFingerprint(subKeyName), ErrMagicMismatch)
+	}
+
+	err = reg.DeleteKey(certStoreKey, subKeyName)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't delete expired cert %s: %w",
+			err, displayFingerprint(subKeyName), ErrRegistryWrite)
+	}
+
+	if meta != nil {
+		log.Debugf("Deleted expired cert %s, injected at %s by certinject %s from %s", displayFingerprint(subKeyName),
+			meta.InjectedAt.Format(time.RFC3339), meta.InjectorVersion, meta.Source)
+	}
+
+	return nil
+}
+
+// RunCleanupDaemon removes expired certs (see CleanCertsCryptoAPI) from the
+// store every interval, until ctx is cancelled.  Each pass's deletions and
+// errors are logged.
+func RunCleanupDaemon(ctx context.Context, store Store, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		result, err := CleanCertsResult(store)
+		if result.Deleted != 0 {
+			deleted := make([]string, 0, len(result.DeletedFingerprints))
+			for _, fingerprintHex := range result.DeletedFingerprints {
+				deleted = append(deleted, displayFingerprint(fingerprintHex))
+			}
+
+			log.Infof("Removed %d expired certs from %s: %s", result.Deleted, store, strings.Join(deleted, ", "))
+		}
+
+		if err != nil {
+			log.Errorf("Couldn't clean certs from %s: %s", store, err)
+		}
+	})
+}
+
+// ConfiguredStoreCryptoAPI returns the CryptoAPI store configured by flags,
+// e.g. for RunCleanupDaemon.  Returned errors wrap ErrInvalidStore if
+// CryptoAPI isn't enabled (see the -certstore.cryptoapi flag) or the
+// configured store is invalid.
+func ConfiguredStoreCryptoAPI() (Store, error) {
+	flagMu.RLock()
+	defer flagMu.RUnlock()
+
+	if !cryptoAPIFlag.Value() {
+		return Store{}, fmt.Errorf("CryptoAPI isn't enabled: %w", ErrInvalidStore)
+	}
+
+	return cryptoAPIFlagStore()
+}
+
+func cleanCertsCryptoAPI() {
+	err := CleanCertsCryptoAPI()
+	if err != nil {
+		log.Errorf("Couldn't clean certs: %s", err)
+	}
+}
+
+// RenewExpired is a variant of cleanup that, for each expired cert in the
+// store, asks provider for replacement DER bytes.  If provider returns ok,
+// the replacement is injected with the currently configured properties, and
+// the expired cert is removed if the replacement has a different
+// fingerprint; otherwise its age is reset, so that cleanup keeps it.  If
+// provider doesn't return ok, the expired cert is removed just like in
+// cleanup.  A cert that can't be checked or renewed doesn't stop the others
+// from being renewed.
+//
+// Returned errors are the same as for CleanCertsCryptoAPI and
+// InjectCertCryptoAPI, joined for every cert that failed, and also wrap
+// ErrNoMagic if a cert is renewed in place without the -set-magic-name flag.
+func RenewExpired(store Store, provider func(old CertInfo) ([]byte, bool)) error {
+	registryBase := store.Base
 
-	appendToEKUList(&ekus, ekuAny.Value(), x509.ExtKeyUsageAny)
-	appendToEKUList(&ekus, ekuServer.Value(), x509.ExtKeyUsageServerAuth)
-	appendToEKUList(&ekus, ekuClient.Value(), x509.ExtKeyUsageClientAuth)
-	appendToEKUList(&ekus, ekuCode.Value(), x509.ExtKeyUsageCodeSigning)
-	appendToEKUList(&ekus, ekuEmail.Value(), x509.ExtKeyUsageEmailProtection)
-	appendToEKUList(&ekus, ekuIPSECEndSystem.Value(), x509.ExtKeyUsageIPSECEndSystem)
-	appendToEKUList(&ekus, ekuIPSECTunnel.Value(), x509.ExtKeyUsageIPSECTunnel)
-	appendToEKUList(&ekus, ekuIPSECUser.Value(), x509.ExtKeyUsageIPSECUser)
-	appendToEKUList(&ekus, ekuTime.Value(), x509.ExtKeyUsageTimeStamping)
-	appendToEKUList(&ekus, ekuOCSP.Value(), x509.ExtKeyUsageOCSPSigning)
-	appendToEKUList(&ekus, ekuMSCodeCom.Value(), x509.ExtKeyUsageMicrosoftCommercialCodeSigning)
-	appendToEKUList(&ekus, ekuMSCodeKernel.Value(), x509.ExtKeyUsageMicrosoftKernelCodeSigning)
+	flagMu.RLock()
+
+	opts, err := injectOptionsFromFlagsLocked()
+	if err != nil {
+		flagMu.RUnlock()
+
+		return err
+	}
+
+	cleanOpts, err := cleanOptionsFromFlagsLocked()
+	flagMu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	opts.Store = store
+
+	storeKey, err := store.singleKey(opts.LogicalStores)
+	if err != nil {
+		return err
+	}
+
+	// Open up the cert store.
+	certStoreKey, err := reg.OpenKey(reg.Root(registryBase, opts.registryView), storeKey, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
+	}
+	defer certStoreKey.Close()
+
+	// get all subkey names in the cert store
+	subKeys, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
+
+	errs := []error{}
+
+	for _, subKeyName := range subKeys {
+		expired, err := checkCertExpiredCryptoAPI(certStoreKey, subKeyName, &cleanOpts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w: couldn't check if cert is expired: %w",
+				displayFingerprint(subKeyName), err, ErrEnumerateCerts))
+
+			continue
+		}
+
+		if !expired {
+			continue
+		}
+
+		err = renewCertCryptoAPI(certStoreKey, registryBase, storeKey, subKeyName, provider, &opts, &cleanOpts)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func renewCertCryptoAPI(certStoreKey regKey, registryBase registry.Key, storeKey, subKeyName string,
+	provider func(old CertInfo) ([]byte, bool), opts *InjectOptions, cleanOpts *cleanOptions,
+) error {
+	old, err := readCertInfo(certStoreKey, subKeyName, opts.maxBlobBytes())
+	if err != nil {
+		return fmt.Errorf("couldn't read expired cert %s: %w", displayFingerprint(subKeyName), err)
+	}
+
+	newDER, ok := provider(old)
+	if ok {
+		newFingerprint := fingerprintHexUpperCryptoAPI(newDER)
+
+		err = injectSingleCertCryptoAPI(newDER, newFingerprint, registryBase, storeKey, opts)
+		if err != nil {
+			return fmt.Errorf("couldn't inject renewal of %s: %w", displayFingerprint(subKeyName), err)
+		}
+
+		if newFingerprint == subKeyName {
+			// Re-injecting an unchanged cert doesn't write anything (see
+			// registryValuesUnchanged), so its age has to be reset
+			// explicitly, or the next cleanup would remove it again.
+			err = refreshRenewedCert(certStoreKey, subKeyName, opts)
+			if err != nil {
+				return fmt.Errorf("couldn't refresh renewal of %s: %w", displayFingerprint(subKeyName), err)
+			}
+
+			log.Infof("Renewed expired cert %s in place", displayFingerprint(subKeyName))
+
+			return nil
+		}
+
+		log.Infof("Renewed expired cert %s with %s", displayFingerprint(subKeyName), displayFingerprint(newFingerprint))
+	}
+
+	return deleteExpirableCert(certStoreKey, subKeyName, cleanOpts)
+}
+
+// refreshRenewedCert resets the age of a cert that was renewed in place, by
+// reapplying its magic tag.  Returned errors wrap ErrNoMagic if opts doesn't
+// set a magic tag, since there's then nothing to reapply.
+func refreshRenewedCert(certStoreKey regKey, subKeyName string, opts *InjectOptions) error {
+	if opts.MagicName == "" {
+		return ErrNoMagic
+	}
+
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrRegistryWrite)
+	}
+	defer certKey.Close()
+
+	return applyMagic(certKey, opts)
+}
+
+// readCertInfo reads the blob and metadata of the cert stored in the
+// specified subkey of an open store.  Blobs larger than maxBlobBytes are
+// rejected.
+func readCertInfo(certStoreKey regKey, subKeyName string, maxBlobBytes int) (CertInfo, error) {
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
+	if err != nil {
+		return CertInfo{}, fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrGetInitialBlob)
+	}
+	defer certKey.Close()
+
+	blob, err := readBlobValue(certKey, maxBlobBytes)
+	if err != nil {
+		return CertInfo{}, err
+	}
+
+	certKeyInfo, err := certKey.Stat()
+	if err != nil {
+		return CertInfo{}, fmt.Errorf("%w: couldn't read metadata for cert registry key: %w", err, ErrGetInitialBlob)
+	}
+
+	notBefore, notAfter := certValidity(certKey, blob)
+
+	return CertInfo{
+		Fingerprint: subKeyName,
+		Blob:        blob,
+		ModTime:     certKeyInfo.ModTime(),
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		Meta:        readInjectMeta(certKey, subKeyName),
+	}, nil
+}
+
+// CleanInjectedBefore removes every cert in the store that carries the
+// expirable magic tag and whose registry key was last modified before cutoff,
+// regardless of the -certstore.expire flag.  It returns the fingerprints of
+// the removed certs.
+//
+// Returned errors are the same as for CleanCertsCryptoAPI.
+func CleanInjectedBefore(store Store, cutoff time.Time) ([]string, error) {
+	flagMu.RLock()
+
+	err := snapshotLogFlagsLocked()
+	if err != nil {
+		flagMu.RUnlock()
+
+		return nil, err
+	}
+
+	flags, err := snapshotStoreFlagsLocked()
+	opts := cleanOptions{
+		storeFlags:         flags,
+		expirableMagicName: expirableMagicName.Value(),
+		expirableMagicData: expirableMagicData.Value(),
+	}
+	flagMu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Open up the cert store.
+	certStoreKey, err := openSingleStore(store, &opts.storeFlags, registry.ALL_ACCESS)
+	if err != nil {
+		return nil, err
+	}
+	defer certStoreKey.Close()
+
+	subKeys, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
+
+	removed := []string{}
+	errs := []error{}
+
+	for _, subKeyName := range subKeys {
+		modTime, expirable, err := expirableCertModTimeCryptoAPI(certStoreKey, subKeyName, &opts)
+		if err != nil {
+			return removed, fmt.Errorf("%w: couldn't check cert %s: %w",
+				err, displayFingerprint(subKeyName), ErrEnumerateCerts)
+		}
+
+		if !expirable || !modTime.Before(cutoff) {
+			continue
+		}
+
+		err = deleteExpirableCert(certStoreKey, subKeyName, &opts)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		removed = append(removed, subKeyName)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// TouchCert bumps the last modified time of an injected cert's registry key,
+// so that cleanup considers it fresh, without re-injecting it.  It rewrites
+// the magic tag set by the -set-magic-name and -set-magic-data flags, and
+// leaves the blob untouched.  See TouchCertsFrom for touching many certs.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set,
+// ErrStoreOpen if the store can't be opened, ErrCertNotFound if the cert isn't
+// present or doesn't carry the magic tag, and ErrSetMagic if the magic tag
+// can't be rewritten.
+func TouchCert(store Store, fingerprintHex string) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	if flags.magicName == "" {
+		return ErrNoMagic
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	return touchCertAt(certStoreKey, normalizeFingerprintCryptoAPI(fingerprintHex), &flags)
+}
+
+// TouchCertsFrom touches each cert listed in r (see TouchCert), opening the
+// store only once, and writes a result line for each to w; see
+// processFingerprints.  Returned errors are the same as for TouchCert, joined
+// for every fingerprint that failed, and also wrap ErrInvalidOption if a line
+// isn't a fingerprint.
+func TouchCertsFrom(store Store, r io.Reader, w io.Writer) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	if flags.magicName == "" {
+		return ErrNoMagic
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	return processFingerprints(r, w, func(fingerprintHexUpper string) error {
+		return touchCertAt(certStoreKey, fingerprintHexUpper, &flags)
+	})
+}
+
+// touchCertAt touches the cert in the open store, rewriting the magic tag of
+// flags.
+func touchCertAt(certStoreKey regKey, fingerprintHex string, flags *storeFlags) error {
+	certKey, err := reg.OpenKey(certStoreKey, fingerprintHex, registry.QUERY_VALUE|registry.SET_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return fmt.Errorf("%s: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrStoreOpen)
+	}
+	defer certKey.Close()
+
+	if !hasMagic(certKey, flags.magicName, flags.magicData) {
+		return fmt.Errorf("%s: magic tag missing: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	// Deleting and recreating the value is what updates the "last modified"
+	// metadata; see applyMagic.
+	err = certKey.DeleteValue(flags.magicName)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't delete magic '%s': %w", err, flags.magicName, ErrSetMagic)
+	}
+
+	err = certKey.SetDWordValue(flags.magicName, uint32(flags.magicData))
+	if err != nil {
+		return fmt.Errorf("%w: couldn't apply magic '%s'='%d': %w", err,
+			flags.magicName, uint32(flags.magicData), ErrSetMagic)
+	}
+
+	return nil
+}
+
+// MigrateMagic rewrites the magic tag of certs injected by an older version
+// that tagged them with the legacy oldName and oldValue, so that they carry
+// the magic tag set by the -set-magic-name and -set-magic-data flags instead,
+// and are recognized by cleanup and listing.  The legacy tag is removed unless
+// its name is the same as the current one.  Like TouchCert, migrating a cert
+// bumps its last modified time.  It returns the fingerprints of the migrated
+// certs; certs that already carry the current magic tag, or the tag set by the
+// -skip-magic-name and -skip-magic-data flags, are skipped.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag or oldName isn't
+// set, ErrStoreOpen if the store or a cert can't be opened, ErrEnumerateCerts
+// if the certs in the store can't be listed, and ErrSetMagic if a magic tag
+// can't be rewritten.
+func MigrateMagic(store Store, oldName string, oldValue uint32) ([]string, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.magicName == "" {
+		return nil, ErrNoMagic
+	}
+
+	if oldName == "" {
+		return nil, fmt.Errorf("no legacy magic name specified: %w", ErrNoMagic)
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil, err
+	}
+	defer certStoreKey.Close()
+
+	subKeys, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
+
+	migrated := []string{}
+	errs := []error{}
+
+	for _, subKeyName := range subKeys {
+		ok, err := migrateMagicCert(certStoreKey, subKeyName, oldName, oldValue, &flags)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", displayFingerprint(subKeyName), err))
+
+			continue
+		}
+
+		if ok {
+			migrated = append(migrated, subKeyName)
+		}
+	}
+
+	return migrated, errors.Join(errs...)
+}
+
+// migrateMagicCert replaces the legacy magic tag of a single cert with the
+// magic tag of flags, returning true if the cert carried the legacy tag.
+func migrateMagicCert(certStoreKey regKey, subKeyName, oldName string, oldValue uint32,
+	flags *storeFlags,
+) (bool, error) {
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE|registry.SET_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		// The cert was removed since we listed it.
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrStoreOpen)
+	}
+	defer certKey.Close()
+
+	if !hasMagic(certKey, oldName, int(oldValue)) ||
+		hasMagic(certKey, flags.magicName, flags.magicData) {
+		return false, nil
+	}
+
+	if flags.skipMagicName != "" && hasMagic(certKey, flags.skipMagicName, flags.skipMagicData) {
+		return false, nil
+	}
+
+	if oldName != flags.magicName {
+		err = certKey.DeleteValue(oldName)
+		if err != nil {
+			return false, fmt.Errorf("%w: couldn't delete legacy magic '%s': %w", err, oldName, ErrSetMagic)
+		}
+	}
+
+	err = applyMagic(certKey, &InjectOptions{MagicName: flags.magicName, MagicData: flags.magicData})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RemoveCert deletes the cert with the given fingerprint from the store,
+// regardless of any magic tags.  See RemoveCertsFrom for removing many certs.
+//
+// Returned errors wrap ErrStoreOpen if the store can't be opened,
+// ErrCertNotFound if the cert isn't present, and ErrRegistryWrite if it can't
+// be deleted.
+func RemoveCert(store Store, fingerprintHex string) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	return removeCertAt(certStoreKey, normalizeFingerprintCryptoAPI(fingerprintHex))
+}
+
+// RemoveCertsFrom removes each cert listed in r (see RemoveCert), opening the
+// store only once, and writes a result line for each to w; see
+// processFingerprints.  Returned errors are the same as for RemoveCert, joined
+// for every fingerprint that failed, and also wrap ErrInvalidOption if a line
+// isn't a fingerprint.
+func RemoveCertsFrom(store Store, r io.Reader, w io.Writer) error {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return err
+	}
+
+	certStoreKey, err := openSingleStore(store, &flags, registry.ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer certStoreKey.Close()
+
+	return processFingerprints(r, w, func(fingerprintHexUpper string) error {
+		return removeCertAt(certStoreKey, fingerprintHexUpper)
+	})
+}
+
+// removeCertAt deletes the cert from the open store.
+func removeCertAt(certStoreKey regKey, fingerprintHex string) error {
+	err := reg.DeleteKey(certStoreKey, fingerprintHex)
+	if errors.Is(err, registry.ErrNotExist) {
+		return fmt.Errorf("%s: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: couldn't delete cert %s: %w", err, displayFingerprint(fingerprintHex), ErrRegistryWrite)
+	}
+
+	return nil
+}
+
+// processFingerprints calls fn for each fingerprint listed in r, one per line
+// (in any case, optionally separated by colons or spaces), and writes a
+// result line for each to w: the fingerprint followed by "ok" or the error.
+// Blank lines and lines starting with # are skipped, and lines that aren't
+// SHA-1 fingerprints fail with ErrInvalidOption, and are written back as they
+// were read.  The errors for each fingerprint are joined, and processing
+// continues after a failure.
+func processFingerprints(r io.Reader, w io.Writer, fn func(fingerprintHexUpper string) error) error {
+	scanner := bufio.NewScanner(r)
+	errs := []error{}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fingerprintHexUpper := normalizeFingerprintCryptoAPI(line)
+		if !isFingerprintHex(fingerprintHexUpper) {
+			err := fmt.Errorf("%q isn't a SHA-1 fingerprint: %w", line, ErrInvalidOption)
+			errs = append(errs, err)
+
+			fmt.Fprintf(w, "%s error: %s\n", line, err)
+
+			continue
+		}
+
+		err := fn(fingerprintHexUpper)
+		if err != nil {
+			errs = append(errs, err)
 
-	return ekus
-}
+			fmt.Fprintf(w, "%s error: %s\n", displayFingerprint(fingerprintHexUpper), err)
 
-func appendToEKUList(ekus *[]x509.ExtKeyUsage, enable bool, usage x509.ExtKeyUsage) {
-	if enable {
-		*ekus = append(*ekus, usage)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s ok\n", displayFingerprint(fingerprintHexUpper))
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't read fingerprints: %w", err))
 	}
+
+	return errors.Join(errs...)
 }
 
-func editBlobNameConstraints(blob certblob.Blob) error {
-	nameConstraintsTemplate, nameConstraintsValid, err := buildNameConstraintsTemplate()
+// RemoveCertFile is like RemoveCert, for the cert in the DER or PEM file at
+// path, so that callers don't need to compute its fingerprint.  The file must
+// contain exactly one cert.  Returned errors also wrap ErrCertRead if the file
+// can't be read, and ErrBadCert if it can't be decoded.
+func RemoveCertFile(store Store, path string) error {
+	derBytes, err := readCertFile(path)
 	if err != nil {
 		return err
 	}
 
-	if nameConstraintsValid {
-		nameConstraintsProperty, err := certblob.BuildNameConstraints(nameConstraintsTemplate)
+	return RemoveCert(store, fingerprintHexUpperCryptoAPI(derBytes))
+}
+
+// RemoveCerts deletes the certs with the given fingerprints (SHA-1 hex, in
+// any case, optionally separated by colons or spaces) from the store, opening
+// it only once.  Unlike RemoveCert, only certs carrying the magic tag set by
+// the -set-magic-name and -set-magic-data flags are deleted.  It returns the
+// normalized fingerprints that were removed and those that weren't.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set, and
+// ErrStoreOpen if the store can't be opened; otherwise, the error for each
+// failed cert is joined, wrapping ErrCertNotFound if the cert isn't present
+// or lacks the magic tag, and ErrRegistryWrite if it can't be deleted.
+func RemoveCerts(store Store, fingerprints []string) ([]string, []string, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return removeCerts(store, fingerprints, &flags)
+}
+
+// removeCerts implements RemoveCerts with the given flags.
+func removeCerts(store Store, fingerprints []string, flags *storeFlags) ([]string, []string, error) {
+	if flags.magicName == "" {
+		return nil, nil, ErrNoMagic
+	}
+
+	certStoreKey, err := openSingleStore(store, flags, registry.ALL_ACCESS)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer certStoreKey.Close()
+
+	removed := []string{}
+	failed := []string{}
+	errs := []error{}
+
+	for _, fingerprintHex := range fingerprints {
+		fingerprintHex = normalizeFingerprintCryptoAPI(fingerprintHex)
+
+		err := removeInjectedCert(certStoreKey, fingerprintHex, flags)
 		if err != nil {
-			return fmt.Errorf("%s: couldn't marshal name constraints property: %w", err, ErrEditBlob)
+			failed = append(failed, fingerprintHex)
+			errs = append(errs, err)
+
+			continue
 		}
 
-		blob.SetProperty(nameConstraintsProperty)
+		removed = append(removed, fingerprintHex)
+	}
+
+	return removed, failed, errors.Join(errs...)
+}
+
+// removeInjectedCert deletes the cert from the open store if it carries the
+// magic tag of flags.
+func removeInjectedCert(certStoreKey regKey, fingerprintHex string, flags *storeFlags) error {
+	certKey, err := reg.OpenKey(certStoreKey, fingerprintHex, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return fmt.Errorf("%s: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: couldn't open cert %s: %w", err, displayFingerprint(fingerprintHex), ErrStoreOpen)
+	}
+
+	ours := hasMagic(certKey, flags.magicName, flags.magicData)
+	certKey.Close()
+
+	if !ours {
+		return fmt.Errorf("%s lacks magic tag: %w", displayFingerprint(fingerprintHex), ErrCertNotFound)
+	}
+
+	err = reg.DeleteKey(certStoreKey, fingerprintHex)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't delete cert %s: %w", err, displayFingerprint(fingerprintHex), ErrRegistryWrite)
 	}
 
 	return nil
 }
 
-func buildNameConstraintsTemplate() (*x509.Certificate, bool, error) {
-	nameConstraintsValid := false
-	nameConstraintsTemplate := x509.Certificate{}
+// RepairStore fixes inconsistencies in the store that confuse enumeration,
+// and returns the fingerprints of the certs it repaired.  Only certs that
+// carry the magic tag set by the -set-magic-name and -set-magic-data flags are
+// touched.
+//
+// Currently, it consolidates certs whose subkey name isn't in the uppercase
+// hex form used by Windows (e.g. because another tool wrote it with
+// separators).  The properties of such a duplicate are merged into the
+// canonical subkey, keeping the canonical subkey's value for any property
+// present in both, and the duplicate is deleted.  A canonical subkey that
+// lacks the magic tag isn't tagged by the merge.  Names that only differ in
+// case need no repair, since registry key names are case-insensitive.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set,
+// ErrStoreOpen if the store can't be opened, ErrEnumerateCerts if the certs in
+// the store can't be listed, ErrBlobRead if a blob can't be read,
+// ErrCorruptCert if a duplicate's cert doesn't match its subkey name, and
+// ErrRegistryWrite if a repair can't be written.
+func RepairStore(store Store) ([]string, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, err
+	}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.PermittedDNSDomains,
-		nameConstraintsPermittedDNS.Value(), &nameConstraintsValid)
+	if flags.magicName == "" {
+		return nil, ErrNoMagic
+	}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.ExcludedDNSDomains,
-		nameConstraintsExcludedDNS.Value(), &nameConstraintsValid)
+	storeKey, err := store.singleKey(flags.logicalStores)
+	if err != nil {
+		return nil, err
+	}
 
-	err := setNameConstraintsIPRanges(
-		&nameConstraintsTemplate.PermittedIPRanges,
-		nameConstraintsPermittedIP.Value(), &nameConstraintsValid)
+	certStoreKey, err := reg.OpenKey(reg.Root(store.Base, flags.registryView), storeKey, registry.ALL_ACCESS)
 	if err != nil {
-		return nil, false, fmt.Errorf("permitted: %w", err)
+		return nil, fmt.Errorf("%w: couldn't open cert store: %w", err, ErrStoreOpen)
 	}
+	defer certStoreKey.Close()
 
-	err = setNameConstraintsIPRanges(
-		&nameConstraintsTemplate.ExcludedIPRanges,
-		nameConstraintsExcludedIP.Value(), &nameConstraintsValid)
+	subKeys, err := readSubKeyNames(certStoreKey)
 	if err != nil {
-		return nil, false, fmt.Errorf("excluded: %w", err)
+		return nil, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
 	}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.PermittedEmailAddresses,
-		nameConstraintsPermittedEmail.Value(), &nameConstraintsValid)
+	opts := InjectOptions{
+		MagicName:    flags.magicName,
+		MagicData:    flags.magicData,
+		MaxBlobBytes: flags.maxBlobBytes,
+		registryView: flags.registryView,
+	}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.ExcludedEmailAddresses,
-		nameConstraintsExcludedEmail.Value(), &nameConstraintsValid)
+	repaired := []string{}
+	errs := []error{}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.PermittedURIDomains,
-		nameConstraintsPermittedURI.Value(), &nameConstraintsValid)
+	for _, subKeyName := range subKeys {
+		canonical := normalizeFingerprintCryptoAPI(subKeyName)
+		if strings.EqualFold(canonical, subKeyName) || !isFingerprintHex(canonical) {
+			continue
+		}
 
-	setNameConstraintsStrings(
-		&nameConstraintsTemplate.ExcludedURIDomains,
-		nameConstraintsExcludedURI.Value(), &nameConstraintsValid)
+		ok, err := consolidateCertKey(certStoreKey, store.Base, storeKey, subKeyName, canonical, &opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", displayFingerprint(subKeyName), err))
 
-	return &nameConstraintsTemplate, nameConstraintsValid, nil
+			continue
+		}
+
+		if ok {
+			log.Infof("Consolidated duplicate cert %s into %s",
+				displayFingerprint(subKeyName), displayFingerprint(canonical))
+
+			repaired = append(repaired, canonical)
+		}
+	}
+
+	return repaired, errors.Join(errs...)
 }
 
-func setNameConstraintsStrings(ncs *[]string, val string, valid *bool) {
-	if val != "" {
-		*ncs = []string{val}
-		*valid = true
+// isFingerprintHex returns true if s is an uppercase hex SHA-1 fingerprint.
+func isFingerprintHex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
 	}
+
+	_, err := hex.DecodeString(s)
+
+	return err == nil && strings.ToUpper(s) == s
 }
 
-func setNameConstraintsIPRanges(ncs *[]*net.IPNet, val string, valid *bool) error {
-	if val != "" {
-		_, IPNet, err := net.ParseCIDR(val)
+// consolidateCertKey merges the duplicate cert key into the canonical one and
+// deletes the duplicate.  It returns false if the duplicate isn't tagged with
+// opts.MagicName, in which case nothing is changed.  The duplicate's cert must
+// match the canonical name.  If the canonical key already exists without the
+// magic tag (e.g. because Windows added the cert), the merge doesn't tag it,
+// so that the cert isn't claimed for cleanup.
+func consolidateCertKey(certStoreKey regKey, registryBase registry.Key, storeKey, duplicate, canonical string,
+	opts *InjectOptions,
+) (bool, error) {
+	duplicateKey, err := reg.OpenKey(certStoreKey, duplicate, registry.QUERY_VALUE)
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't open cert registry key: %w", err, ErrGetInitialBlob)
+	}
+
+	if !hasMagic(duplicateKey, opts.MagicName, opts.MagicData) {
+		duplicateKey.Close()
+
+		return false, nil
+	}
+
+	merged, err := readBlobValue(duplicateKey, opts.maxBlobBytes())
+	duplicateKey.Close()
+
+	if err != nil {
+		return false, err
+	}
+
+	err = checkBlobFingerprint(merged, canonical)
+	if err != nil {
+		return false, err
+	}
+
+	writeOpts := *opts
+
+	canonicalKey, err := reg.OpenKey(certStoreKey, canonical, registry.QUERY_VALUE)
+	if err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return false, fmt.Errorf("%w: couldn't open canonical cert registry key: %w", err, ErrGetInitialBlob)
+	}
+
+	if err == nil {
+		if !hasMagic(canonicalKey, opts.MagicName, opts.MagicData) {
+			writeOpts.MagicName = ""
+		}
+
+		canonicalBlob, err := readBlobValue(canonicalKey, opts.maxBlobBytes())
+		canonicalKey.Close()
+
 		if err != nil {
-			return fmt.Errorf("%s: couldn't parse IP CIDR: %w", err, ErrEditBlob)
+			return false, err
 		}
 
-		*ncs = []*net.IPNet{IPNet}
-		*valid = true
+		for id, value := range canonicalBlob {
+			merged[id] = value
+		}
 	}
 
-	return nil
+	err = writeBlobCryptoAPI(merged, canonical, registryBase, storeKey, &writeOpts)
+	if err != nil {
+		return false, err
+	}
+
+	err = reg.DeleteKey(certStoreKey, duplicate)
+	if err != nil {
+		return false, fmt.Errorf("%w: couldn't delete duplicate cert: %w", err, ErrRegistryWrite)
+	}
+
+	return true, nil
 }
 
-func cleanCertsCryptoAPI() {
-	store, err := cryptoAPINameToStore(cryptoAPIFlagPhysicalStoreName.Value())
+// CountInjected returns the number of certs in the store that carry the magic
+// tag set by the -set-magic-name and -set-magic-data flags, i.e. the certs
+// that ListInjectedCerts lists, plus any whose blob can't be read.  Unlike
+// VerifyInjected, it doesn't read any blobs, so it's cheap enough for a status
+// indicator.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set,
+// ErrStoreOpen if the store can't be opened, and ErrEnumerateCerts if the
+// certs in the store can't be listed.
+func CountInjected(store Store) (int, error) {
+	flags, err := snapshotStoreFlags()
 	if err != nil {
-		log.Errorf("error: %s", err.Error())
+		return 0, err
+	}
 
-		return
+	if flags.magicName == "" {
+		return 0, ErrNoMagic
 	}
 
-	registryBase := store.Base
-	storeKey := store.Key()
+	certStoreKey, err := openSingleStore(store, &flags, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return 0, err
+	}
+	defer certStoreKey.Close()
 
-	// Open up the cert store.
-	certStoreKey, err := registry.OpenKey(registryBase, storeKey, registry.ALL_ACCESS)
+	subKeys, err := readSubKeyNames(certStoreKey)
 	if err != nil {
-		log.Errorf("Couldn't open cert store: %s", err)
+		return 0, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
 
-		return
+	count := 0
+
+	for i, subKeyName := range subKeys {
+		logScanProgress(store.LogicalKey(flags.logicalStores[0]), subKeyName, i+1, len(subKeys))
+
+		certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
+		if err != nil {
+			// The cert may have been removed since we listed it.
+			continue
+		}
+
+		if hasMagic(certKey, flags.magicName, flags.magicData) {
+			count++
+		}
+
+		certKey.Close()
 	}
-	defer certStoreKey.Close()
 
-	// get all subkey names in the cert store
-	subKeys, err := certStoreKey.ReadSubKeyNames(0)
+	return count, nil
+}
+
+// ListInjectedCerts returns the certs in the store that carry the magic tag
+// set by the -set-magic-name and -set-magic-data flags, sorted by
+// fingerprint.  Certs whose blob can't be read are left out, and their errors
+// are joined.  See ListInjectedCertsWin32API for the certs that applications
+// see, which may include other physical stores' certs.
+//
+// Returned errors wrap ErrNoMagic if the -set-magic-name flag isn't set,
+// ErrStoreOpen if the store can't be opened, ErrEnumerateCerts if the certs in
+// the store can't be listed, and ErrBlobRead if a blob can't be read.
+func ListInjectedCerts(store Store) ([]CertInfo, error) {
+	flags, err := snapshotStoreFlags()
 	if err != nil {
-		log.Errorf("Couldn't list certs in cert store: %s", err)
+		return nil, err
+	}
 
-		return
+	return listInjectedCerts(store, &flags)
+}
+
+// listInjectedCerts implements ListInjectedCerts with the given flags.
+func listInjectedCerts(store Store, flags *storeFlags) ([]CertInfo, error) {
+	if flags.magicName == "" {
+		return nil, ErrNoMagic
 	}
 
-	// for all certs in the cert store
-	for _, subKeyName := range subKeys {
-		// Check if the cert is expired
-		expired, err := checkCertExpiredCryptoAPI(certStoreKey, subKeyName)
+	certStoreKey, err := openSingleStore(store, flags, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil, err
+	}
+	defer certStoreKey.Close()
+
+	subKeys, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't list certs in cert store: %w", err, ErrEnumerateCerts)
+	}
+
+	certs := []CertInfo{}
+	errs := []error{}
+
+	for i, subKeyName := range subKeys {
+		logScanProgress(store.LogicalKey(flags.logicalStores[0]), subKeyName, i+1, len(subKeys))
+
+		info, ok, err := readInjectedCert(certStoreKey, subKeyName, flags)
 		if err != nil {
-			log.Errorf("Couldn't check if cert is expired: %s", err)
+			errs = append(errs, err)
 
-			return
+			continue
 		}
 
-		// delete the cert if it's expired
-		if expired {
-			if err := registry.DeleteKey(certStoreKey, subKeyName); err != nil {
-				log.Errorf("Coudn't delete expired cert: %s", err)
-			}
+		if ok {
+			certs = append(certs, info)
 		}
 	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].Fingerprint < certs[j].Fingerprint
+	})
+
+	return certs, errors.Join(errs...)
 }
 
-// This function is specific to the dehydrated certificate method of positive
-// overrides, which is deprecated; thus we're not going to maintain this
-// function.
+// readInjectedCert reads the named cert from the open store.  It returns
+// false if the cert doesn't carry the magic tag of flags, or has been removed
+// since it was listed.
+func readInjectedCert(certStoreKey regKey, subKeyName string, flags *storeFlags) (CertInfo, bool, error) {
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
+	if err != nil {
+		return CertInfo{}, false, nil
+	}
+	defer certKey.Close()
+
+	if !hasMagic(certKey, flags.magicName, flags.magicData) {
+		return CertInfo{}, false, nil
+	}
+
+	blob, err := readBlobValue(certKey, flags.maxBlobBytes)
+	if err != nil {
+		return CertInfo{}, false, fmt.Errorf("%s: %w", displayFingerprint(subKeyName), err)
+	}
+
+	info := CertInfo{Fingerprint: subKeyName, Blob: blob, Meta: readInjectMeta(certKey, subKeyName)}
+	info.NotBefore, info.NotAfter = certValidity(certKey, blob)
+
+	stat, err := certKey.Stat()
+	if err == nil {
+		info.ModTime = stat.ModTime()
+	}
+
+	return info, true, nil
+}
+
+// DiffStores compares the certs carrying the magic tag in stores a and b by
+// fingerprint, e.g. to check a machine against a reference.  It returns the
+// normalized fingerprints that are only in a and only in b, sorted.
+//
+// Returned errors are the same as for ListInjectedCerts.
+func DiffStores(a, b Store) ([]string, []string, error) {
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certsA, err := listInjectedCerts(a, &flags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", a, err)
+	}
+
+	certsB, err := listInjectedCerts(b, &flags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", b, err)
+	}
+
+	return diffFingerprints(certsA, certsB), diffFingerprints(certsB, certsA), nil
+}
+
+// diffFingerprints returns the normalized fingerprints of the certs in a that
+// aren't in b, sorted.
+func diffFingerprints(a, b []CertInfo) []string {
+	inB := map[string]bool{}
+	for _, info := range b {
+		inB[normalizeFingerprintCryptoAPI(info.Fingerprint)] = true
+	}
+
+	only := []string{}
+
+	for _, info := range a {
+		fingerprintHexUpper := normalizeFingerprintCryptoAPI(info.Fingerprint)
+		if !inB[fingerprintHexUpper] {
+			only = append(only, fingerprintHexUpper)
+		}
+	}
+
+	sort.Strings(only)
+
+	return only
+}
+
+// expirableCertModTimeCryptoAPI returns the last modified time of the
+// specified cert's registry key, and whether the cert carries the expirable
+// magic tag.  Certs without the tag must never be removed by cleanup.
 //
 //nolint:all
-func checkCertExpiredCryptoAPI(certStoreKey registry.Key, subKeyName string) (bool, error) {
+func expirableCertModTimeCryptoAPI(certStoreKey regKey, subKeyName string,
+	opts *cleanOptions,
+) (time.Time, bool, error) {
 	// Open the cert
-	certKey, err := registry.OpenKey(certStoreKey, subKeyName, registry.ALL_ACCESS)
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
 	if err != nil {
-		return false, fmt.Errorf("Couldn't open cert registry key: %s", err)
+		return time.Time{}, false, fmt.Errorf("Couldn't open cert registry key: %s", err)
 	}
 	defer certKey.Close()
 
-	if expirableMagicName.Value() == "" {
-		// Magic expiration is disabled.  Therefore don't consider it expired.
-		return false, nil
+	if opts.expirableMagicName == "" {
+		// Magic expiration is disabled.  Therefore don't consider it expirable.
+		return time.Time{}, false, nil
 	}
 
 	// Check for magic value
-	isNamecoin, _, err := certKey.GetIntegerValue(expirableMagicName.Value())
+	isNamecoin, _, err := certKey.GetIntegerValue(opts.expirableMagicName)
 	if err != nil {
-		// Magic value wasn't found.  Therefore don't consider it expired.
-		return false, nil
+		// Magic value wasn't found.  Therefore don't consider it expirable.
+		return time.Time{}, false, nil
 	}
 
-	if isNamecoin != uint64(expirableMagicData.Value()) {
-		// Magic value was found but it wasn't the one we recognize.  Therefore don't consider it expired.
-		return false, nil
+	if isNamecoin != uint64(opts.expirableMagicData) {
+		// Magic value was found but it wasn't the one we recognize.  Therefore don't consider it expirable.
+		return time.Time{}, false, nil
 	}
 
 	// Get metadata about the cert key
 	certKeyInfo, err := certKey.Stat()
 	if err != nil {
-		return false, fmt.Errorf("Couldn't read metadata for cert registry key: %s", err)
+		return time.Time{}, false, fmt.Errorf("Couldn't read metadata for cert registry key: %s", err)
 	}
 
 	// Get the last modified time
-	certKeyModTime := certKeyInfo.ModTime()
+	return certKeyInfo.ModTime(), true, nil
+}
+
+// expiryValueName is the registry value in which InjectWithExpiry records a
+// cert's expiry time, as a QWORD of seconds since the Unix epoch.  CryptoAPI
+// ignores it.
+const expiryValueName = "NamecoinExpiry"
+
+// notBeforeValueName and notAfterValueName are the registry values in which
+// the cert's validity period is recorded at injection time, as QWORDs of
+// seconds since the Unix epoch, so that it can be checked without parsing the
+// blob.  CryptoAPI ignores them.
+const (
+	notBeforeValueName = "NamecoinNotBefore"
+	notAfterValueName  = "NamecoinNotAfter"
+)
+
+// timeValues returns the QWORD registry values that record the expiry time
+// (if opts sets one) and the validity period of the cert in blobBytes (if it
+// can be parsed).
+func timeValues(blobBytes []byte, opts *InjectOptions) map[string]uint64 {
+	values := map[string]uint64{}
+
+	if !opts.ExpiresAt.IsZero() {
+		values[expiryValueName] = unixSeconds(opts.ExpiresAt)
+	}
+
+	blob, err := certblob.ParseBlob(blobBytes)
+	if err != nil {
+		return values
+	}
+
+	cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
+	if err != nil {
+		return values
+	}
+
+	values[notBeforeValueName] = unixSeconds(cert.NotBefore)
+	values[notAfterValueName] = unixSeconds(cert.NotAfter)
+
+	return values
+}
+
+// unixSeconds returns t as seconds since the Unix epoch, clamped to 0.
+func unixSeconds(t time.Time) uint64 {
+	if t.Unix() < 0 {
+		return 0
+	}
+
+	return uint64(t.Unix())
+}
+
+// readTimeValue reads a time recorded by applyRegistryValues.
+func readTimeValue(certKey regKey, name string) (time.Time, bool) {
+	seconds, _, err := certKey.GetIntegerValue(name)
+	if err != nil || seconds > math.MaxInt64 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(seconds), 0), true
+}
+
+// explicitExpiryCryptoAPI returns the expiry time recorded by
+// InjectWithExpiry for the specified cert, if any.
+func explicitExpiryCryptoAPI(certStoreKey regKey, subKeyName string) (time.Time, bool) {
+	return recordedTimeCryptoAPI(certStoreKey, subKeyName, expiryValueName)
+}
+
+// recordedTimeCryptoAPI reads a time recorded by applyRegistryValues for the
+// specified cert, if any.
+func recordedTimeCryptoAPI(certStoreKey regKey, subKeyName, name string) (time.Time, bool) {
+	certKey, err := reg.OpenKey(certStoreKey, subKeyName, registry.QUERY_VALUE)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer certKey.Close()
+
+	return readTimeValue(certKey, name)
+}
+
+// certValidity returns the cert's validity period as recorded in its registry
+// key, falling back to parsing the blob for certs injected by older versions.
+// Zero times are returned if neither works.
+func certValidity(certKey regKey, blob certblob.Blob) (time.Time, time.Time) {
+	notBefore, okBefore := readTimeValue(certKey, notBeforeValueName)
+	notAfter, okAfter := readTimeValue(certKey, notAfterValueName)
+
+	if okBefore && okAfter {
+		return notBefore, notAfter
+	}
+
+	cert, err := x509.ParseCertificate(blob[certblob.CertContentCertPropID])
+	if err != nil {
+		return time.Time{}, time.Time{}
+	}
+
+	return cert.NotBefore, cert.NotAfter
+}
+
+// This function is specific to the dehydrated certificate method of positive
+// overrides, which is deprecated; thus we're not going to maintain this
+// function.
+//
+//nolint:all
+func checkCertExpiredCryptoAPI(certStoreKey regKey, subKeyName string, opts *cleanOptions) (bool, error) {
+	certKeyModTime, expirable, err := expirableCertModTimeCryptoAPI(certStoreKey, subKeyName, opts)
+	if err != nil || !expirable {
+		return false, err
+	}
+
+	// An explicit expiry time is deterministic, so prefer it.
+	if expiry, ok := explicitExpiryCryptoAPI(certStoreKey, subKeyName); ok {
+		return time.Now().After(expiry), nil
+	}
 
 	// If the cert's last modified timestamp differs too much from the
 	// current time in either direction, consider it expired
-	expired := math.Abs(time.Since(certKeyModTime).Seconds()) > float64(certExpirePeriod.Value())
+	expired := time.Since(certKeyModTime).Abs() > opts.maxAge
 
 	return expired, nil
 }
@@ -4,9 +4,33 @@
 package certinject
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+
+	"github.com/namecoin/certinject/certblob"
 )
 
 type registryKeyNamesTestCase struct {
@@ -31,6 +55,8 @@ func registryKeyNamesTestData() []registryKeyNamesTestCase {
 		{"user+CA", "current-user", "CA", `SOFTWARE\Microsoft\SystemCertificates\CA\Certificates`, hkcu},
 		{"user+My", "current-user", "My", `SOFTWARE\Microsoft\SystemCertificates\My\Certificates`, hkcu},
 		{"user+Trust", "current-user", "Trust", `SOFTWARE\Microsoft\SystemCertificates\Trust\Certificates`, hkcu},
+		{"user-group+root", "current-user-group-policy", "Root", `SOFTWARE\Policies\Microsoft\SystemCertificates\Root\Certificates`, hkcu},
+		{"user-group+TrustedPeople", "current-user-group-policy", "TrustedPeople", `SOFTWARE\Policies\Microsoft\SystemCertificates\TrustedPeople\Certificates`, hkcu},
 		{"enterprise+root", "enterprise", "Root", `SOFTWARE\Microsoft\EnterpriseCertificates\Root\Certificates`, hklm},
 		{"enterprise+CA", "enterprise", "CA", `SOFTWARE\Microsoft\EnterpriseCertificates\CA\Certificates`, hklm},
 		{"enterprise+My", "enterprise", "My", `SOFTWARE\Microsoft\EnterpriseCertificates\My\Certificates`, hklm},
@@ -92,3 +118,5045 @@ func TestRegistryKeyNames(t *testing.T) {
 		t.Logf("[PASS] test %q: %s\\%s", testCase.Name, base2str(t, base), key)
 	}
 }
+
+func TestCheckBlobSize(t *testing.T) {
+	if err := checkBlobSize(16, 16); err != nil {
+		t.Errorf("expected blob at the limit to be accepted, got: %v", err)
+	}
+
+	err := checkBlobSize(17, 16)
+	if !errors.Is(err, ErrBlobTooLarge) {
+		t.Errorf("expected ErrBlobTooLarge for oversized blob, got: %v", err)
+	}
+
+	if !errors.Is(err, ErrGetInitialBlob) {
+		t.Errorf("expected oversized blob error to wrap ErrGetInitialBlob, got: %v", err)
+	}
+}
+
+const testStoreKey = `SOFTWARE\Namecoin\certinject-test\Root\Certificates`
+
+// testCryptoAPIStore is the Store whose key is testStoreKey, with the default
+// -logical-store flag.
+var testCryptoAPIStore = Store{registry.CURRENT_USER, `SOFTWARE\Namecoin\certinject-test`, `%s\Certificates`}
+
+// useMemReg replaces the registry with an empty in-memory one and returns a
+// function that restores the real registry.
+func useMemReg() (*memRegBackend, func()) {
+	mem := newMemRegBackend()
+	oldReg := reg
+	reg = mem
+
+	return mem, func() { reg = oldReg }
+}
+
+// testStore replaces the registry with an in-memory one containing an empty
+// cert store under HKCU, and returns a function that restores the real
+// registry.
+func testStore(t *testing.T) (*memRegBackend, func()) {
+	t.Helper()
+
+	mem, restore := useMemReg()
+
+	storeKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		restore()
+		t.Fatalf("couldn't create test store: %v", err)
+	}
+	storeKey.Close()
+
+	return mem, restore
+}
+
+// testInjectOptions returns the InjectOptions configured by the current flag
+// values.  Since the test cert is a self-signed end-entity cert, injecting it
+// into Root is allowed.
+func testInjectOptions(t *testing.T) *InjectOptions {
+	t.Helper()
+
+	opts, err := injectOptionsFromFlags()
+	if err != nil {
+		t.Fatalf("couldn't build options from flags: %v", err)
+	}
+
+	opts.AllowLeafInRoot = true
+
+	return &opts
+}
+
+// testStoreFlags returns the storeFlags configured by the current flag
+// values.
+func testStoreFlags(t *testing.T) *storeFlags {
+	t.Helper()
+
+	flags, err := snapshotStoreFlags()
+	if err != nil {
+		t.Fatalf("couldn't snapshot flags: %v", err)
+	}
+
+	return &flags
+}
+
+func testCertDER(t *testing.T) []byte {
+	t.Helper()
+
+	derBytes, err := os.ReadFile("testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read test cert: %v", err)
+	}
+
+	return derBytes
+}
+
+// testExpireDuration returns the -expire flag's duration.
+func testExpireDuration(t *testing.T) time.Duration {
+	t.Helper()
+
+	maxAge, err := certExpireDuration()
+	if err != nil {
+		t.Fatalf("couldn't parse expire period: %v", err)
+	}
+
+	return maxAge
+}
+
+// setTestMagicName sets the -set-magic-name flag until the test ends.
+func setTestMagicName(t *testing.T, name string) {
+	t.Helper()
+
+	if err := setMagicName.CfSetValue(name); err != nil {
+		t.Fatalf("couldn't set magic name: %v", err)
+	}
+
+	t.Cleanup(func() { setMagicName.CfSetValue("") }) //nolint:errcheck
+}
+
+// testCleanOptions returns the cleanup options configured by the flags.
+func testCleanOptions(t *testing.T) *cleanOptions {
+	t.Helper()
+
+	opts, err := cleanOptionsFromFlagsLocked()
+	if err != nil {
+		t.Fatalf("couldn't read cleanup flags: %v", err)
+	}
+
+	return &opts
+}
+
+func testCertModTime(t *testing.T, fingerprintHexUpper string) time.Time {
+	t.Helper()
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+	defer certKey.Close()
+
+	certKeyInfo, err := certKey.Stat()
+	if err != nil {
+		t.Fatalf("couldn't stat injected cert: %v", err)
+	}
+
+	return certKeyInfo.ModTime()
+}
+
+func TestInjectUnchangedKeepsModTime(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("first injection failed: %v", err)
+	}
+
+	modTime1 := testCertModTime(t, fingerprintHexUpper)
+
+	time.Sleep(50 * time.Millisecond)
+
+	err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("second injection failed: %v", err)
+	}
+
+	modTime2 := testCertModTime(t, fingerprintHexUpper)
+
+	if !modTime1.Equal(modTime2) {
+		t.Errorf("identical injection changed modtime from %v to %v", modTime1, modTime2)
+	}
+}
+
+func TestParseRawProperties(t *testing.T) {
+	props, err := parseRawProperties("11:4e00430000, 0x14:00ff")
+	if err != nil {
+		t.Fatalf("couldn't parse valid raw properties: %v", err)
+	}
+
+	if len(props) != 2 || props[0].ID != 11 || props[1].ID != 0x14 {
+		t.Fatalf("unexpected raw properties: %+v", props)
+	}
+
+	if string(props[1].Value) != "\x00\xff" {
+		t.Errorf("unexpected raw property value: %x", props[1].Value)
+	}
+
+	for _, invalid := range []string{"11", "x:00", "11:zz"} {
+		if _, err := parseRawProperties(invalid); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("expected ErrInvalidOption for %q, got: %v", invalid, err)
+		}
+	}
+
+	// A malformed flag is a usage error.
+	if err := rawProperties.CfSetValue("11"); err != nil {
+		t.Fatalf("couldn't set raw-properties: %v", err)
+	}
+	defer rawProperties.CfSetValue("") //nolint:errcheck
+
+	if _, err := injectOptionsFromFlags(); ExitCode(err) != ExitInvalidStore {
+		t.Errorf("expected exit code %d for a malformed flag, got %d (err %v)", ExitInvalidStore, ExitCode(err), err)
+	}
+}
+
+func TestCheckCertExpiredCryptoAPI(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin-Expirable")
+
+	if err := expirableMagicName.CfSetValue("Namecoin-Expirable"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+
+	// The cert itself must still be valid, since a cert past its NotAfter
+	// is expired however recently it was injected.
+	derBytes, _ := testCertChain(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certStoreKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't open test store: %v", err)
+	}
+	defer certStoreKey.Close()
+
+	expired, err := checkCertExpiredCryptoAPI(certStoreKey, fingerprintHexUpper, testCleanOptions(t))
+	if err != nil || expired {
+		t.Fatalf("expected fresh cert to be unexpired, got expired=%t err=%v", expired, err)
+	}
+
+	certKey, err := reg.OpenKey(certStoreKey, fingerprintHexUpper, registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+
+	age := testExpireDuration(t) + time.Minute
+	certKey.(memRegKey).node.modTime = time.Now().Add(-age)
+
+	expired, err = checkCertExpiredCryptoAPI(certStoreKey, fingerprintHexUpper, testCleanOptions(t))
+	if err != nil || !expired {
+		t.Errorf("expected stale cert to be expired, got expired=%t err=%v", expired, err)
+	}
+}
+
+func TestScanProgressDue(t *testing.T) {
+	tests := []struct {
+		scanned, interval int
+		due               bool
+	}{
+		{1, 1000, false},
+		{999, 1000, false},
+		{1000, 1000, true},
+		{5000, 1000, true},
+		{5001, 1000, false},
+		{1000, 0, false},
+		{3, 1, true},
+	}
+
+	for _, tc := range tests {
+		if due := scanProgressDue(tc.scanned, tc.interval); due != tc.due {
+			t.Errorf("scanned %d, interval %d: expected %t, got %t", tc.scanned, tc.interval, tc.due, due)
+		}
+	}
+}
+
+func TestReadSubKeyNamesBatched(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	certStoreKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't open test store: %v", err)
+	}
+	defer certStoreKey.Close()
+
+	// Enough subkeys to need several batches, plus a partial one.
+	count := 2*subKeyBatchSize + 3
+
+	for i := 0; i < count; i++ {
+		certKey, _, err := reg.CreateKey(certStoreKey, fmt.Sprintf("%040X", i), registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create subkey: %v", err)
+		}
+		certKey.Close()
+	}
+
+	names, err := readSubKeyNames(certStoreKey)
+	if err != nil {
+		t.Fatalf("couldn't read subkey names: %v", err)
+	}
+
+	if len(names) != count {
+		t.Errorf("expected %d subkey names, got %d", count, len(names))
+	}
+}
+
+func TestInjectMultipleLogicalStores(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("current-user"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+	defer cryptoAPIFlagPhysicalStoreName.CfSetValue("system") //nolint:errcheck
+
+	if err := cryptoAPIFlagLogicalStoreName.CfSetValue("Root, CA"); err != nil {
+		t.Fatalf("couldn't set logical stores: %v", err)
+	}
+	defer cryptoAPIFlagLogicalStoreName.CfSetValue("Root") //nolint:errcheck
+
+	store := cryptoAPIStores["current-user"]
+
+	for _, logical := range []string{"Root", "CA"} {
+		storeKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.LogicalKey(logical), registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", logical, err)
+		}
+		storeKey.Close()
+	}
+
+	if err := allowLeafInRoot.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set allow-leaf-in-root: %v", err)
+	}
+	defer allowLeafInRoot.CfSetValue(false) //nolint:errcheck
+
+	derBytes := testCertDER(t)
+	if err := InjectCertCryptoAPI(derBytes); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	for _, logical := range []string{"Root", "CA"} {
+		certKey, err := reg.OpenKey(reg.Root(store.Base, 0), store.LogicalKey(logical)+`\`+fingerprintHexUpper,
+			registry.QUERY_VALUE)
+		if err != nil {
+			t.Errorf("cert missing from %s store: %v", logical, err)
+
+			continue
+		}
+		certKey.Close()
+	}
+
+	// Operations on a single store key don't silently ignore CA.
+	setTestMagicName(t, "Namecoin")
+
+	if err := CheckStoreAccess(store); err != nil {
+		t.Errorf("expected both logical stores to be writable, got %v", err)
+	}
+
+	if _, err := ListInjectedCerts(store); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore from ListInjectedCerts, got %v", err)
+	}
+
+	if _, err := IsInjected(store, derBytes); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore from IsInjected, got %v", err)
+	}
+
+	if err := RemoveCert(store, fingerprintHexUpper); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore from RemoveCert, got %v", err)
+	}
+
+	// Cleanup covers every logical store.
+	result, err := cleanStoreCryptoAPI(store, testCleanOptions(t))
+	if err != nil || result.Scanned != 2 {
+		t.Errorf("expected cleanup to scan the cert in both logical stores, got %+v (err %v)", result, err)
+	}
+}
+
+func TestBuildNameConstraintsTemplateFromCert(t *testing.T) {
+	cert := &x509.Certificate{
+		PermittedDNSDomains: []string{"bit"},
+		ExcludedDNSDomains:  []string{"example.bit"},
+	}
+
+	if hasNameConstraints(overlayNameConstraints(&x509.Certificate{}, nil)) {
+		t.Error("expected unconstrained cert to yield no name constraints")
+	}
+
+	if err := nameConstraintsPermittedDNS.CfSetValue("onion"); err != nil {
+		t.Fatalf("couldn't set permitted DNS: %v", err)
+	}
+	defer nameConstraintsPermittedDNS.CfSetValue("") //nolint:errcheck
+
+	flagsTemplate, err := nameConstraintsFlagsTemplate()
+	if err != nil {
+		t.Fatalf("couldn't build name constraints: %v", err)
+	}
+
+	template := overlayNameConstraints(cert, flagsTemplate)
+
+	if !hasNameConstraints(template) {
+		t.Fatal("expected name constraints to be valid")
+	}
+
+	// Explicit flags win over the cert's own constraints.
+	if len(template.PermittedDNSDomains) != 1 || template.PermittedDNSDomains[0] != "onion" {
+		t.Errorf("expected permitted DNS from flag, got %v", template.PermittedDNSDomains)
+	}
+
+	if len(template.ExcludedDNSDomains) != 1 || template.ExcludedDNSDomains[0] != "example.bit" {
+		t.Errorf("expected excluded DNS from cert, got %v", template.ExcludedDNSDomains)
+	}
+}
+
+func TestParseEmailConstraints(t *testing.T) {
+	emails, err := parseEmailConstraints("admin@Example.bit, @Example.bit, example.bit, .Example.bit")
+	if err != nil {
+		t.Fatalf("couldn't parse email constraints: %v", err)
+	}
+
+	expected := []string{"admin@example.bit", "example.bit", "example.bit", ".example.bit"}
+	if !reflect.DeepEqual(emails, expected) {
+		t.Errorf("expected %v, got %v", expected, emails)
+	}
+
+	for _, invalid := range []string{"admin@", "a@b@example.bit", "example..bit", "exa mple.bit", ""} {
+		if _, err := parseEmailConstraints(invalid); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%q: expected ErrInvalidOption, got: %v", invalid, err)
+		}
+	}
+
+	// A malformed flag is a usage error.
+	if err := nameConstraintsPermittedEmail.CfSetValue("a b@bit"); err != nil {
+		t.Fatalf("couldn't set permitted email: %v", err)
+	}
+	defer nameConstraintsPermittedEmail.CfSetValue("") //nolint:errcheck
+
+	if _, err := injectOptionsFromFlags(); ExitCode(err) != ExitInvalidStore {
+		t.Errorf("expected exit code %d for a malformed flag, got %d (err %v)", ExitInvalidStore, ExitCode(err), err)
+	}
+}
+
+func TestEditBlobNameConstraintsMerge(t *testing.T) {
+	existing, err := certblob.BuildNameConstraints(&x509.Certificate{
+		PermittedDNSDomains: []string{"bit", "example.bit"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't build existing name constraints: %v", err)
+	}
+
+	blob := certblob.Blob{}
+	blob.SetProperty(existing)
+
+	if err := nameConstraintsMerge.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set nc-merge: %v", err)
+	}
+	defer nameConstraintsMerge.CfSetValue(false) //nolint:errcheck
+
+	if err := nameConstraintsPermittedDNS.CfSetValue("onion"); err != nil {
+		t.Fatalf("couldn't set permitted DNS: %v", err)
+	}
+	defer nameConstraintsPermittedDNS.CfSetValue("") //nolint:errcheck
+
+	if err := editBlobNameConstraints(blob, testInjectOptions(t)); err != nil {
+		t.Fatalf("couldn't edit name constraints: %v", err)
+	}
+
+	merged, err := certblob.ParseNameConstraints(&certblob.Property{
+		ID:    certblob.CertRootProgramNameConstraintsPropID,
+		Value: blob[certblob.CertRootProgramNameConstraintsPropID],
+	})
+	if err != nil {
+		t.Fatalf("couldn't parse merged name constraints: %v", err)
+	}
+
+	expected := []string{"bit", "example.bit", "onion"}
+	if !reflect.DeepEqual(merged.PermittedDNSDomains, expected) {
+		t.Errorf("expected permitted DNS %v, got %v", expected, merged.PermittedDNSDomains)
+	}
+}
+
+func TestCheckStoreAccess(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	store := cryptoAPIStores["current-user"]
+
+	err := CheckStoreAccess(store)
+	if !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("expected ErrStoreNotFound for missing store, got: %v", err)
+	}
+
+	if ExitCode(err) != ExitInvalidStore {
+		t.Errorf("expected exit code %d for missing store, got %d", ExitInvalidStore, ExitCode(err))
+	}
+
+	storeKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.Key(), registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create store: %v", err)
+	}
+	storeKey.Close()
+
+	if err := CheckStoreAccess(store); err != nil {
+		t.Errorf("expected existing store to be accessible, got: %v", err)
+	}
+}
+
+func TestEditBlobEKUNone(t *testing.T) {
+	if err := ekuNone.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set eku-none: %v", err)
+	}
+	defer ekuNone.CfSetValue(false) //nolint:errcheck
+
+	blob := certblob.Blob{}
+	if err := editBlobEKU(blob, testInjectOptions(t)); err != nil {
+		t.Fatalf("couldn't apply eku-none: %v", err)
+	}
+
+	if string(blob[certblob.CertEnhkeyUsagePropID]) != "\x30\x00" {
+		t.Errorf("expected empty EKU property, got %x", blob[certblob.CertEnhkeyUsagePropID])
+	}
+
+	if err := ekuServer.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set eku.server: %v", err)
+	}
+	defer ekuServer.CfSetValue(false) //nolint:errcheck
+
+	if err := editBlobEKU(certblob.Blob{}, testInjectOptions(t)); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("expected ErrInvalidOption when combining eku-none with eku.server, got: %v", err)
+	}
+}
+
+func TestEditBlobKeyIdentifier(t *testing.T) {
+	rootDER, _ := testCertChain(t)
+	rootStoreKey := `SOFTWARE\Microsoft\SystemCertificates\Root\Certificates`
+	myStoreKey := `SOFTWARE\Microsoft\SystemCertificates\My\Certificates`
+
+	for _, testCase := range []struct {
+		SetKeyIdentifier string
+		StoreKey         string
+		Want             bool
+	}{
+		{"", rootStoreKey, true},
+		{"auto", myStoreKey, false},
+		{"true", myStoreKey, true},
+		{"false", rootStoreKey, false},
+	} {
+		blob := certblob.Blob{certblob.CertContentCertPropID: rootDER}
+
+		err := editBlobKeyIdentifier(blob, testCase.StoreKey, &InjectOptions{SetKeyIdentifier: testCase.SetKeyIdentifier})
+		if err != nil {
+			t.Errorf("%q: couldn't set key identifier: %v", testCase.SetKeyIdentifier, err)
+		}
+
+		if _, ok := blob[certblob.CertKeyIdentifierPropID]; ok != testCase.Want {
+			t.Errorf("%q in %s: expected key identifier %t, got %t", testCase.SetKeyIdentifier, testCase.StoreKey,
+				testCase.Want, ok)
+		}
+	}
+
+	// An unknown choice is a usage error.
+	err := editBlobKeyIdentifier(certblob.Blob{certblob.CertContentCertPropID: rootDER}, rootStoreKey,
+		&InjectOptions{SetKeyIdentifier: "yes"})
+	if !errors.Is(err, ErrInvalidOption) || ExitCode(err) != ExitInvalidStore {
+		t.Errorf("expected ErrInvalidOption for an unknown choice, got %v", err)
+	}
+}
+
+func TestIsCAStoreKey(t *testing.T) {
+	tests := map[string]bool{
+		`SOFTWARE\Microsoft\SystemCertificates\Root\Certificates`:     true,
+		`SOFTWARE\Microsoft\SystemCertificates\authroot\Certificates`: true,
+		`SOFTWARE\Microsoft\SystemCertificates\CA\Certificates`:       true,
+		`SOFTWARE\Microsoft\SystemCertificates\My\Certificates`:       false,
+		`SOFTWARE\Namecoin\certinject-test\Certificates`:              false,
+	}
+
+	for storeKey, expected := range tests {
+		if isCAStoreKey(storeKey) != expected {
+			t.Errorf("isCAStoreKey(%q): expected %t", storeKey, expected)
+		}
+	}
+}
+
+func TestCountInjected(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	store := testCryptoAPIStore
+
+	if _, err := CountInjected(store); !errors.Is(err, ErrNoMagic) {
+		t.Errorf("expected ErrNoMagic without a magic name, got: %v", err)
+	}
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpperCryptoAPI(derBytes), registry.CURRENT_USER,
+		testStoreKey, testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	// A cert without the magic tag mustn't be counted.
+	certStoreKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't open test store: %v", err)
+	}
+	defer certStoreKey.Close()
+
+	otherKey, _, err := reg.CreateKey(certStoreKey, "0000000000000000000000000000000000000000", registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create untagged cert: %v", err)
+	}
+	otherKey.Close()
+
+	count, err := CountInjected(store)
+	if err != nil {
+		t.Fatalf("couldn't count injected certs: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("expected 1 injected cert, got %d", count)
+	}
+
+	// ListInjectedCerts agrees, whatever the -method flag says.
+	if err := injectMethod.CfSetValue(InjectMethodWin32API); err != nil {
+		t.Fatalf("couldn't set method: %v", err)
+	}
+	defer injectMethod.CfSetValue(InjectMethodRegistry) //nolint:errcheck
+
+	certs, err := ListInjectedCerts(store)
+	if err != nil || len(certs) != count {
+		t.Errorf("expected ListInjectedCerts to list %d certs, got %d (err %v)", count, len(certs), err)
+	}
+}
+
+func TestInjectRepairsHalfWrittenCert(t *testing.T) {
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	for name, blobBytes := range map[string][]byte{
+		"missing blob":     nil,
+		"unparseable blob": {0x20, 0, 0, 0, 1, 0, 0, 0, 0xff, 0xff, 0, 0},
+	} {
+		_, restore := testStore(t)
+
+		certKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+			registry.ALL_ACCESS)
+		if err != nil {
+			restore()
+			t.Fatalf("%s: couldn't create cert key: %v", name, err)
+		}
+
+		_ = certKey.SetDWordValue("Namecoin", 1)
+
+		if blobBytes != nil {
+			_ = certKey.SetBinaryValue("Blob", blobBytes)
+		}
+
+		certKey.Close()
+
+		err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+			testInjectOptions(t))
+		if err != nil {
+			t.Errorf("%s: injection failed: %v", name, err)
+		}
+
+		if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+			t.Errorf("%s: injected cert doesn't verify: %v", name, err)
+		}
+
+		restore()
+	}
+}
+
+// testCertChain returns a self-signed root and an intermediate signed by it.
+func testCertChain(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate root key: %v", err)
+	}
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate intermediate key: %v", err)
+	}
+
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "certinject test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("couldn't create root: %v", err)
+	}
+
+	intermediateTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "certinject test intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	intermediateDER, err := x509.CreateCertificate(rand.Reader, intermediateTemplate, rootTemplate,
+		&intermediateKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("couldn't create intermediate: %v", err)
+	}
+
+	return rootDER, intermediateDER
+}
+
+func TestVerifyChain(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	if err := verifyChain.CfSetValue("fail"); err != nil {
+		t.Fatalf("couldn't set verify-chain: %v", err)
+	}
+	defer verifyChain.CfSetValue("") //nolint:errcheck
+
+	rootDER, intermediateDER := testCertChain(t)
+	rootStoreKey := testCryptoAPIStore.LogicalKey("Root")
+	caStoreKey := testCryptoAPIStore.LogicalKey("CA")
+
+	storeKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), caStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create CA store: %v", err)
+	}
+	storeKey.Close()
+
+	err = injectSingleCertCryptoAPI(intermediateDER, fingerprintHexUpperCryptoAPI(intermediateDER),
+		registry.CURRENT_USER, caStoreKey, testInjectOptions(t))
+	if !errors.Is(err, ErrChainVerify) {
+		t.Errorf("expected ErrChainVerify without the root, got: %v", err)
+	}
+
+	err = injectSingleCertCryptoAPI(rootDER, fingerprintHexUpperCryptoAPI(rootDER), registry.CURRENT_USER,
+		rootStoreKey, testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("couldn't inject root: %v", err)
+	}
+
+	err = injectSingleCertCryptoAPI(intermediateDER, fingerprintHexUpperCryptoAPI(intermediateDER),
+		registry.CURRENT_USER, caStoreKey, testInjectOptions(t))
+	if err != nil {
+		t.Errorf("expected intermediate to chain to injected root, got: %v", err)
+	}
+
+	opts := testInjectOptions(t)
+	opts.VerifyChain = "sometimes"
+
+	err = injectSingleCertCryptoAPI(intermediateDER, fingerprintHexUpperCryptoAPI(intermediateDER),
+		registry.CURRENT_USER, caStoreKey, opts)
+	if !errors.Is(err, ErrInvalidOption) || errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidOption for an invalid verify-chain value, got: %v", err)
+	}
+
+	if ExitCode(err) != ExitInvalidStore {
+		t.Errorf("expected exit code %d for an invalid option, got %d", ExitInvalidStore, ExitCode(err))
+	}
+}
+
+func TestParseIPRanges(t *testing.T) {
+	tests := []struct {
+		val      string
+		expected []string
+	}{
+		{"10.0.0.5", []string{"10.0.0.5/32"}},
+		{"2001:db8::1", []string{"2001:db8::1/128"}},
+		{"10.0.0.0/8, 192.168.1.1,2001:db8::/32", []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32"}},
+	}
+
+	for _, test := range tests {
+		ipNets, err := parseIPRanges(test.val)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.val, err)
+
+			continue
+		}
+
+		if len(ipNets) != len(test.expected) {
+			t.Errorf("%q: expected %d ranges, got %v", test.val, len(test.expected), ipNets)
+
+			continue
+		}
+
+		for i, ipNet := range ipNets {
+			if ipNet.String() != test.expected[i] {
+				t.Errorf("%q: expected range %d to be %s, got %s", test.val, i, test.expected[i], ipNet)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.256", "10.0.0.0/33", "10.0.0.1,"} {
+		if _, err := parseIPRanges(invalid); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("expected ErrInvalidOption for %q, got: %v", invalid, err)
+		}
+	}
+
+	// A malformed flag is a usage error.
+	if err := nameConstraintsExcludedIP.CfSetValue("10.0.0.0/33"); err != nil {
+		t.Fatalf("couldn't set excluded IP: %v", err)
+	}
+	defer nameConstraintsExcludedIP.CfSetValue("") //nolint:errcheck
+
+	if _, err := injectOptionsFromFlags(); ExitCode(err) != ExitInvalidStore {
+		t.Errorf("expected exit code %d for a malformed flag, got %d (err %v)", ExitInvalidStore, ExitCode(err), err)
+	}
+}
+
+func TestMismatchedIPFamilies(t *testing.T) {
+	tests := []struct {
+		permitted, excluded string
+		expected            []string
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", []string{}},
+		{"10.0.0.0/8", "fd00::/8", []string{"fd00::/8"}},
+		{"fd00::/8", "10.1.0.0/16, fd00:1::/32", []string{"10.1.0.0/16"}},
+		{"10.0.0.0/8, fd00::/8", "10.1.0.0/16, fd00:1::/32", []string{}},
+		{"", "10.1.0.0/16, fd00:1::/32", nil},
+	}
+
+	for _, test := range tests {
+		template := &x509.Certificate{}
+		valid := false
+
+		if err := setNameConstraintsIPRanges(&template.PermittedIPRanges, test.permitted, &valid); err != nil {
+			t.Fatalf("%q: couldn't parse permitted ranges: %v", test.permitted, err)
+		}
+
+		if err := setNameConstraintsIPRanges(&template.ExcludedIPRanges, test.excluded, &valid); err != nil {
+			t.Fatalf("%q: couldn't parse excluded ranges: %v", test.excluded, err)
+		}
+
+		var mismatched []string
+		if ipNets := mismatchedIPFamilies(template); ipNets != nil {
+			mismatched = []string{}
+
+			for _, ipNet := range ipNets {
+				mismatched = append(mismatched, ipNet.String())
+			}
+		}
+
+		if !reflect.DeepEqual(mismatched, test.expected) {
+			t.Errorf("permitted %q, excluded %q: expected mismatched %v, got %v", test.permitted, test.excluded,
+				test.expected, mismatched)
+		}
+	}
+}
+
+func TestTouchCert(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	if err := TouchCert(testCryptoAPIStore, fingerprintHexUpper); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound before injection, got: %v", err)
+	}
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+	defer certKey.Close()
+
+	oldBlobBytes, _, _ := certKey.GetBinaryValue("Blob")
+	staleModTime := time.Now().Add(-24 * time.Hour)
+	certKey.(memRegKey).node.modTime = staleModTime
+
+	if err := TouchCert(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Fatalf("couldn't touch cert: %v", err)
+	}
+
+	if !testCertModTime(t, fingerprintHexUpper).After(staleModTime) {
+		t.Error("expected touch to bump the modtime")
+	}
+
+	newBlobBytes, _, _ := certKey.GetBinaryValue("Blob")
+	if string(newBlobBytes) != string(oldBlobBytes) {
+		t.Error("expected touch to leave the blob untouched")
+	}
+}
+
+func TestCleanAllStores(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	if err := expirableMagicName.CfSetValue("Namecoin"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	// Only current-user and system exist; the other stores must be skipped.
+	for _, name := range []string{"current-user", "system"} {
+		store := cryptoAPIStores[name]
+
+		storeKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.Key(), registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", name, err)
+		}
+		storeKey.Close()
+
+		err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, store.Base, store.Key(),
+			testInjectOptions(t))
+		if err != nil {
+			t.Fatalf("couldn't inject into %s store: %v", name, err)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := CleanAllStores(time.Millisecond); err != nil {
+		t.Fatalf("couldn't clean all stores: %v", err)
+	}
+
+	for _, name := range []string{"current-user", "system"} {
+		err := VerifyInjected(cryptoAPIStores[name], fingerprintHexUpper)
+		if !errors.Is(err, ErrCertNotFound) {
+			t.Errorf("expected expired cert to be removed from %s store, got: %v", name, err)
+		}
+	}
+}
+
+func TestInjectRawBlob(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	// The content deliberately doesn't match the fingerprint.
+	const fingerprintHexUpper = "00112233445566778899AABBCCDDEEFF00112233"
+
+	blob := certblob.Blob{
+		certblob.CertContentCertPropID:  []byte("not a cert"),
+		certblob.CertFriendlyNamePropID: []byte("N\x00C\x00\x00\x00"),
+	}
+
+	if err := InjectRawBlob(testCryptoAPIStore, fingerprintHexUpper, blob); err != nil {
+		t.Fatalf("couldn't inject raw blob: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+	defer certKey.Close()
+
+	written, err := readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read injected blob: %v", err)
+	}
+
+	if len(certblob.DiffBlobs(blob, written)) != 0 {
+		t.Errorf("written blob differs from the raw blob: %+v", certblob.DiffBlobs(blob, written))
+	}
+
+	if !hasMagic(certKey, "Namecoin", 1) {
+		t.Error("expected raw blob injection to set the magic tag")
+	}
+}
+
+func TestReadBlobValueNonBinary(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	blobBytes, err := certblob.Blob{certblob.CertContentCertPropID: derBytes}.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	certKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create cert key: %v", err)
+	}
+	defer certKey.Close()
+
+	certKey.(memRegKey).node.values["Blob"] = memRegValue{registry.NONE, blobBytes}
+
+	if _, _, err := certKey.GetBinaryValue("Blob"); !errors.Is(err, registry.ErrUnexpectedType) {
+		t.Fatalf("expected the test value not to be REG_BINARY, got: %v", err)
+	}
+
+	blob, err := readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read REG_NONE blob: %v", err)
+	}
+
+	if err := checkBlobFingerprint(blob, fingerprintHexUpper); err != nil {
+		t.Errorf("REG_NONE blob didn't parse correctly: %v", err)
+	}
+}
+
+func TestInjectRejectsOversizedBlob(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	blobBytes, err := certblob.Blob{certblob.CertContentCertPropID: derBytes}.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	certKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create cert key: %v", err)
+	}
+	defer certKey.Close()
+
+	if err := certKey.SetBinaryValue("Blob", blobBytes); err != nil {
+		t.Fatalf("couldn't write existing blob: %v", err)
+	}
+
+	opts := testInjectOptions(t)
+	opts.Store = testCryptoAPIStore
+	opts.FriendlyName = "Namecoin"
+	opts.MaxBlobBytes = len(blobBytes) - 1
+
+	// The existing blob is rejected before it's parsed, and left alone.
+	err = InjectWithOptions(derBytes, *opts)
+	if !errors.Is(err, ErrBlobTooLarge) || !errors.Is(err, ErrGetInitialBlob) {
+		t.Errorf("expected ErrBlobTooLarge wrapping ErrGetInitialBlob, got %v", err)
+	}
+
+	if got, _, _ := certKey.GetBinaryValue("Blob"); !bytes.Equal(got, blobBytes) {
+		t.Error("expected the oversized blob not to be rewritten")
+	}
+
+	// The same blob is accepted at the limit.
+	opts.MaxBlobBytes = len(blobBytes)
+
+	if err := InjectWithOptions(derBytes, *opts); err != nil {
+		t.Errorf("expected a blob at the limit to be accepted, got %v", err)
+	}
+
+	// The -max-blob-bytes flag limits flag-driven injection the same way.
+	if err := maxBlobBytes.CfSetValue(len(blobBytes) - 1); err != nil {
+		t.Fatalf("couldn't set max-blob-bytes: %v", err)
+	}
+	defer maxBlobBytes.CfSetValue(defaultMaxBlobBytes) //nolint:errcheck
+
+	flagOpts, err := injectOptionsFromFlags()
+	if err != nil {
+		t.Fatalf("couldn't read flags: %v", err)
+	}
+
+	if flagOpts.MaxBlobBytes != len(blobBytes)-1 {
+		t.Errorf("expected MaxBlobBytes %d from the flag, got %d", len(blobBytes)-1, flagOpts.MaxBlobBytes)
+	}
+}
+
+func TestWriteBlobTooLarge(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	blob := certblob.Blob{
+		certblob.CertContentCertPropID:  derBytes,
+		certblob.CertFriendlyNamePropID: make([]byte, maxRegistryValueBytes),
+	}
+
+	err := InjectRawBlob(testCryptoAPIStore, fingerprintHexUpper, blob)
+	if !errors.Is(err, ErrBlobTooLargeToWrite) {
+		t.Fatalf("expected ErrBlobTooLargeToWrite, got %v", err)
+	}
+
+	if errors.Is(err, ErrBlobRead) {
+		t.Errorf("expected a write failure not to wrap ErrBlobRead, got %v", err)
+	}
+
+	size := 12 + len(derBytes) + 12 + maxRegistryValueBytes
+	if !strings.Contains(err.Error(), fmt.Sprintf("%d bytes", size)) {
+		t.Errorf("expected error to report the blob's size of %d bytes, got %v", size, err)
+	}
+
+	if _, ok, _ := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t)); ok {
+		t.Error("expected no cert key to be created for an oversized blob")
+	}
+}
+
+func TestReadInputBlobParseError(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	blobBytes, err := certblob.Blob{certblob.CertContentCertPropID: derBytes}.Marshal()
+	if err != nil {
+		t.Fatalf("couldn't marshal blob: %v", err)
+	}
+
+	certKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create cert key: %v", err)
+	}
+	defer certKey.Close()
+
+	if err := certKey.SetBinaryValue("Blob", blobBytes[:len(blobBytes)-1]); err != nil {
+		t.Fatalf("couldn't write truncated blob: %v", err)
+	}
+
+	_, err = readInputBlob(nil, registry.CURRENT_USER, testStoreKey+`\`+fingerprintHexUpper, testInjectOptions(t))
+	if !errors.Is(err, ErrGetInitialBlob) || !errors.Is(err, certblob.ErrPropertyParse) {
+		t.Fatalf("expected a parse error wrapping ErrGetInitialBlob, got: %v", err)
+	}
+
+	want := fmt.Sprintf("offset 12: property %d: value truncated", certblob.CertContentCertPropID)
+	if !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), fingerprintHexUpper) {
+		t.Errorf("expected error to name the cert and contain %q, got: %v", want, err)
+	}
+}
+
+func TestRunCleanupDaemon(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	if err := expirableMagicName.CfSetValue("Namecoin"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+
+	certKey.(memRegKey).node.modTime = time.Now().Add(-2 * testExpireDuration(t))
+	certKey.Close()
+
+	// A cancelled context still gets one pass.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	RunCleanupDaemon(ctx, testCryptoAPIStore, time.Hour)
+
+	if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpper); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected expired cert to be removed, got: %v", err)
+	}
+}
+
+// testSystemStoreDenied sets up the system and current-user Root stores
+// for injection via the flags, with the system store denying write access
+// like it does to an unelevated process.
+func testSystemStoreDenied(t *testing.T) {
+	t.Helper()
+
+	mem, restore := useMemReg()
+	t.Cleanup(restore)
+
+	for _, name := range []string{"system", "current-user"} {
+		storeKey, _, err := reg.CreateKey(reg.Root(cryptoAPIStores[name].Base, 0), cryptoAPIStores[name].LogicalKey("Root"),
+			registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", name, err)
+		}
+		storeKey.Close()
+	}
+
+	mem.readOnlyRoots[registry.LOCAL_MACHINE] = true
+
+	if err := cryptoAPIFlag.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't enable CryptoAPI: %v", err)
+	}
+
+	t.Cleanup(func() { cryptoAPIFlag.CfSetValue(false) }) //nolint:errcheck
+
+	if err := allowLeafInRoot.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set allow-leaf-in-root: %v", err)
+	}
+
+	t.Cleanup(func() { allowLeafInRoot.CfSetValue(false) }) //nolint:errcheck
+}
+
+func TestAutoUserFallback(t *testing.T) {
+	testSystemStoreDenied(t)
+
+	if err := autoUserFallback.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set auto-user-fallback: %v", err)
+	}
+	defer autoUserFallback.CfSetValue(false) //nolint:errcheck
+
+	store, err := cryptoAPIInjectStore()
+	if err != nil || store != cryptoAPIStores["current-user"] {
+		t.Errorf("expected the current-user store, got %+v (err %v)", store, err)
+	}
+
+	derBytes := testCertDER(t)
+
+	if err := InjectCertErr(derBytes); err != nil {
+		t.Fatalf("expected injection to fall back to the current-user store, got %v", err)
+	}
+
+	if injected, err := IsInjected(cryptoAPIStores["current-user"], derBytes); err != nil || !injected {
+		t.Errorf("expected the cert in the current-user store, got %t (err %v)", injected, err)
+	}
+
+	if injected, _ := IsInjected(cryptoAPIStores["system"], derBytes); injected {
+		t.Error("expected the cert not to be in the system store")
+	}
+}
+
+func TestAutoUserFallbackDisabled(t *testing.T) {
+	testSystemStoreDenied(t)
+
+	store, err := cryptoAPIInjectStore()
+	if err != nil || store != cryptoAPIStores["system"] {
+		t.Errorf("expected the system store, got %+v (err %v)", store, err)
+	}
+
+	derBytes := testCertDER(t)
+
+	err = InjectCertErr(derBytes)
+	if !errors.Is(err, ErrStoreOpen) || !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		t.Errorf("expected access to the system store to be denied without the fallback, got %v", err)
+	}
+
+	if injected, _ := IsInjected(cryptoAPIStores["current-user"], derBytes); injected {
+		t.Error("expected the cert not to be in the current-user store")
+	}
+}
+
+// setTestExpirableMagicName sets the -set-magic-name and
+// -expirable-magic-name flags until the test ends, so that injected certs
+// can expire.
+func setTestExpirableMagicName(t *testing.T, name string) {
+	t.Helper()
+
+	setTestMagicName(t, name)
+
+	if err := expirableMagicName.CfSetValue(name); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+
+	t.Cleanup(func() { expirableMagicName.CfSetValue("") }) //nolint:errcheck
+}
+
+// injectAgedTestCert injects the cert into the test store with the flags'
+// options, and sets its last modified time to modTime.
+func injectAgedTestCert(t *testing.T, derBytes []byte, modTime time.Time) string {
+	t.Helper()
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+	defer certKey.Close()
+
+	certKey.(memRegKey).node.modTime = modTime
+
+	return fingerprintHexUpper
+}
+
+func TestRenewExpiredSameFingerprint(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestExpirableMagicName(t, "Namecoin")
+	testFlagStore(t)
+
+	rootDER, _ := testCertChain(t)
+	fingerprintHexUpper := injectAgedTestCert(t, rootDER, time.Now().Add(-2*testExpireDuration(t)))
+
+	err := RenewExpired(testCryptoAPIStore, func(old CertInfo) ([]byte, bool) {
+		if old.Fingerprint != fingerprintHexUpper {
+			t.Errorf("expected renewal of %s, got %s", fingerprintHexUpper, old.Fingerprint)
+		}
+
+		return old.Blob[certblob.CertContentCertPropID], true
+	})
+	if err != nil {
+		t.Fatalf("RenewExpired failed: %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Fatalf("expected the renewed cert to be kept, got %v", err)
+	}
+
+	// The unchanged cert's age is reset, so that cleanup doesn't remove it.
+	if age := time.Since(testCertModTime(t, fingerprintHexUpper)); age > time.Minute {
+		t.Errorf("expected the renewed cert's age to be reset, got %s", age)
+	}
+
+	if err := CleanCertsCryptoAPI(); err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Errorf("expected the renewed cert to survive cleanup, got %v", err)
+	}
+}
+
+func TestRenewExpiredNewFingerprint(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestExpirableMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	oldFingerprint := injectAgedTestCert(t, rootDER, time.Now().Add(-2*testExpireDuration(t)))
+
+	err := RenewExpired(testCryptoAPIStore, func(_ CertInfo) ([]byte, bool) {
+		return intermediateDER, true
+	})
+	if err != nil {
+		t.Fatalf("RenewExpired failed: %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, oldFingerprint); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected the expired cert to be removed, got %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpperCryptoAPI(intermediateDER)); err != nil {
+		t.Errorf("expected the replacement to be injected with the magic tag, got %v", err)
+	}
+}
+
+func TestRenewExpiredNoReplacement(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestExpirableMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	expired := injectAgedTestCert(t, rootDER, time.Now().Add(-2*testExpireDuration(t)))
+	fresh := injectAgedTestCert(t, intermediateDER, time.Now())
+
+	calls := 0
+
+	err := RenewExpired(testCryptoAPIStore, func(_ CertInfo) ([]byte, bool) {
+		calls++
+
+		return nil, false
+	})
+	if err != nil {
+		t.Fatalf("RenewExpired failed: %v", err)
+	}
+
+	// Only expired certs are offered for renewal.
+	if calls != 1 {
+		t.Errorf("expected the provider to be called once, got %d", calls)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, expired); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected the expired cert to be removed, got %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, fresh); err != nil {
+		t.Errorf("expected the fresh cert to be kept, got %v", err)
+	}
+}
+
+func TestRenewExpiredContinuesAfterError(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestExpirableMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	stale := time.Now().Add(-2 * testExpireDuration(t))
+	corrupt := injectAgedTestCert(t, rootDER, stale)
+	renewable := injectAgedTestCert(t, intermediateDER, stale)
+
+	// A blob that can't be read makes the cert's renewal fail.
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+corrupt, registry.SET_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+
+	if err := certKey.SetBinaryValue("Blob", []byte{0xff}); err != nil {
+		t.Fatalf("couldn't corrupt blob: %v", err)
+	}
+
+	certKey.(memRegKey).node.modTime = stale
+	certKey.Close()
+
+	renewed := []string{}
+
+	err = RenewExpired(testCryptoAPIStore, func(old CertInfo) ([]byte, bool) {
+		renewed = append(renewed, old.Fingerprint)
+
+		return old.Blob[certblob.CertContentCertPropID], true
+	})
+	if err == nil || !strings.Contains(err.Error(), displayFingerprint(corrupt)) {
+		t.Errorf("expected an error naming the corrupt cert, got %v", err)
+	}
+
+	if len(renewed) != 1 || renewed[0] != renewable {
+		t.Errorf("expected the other cert to be renewed anyway, got %v", renewed)
+	}
+}
+
+func TestCleanInjectedBefore(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestExpirableMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	derBytes := testCertDER(t)
+	cutoff := time.Now().Add(-48 * time.Hour)
+
+	before := injectAgedTestCert(t, rootDER, cutoff.Add(-time.Hour))
+	// Older than the -expire flag allows, but after the cutoff.
+	after := injectAgedTestCert(t, intermediateDER, cutoff.Add(time.Hour))
+
+	// A cert without the magic tag is never removed, however old.
+	untagged := fingerprintHexUpperCryptoAPI(derBytes)
+
+	err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes}, untagged,
+		registry.CURRENT_USER, testStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write untagged cert: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+untagged, registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open untagged cert: %v", err)
+	}
+
+	certKey.(memRegKey).node.modTime = cutoff.Add(-time.Hour)
+	certKey.Close()
+
+	removed, err := CleanInjectedBefore(testCryptoAPIStore, cutoff)
+	if err != nil || len(removed) != 1 || removed[0] != before {
+		t.Errorf("expected only %s to be removed, got %v (err %v)", before, removed, err)
+	}
+
+	if injected, err := IsInjected(testCryptoAPIStore, rootDER); err != nil || injected {
+		t.Errorf("expected the cert injected before the cutoff to be removed, got %t (err %v)", injected, err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, after); err != nil {
+		t.Errorf("expected the cert injected after the cutoff to be kept, got %v", err)
+	}
+
+	if injected, err := IsInjected(testCryptoAPIStore, derBytes); err != nil || !injected {
+		t.Errorf("expected the untagged cert to be kept, got %t (err %v)", injected, err)
+	}
+}
+
+// testFlagStore enables CryptoAPI injection via the flags, into the test
+// store, for tests of the cross-platform entry points.  Leaf certs are
+// allowed, since the test cert is one.
+func testFlagStore(t *testing.T) {
+	t.Helper()
+
+	if err := RegisterStore("test-flags", testCryptoAPIStore); err != nil {
+		t.Fatalf("couldn't register store: %v", err)
+	}
+
+	t.Cleanup(func() {
+		cryptoAPIStoresMu.Lock()
+		delete(cryptoAPIStores, "test-flags")
+		cryptoAPIStoresMu.Unlock()
+	})
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("test-flags"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+
+	t.Cleanup(func() { cryptoAPIFlagPhysicalStoreName.CfSetValue("system") }) //nolint:errcheck
+
+	if err := cryptoAPIFlag.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't enable CryptoAPI: %v", err)
+	}
+
+	t.Cleanup(func() { cryptoAPIFlag.CfSetValue(false) }) //nolint:errcheck
+
+	if err := allowLeafInRoot.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set allow-leaf-in-root: %v", err)
+	}
+
+	t.Cleanup(func() { allowLeafInRoot.CfSetValue(false) }) //nolint:errcheck
+}
+
+func TestInjectCertResultCryptoAPI(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	testFlagStore(t)
+
+	derBytes := testCertDER(t)
+
+	fingerprint, err := InjectCertResult(derBytes)
+	if err != nil {
+		t.Fatalf("InjectCertResult failed: %v", err)
+	}
+
+	if fingerprint != fingerprintHexUpperCryptoAPI(derBytes) {
+		t.Errorf("expected fingerprint %s, got %s", fingerprintHexUpperCryptoAPI(derBytes), fingerprint)
+	}
+
+	// The returned fingerprint identifies the injected cert.
+	if err := VerifyInjected(testCryptoAPIStore, fingerprint); err != nil {
+		t.Errorf("expected cert to be injected as %s: %v", fingerprint, err)
+	}
+
+	if err := RemoveCert(testCryptoAPIStore, fingerprint); err != nil {
+		t.Errorf("couldn't remove cert by the returned fingerprint: %v", err)
+	}
+}
+
+func TestInjectPEMReaderCryptoAPI(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	testFlagStore(t)
+
+	rootDER, intermediateDER := testCertChain(t)
+
+	var bundle bytes.Buffer
+
+	for _, block := range []*pem.Block{
+		{Type: "CERTIFICATE", Bytes: rootDER},
+		{Type: "PRIVATE KEY", Bytes: []byte("key")},
+		{Type: "CERTIFICATE", Bytes: intermediateDER},
+	} {
+		if err := pem.Encode(&bundle, block); err != nil {
+			t.Fatalf("couldn't encode PEM: %v", err)
+		}
+	}
+
+	n, err := InjectPEMReader(&bundle)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 certs to be injected, got %d (err %v)", n, err)
+	}
+
+	for _, derBytes := range [][]byte{rootDER, intermediateDER} {
+		if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpperCryptoAPI(derBytes)); err != nil {
+			t.Errorf("expected cert to be injected: %v", err)
+		}
+	}
+
+	// Injection errors stop the stream, and aren't counted.
+	bad := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a cert")})
+
+	n, err = InjectPEMReader(bytes.NewReader(append(pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: rootDER,
+	}), bad...)))
+	if !errors.Is(err, ErrBadCert) || n != 1 {
+		t.Errorf("expected ErrBadCert after 1 cert, got %d (err %v)", n, err)
+	}
+}
+
+func TestInjectCertsProgressCryptoAPI(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	testFlagStore(t)
+
+	derBytes := testCertDER(t)
+	certs := [][]byte{derBytes, []byte("garbage")}
+	calls := 0
+
+	err := InjectCerts(certs, func(done, total int, fingerprint string, err error) {
+		calls++
+
+		if done != calls || total != len(certs) {
+			t.Errorf("unexpected progress %d/%d", done, total)
+		}
+
+		if fingerprint != fingerprintHexUpperCryptoAPI(certs[done-1]) {
+			t.Errorf("cert %d: unexpected fingerprint %s", done, fingerprint)
+		}
+
+		switch done {
+		case 1:
+			if err != nil {
+				t.Errorf("expected first cert to be injected, got: %v", err)
+			}
+
+			if err := VerifyInjected(testCryptoAPIStore, fingerprint); err != nil {
+				t.Errorf("expected first cert to be in the store before its callback: %v", err)
+			}
+		case 2:
+			if !errors.Is(err, ErrBadCert) {
+				t.Errorf("expected ErrBadCert for the second cert, got: %v", err)
+			}
+		}
+	})
+
+	if calls != len(certs) {
+		t.Errorf("expected %d callbacks, got %d", len(certs), calls)
+	}
+
+	// The failed cert doesn't stop the batch, but is reported.
+	if !errors.Is(err, ErrBadCert) {
+		t.Errorf("expected ErrBadCert from the batch, got: %v", err)
+	}
+}
+
+func TestConfiguredStoreCryptoAPI(t *testing.T) {
+	if _, err := ConfiguredStoreCryptoAPI(); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore without -cryptoapi, got %v", err)
+	}
+
+	if err := cryptoAPIFlag.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't enable CryptoAPI: %v", err)
+	}
+	defer cryptoAPIFlag.CfSetValue(false) //nolint:errcheck
+
+	store, err := ConfiguredStoreCryptoAPI()
+	if err != nil || store != cryptoAPIStores["system"] {
+		t.Errorf("expected the system store, got %v (err %v)", store, err)
+	}
+}
+
+func TestFingerprintForms(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	fingerprintHexLower := strings.ToLower(fingerprintHexUpper)
+
+	colons := []string{}
+	spaces := []string{}
+
+	for i := 0; i < len(fingerprintHexLower); i += 2 {
+		colons = append(colons, fingerprintHexLower[i:i+2])
+		spaces = append(spaces, fingerprintHexUpper[i:i+2])
+	}
+
+	forms := []string{
+		strings.Join(colons, ":"),
+		fingerprintHexLower,
+		fingerprintHexUpper,
+		"\u200e" + strings.Join(spaces, " "),
+	}
+
+	for _, form := range forms {
+		if normalizeFingerprintCryptoAPI(form) != fingerprintHexUpper {
+			t.Errorf("%q: expected %s, got %s", form, fingerprintHexUpper, normalizeFingerprintCryptoAPI(form))
+		}
+
+		err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+			testInjectOptions(t))
+		if err != nil {
+			t.Fatalf("injection failed: %v", err)
+		}
+
+		if err := VerifyInjected(testCryptoAPIStore, form); err != nil {
+			t.Errorf("%q: couldn't verify: %v", form, err)
+		}
+
+		if err := RemoveCert(testCryptoAPIStore, form); err != nil {
+			t.Errorf("%q: couldn't remove: %v", form, err)
+		}
+
+		if err := RemoveCert(testCryptoAPIStore, form); !errors.Is(err, ErrCertNotFound) {
+			t.Errorf("%q: expected ErrCertNotFound after removal, got: %v", form, err)
+		}
+	}
+}
+
+func TestBuiltinStoreKeysValid(t *testing.T) {
+	defer cryptoAPIFlagLogicalStoreName.CfSetValue("Root") //nolint:errcheck
+
+	for _, name := range cryptoAPIStoreNames() {
+		store, err := cryptoAPINameToStore(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for _, logical := range cryptoAPILogicalStores {
+			if err := cryptoAPIFlagLogicalStoreName.CfSetValue(logical); err != nil {
+				t.Fatalf("couldn't set logical store: %v", err)
+			}
+
+			if !validRegistryPath(store.Key()) {
+				t.Errorf("%s+%s: invalid registry path %q", name, logical, store.Key())
+			}
+		}
+	}
+}
+
+func TestRegisterStore(t *testing.T) {
+	store := Store{registry.CURRENT_USER, `SOFTWARE\Namecoin\certinject-test`, `%s\Certificates`}
+
+	defer func() {
+		cryptoAPIStoresMu.Lock()
+		delete(cryptoAPIStores, "test-registered")
+		cryptoAPIStoresMu.Unlock()
+	}()
+
+	if err := RegisterStore("test-registered", store); err != nil {
+		t.Fatalf("couldn't register store: %v", err)
+	}
+
+	if got, err := cryptoAPINameToStore("test-registered"); err != nil || got != store {
+		t.Errorf("expected registered store %v, got %v (err %v)", store, got, err)
+	}
+
+	if err := RegisterStore("test-registered", store); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for duplicate name, got: %v", err)
+	}
+
+	invalid := Store{registry.CURRENT_USER, `SOFTWARE\\Namecoin`, `%s\Certificates`}
+	if err := RegisterStore("test-invalid", invalid); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for invalid path, got: %v", err)
+	}
+}
+
+func TestIsInjected(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+
+	if injected, err := IsInjected(testCryptoAPIStore, derBytes); err != nil || injected {
+		t.Errorf("expected cert not to be injected yet, got %t (err %v)", injected, err)
+	}
+
+	// Simulate a cert added by Windows, without the magic tag.
+	certKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0),
+		testStoreKey+`\`+fingerprintHexUpperCryptoAPI(derBytes), registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create cert key: %v", err)
+	}
+	certKey.Close()
+
+	if injected, err := IsInjected(testCryptoAPIStore, derBytes); err != nil || !injected {
+		t.Errorf("expected cert to be present, got %t (err %v)", injected, err)
+	}
+
+	if injected, err := IsNamecoinInjected(testCryptoAPIStore, derBytes); err != nil || injected {
+		t.Errorf("expected untagged cert not to be Namecoin-injected, got %t (err %v)", injected, err)
+	}
+
+	err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpperCryptoAPI(derBytes), registry.CURRENT_USER,
+		testStoreKey, testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	if injected, err := IsNamecoinInjected(testCryptoAPIStore, derBytes); err != nil || !injected {
+		t.Errorf("expected cert to be Namecoin-injected, got %t (err %v)", injected, err)
+	}
+}
+
+func TestInjectWithOptions(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	err := InjectWithOptions(derBytes, InjectOptions{
+		Store:           testCryptoAPIStore,
+		ExtKeyUsages:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		FriendlyName:    "Namecoin",
+		MagicName:       "NamecoinOptions",
+		MagicData:       2,
+		AllowLeafInRoot: true,
+	})
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+		registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open cert key: %v", err)
+	}
+	defer certKey.Close()
+
+	if !hasMagic(certKey, "NamecoinOptions", 2) {
+		t.Error("expected magic tag from options")
+	}
+
+	blob, err := readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read blob: %v", err)
+	}
+
+	friendlyNameProperty, err := certblob.BuildFriendlyName("Namecoin")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %v", err)
+	}
+
+	if !bytes.Equal(blob[certblob.CertFriendlyNamePropID], friendlyNameProperty.Value) {
+		t.Errorf("unexpected friendly name property %x", blob[certblob.CertFriendlyNamePropID])
+	}
+
+	if blob[certblob.CertEnhkeyUsagePropID] == nil {
+		t.Error("expected extended key usage property")
+	}
+
+	if err := InjectWithOptions(derBytes, InjectOptions{}); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore without a store, got: %v", err)
+	}
+}
+
+func TestRepairStoreConsolidatesDuplicates(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	friendlyNameProperty, err := certblob.BuildFriendlyName("Namecoin")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %v", err)
+	}
+
+	// The canonical key, as written by Windows.
+	err = InjectRawBlob(testCryptoAPIStore, fingerprintHexUpper, certblob.Blob{
+		certblob.CertContentCertPropID: derBytes,
+	})
+	if err != nil {
+		t.Fatalf("couldn't write canonical cert: %v", err)
+	}
+
+	// A duplicate written by another tool, with lowercase colon-separated
+	// hex.  (Names that only differ in case are the same registry key.)
+	pairs := []string{}
+	for i := 0; i < len(fingerprintHexUpper); i += 2 {
+		pairs = append(pairs, strings.ToLower(fingerprintHexUpper[i:i+2]))
+	}
+
+	duplicate := strings.Join(pairs, ":")
+
+	duplicateBlob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+	duplicateBlob.SetProperty(friendlyNameProperty)
+
+	err = writeBlobCryptoAPI(duplicateBlob, duplicate, registry.CURRENT_USER, testStoreKey,
+		&InjectOptions{MagicName: "Namecoin", MagicData: 1})
+	if err != nil {
+		t.Fatalf("couldn't write duplicate cert: %v", err)
+	}
+
+	repaired, err := RepairStore(testCryptoAPIStore)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+
+	if len(repaired) != 1 || repaired[0] != fingerprintHexUpper {
+		t.Errorf("expected %s to be repaired, got %v", fingerprintHexUpper, repaired)
+	}
+
+	root := reg.Root(registry.CURRENT_USER, 0)
+
+	if _, err := reg.OpenKey(root, testStoreKey+`\`+duplicate, registry.QUERY_VALUE); !errors.Is(err,
+		registry.ErrNotExist) {
+		t.Errorf("expected duplicate to be deleted, got: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(root, testStoreKey+`\`+fingerprintHexUpper, registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open canonical cert: %v", err)
+	}
+	defer certKey.Close()
+
+	blob, err := readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read canonical blob: %v", err)
+	}
+
+	if !bytes.Equal(blob[certblob.CertFriendlyNamePropID], friendlyNameProperty.Value) {
+		t.Error("expected duplicate's friendly name to be merged into the canonical cert")
+	}
+}
+
+func TestRepairStoreSkipsUntagged(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	duplicate := strings.ToLower(fingerprintHexUpperCryptoAPI(derBytes)) + " "
+
+	err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes}, duplicate,
+		registry.CURRENT_USER, testStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write duplicate cert: %v", err)
+	}
+
+	repaired, err := RepairStore(testCryptoAPIStore)
+	if err != nil || len(repaired) != 0 {
+		t.Errorf("expected untagged cert to be left alone, got %v (err %v)", repaired, err)
+	}
+}
+
+func TestRepairStoreUntaggedCanonical(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	// The canonical key, as written by Windows, without the magic tag.
+	err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes}, fingerprintHexUpper,
+		registry.CURRENT_USER, testStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write canonical cert: %v", err)
+	}
+
+	duplicate := strings.ToLower(fingerprintHexUpper) + " "
+
+	err = writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes}, duplicate,
+		registry.CURRENT_USER, testStoreKey, &InjectOptions{MagicName: "Namecoin", MagicData: 1})
+	if err != nil {
+		t.Fatalf("couldn't write duplicate cert: %v", err)
+	}
+
+	repaired, err := RepairStore(testCryptoAPIStore)
+	if err != nil || len(repaired) != 1 {
+		t.Fatalf("expected the duplicate to be consolidated, got %v (err %v)", repaired, err)
+	}
+
+	certKey, _, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+	if err != nil {
+		t.Fatalf("couldn't open canonical cert: %v", err)
+	}
+	defer certKey.Close()
+
+	if hasMagic(certKey, "Namecoin", 1) {
+		t.Error("expected the untagged canonical cert not to be tagged by the merge")
+	}
+}
+
+func TestRepairStoreMismatchedDuplicate(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	rootDER, _ := testCertChain(t)
+
+	// A tagged duplicate whose name is derBytes' fingerprint, but whose blob
+	// contains a different cert.
+	duplicate := strings.ToLower(fingerprintHexUpperCryptoAPI(derBytes)) + " "
+
+	err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: rootDER}, duplicate,
+		registry.CURRENT_USER, testStoreKey, &InjectOptions{MagicName: "Namecoin", MagicData: 1})
+	if err != nil {
+		t.Fatalf("couldn't write duplicate cert: %v", err)
+	}
+
+	repaired, err := RepairStore(testCryptoAPIStore)
+	if !errors.Is(err, ErrCorruptCert) || len(repaired) != 0 {
+		t.Errorf("expected ErrCorruptCert and no repairs, got %v (err %v)", repaired, err)
+	}
+
+	if injected, err := IsInjected(testCryptoAPIStore, derBytes); err != nil || injected {
+		t.Errorf("expected no canonical cert to be written, got %t (err %v)", injected, err)
+	}
+
+	if _, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+duplicate,
+		registry.QUERY_VALUE); err != nil {
+		t.Errorf("expected the duplicate to be kept, got %v", err)
+	}
+}
+
+func TestBuildBlobMatchesInjection(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	opts := InjectOptions{
+		Store:           testCryptoAPIStore,
+		ExtKeyUsages:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		FriendlyName:    "Namecoin",
+		AllowLeafInRoot: true,
+	}
+
+	built, err := BuildBlob(derBytes, opts)
+	if err != nil {
+		t.Fatalf("couldn't build blob: %v", err)
+	}
+
+	if !bytes.Equal(built[certblob.CertContentCertPropID], derBytes) {
+		t.Error("expected built blob to contain the cert")
+	}
+
+	// Building doesn't write anything.
+	if injected, err := IsInjected(testCryptoAPIStore, derBytes); err != nil || injected {
+		t.Fatalf("expected BuildBlob not to inject, got %t (err %v)", injected, err)
+	}
+
+	if err := InjectWithOptions(derBytes, opts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0),
+		testStoreKey+`\`+fingerprintHexUpperCryptoAPI(derBytes), registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open cert key: %v", err)
+	}
+	defer certKey.Close()
+
+	written, err := readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read blob: %v", err)
+	}
+
+	if diffs := certblob.DiffBlobs(built, written); len(diffs) != 0 {
+		t.Errorf("expected built blob to match the injected one, got diffs %v", diffs)
+	}
+}
+
+func TestPurgeAllInjected(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	store := cryptoAPIStores["current-user"]
+	root := reg.Root(store.Base, 0)
+	tagged := &InjectOptions{MagicName: "Namecoin", MagicData: 1}
+
+	// A tagged cert in each of two logical stores, and an untagged one.
+	for _, logical := range []string{"Root", "CA"} {
+		storeKey, _, err := reg.CreateKey(root, store.LogicalKey(logical), registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", logical, err)
+		}
+		storeKey.Close()
+
+		err = writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: rootDER},
+			fingerprintHexUpperCryptoAPI(rootDER), store.Base, store.LogicalKey(logical), tagged)
+		if err != nil {
+			t.Fatalf("couldn't inject into %s: %v", logical, err)
+		}
+	}
+
+	untaggedPath := store.LogicalKey("CA") + `\` + fingerprintHexUpperCryptoAPI(intermediateDER)
+
+	err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: intermediateDER},
+		fingerprintHexUpperCryptoAPI(intermediateDER), store.Base, store.LogicalKey("CA"), &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write untagged cert: %v", err)
+	}
+
+	if err := purgeDryRun.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set dry run: %v", err)
+	}
+
+	removed, err := PurgeAllInjected()
+	purgeDryRun.CfSetValue(false) //nolint:errcheck
+
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("expected dry run to report 2 certs, got %v (err %v)", removed, err)
+	}
+
+	if injected, err := IsInjected(store, rootDER); err != nil || !injected {
+		t.Fatalf("expected dry run not to remove anything, got %t (err %v)", injected, err)
+	}
+
+	removed, err = PurgeAllInjected()
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("expected 2 certs to be removed, got %v (err %v)", removed, err)
+	}
+
+	for _, logical := range []string{"Root", "CA"} {
+		_, err := reg.OpenKey(root, store.LogicalKey(logical)+`\`+fingerprintHexUpperCryptoAPI(rootDER),
+			registry.QUERY_VALUE)
+		if !errors.Is(err, registry.ErrNotExist) {
+			t.Errorf("expected tagged cert to be removed from %s, got: %v", logical, err)
+		}
+	}
+
+	certKey, err := reg.OpenKey(root, untaggedPath, registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("expected untagged cert to be kept, got: %v", err)
+	}
+	certKey.Close()
+}
+
+func TestUserSIDStore(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	const sid = "S-1-5-21-1004336348-1177238915-682003330-1001"
+
+	currentUser := cryptoAPIStores["current-user"]
+
+	if _, err := userSIDStore(currentUser, "S-1-5-bogus"); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for malformed SID, got: %v", err)
+	}
+
+	if _, err := userSIDStore(cryptoAPIStores["system"], sid); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for system store, got: %v", err)
+	}
+
+	if _, err := userSIDStore(currentUser, sid); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("expected ErrStoreNotFound for unloaded hive, got: %v", err)
+	}
+
+	hiveKey, _, err := reg.CreateKey(reg.Root(registry.USERS, 0), sid, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create hive: %v", err)
+	}
+	hiveKey.Close()
+
+	store, err := userSIDStore(currentUser, sid)
+	if err != nil {
+		t.Fatalf("couldn't redirect store: %v", err)
+	}
+
+	expected := Store{registry.USERS, sid + `\` + currentUser.Physical, currentUser.Logical}
+	if store != expected {
+		t.Errorf("expected %v, got %v", expected, store)
+	}
+}
+
+func TestAppPackageStore(t *testing.T) {
+	const sid = "S-1-15-2-3251537155-1984446955-2931258699-841473695-1938553385-924012577-2112421744"
+
+	currentUser := cryptoAPIStores["current-user"]
+
+	for _, bogus := range []string{"S-1-5-21-1004336348-1177238915-682003330-1001", "S-1-15-2-1-2-3", "S-1-15-2"} {
+		if _, err := appPackageStore(currentUser, bogus); !errors.Is(err, ErrInvalidStore) {
+			t.Errorf("expected ErrInvalidStore for SID %s, got: %v", bogus, err)
+		}
+	}
+
+	if _, err := appPackageStore(cryptoAPIStores["system"], sid); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for system store, got: %v", err)
+	}
+
+	defer appPackage.CfSetValue("")                           //nolint:errcheck
+	defer cryptoAPIFlagPhysicalStoreName.CfSetValue("system") //nolint:errcheck
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("current-user"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+
+	if err := appPackage.CfSetValue(sid); err != nil {
+		t.Fatalf("couldn't set app package: %v", err)
+	}
+
+	store, err := cryptoAPIFlagStore()
+	if err != nil {
+		t.Fatalf("couldn't redirect store: %v", err)
+	}
+
+	expected := `SOFTWARE\Classes\Local Settings\Software\Microsoft\Windows\CurrentVersion\AppContainer\Storage\` +
+		sid + `\SOFTWARE\Microsoft\SystemCertificates\Root\Certificates`
+	if store.Base != registry.CURRENT_USER || store.Key() != expected {
+		t.Errorf("expected %s, got %v", expected, store)
+	}
+}
+
+func TestInjectWithExpiry(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("current-user"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+	defer cryptoAPIFlagPhysicalStoreName.CfSetValue("system") //nolint:errcheck
+
+	setTestMagicName(t, "Namecoin-Expirable")
+
+	if err := expirableMagicName.CfSetValue("Namecoin-Expirable"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+
+	store := cryptoAPIStores["current-user"]
+
+	certStoreKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.Key(), registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create store: %v", err)
+	}
+	defer certStoreKey.Close()
+
+	// The badssl.com test cert expired long ago.
+	if err := InjectWithExpiry(testCertDER(t), time.Hour); !errors.Is(err, ErrCertExpired) {
+		t.Errorf("expected ErrCertExpired, got: %v", err)
+	}
+
+	rootDER, intermediateDER := testCertChain(t)
+
+	if err := InjectWithExpiry(rootDER, time.Hour); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	for _, ttl := range []time.Duration{0, -time.Minute} {
+		if err := InjectWithExpiry(intermediateDER, ttl); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("expected ErrInvalidOption for TTL %s, got %v", ttl, err)
+		}
+	}
+
+	injectOpts, err := injectOptionsFromFlags()
+	if err != nil {
+		t.Fatalf("couldn't get options: %v", err)
+	}
+
+	injectOpts.Store = store
+	injectOpts.ExpiresAt = time.Now().Add(-time.Minute)
+
+	if err := InjectWithOptions(intermediateDER, injectOpts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	rootFingerprint := fingerprintHexUpperCryptoAPI(rootDER)
+
+	// The explicit expiry wins over a stale last modified time...
+	certKey, err := reg.OpenKey(certStoreKey, rootFingerprint, registry.QUERY_VALUE)
+	if err != nil {
+		t.Fatalf("couldn't open injected cert: %v", err)
+	}
+	certKey.(memRegKey).node.modTime = time.Now().Add(-24 * time.Hour)
+	certKey.Close()
+
+	opts := testCleanOptions(t)
+	opts.maxAge = time.Minute
+
+	expired, err := checkCertExpiredCryptoAPI(certStoreKey, rootFingerprint, opts)
+	if err != nil || expired {
+		t.Errorf("expected cert with future expiry to be unexpired, got expired=%t err=%v", expired, err)
+	}
+
+	// ...and over a fresh one.
+	opts.maxAge = time.Hour
+
+	expired, err = checkCertExpiredCryptoAPI(certStoreKey, fingerprintHexUpperCryptoAPI(intermediateDER), opts)
+	if err != nil || !expired {
+		t.Errorf("expected cert with past expiry to be expired, got expired=%t err=%v", expired, err)
+	}
+}
+
+func TestInjectWithExpiryCapAndClear(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("current-user"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+	defer cryptoAPIFlagPhysicalStoreName.CfSetValue("system") //nolint:errcheck
+
+	setTestMagicName(t, "Namecoin")
+
+	store := cryptoAPIStores["current-user"]
+
+	certStoreKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.Key(), registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create store: %v", err)
+	}
+	defer certStoreKey.Close()
+
+	rootDER, _ := testCertChain(t)
+	rootFingerprint := fingerprintHexUpperCryptoAPI(rootDER)
+
+	cert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatalf("couldn't parse cert: %v", err)
+	}
+
+	// The test root expires in an hour, so a day's TTL is capped.
+	if err := InjectWithExpiry(rootDER, 24*time.Hour); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	expiry, ok := explicitExpiryCryptoAPI(certStoreKey, rootFingerprint)
+	if !ok || !expiry.Equal(cert.NotAfter.Truncate(time.Second)) {
+		t.Errorf("expected expiry to be capped at %s, got %s (ok %t)", cert.NotAfter, expiry, ok)
+	}
+
+	// Re-injecting without an expiry removes the recorded one.
+	if err := InjectCertCryptoAPI(rootDER); err != nil {
+		t.Fatalf("re-injection failed: %v", err)
+	}
+
+	if expiry, ok := explicitExpiryCryptoAPI(certStoreKey, rootFingerprint); ok {
+		t.Errorf("expected re-injection to clear the expiry, got %s", expiry)
+	}
+}
+
+func TestFriendlyNamePreservation(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	readFriendlyName := func() []byte {
+		t.Helper()
+
+		certKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey+`\`+fingerprintHexUpper,
+			registry.QUERY_VALUE)
+		if err != nil {
+			t.Fatalf("couldn't open cert key: %v", err)
+		}
+		defer certKey.Close()
+
+		blob, err := readBlobValue(certKey, defaultMaxBlobBytes)
+		if err != nil {
+			t.Fatalf("couldn't read blob: %v", err)
+		}
+
+		return blob[certblob.CertFriendlyNamePropID]
+	}
+
+	inject := func(name string, reset bool) {
+		t.Helper()
+
+		err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+			&InjectOptions{FriendlyName: name, Reset: reset, AllowLeafInRoot: true})
+		if err != nil {
+			t.Fatalf("injection failed: %v", err)
+		}
+	}
+
+	// Simulate a name set by the user in certmgr.
+	userName, err := certblob.BuildFriendlyName("Set by user")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %v", err)
+	}
+
+	inject("Set by user", false)
+
+	// Preserve: an empty flag keeps the existing name.
+	inject("", false)
+
+	if !bytes.Equal(readFriendlyName(), userName.Value) {
+		t.Errorf("expected existing friendly name to be preserved, got %x", readFriendlyName())
+	}
+
+	// Overwrite: a non-empty flag replaces it.
+	newName, err := certblob.BuildFriendlyName("Namecoin")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %v", err)
+	}
+
+	inject("Namecoin", false)
+
+	if !bytes.Equal(readFriendlyName(), newName.Value) {
+		t.Errorf("expected friendly name to be overwritten, got %x", readFriendlyName())
+	}
+
+	// Explicit clear: an empty flag with a reset removes it.
+	inject("", true)
+
+	if readFriendlyName() != nil {
+		t.Errorf("expected friendly name to be cleared, got %x", readFriendlyName())
+	}
+}
+
+func TestTrustStatusReason(t *testing.T) {
+	if reason := trustStatusReason(0); reason != "" {
+		t.Errorf("expected no reason for a clean status, got %q", reason)
+	}
+
+	reason := trustStatusReason(windows.CERT_TRUST_IS_EXPLICIT_DISTRUST | windows.CERT_TRUST_IS_NOT_VALID_FOR_USAGE)
+	if !strings.Contains(reason, "distrusted") || !strings.Contains(reason, "usage") {
+		t.Errorf("expected both reasons, got %q", reason)
+	}
+}
+
+func TestEvaluateTrustUnsupportedPurpose(t *testing.T) {
+	_, _, err := EvaluateTrust(testCertDER(t), x509.ExtKeyUsageMicrosoftKernelCodeSigning+100)
+	if !errors.Is(err, ErrInvalidOption) || errors.Is(err, ErrEditBlob) {
+		t.Errorf("expected ErrInvalidOption for an unsupported purpose, got %v", err)
+	}
+}
+
+func TestRemoveCerts(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	tagged := fingerprintHexUpperCryptoAPI(derBytes)
+	untagged := strings.Repeat("AB", 20)
+	missing := strings.Repeat("CD", 20)
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+
+	err := writeBlobCryptoAPI(blob, tagged, registry.CURRENT_USER, testStoreKey,
+		&InjectOptions{MagicName: "Namecoin", MagicData: setMagicData.Value()})
+	if err != nil {
+		t.Fatalf("couldn't write tagged cert: %v", err)
+	}
+
+	err = writeBlobCryptoAPI(blob, untagged, registry.CURRENT_USER, testStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write untagged cert: %v", err)
+	}
+
+	removed, failed, err := RemoveCerts(testCryptoAPIStore,
+		[]string{strings.ToLower(tagged), untagged, missing})
+	if !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound for the failed certs, got %v", err)
+	}
+
+	if !reflect.DeepEqual(removed, []string{tagged}) {
+		t.Errorf("expected only the tagged cert to be removed, got %v", removed)
+	}
+
+	if !reflect.DeepEqual(failed, []string{untagged, missing}) {
+		t.Errorf("expected the untagged and missing certs to fail, got %v", failed)
+	}
+
+	if injected, err := IsInjected(testCryptoAPIStore, derBytes); err != nil || injected {
+		t.Errorf("expected tagged cert to be gone, got %t (err %v)", injected, err)
+	}
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, untagged, testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("expected untagged cert to be kept (err %v)", err)
+	}
+	certKey.Close()
+}
+
+func TestCleanCertsResult(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	if err := expirableMagicName.CfSetValue("Namecoin"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+
+	derBytes := testCertDER(t)
+	expired := fingerprintHexUpperCryptoAPI(derBytes)
+	untagged := strings.Repeat("AB", 20)
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+
+	err := writeBlobCryptoAPI(blob, expired, registry.CURRENT_USER, testStoreKey, &InjectOptions{
+		MagicName: "Namecoin",
+		MagicData: setMagicData.Value(),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("couldn't write expired cert: %v", err)
+	}
+
+	err = writeBlobCryptoAPI(blob, untagged, registry.CURRENT_USER, testStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write untagged cert: %v", err)
+	}
+
+	result, err := CleanCertsResult(testCryptoAPIStore)
+	if err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+
+	expected := CleanResult{
+		Scanned:             2,
+		Expired:             1,
+		Deleted:             1,
+		DeletedFingerprints: []string{expired},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+}
+
+func TestCleanExcludeFile(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	if err := expirableMagicName.CfSetValue("Namecoin"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+	defer cleanExcludeFile.CfSetValue("")   //nolint:errcheck
+
+	rootDER, intermediateDER := testCertChain(t)
+	pinned := fingerprintHexUpperCryptoAPI(rootDER)
+	expired := fingerprintHexUpperCryptoAPI(intermediateDER)
+
+	for _, derBytes := range [][]byte{rootDER, intermediateDER} {
+		err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes},
+			fingerprintHexUpperCryptoAPI(derBytes), registry.CURRENT_USER, testStoreKey, &InjectOptions{
+				MagicName: "Namecoin",
+				MagicData: setMagicData.Value(),
+				ExpiresAt: time.Now().Add(-time.Minute),
+			})
+		if err != nil {
+			t.Fatalf("couldn't write expired cert: %v", err)
+		}
+	}
+
+	dir := t.TempDir()
+	excludePath := filepath.Join(dir, "exclude.txt")
+	// The pinned root is listed in lowercase with a separator, to check that
+	// fingerprints are normalized.
+	excludeData := "# Pinned roots\n\n" + strings.ToLower(pinned[:20]+":"+pinned[20:]) + "\n"
+
+	if err := os.WriteFile(excludePath, []byte(excludeData), 0o600); err != nil {
+		t.Fatalf("couldn't write exclusions file: %v", err)
+	}
+
+	badPath := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(badPath, []byte("not a fingerprint\n"), 0o600); err != nil {
+		t.Fatalf("couldn't write exclusions file: %v", err)
+	}
+
+	if err := cleanExcludeFile.CfSetValue(badPath); err != nil {
+		t.Fatalf("couldn't set exclusions file: %v", err)
+	}
+
+	if _, err := CleanCertsResult(testCryptoAPIStore); !errors.Is(err, ErrCleanExcludeFile) {
+		t.Errorf("expected ErrCleanExcludeFile for a malformed file, got %v", err)
+	}
+
+	if err := cleanExcludeFile.CfSetValue(excludePath); err != nil {
+		t.Fatalf("couldn't set exclusions file: %v", err)
+	}
+
+	result, err := CleanCertsResult(testCryptoAPIStore)
+	if err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+
+	expected := CleanResult{
+		Scanned:             2,
+		Expired:             2,
+		Deleted:             1,
+		DeletedFingerprints: []string{expired},
+		Excluded:            1,
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	if _, ok, err := openCertKey(testCryptoAPIStore, pinned, testStoreFlags(t)); !ok || err != nil {
+		t.Errorf("expected excluded cert to be retained (err %v)", err)
+	}
+}
+
+func TestRegistryViewAccess(t *testing.T) {
+	defer registryView.CfSetValue("native") //nolint:errcheck
+
+	for view, expected := range map[string]uint32{
+		"native": 0,
+		"32":     registry.WOW64_32KEY,
+		"64":     registry.WOW64_64KEY,
+	} {
+		if err := registryView.CfSetValue(view); err != nil {
+			t.Fatalf("couldn't set registry view: %v", err)
+		}
+
+		access, err := registryViewAccess()
+		if err != nil || access != expected {
+			t.Errorf("view %s: expected %#x, got %#x (err %v)", view, expected, access, err)
+		}
+	}
+
+	if err := registryView.CfSetValue("128"); err != nil {
+		t.Fatalf("couldn't set registry view: %v", err)
+	}
+
+	if _, err := registryViewAccess(); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for an unknown view, got %v", err)
+	}
+
+	// An unknown view is reported before anything is opened.
+	if _, err := injectOptionsFromFlags(); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore from injectOptionsFromFlags, got %v", err)
+	}
+
+	if _, err := cleanOptionsFromFlagsLocked(); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore from cleanOptionsFromFlagsLocked, got %v", err)
+	}
+
+	// The view is part of the options snapshot, so that it can't change
+	// while injecting.
+	if err := registryView.CfSetValue("32"); err != nil {
+		t.Fatalf("couldn't set registry view: %v", err)
+	}
+
+	opts, err := injectOptionsFromFlags()
+	if err != nil || opts.registryView != registry.WOW64_32KEY {
+		t.Fatalf("expected the 32-bit view in the options, got %#x (err %v)", opts.registryView, err)
+	}
+
+	// The Win32 API can't write to another view.
+	opts.Method = InjectMethodWin32API
+	if err := opts.checkMethod(); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for the %s method in the 32-bit view, got %v", InjectMethodWin32API, err)
+	}
+
+	// Only the real registry can be watched.
+	mem, restore := useMemReg()
+	defer restore()
+
+	if err := waitRegChange(mem.Root(registry.CURRENT_USER, 0)); !errors.Is(err, ErrStoreOpen) {
+		t.Errorf("expected ErrStoreOpen for an in-memory key, got %v", err)
+	}
+}
+
+func TestInjectLeafIntoRoot(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	leafDER := testCertDER(t)
+	rootDER, _ := testCertChain(t)
+
+	inject := func(derBytes []byte, allow bool) error {
+		return injectSingleCertCryptoAPI(derBytes, fingerprintHexUpperCryptoAPI(derBytes), registry.CURRENT_USER,
+			testStoreKey, &InjectOptions{AllowLeafInRoot: allow})
+	}
+
+	if err := inject(leafDER, false); !errors.Is(err, ErrUnsuitableCert) {
+		t.Errorf("expected leaf cert to be refused, got %v", err)
+	}
+
+	if injected, err := IsInjected(testCryptoAPIStore, leafDER); err != nil || injected {
+		t.Errorf("expected refused leaf cert not to be written, got %t (err %v)", injected, err)
+	}
+
+	if err := inject(rootDER, false); err != nil {
+		t.Errorf("expected CA cert to be accepted, got %v", err)
+	}
+
+	if err := inject(leafDER, true); err != nil {
+		t.Errorf("expected leaf cert to be accepted with the override, got %v", err)
+	}
+
+	// Other logical stores don't care.
+	myStoreKey := testCryptoAPIStore.LogicalKey("My")
+
+	storeKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), myStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create My store: %v", err)
+	}
+	storeKey.Close()
+
+	err = injectSingleCertCryptoAPI(leafDER, fingerprintHexUpperCryptoAPI(leafDER), registry.CURRENT_USER,
+		myStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Errorf("expected leaf cert to be accepted into My, got %v", err)
+	}
+}
+
+func TestDiffStores(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	other := Store{registry.CURRENT_USER, `SOFTWARE\Namecoin\certinject-test2`, `%s\Certificates`}
+
+	storeKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), other.Key(), registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create other store: %v", err)
+	}
+	storeKey.Close()
+
+	common := testCertDER(t)
+	onlyA, onlyB := testCertChain(t)
+	tagged := &InjectOptions{MagicName: "Namecoin", MagicData: setMagicData.Value()}
+
+	write := func(store Store, derBytes []byte, opts *InjectOptions) {
+		t.Helper()
+
+		err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes},
+			fingerprintHexUpperCryptoAPI(derBytes), store.Base, store.Key(), opts)
+		if err != nil {
+			t.Fatalf("couldn't write cert: %v", err)
+		}
+	}
+
+	write(testCryptoAPIStore, common, tagged)
+	write(testCryptoAPIStore, onlyA, tagged)
+	write(other, common, tagged)
+	write(other, onlyB, tagged)
+	// Untagged certs aren't ours, so they don't count as drift.
+	write(other, onlyA, &InjectOptions{})
+
+	gotA, gotB, err := DiffStores(testCryptoAPIStore, other)
+	if err != nil {
+		t.Fatalf("couldn't diff stores: %v", err)
+	}
+
+	if !reflect.DeepEqual(gotA, []string{fingerprintHexUpperCryptoAPI(onlyA)}) {
+		t.Errorf("unexpected certs only in a: %v", gotA)
+	}
+
+	if !reflect.DeepEqual(gotB, []string{fingerprintHexUpperCryptoAPI(onlyB)}) {
+		t.Errorf("unexpected certs only in b: %v", gotB)
+	}
+}
+
+func TestEditBlobDescription(t *testing.T) {
+	existing, err := certblob.BuildDescription("Set by user")
+	if err != nil {
+		t.Fatalf("couldn't build description: %v", err)
+	}
+
+	blob := certblob.Blob{}
+	blob.SetProperty(existing)
+
+	if err := editBlobDescription(blob, &InjectOptions{}); err != nil {
+		t.Fatalf("couldn't edit blob: %v", err)
+	}
+
+	if !bytes.Equal(blob[certblob.CertDescriptionPropID], existing.Value) {
+		t.Errorf("expected existing description to be kept, got %x", blob[certblob.CertDescriptionPropID])
+	}
+
+	if err := editBlobDescription(blob, &InjectOptions{Description: "Namecoin"}); err != nil {
+		t.Fatalf("couldn't edit blob: %v", err)
+	}
+
+	replaced, err := certblob.BuildDescription("Namecoin")
+	if err != nil {
+		t.Fatalf("couldn't build description: %v", err)
+	}
+
+	if !bytes.Equal(blob[certblob.CertDescriptionPropID], replaced.Value) {
+		t.Errorf("expected description to be replaced, got %x", blob[certblob.CertDescriptionPropID])
+	}
+}
+
+func TestCleanupNeverDeletesUntagged(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	if err := expirableMagicName.CfSetValue("Namecoin"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+
+	// Simulate a buggy expiry check that considers every cert expired.
+	defer func(check func(regKey, string, *cleanOptions) (bool, error)) {
+		checkCertExpired = check
+	}(checkCertExpired)
+
+	checkCertExpired = func(regKey, string, *cleanOptions) (bool, error) {
+		return true, nil
+	}
+
+	derBytes := testCertDER(t)
+	tagged := fingerprintHexUpperCryptoAPI(derBytes)
+	untagged := strings.Repeat("AB", 20)
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+
+	err := writeBlobCryptoAPI(blob, tagged, registry.CURRENT_USER, testStoreKey,
+		&InjectOptions{MagicName: "Namecoin", MagicData: expirableMagicData.Value()})
+	if err != nil {
+		t.Fatalf("couldn't write tagged cert: %v", err)
+	}
+
+	err = writeBlobCryptoAPI(blob, untagged, registry.CURRENT_USER, testStoreKey,
+		&InjectOptions{MagicName: "Namecoin", MagicData: expirableMagicData.Value() + 1})
+	if err != nil {
+		t.Fatalf("couldn't write untagged cert: %v", err)
+	}
+
+	result, err := CleanCertsResult(testCryptoAPIStore)
+	if !errors.Is(err, ErrMagicMismatch) {
+		t.Errorf("expected ErrMagicMismatch, got %v", err)
+	}
+
+	if !reflect.DeepEqual(result.DeletedFingerprints, []string{tagged}) || result.Errored != 1 {
+		t.Errorf("expected only the tagged cert to be deleted, got %+v", result)
+	}
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, untagged, testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("expected untagged cert to survive cleanup (err %v)", err)
+	}
+	certKey.Close()
+}
+
+func TestFindCert(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+
+	// Only current-user (tagged) and system (untagged) contain the cert.
+	for name, opts := range map[string]*InjectOptions{
+		"current-user": {MagicName: "Namecoin", MagicData: setMagicData.Value()},
+		"system":       {},
+	} {
+		store := cryptoAPIStores[name]
+
+		storeKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.Key(), registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", name, err)
+		}
+		storeKey.Close()
+
+		err = writeBlobCryptoAPI(blob, fingerprintHexUpper, store.Base, store.Key(), opts)
+		if err != nil {
+			t.Fatalf("couldn't write cert into %s store: %v", name, err)
+		}
+	}
+
+	locations, err := FindCert(strings.ToLower(fingerprintHexUpper))
+	if err != nil {
+		t.Fatalf("couldn't find cert: %v", err)
+	}
+
+	expected := []Location{
+		{PhysicalStore: "current-user", LogicalStore: "Root", Injected: true},
+		{PhysicalStore: "system", LogicalStore: "Root", Injected: false},
+	}
+	if !reflect.DeepEqual(locations, expected) {
+		t.Errorf("expected %+v, got %+v", expected, locations)
+	}
+}
+
+func TestDedupCert(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	blob := certblob.Blob{certblob.CertContentCertPropID: derBytes}
+	tagged := &InjectOptions{MagicName: "Namecoin", MagicData: setMagicData.Value()}
+
+	for _, name := range []string{"current-user", "system"} {
+		store := cryptoAPIStores[name]
+
+		storeKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.Key(), registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", name, err)
+		}
+		storeKey.Close()
+
+		err = writeBlobCryptoAPI(blob, fingerprintHexUpper, store.Base, store.Key(), tagged)
+		if err != nil {
+			t.Fatalf("couldn't write cert into %s store: %v", name, err)
+		}
+	}
+
+	_, err := DedupCert(fingerprintHexUpper, "keep-both")
+	if !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for unknown policy, got %v", err)
+	}
+
+	removed, err := DedupCert(fingerprintHexUpper, DedupKeepSystem)
+	if err != nil {
+		t.Fatalf("couldn't dedup cert: %v", err)
+	}
+
+	expected := []Location{{PhysicalStore: "current-user", LogicalStore: "Root", Injected: true}}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected %+v removed, got %+v", expected, removed)
+	}
+
+	// With only one copy left, there's nothing to do.
+	removed, err = DedupCert(fingerprintHexUpper, DedupKeepUser)
+	if err != nil {
+		t.Fatalf("couldn't dedup cert: %v", err)
+	}
+
+	if len(removed) != 0 {
+		t.Errorf("expected nothing removed without duplicates, got %+v", removed)
+	}
+
+	// A duplicate that we didn't inject is left alone.
+	store := cryptoAPIStores["current-user"]
+
+	err = writeBlobCryptoAPI(blob, fingerprintHexUpper, store.Base, store.Key(), &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write untagged cert: %v", err)
+	}
+
+	removed, err = DedupCert(fingerprintHexUpper, DedupKeepSystem)
+	if err != nil {
+		t.Fatalf("couldn't dedup cert: %v", err)
+	}
+
+	if len(removed) != 0 {
+		t.Errorf("expected untagged duplicate to be kept, got %+v removed", removed)
+	}
+
+	locations, err := FindCert(fingerprintHexUpper)
+	if err != nil {
+		t.Fatalf("couldn't find cert: %v", err)
+	}
+
+	if len(locations) != 2 {
+		t.Errorf("expected cert in both stores, got %+v", locations)
+	}
+
+	// An unknown -dedup flag is rejected before anything is injected.
+	if err := dedup.CfSetValue("keep-both"); err != nil {
+		t.Fatalf("couldn't set dedup: %v", err)
+	}
+	defer dedup.CfSetValue("") //nolint:errcheck
+
+	if _, err := injectOptionsFromFlags(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("expected ErrInvalidOption for an unknown dedup flag, got %v", err)
+	}
+}
+
+func TestCertValidityRecorded(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	if err := expirableMagicName.CfSetValue("Namecoin"); err != nil {
+		t.Fatalf("couldn't set expirable magic name: %v", err)
+	}
+	defer expirableMagicName.CfSetValue("") //nolint:errcheck
+
+	// The test cert's NotAfter has passed.
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse test cert: %v", err)
+	}
+
+	err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("couldn't open injected cert (err %v)", err)
+	}
+	defer certKey.Close()
+
+	for name, expected := range map[string]time.Time{
+		notBeforeValueName: cert.NotBefore,
+		notAfterValueName:  cert.NotAfter,
+	} {
+		recorded, ok := readTimeValue(certKey, name)
+		if !ok || !recorded.Equal(expected.Truncate(time.Second)) {
+			t.Errorf("expected %s %s, got %s", name, expected, recorded)
+		}
+	}
+
+	certs, err := ListInjectedCerts(testCryptoAPIStore)
+	if err != nil || len(certs) != 1 || !certs[0].NotAfter.Equal(cert.NotAfter) {
+		t.Errorf("expected listed cert to report NotAfter %s, got %+v (err %v)", cert.NotAfter, certs, err)
+	}
+
+	certStoreKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't open test store: %v", err)
+	}
+	defer certStoreKey.Close()
+
+	// Cleanup goes by injection age, not by the recorded validity period.
+	expired, err := checkCertExpiredCryptoAPI(certStoreKey, fingerprintHexUpper, testCleanOptions(t))
+	if err != nil || expired {
+		t.Errorf("expected freshly injected cert past its NotAfter not to be expired, got expired=%t err=%v",
+			expired, err)
+	}
+}
+
+func TestInjectMeta(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	opts := testInjectOptions(t)
+	opts.MetaSource = "https://example.invalid/ca.pem"
+	before := time.Now().Truncate(time.Second)
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey, opts)
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certs, err := ListInjectedCerts(testCryptoAPIStore)
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("expected 1 injected cert, got %d (err %v)", len(certs), err)
+	}
+
+	meta := certs[0].Meta
+	if meta == nil {
+		t.Fatal("expected listed cert to have a metadata record")
+	}
+
+	if meta.Source != opts.MetaSource || meta.InjectorVersion != injectorVersion() ||
+		meta.InjectedAt.Before(before) {
+		t.Errorf("unexpected metadata record %+v", meta)
+	}
+
+	// The plain magic tag is still set for older readers.
+	certKey, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("couldn't open injected cert (err %v)", err)
+	}
+	defer certKey.Close()
+
+	if !hasMagic(certKey, "Namecoin", setMagicData.Value()) {
+		t.Error("expected magic tag alongside metadata record")
+	}
+
+	// Re-injecting without a source removes the stale record.
+	opts.MetaSource = ""
+
+	err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey, opts)
+	if err != nil {
+		t.Fatalf("re-injection failed: %v", err)
+	}
+
+	if meta := readInjectMeta(certKey, fingerprintHexUpper); meta != nil {
+		t.Errorf("expected metadata record to be removed, got %+v", meta)
+	}
+}
+
+func TestDecodeInjectMeta(t *testing.T) {
+	meta := InjectMeta{
+		InjectorVersion: "v0.1.0",
+		InjectedAt:      time.Unix(1700000000, 0),
+		Source:          "namecoin",
+	}
+	record := encodeInjectMeta(meta)
+
+	decoded, err := decodeInjectMeta(record)
+	if err != nil || !reflect.DeepEqual(decoded, meta) {
+		t.Errorf("expected %+v, got %+v (err %v)", meta, decoded, err)
+	}
+
+	for i := 0; i < len(record); i++ {
+		if _, err := decodeInjectMeta(record[:i]); !errors.Is(err, errMetaRecord) {
+			t.Errorf("expected errMetaRecord for %d-byte truncated record, got %v", i, err)
+		}
+	}
+
+	record[0] = metaRecordVersion + 1
+	if _, err := decodeInjectMeta(record); !errors.Is(err, errMetaRecord) {
+		t.Errorf("expected errMetaRecord for unknown record version, got %v", err)
+	}
+}
+
+func TestReadOnlyOperations(t *testing.T) {
+	mem, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes}, fingerprintHexUpper,
+		registry.CURRENT_USER, testStoreKey, &InjectOptions{MagicName: "Namecoin", MagicData: setMagicData.Value()})
+	if err != nil {
+		t.Fatalf("couldn't write cert: %v", err)
+	}
+
+	// An unprivileged user can inspect the store without write rights.
+	mem.readOnly = true
+
+	if certs, err := ListInjectedCerts(testCryptoAPIStore); err != nil || len(certs) != 1 {
+		t.Errorf("expected list to work read-only, got %d certs (err %v)", len(certs), err)
+	}
+
+	if count, err := CountInjected(testCryptoAPIStore); err != nil || count != 1 {
+		t.Errorf("expected count to work read-only, got %d (err %v)", count, err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Errorf("expected verify to work read-only, got %v", err)
+	}
+
+	if injected, err := IsNamecoinInjected(testCryptoAPIStore, derBytes); err != nil || !injected {
+		t.Errorf("expected IsNamecoinInjected to work read-only, got %t (err %v)", injected, err)
+	}
+
+	// But it can't modify the store.
+	if err := RemoveCert(testCryptoAPIStore, fingerprintHexUpper); !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		t.Errorf("expected removal to be denied, got %v", err)
+	}
+}
+
+func TestInjectPKCS12(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	for _, logical := range []string{"CA", "My"} {
+		storeKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), testCryptoAPIStore.LogicalKey(logical),
+			registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", logical, err)
+		}
+		storeKey.Close()
+	}
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate root key: %v", err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate leaf key: %v", err)
+	}
+
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "certinject test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("couldn't create root: %v", err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.bit"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, rootTemplate, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("couldn't create leaf: %v", err)
+	}
+
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatalf("couldn't parse root: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatalf("couldn't parse leaf: %v", err)
+	}
+
+	pfxBytes, err := pkcs12.Modern.Encode(leafKey, leaf, []*x509.Certificate{root}, "hunter2")
+	if err != nil {
+		t.Fatalf("couldn't encode PKCS#12: %v", err)
+	}
+
+	err = injectPKCS12(pfxBytes, "wrong", InjectOptions{Store: testCryptoAPIStore})
+	if !errors.Is(err, ErrPKCS12Password) {
+		t.Errorf("expected ErrPKCS12Password, got %v", err)
+	}
+
+	if err := injectPKCS12(pfxBytes, "hunter2", InjectOptions{Store: testCryptoAPIStore}); err != nil {
+		t.Fatalf("couldn't inject PKCS#12: %v", err)
+	}
+
+	for logical, derBytes := range map[string][]byte{"Root": rootDER, "My": leafDER} {
+		_, ok, err := openCertKeyAt(registry.CURRENT_USER, 0,
+			testCryptoAPIStore.LogicalKey(logical)+`\`+fingerprintHexUpperCryptoAPI(derBytes))
+		if !ok || err != nil {
+			t.Errorf("expected cert in %s store (err %v)", logical, err)
+		}
+	}
+}
+
+func TestDisplayFingerprint(t *testing.T) {
+	defer func() {
+		fingerprintFormat.CfSetValue("bare") //nolint:errcheck
+		snapshotLogFlagsLocked()             //nolint:errcheck
+	}()
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(testCertDER(t))
+
+	for format, sep := range map[string]string{"bare": "", "colon": ":", "space": " "} {
+		if err := fingerprintFormat.CfSetValue(format); err != nil {
+			t.Fatalf("couldn't set fingerprint format: %v", err)
+		}
+
+		// Log flags only take effect once an operation snapshots them.
+		if err := snapshotLogFlagsLocked(); err != nil {
+			t.Fatalf("couldn't snapshot log flags: %v", err)
+		}
+
+		displayed := displayFingerprint(fingerprintHexUpper)
+		if len(displayed) != len(fingerprintHexUpper)+19*len(sep) || displayed[:2] != fingerprintHexUpper[:2] {
+			t.Errorf("format %s: unexpected fingerprint %q", format, displayed)
+		}
+
+		if normalizeFingerprintCryptoAPI(displayed) != fingerprintHexUpper {
+			t.Errorf("format %s: %q doesn't normalize back to %s", format, displayed, fingerprintHexUpper)
+		}
+
+		if displayFingerprint("Foo") != "Foo" {
+			t.Errorf("format %s: non-fingerprint subkey name was changed", format)
+		}
+	}
+}
+
+func TestUnknownFingerprintFormat(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	if err := fingerprintFormat.CfSetValue("dashes"); err != nil {
+		t.Fatalf("couldn't set fingerprint format: %v", err)
+	}
+	defer fingerprintFormat.CfSetValue("bare") //nolint:errcheck
+
+	if _, err := injectOptionsFromFlags(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("expected ErrInvalidOption from injection, got: %v", err)
+	}
+
+	if _, err := CleanCertsResult(testCryptoAPIStore); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("expected ErrInvalidOption from cleanup, got: %v", err)
+	}
+}
+
+func TestMigrateMagic(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	legacyFingerprint := fingerprintHexUpperCryptoAPI(rootDER)
+
+	// Simulate a cert injected by an old version with a different magic tag,
+	// and one injected without any.
+	legacyOpts := InjectOptions{MagicName: "NamecoinLegacy", MagicData: 7}
+	for _, derBytes := range [][]byte{rootDER, intermediateDER} {
+		err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpperCryptoAPI(derBytes), registry.CURRENT_USER,
+			testStoreKey, &legacyOpts)
+		if err != nil {
+			t.Fatalf("injection failed: %v", err)
+		}
+
+		legacyOpts = InjectOptions{}
+	}
+
+	migrated, err := MigrateMagic(testCryptoAPIStore, "NamecoinLegacy", 7)
+	if err != nil {
+		t.Fatalf("couldn't migrate magic: %v", err)
+	}
+
+	if len(migrated) != 1 || migrated[0] != legacyFingerprint {
+		t.Errorf("expected only %s to be migrated, got %v", legacyFingerprint, migrated)
+	}
+
+	certKey, _, err := openCertKey(testCryptoAPIStore, legacyFingerprint, testStoreFlags(t))
+	if err != nil {
+		t.Fatalf("couldn't open migrated cert: %v", err)
+	}
+	defer certKey.Close()
+
+	if !hasMagic(certKey, "Namecoin", 1) {
+		t.Error("expected migrated cert to carry the current magic tag")
+	}
+
+	if _, _, err := certKey.GetIntegerValue("NamecoinLegacy"); err == nil {
+		t.Error("expected legacy magic tag to be removed")
+	}
+
+	count, err := CountInjected(testCryptoAPIStore)
+	if err != nil || count != 1 {
+		t.Errorf("expected 1 injected cert after migration, got %d (err %v)", count, err)
+	}
+
+	migrated, err = MigrateMagic(testCryptoAPIStore, "NamecoinLegacy", 7)
+	if err != nil || len(migrated) != 0 {
+		t.Errorf("expected a second migration to be a no-op, got %v (err %v)", migrated, err)
+	}
+
+	if _, err := MigrateMagic(testCryptoAPIStore, "", 0); !errors.Is(err, ErrNoMagic) {
+		t.Errorf("expected ErrNoMagic without a legacy name, got %v", err)
+	}
+}
+
+func TestMigrateMagicSkipsAndFails(t *testing.T) {
+	mem, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	if err := skipMagicName.CfSetValue("NamecoinSkip"); err != nil {
+		t.Fatalf("couldn't set skip magic name: %v", err)
+	}
+	defer skipMagicName.CfSetValue("") //nolint:errcheck
+
+	rootDER, _ := testCertChain(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(rootDER)
+
+	err := injectSingleCertCryptoAPI(rootDER, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		&InjectOptions{MagicName: "NamecoinLegacy", MagicData: 7})
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, _, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+	if err != nil {
+		t.Fatalf("couldn't open cert: %v", err)
+	}
+
+	if err := certKey.SetDWordValue("NamecoinSkip", 1); err != nil {
+		t.Fatalf("couldn't set skip magic: %v", err)
+	}
+
+	certKey.Close()
+
+	migrated, err := MigrateMagic(testCryptoAPIStore, "NamecoinLegacy", 7)
+	if err != nil || len(migrated) != 0 {
+		t.Errorf("expected the skip-magic cert to be left alone, got %v (err %v)", migrated, err)
+	}
+
+	if err := skipMagicName.CfSetValue(""); err != nil {
+		t.Fatalf("couldn't reset skip magic name: %v", err)
+	}
+
+	// A cert that can't be opened for writing is reported, not skipped.
+	mem.readOnly = true
+
+	_, err = MigrateMagic(testCryptoAPIStore, "NamecoinLegacy", 7)
+	if !errors.Is(err, ErrStoreOpen) {
+		t.Errorf("expected ErrStoreOpen for a read-only cert, got %v", err)
+	}
+}
+
+func TestNoMagic(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	if err := noMagic.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set no-magic: %v", err)
+	}
+	defer noMagic.CfSetValue(false) //nolint:errcheck
+
+	rootDER, intermediateDER := testCertChain(t)
+
+	opts, err := injectOptionsFromFlags()
+	if err != nil {
+		t.Fatalf("couldn't build options: %v", err)
+	}
+
+	opts.Store = testCryptoAPIStore
+
+	if err := InjectWithOptions(rootDER, opts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	if err := noMagic.CfSetValue(false); err != nil {
+		t.Fatalf("couldn't set no-magic: %v", err)
+	}
+
+	opts, err = injectOptionsFromFlags()
+	if err != nil {
+		t.Fatalf("couldn't build options: %v", err)
+	}
+
+	opts.Store = testCryptoAPIStore
+
+	if err := InjectWithOptions(intermediateDER, opts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	_, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpperCryptoAPI(rootDER), testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("expected no-magic cert to be injected (err %v)", err)
+	}
+
+	certs, err := ListInjectedCerts(testCryptoAPIStore)
+	if err != nil {
+		t.Fatalf("couldn't list injected certs: %v", err)
+	}
+
+	if len(certs) != 1 || certs[0].Fingerprint != fingerprintHexUpperCryptoAPI(intermediateDER) {
+		t.Errorf("expected only the tagged cert to be listed, got %v", certs)
+	}
+}
+
+func TestSetPropertiesPreserving(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	rootDER, _ := testCertChain(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(rootDER)
+
+	opts := InjectOptions{
+		LogicalStores: []string{"Root"},
+		ExtKeyUsages:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	err := SetPropertiesPreserving(testCryptoAPIStore, fingerprintHexUpper, opts)
+	if !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound for a missing cert, got %v", err)
+	}
+
+	// Simulate a root that shipped with Windows, with a friendly name and
+	// no magic tag.
+	osName, err := certblob.BuildFriendlyName("Shipped by Windows")
+	if err != nil {
+		t.Fatalf("couldn't build friendly name: %v", err)
+	}
+
+	blob := certblob.Blob{certblob.CertContentCertPropID: rootDER}
+	blob.SetProperty(osName)
+
+	err = writeBlobCryptoAPI(blob, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Fatalf("couldn't write OS cert: %v", err)
+	}
+
+	otherOpts := opts
+	otherOpts.Store = Store{registry.LOCAL_MACHINE, testCryptoAPIStore.Physical, testCryptoAPIStore.Logical}
+
+	err = SetPropertiesPreserving(testCryptoAPIStore, fingerprintHexUpper, otherOpts)
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("expected ErrInvalidOption for a different opts.Store, got %v", err)
+	}
+
+	opts.Store = testCryptoAPIStore
+
+	if err := SetPropertiesPreserving(testCryptoAPIStore, fingerprintHexUpper, opts); err != nil {
+		t.Fatalf("couldn't set properties: %v", err)
+	}
+
+	certKey, _, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+	if err != nil {
+		t.Fatalf("couldn't open cert: %v", err)
+	}
+	defer certKey.Close()
+
+	blob, err = readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read blob: %v", err)
+	}
+
+	if !bytes.Equal(blob[certblob.CertContentCertPropID], rootDER) {
+		t.Error("expected cert content to be unchanged")
+	}
+
+	if !bytes.Equal(blob[certblob.CertFriendlyNamePropID], osName.Value) {
+		t.Error("expected OS friendly name to be kept")
+	}
+
+	if blob[certblob.CertEnhkeyUsagePropID] == nil {
+		t.Error("expected EKU property to be set")
+	}
+
+	if _, _, err := certKey.GetIntegerValue("Namecoin"); err == nil {
+		t.Error("expected no magic tag")
+	}
+}
+
+func TestServiceStore(t *testing.T) {
+	defer cryptoAPIFlagPhysicalStoreName.CfSetValue("system") //nolint:errcheck
+	defer serviceName.CfSetValue("")                          //nolint:errcheck
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("service"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+
+	if _, err := cryptoAPIFlagStore(); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore without a service name, got %v", err)
+	}
+
+	for _, name := range []string{`Foo\Bar`, "Foo/Bar", strings.Repeat("a", maxServiceNameLen+1)} {
+		if _, err := serviceStore(name); !errors.Is(err, ErrInvalidStore) {
+			t.Errorf("expected ErrInvalidStore for service name %q, got %v", name, err)
+		}
+	}
+
+	if err := serviceName.CfSetValue("W3SVC"); err != nil {
+		t.Fatalf("couldn't set service name: %v", err)
+	}
+
+	store, err := cryptoAPIFlagStore()
+	if err != nil {
+		t.Fatalf("couldn't get service store: %v", err)
+	}
+
+	expected := `SOFTWARE\Microsoft\Cryptography\Services\W3SVC\SystemCertificates\Root\Certificates`
+	if store.Base != registry.LOCAL_MACHINE || store.LogicalKey("Root") != expected {
+		t.Errorf("unexpected service store %v", store)
+	}
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("system"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+
+	if _, err := cryptoAPIFlagStore(); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for a service name with the system store, got %v", err)
+	}
+
+	if err := RegisterStore("service", store); !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore when registering the service store name, got %v", err)
+	}
+}
+
+func TestCheckBlobNameConstraints(t *testing.T) {
+	written := &x509.Certificate{
+		PermittedDNSDomains: []string{"bit", "example.com"},
+		ExcludedDNSDomains:  []string{"example.bit"},
+	}
+
+	prop, err := certblob.BuildNameConstraints(written)
+	if err != nil {
+		t.Fatalf("couldn't build name constraints: %v", err)
+	}
+
+	blob := certblob.Blob{}
+	blob.SetProperty(prop)
+
+	for _, testCase := range []struct {
+		requested *x509.Certificate
+		merged    bool
+		ok        bool
+	}{
+		{&x509.Certificate{PermittedDNSDomains: []string{"bit", "example.com"}}, false, true},
+		{&x509.Certificate{PermittedDNSDomains: []string{"bit"}}, true, true},
+		{&x509.Certificate{PermittedDNSDomains: []string{"bit"}}, false, false},
+		{&x509.Certificate{PermittedDNSDomains: []string{"onion"}}, true, false},
+		{&x509.Certificate{PermittedEmailAddresses: []string{"example.bit"}}, true, false},
+	} {
+		err := checkBlobNameConstraints(blob, "Foo", testCase.requested, testCase.merged)
+		if testCase.ok != (err == nil) || (err != nil && !errors.Is(err, ErrNameConstraintsMismatch)) {
+			t.Errorf("requested %v (merged %t): unexpected result %v", testCase.requested, testCase.merged, err)
+		}
+	}
+
+	err = checkBlobNameConstraints(certblob.Blob{}, "Foo", written, false)
+	if !errors.Is(err, ErrNameConstraintsMismatch) {
+		t.Errorf("expected ErrNameConstraintsMismatch for a missing property, got %v", err)
+	}
+}
+
+func TestVerifyInjectedSubKeyMismatch(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	rootDER, intermediateDER := testCertChain(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	opts := &InjectOptions{MagicName: "Namecoin", MagicData: 1}
+
+	// A swapped blob: the subkey is named after derBytes, but holds rootDER.
+	err := writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: rootDER}, fingerprintHexUpper,
+		registry.CURRENT_USER, testStoreKey, opts)
+	if err != nil {
+		t.Fatalf("couldn't write swapped blob: %v", err)
+	}
+
+	err = VerifyInjected(testCryptoAPIStore, fingerprintHexUpper)
+	if !errors.Is(err, ErrCorruptCert) {
+		t.Errorf("expected ErrCorruptCert for a swapped blob, got %v", err)
+	} else if !strings.Contains(err.Error(), displayFingerprint(fingerprintHexUpperCryptoAPI(rootDER))) {
+		t.Errorf("expected the error to name the cert actually in the blob, got %v", err)
+	}
+
+	// The same check applies to fingerprints given in other forms.
+	err = VerifyInjected(testCryptoAPIStore, strings.ToLower(fingerprintHexUpper))
+	if !errors.Is(err, ErrCorruptCert) {
+		t.Errorf("expected ErrCorruptCert for a lowercase fingerprint, got %v", err)
+	}
+
+	// A blob without cert content.
+	intermediateFingerprint := fingerprintHexUpperCryptoAPI(intermediateDER)
+
+	err = writeBlobCryptoAPI(certblob.Blob{certblob.CertFriendlyNamePropID: []byte("Namecoin")},
+		intermediateFingerprint, registry.CURRENT_USER, testStoreKey, opts)
+	if err != nil {
+		t.Fatalf("couldn't write blob without cert: %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, intermediateFingerprint); !errors.Is(err, ErrCorruptCert) {
+		t.Errorf("expected ErrCorruptCert for a blob without cert content, got %v", err)
+	}
+
+	// Rewriting the blob with the right cert fixes it.
+	err = writeBlobCryptoAPI(certblob.Blob{certblob.CertContentCertPropID: derBytes}, fingerprintHexUpper,
+		registry.CURRENT_USER, testStoreKey, opts)
+	if err != nil {
+		t.Fatalf("couldn't rewrite blob: %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Errorf("expected a matching blob to verify, got %v", err)
+	}
+
+	// A missing cert isn't corrupt.
+	err = VerifyInjected(testCryptoAPIStore, fingerprintHexUpperCryptoAPI(rootDER))
+	if !errors.Is(err, ErrCertNotFound) || errors.Is(err, ErrCorruptCert) {
+		t.Errorf("expected only ErrCertNotFound for a missing cert, got %v", err)
+	}
+}
+
+func TestVerifyInjectedNameConstraints(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	defer nameConstraintsPermittedDNS.CfSetValue("") //nolint:errcheck
+
+	rootDER, _ := testCertChain(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(rootDER)
+
+	err := injectSingleCertCryptoAPI(rootDER, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey,
+		&InjectOptions{NameConstraints: &x509.Certificate{PermittedDNSDomains: []string{"bit"}}})
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	err = VerifyInjectedNameConstraints(testCryptoAPIStore, fingerprintHexUpper,
+		&x509.Certificate{PermittedDNSDomains: []string{"bit"}}, false)
+	if err != nil {
+		t.Errorf("expected matching name constraints to verify, got %v", err)
+	}
+
+	onion := &x509.Certificate{PermittedDNSDomains: []string{"onion"}}
+
+	err = VerifyInjectedNameConstraints(testCryptoAPIStore, fingerprintHexUpper, onion, false)
+	if !errors.Is(err, ErrNameConstraintsMismatch) {
+		t.Errorf("expected ErrNameConstraintsMismatch, got %v", err)
+	}
+
+	// The nc.* flags don't affect plain verification.
+	if err := nameConstraintsPermittedDNS.CfSetValue("onion"); err != nil {
+		t.Fatalf("couldn't set permitted DNS: %v", err)
+	}
+
+	if err := VerifyInjected(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Errorf("expected VerifyInjected to ignore the nc.* flags, got %v", err)
+	}
+}
+
+func TestCertFileOperations(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	rootDER, _ := testCertChain(t)
+	path := filepath.Join(t.TempDir(), "root.pem")
+
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}), 0o600)
+	if err != nil {
+		t.Fatalf("couldn't write cert file: %v", err)
+	}
+
+	if err := VerifyInjectedFile(testCryptoAPIStore, path); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound before injection, got %v", err)
+	}
+
+	err = injectSingleCertCryptoAPI(rootDER, fingerprintHexUpperCryptoAPI(rootDER), registry.CURRENT_USER,
+		testStoreKey, &InjectOptions{})
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	if err := VerifyInjectedFile(testCryptoAPIStore, path); err != nil {
+		t.Errorf("couldn't verify cert file: %v", err)
+	}
+
+	if err := RemoveCertFile(testCryptoAPIStore, path); err != nil {
+		t.Fatalf("couldn't remove cert file: %v", err)
+	}
+
+	if ok, err := IsInjected(testCryptoAPIStore, rootDER); ok || err != nil {
+		t.Errorf("expected cert to be removed (err %v)", err)
+	}
+
+	if err := RemoveCertFile(testCryptoAPIStore, path+".missing"); !errors.Is(err, ErrCertRead) {
+		t.Errorf("expected ErrCertRead for a missing file, got %v", err)
+	}
+}
+
+// testCTL returns an unsigned PKCS#7 SignedData structure with the given
+// content type, which is enough for checkCTL.
+func testCTL(t *testing.T, contentType asn1.ObjectIdentifier) []byte {
+	t.Helper()
+
+	signedData := pkcs7SignedData{Version: 1, DigestAlgorithms: asn1.RawValue{
+		Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true,
+	}}
+	signedData.EncapContentInfo.ContentType = contentType
+
+	signedDataBytes, err := asn1.Marshal(signedData)
+	if err != nil {
+		t.Fatalf("couldn't marshal signed data: %v", err)
+	}
+
+	// Marshal ignores the explicit tag of a RawValue field, so add it by
+	// hand.
+	ctlDER, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: signedDataBytes},
+	})
+	if err != nil {
+		t.Fatalf("couldn't marshal content info: %v", err)
+	}
+
+	return ctlDER
+}
+
+func TestInjectCTL(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	ctlDER := testCTL(t, oidCTL)
+
+	if err := checkCTL(ctlDER); err != nil {
+		t.Fatalf("expected a valid CTL, got %v", err)
+	}
+
+	oidData := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	if err := checkCTL(testCTL(t, oidData)); !errors.Is(err, ErrBadCert) {
+		t.Errorf("expected ErrBadCert for a non-CTL, got %v", err)
+	}
+
+	if err := checkCTL(testCertDER(t)); !errors.Is(err, ErrBadCert) {
+		t.Errorf("expected ErrBadCert for a cert, got %v", err)
+	}
+
+	opts := InjectOptions{MagicName: "Namecoin", MagicData: setMagicData.Value()}
+	if err := injectCTL(ctlDER, testCryptoAPIStore, []string{"Root"}, &opts); err != nil {
+		t.Fatalf("couldn't inject CTL: %v", err)
+	}
+
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(ctlDER)
+
+	ctlKey, ok, err := openCertKeyAt(registry.CURRENT_USER, 0,
+		testCryptoAPIStore.Physical+`\Root\CTLs\`+fingerprintHexUpper)
+	if !ok || err != nil {
+		t.Fatalf("expected CTL in the Root CTLs key (err %v)", err)
+	}
+
+	blob, err := readBlobValue(ctlKey, defaultMaxBlobBytes)
+	ctlKey.Close()
+
+	if err != nil || !bytes.Equal(blob[certblob.CertContentCTLPropID], ctlDER) {
+		t.Errorf("unexpected CTL blob (err %v)", err)
+	}
+
+	ctls, err := ListInjectedCTLs(testCryptoAPIStore)
+	if err != nil || !reflect.DeepEqual(ctls, []string{fingerprintHexUpper}) {
+		t.Errorf("unexpected injected CTLs %v (err %v)", ctls, err)
+	}
+
+	if err := RemoveCTL(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Fatalf("couldn't remove CTL: %v", err)
+	}
+
+	if err := RemoveCTL(testCryptoAPIStore, fingerprintHexUpper); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound after removal, got %v", err)
+	}
+
+	ctls, err = ListInjectedCTLs(testCryptoAPIStore)
+	if err != nil || len(ctls) != 0 {
+		t.Errorf("expected no CTLs after removal, got %v (err %v)", ctls, err)
+	}
+}
+
+func TestInjectedCTLsAcrossLogicalStores(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	if err := cryptoAPIFlagLogicalStoreName.CfSetValue("Root,CA"); err != nil {
+		t.Fatalf("couldn't set logical stores: %v", err)
+	}
+	defer cryptoAPIFlagLogicalStoreName.CfSetValue("Root") //nolint:errcheck
+
+	ctlDER := testCTL(t, oidCTL)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(ctlDER)
+
+	opts := InjectOptions{MagicName: "Namecoin", MagicData: setMagicData.Value()}
+	if err := injectCTL(ctlDER, testCryptoAPIStore, []string{"CA"}, &opts); err != nil {
+		t.Fatalf("couldn't inject CTL: %v", err)
+	}
+
+	ctls, err := ListInjectedCTLs(testCryptoAPIStore)
+	if err != nil || !reflect.DeepEqual(ctls, []string{fingerprintHexUpper}) {
+		t.Errorf("expected the CTL in the CA store to be listed, got %v (err %v)", ctls, err)
+	}
+
+	if err := RemoveCTL(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+		t.Fatalf("couldn't remove CTL from the CA store: %v", err)
+	}
+
+	// CTLs without the magic tag aren't listed or removed.
+	if err := injectCTL(ctlDER, testCryptoAPIStore, []string{"Root"}, &InjectOptions{}); err != nil {
+		t.Fatalf("couldn't inject untagged CTL: %v", err)
+	}
+
+	ctls, err = ListInjectedCTLs(testCryptoAPIStore)
+	if err != nil || len(ctls) != 0 {
+		t.Errorf("expected no injected CTLs, got %v (err %v)", ctls, err)
+	}
+
+	if err := RemoveCTL(testCryptoAPIStore, fingerprintHexUpper); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound for an untagged CTL, got %v", err)
+	}
+
+	ctlKey, ok, err := openCertKeyAt(registry.CURRENT_USER, 0,
+		testCryptoAPIStore.Physical+`\Root\CTLs\`+fingerprintHexUpper)
+	if !ok || err != nil {
+		t.Fatalf("expected the untagged CTL to be kept (err %v)", err)
+	}
+
+	ctlKey.Close()
+}
+
+func TestCleanAndPurgeCTLs(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	store := cryptoAPIStores["current-user"]
+
+	certStoreKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.LogicalKey("Root"), registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't create store: %v", err)
+	}
+	certStoreKey.Close()
+
+	expiredDER := testCTL(t, oidCTL)
+	// A second, distinct CTL; injectCTL doesn't check the content type.
+	currentDER := testCTL(t, asn1.ObjectIdentifier(append(append([]int{}, oidCTL...), 1)))
+
+	expired := InjectOptions{MagicName: "Namecoin", MagicData: 1, ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := injectCTL(expiredDER, store, []string{"Root"}, &expired); err != nil {
+		t.Fatalf("couldn't inject expired CTL: %v", err)
+	}
+
+	current := InjectOptions{MagicName: "Namecoin", MagicData: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := injectCTL(currentDER, store, []string{"Root"}, &current); err != nil {
+		t.Fatalf("couldn't inject current CTL: %v", err)
+	}
+
+	opts := testCleanOptions(t)
+	opts.expirableMagicName = "Namecoin"
+	opts.expirableMagicData = 1
+
+	result, err := cleanStoreCryptoAPI(store, opts)
+	if err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+
+	expiredFingerprint := fingerprintHexUpperCryptoAPI(expiredDER)
+	if !reflect.DeepEqual(result.DeletedFingerprints, []string{expiredFingerprint}) {
+		t.Errorf("expected only the expired CTL to be cleaned, got %v", result.DeletedFingerprints)
+	}
+
+	removed, err := PurgeAllInjected()
+	if err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+
+	currentFingerprint := fingerprintHexUpperCryptoAPI(currentDER)
+	if !reflect.DeepEqual(removed, []string{currentFingerprint}) {
+		t.Errorf("expected the remaining CTL to be purged, got %v", removed)
+	}
+}
+
+func TestSecureACL(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	if err := secureACL.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set secure-acl: %v", err)
+	}
+	defer secureACL.CfSetValue(false) //nolint:errcheck
+
+	rootDER, intermediateDER := testCertChain(t)
+
+	opts := testInjectOptions(t)
+	opts.Store = testCryptoAPIStore
+
+	if err := InjectWithOptions(rootDER, *opts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	opts.SecureACL = false
+
+	if err := InjectWithOptions(intermediateDER, *opts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		derBytes []byte
+		dacl     string
+	}{
+		{rootDER, secureACLSDDL},
+		{intermediateDER, ""},
+	} {
+		fingerprintHexUpper := fingerprintHexUpperCryptoAPI(tc.derBytes)
+
+		certKey, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+		if !ok || err != nil {
+			t.Fatalf("expected %s to be injected (err %v)", fingerprintHexUpper, err)
+		}
+
+		if got := certKey.(memRegKey).node.dacl; got != tc.dacl {
+			t.Errorf("%s: expected DACL %q, got %q", fingerprintHexUpper, tc.dacl, got)
+		}
+
+		certKey.Close()
+	}
+}
+
+func TestSecureACLUnchangedAndDelete(t *testing.T) {
+	mem, restore := testStore(t)
+	defer restore()
+
+	rootDER, _ := testCertChain(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(rootDER)
+
+	opts := testInjectOptions(t)
+	opts.Store = testCryptoAPIStore
+
+	if err := InjectWithOptions(rootDER, *opts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	// Re-injecting the unchanged cert with SecureACL still secures it.
+	opts.SecureACL = true
+
+	if err := InjectWithOptions(rootDER, *opts); err != nil {
+		t.Fatalf("re-injection failed: %v", err)
+	}
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("expected %s to be injected (err %v)", fingerprintHexUpper, err)
+	}
+
+	if got := certKey.(memRegKey).node.dacl; got != secureACLSDDL {
+		t.Errorf("expected DACL %q after re-injection, got %q", secureACLSDDL, got)
+	}
+
+	certKey.Close()
+
+	// Deleting the secured key is denied until its default ACL is restored.
+	mem.denyDeleteDACL = secureACLSDDL
+
+	storeKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("couldn't open store: %v", err)
+	}
+	defer storeKey.Close()
+
+	if err := reg.DeleteKey(storeKey, fingerprintHexUpper); err != nil {
+		t.Fatalf("expected the ACL to be reset and the key deleted, got %v", err)
+	}
+
+	if injected, err := IsInjected(testCryptoAPIStore, rootDER); err != nil || injected {
+		t.Errorf("expected %s to be deleted, got %t (err %v)", fingerprintHexUpper, injected, err)
+	}
+}
+
+func TestSyncWithSource(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	rootFingerprint := fingerprintHexUpperCryptoAPI(rootDER)
+	intermediateFingerprint := fingerprintHexUpperCryptoAPI(intermediateDER)
+
+	source := func() ([][]byte, error) {
+		return [][]byte{rootDER, intermediateDER, rootDER}, nil
+	}
+
+	added, updated, removed, err := SyncWithSource(testCryptoAPIStore, source)
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	want := []string{intermediateFingerprint, rootFingerprint}
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(added, want) || len(updated) != 0 || len(removed) != 0 {
+		t.Errorf("unexpected first sync: added %v, updated %v, removed %v", added, updated, removed)
+	}
+
+	added, updated, removed, err = SyncWithSource(testCryptoAPIStore, source)
+	if err != nil || len(added) != 0 || len(updated) != 0 || len(removed) != 0 {
+		t.Errorf("expected no-op sync, got added %v, updated %v, removed %v (err %v)", added, updated, removed, err)
+	}
+
+	_, _, _, err = SyncWithSource(testCryptoAPIStore, func() ([][]byte, error) {
+		return nil, errors.New("source unavailable")
+	})
+	if !errors.Is(err, ErrSourceFetch) {
+		t.Errorf("expected ErrSourceFetch, got %v", err)
+	}
+
+	if err := friendlyName.CfSetValue("Namecoin Root"); err != nil {
+		t.Fatalf("couldn't set friendly name: %v", err)
+	}
+	defer friendlyName.CfSetValue("") //nolint:errcheck
+
+	added, updated, removed, err = SyncWithSource(testCryptoAPIStore, func() ([][]byte, error) {
+		return [][]byte{rootDER}, nil
+	})
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if len(added) != 0 || !reflect.DeepEqual(updated, []string{rootFingerprint}) ||
+		!reflect.DeepEqual(removed, []string{intermediateFingerprint}) {
+		t.Errorf("unexpected second sync: added %v, updated %v, removed %v", added, updated, removed)
+	}
+
+	certs, err := ListInjectedCerts(testCryptoAPIStore)
+	if err != nil || len(certs) != 1 || certs[0].Fingerprint != rootFingerprint {
+		t.Errorf("expected only the root to remain, got %v (err %v)", certs, err)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	defer timeout.CfSetValue("") //nolint:errcheck
+
+	errFn := errors.New("fn failed")
+
+	if err := withTimeout(func() error { return errFn }); !errors.Is(err, errFn) {
+		t.Errorf("expected fn's error without a timeout, got %v", err)
+	}
+
+	if err := timeout.CfSetValue("soon"); err != nil {
+		t.Fatalf("couldn't set timeout: %v", err)
+	}
+
+	if err := withTimeout(func() error { return nil }); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("expected ErrInvalidOption for a malformed timeout, got %v", err)
+	}
+
+	if err := timeout.CfSetValue("50ms"); err != nil {
+		t.Fatalf("couldn't set timeout: %v", err)
+	}
+
+	if err := withTimeout(func() error { return errFn }); !errors.Is(err, errFn) {
+		t.Errorf("expected fn's error within the timeout, got %v", err)
+	}
+
+	hung := make(chan struct{})
+	defer close(hung)
+
+	err := withTimeout(func() error {
+		<-hung
+
+		return nil
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout for a hung call, got %v", err)
+	}
+}
+
+func TestFingerprintsFromReader(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	rootDER, intermediateDER := testCertChain(t)
+	root := fingerprintHexUpperCryptoAPI(rootDER)
+	intermediate := fingerprintHexUpperCryptoAPI(intermediateDER)
+
+	opts := testInjectOptions(t)
+	opts.Store = testCryptoAPIStore
+
+	for _, derBytes := range [][]byte{rootDER, intermediateDER} {
+		if err := InjectWithOptions(derBytes, *opts); err != nil {
+			t.Fatalf("injection failed: %v", err)
+		}
+	}
+
+	input := "# certs to renew\n" + strings.ToLower(root) + "\n\nbogus\n" + intermediate + "\n"
+	out := &bytes.Buffer{}
+
+	err := TouchCertsFrom(testCryptoAPIStore, strings.NewReader(input), out)
+	if !errors.Is(err, ErrInvalidOption) || errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected only ErrInvalidOption for the bogus line, got %v", err)
+	}
+
+	expected := root + " ok\nbogus error: \"bogus\" isn't a SHA-1 fingerprint: " + ErrInvalidOption.Error() + "\n" +
+		intermediate + " ok\n"
+	if out.String() != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+
+	err = RemoveCertsFrom(testCryptoAPIStore, strings.NewReader(root+"\n"+root+"\n"), out)
+	if !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound for the repeated fingerprint, got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || lines[0] != root+" ok" || !strings.HasPrefix(lines[1], root+" error: ") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	certs, err := ListInjectedCerts(testCryptoAPIStore)
+	if err != nil || len(certs) != 1 || certs[0].Fingerprint != intermediate {
+		t.Errorf("expected only the intermediate to remain, got %v (err %v)", certs, err)
+	}
+}
+
+func TestInjectWithProfile(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	defer func() {
+		cryptoAPIStoresMu.Lock()
+		delete(cryptoAPIStores, "test-profile")
+		cryptoAPIStoresMu.Unlock()
+	}()
+
+	if err := RegisterStore("test-profile", testCryptoAPIStore); err != nil {
+		t.Fatalf("couldn't register store: %v", err)
+	}
+
+	dir := t.TempDir()
+	writeProfile := func(name, profile string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(profile), 0o600); err != nil {
+			t.Fatalf("couldn't write profile: %v", err)
+		}
+
+		return path
+	}
+
+	derBytes := testCertDER(t)
+
+	for name, profile := range map[string]string{
+		"unknown-field.json": `{"physicalStore": "test-profile", "frendlyName": "typo"}`,
+		"unknown-eku.json":   `{"physicalStore": "test-profile", "extKeyUsages": ["bogus"]}`,
+		"bad-ip.json":        `{"physicalStore": "test-profile", "nameConstraints": {"excludedIP": ["bogus"]}}`,
+		"trailing.json":      `{"physicalStore": "test-profile"} {}`,
+	} {
+		err := InjectWithProfile(derBytes, writeProfile(name, profile))
+		if !errors.Is(err, ErrProfile) {
+			t.Errorf("%s: expected ErrProfile, got %v", name, err)
+		}
+	}
+
+	path := writeProfile("profile.json", `{
+		"physicalStore": "test-profile",
+		"logicalStores": ["Root"],
+		"extKeyUsages": ["server", "client"],
+		"nameConstraints": {"permittedDNS": ["bit", "example.bit"], "excludedIP": ["0.0.0.0/0"]},
+		"allowLeafInRoot": true,
+		"friendlyName": "Namecoin Profile"
+	}`)
+
+	if err := InjectWithProfile(derBytes, path); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpperCryptoAPI(derBytes), testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("expected cert to be injected (err %v)", err)
+	}
+	defer certKey.Close()
+
+	blob, err := readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read blob: %v", err)
+	}
+
+	for _, id := range []uint32{
+		certblob.CertEnhkeyUsagePropID, certblob.CertRootProgramNameConstraintsPropID, certblob.CertFriendlyNamePropID,
+	} {
+		if blob[id] == nil {
+			t.Errorf("expected property %d to be set from the profile", id)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	mem, restore := testStore(t)
+	defer restore()
+
+	if err := SelfTest(testCryptoAPIStore); err != nil {
+		t.Fatalf("self-test failed: %v", err)
+	}
+
+	storeKey, err := reg.OpenKey(reg.Root(registry.CURRENT_USER, 0), testStoreKey, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		t.Fatalf("couldn't open store: %v", err)
+	}
+
+	names, err := storeKey.ReadSubKeyNamesAt(0, -1)
+	storeKey.Close()
+
+	if (err != nil && !errors.Is(err, io.EOF)) || len(names) != 0 {
+		t.Errorf("expected self-test to leave the store empty, got %v (err %v)", names, err)
+	}
+
+	// A store that can't be written fails the inject step.
+	mem.readOnly = true
+
+	err = SelfTest(testCryptoAPIStore)
+	if !errors.Is(err, ErrSelfTest) || !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		t.Errorf("expected self-test to fail with access denied, got %v", err)
+	}
+}
+
+func TestBackupRestoreStore(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	rootDER, intermediateDER := testCertChain(t)
+	rootFingerprint := fingerprintHexUpperCryptoAPI(rootDER)
+	intermediateFingerprint := fingerprintHexUpperCryptoAPI(intermediateDER)
+
+	// One cert is ours and one isn't; both must be backed up.
+	opts := testInjectOptions(t)
+	opts.MagicName = "Namecoin"
+	opts.MagicData = 1
+
+	if err := injectSingleCertCryptoAPI(rootDER, rootFingerprint, registry.CURRENT_USER, testStoreKey,
+		opts); err != nil {
+		t.Fatalf("couldn't inject root: %v", err)
+	}
+
+	opts.MagicName = ""
+
+	if err := injectSingleCertCryptoAPI(intermediateDER, intermediateFingerprint, registry.CURRENT_USER,
+		testStoreKey, opts); err != nil {
+		t.Fatalf("couldn't inject intermediate: %v", err)
+	}
+
+	// Values that certinject doesn't write keep their registry type.
+	certKey, _, err := openCertKey(testCryptoAPIStore, rootFingerprint, testStoreFlags(t))
+	if err != nil {
+		t.Fatalf("couldn't open root: %v", err)
+	}
+
+	noteData := []byte{'n', 0, 'o', 0, 't', 0, 'e', 0, 0, 0}
+	if err := certKey.SetValue("Note", registry.SZ, noteData); err != nil {
+		t.Fatalf("couldn't set string value: %v", err)
+	}
+
+	certKey.Close()
+
+	oldRootBlob := storedBlobBytes(testCryptoAPIStore, rootFingerprint, testStoreFlags(t))
+
+	backup := &bytes.Buffer{}
+	if err := BackupStore(testCryptoAPIStore, backup); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	for _, fingerprintHexUpper := range []string{rootFingerprint, intermediateFingerprint} {
+		if err := RemoveCert(testCryptoAPIStore, fingerprintHexUpper); err != nil {
+			t.Fatalf("couldn't remove cert: %v", err)
+		}
+	}
+
+	// A truncated backup is rejected without touching the store.
+	truncated := bytes.NewReader(backup.Bytes()[:backup.Len()-1])
+	if err := RestoreStore(testCryptoAPIStore, truncated); !errors.Is(err, ErrBackupFormat) {
+		t.Errorf("expected ErrBackupFormat for a truncated backup, got %v", err)
+	}
+
+	if injected, _ := IsInjected(testCryptoAPIStore, rootDER); injected {
+		t.Errorf("expected a truncated backup not to restore anything")
+	}
+
+	if err := RestoreStore(testCryptoAPIStore, bytes.NewReader([]byte("not a backup"))); !errors.Is(err,
+		ErrBackupFormat) {
+		t.Errorf("expected ErrBackupFormat without a header, got %v", err)
+	}
+
+	if err := RestoreStore(testCryptoAPIStore, bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	if !bytes.Equal(storedBlobBytes(testCryptoAPIStore, rootFingerprint, testStoreFlags(t)), oldRootBlob) {
+		t.Errorf("expected the restored blob to match the original")
+	}
+
+	if injected, err := IsInjected(testCryptoAPIStore, intermediateDER); err != nil || !injected {
+		t.Errorf("expected the untagged cert to be restored (err %v)", err)
+	}
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, rootFingerprint, testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("expected root to be restored (err %v)", err)
+	}
+	defer certKey.Close()
+
+	if !hasMagic(certKey, "Namecoin", 1) {
+		t.Errorf("expected the magic tag to be restored")
+	}
+
+	buf := make([]byte, len(noteData))
+	if n, valType, err := certKey.GetValue("Note", buf); err != nil || valType != registry.SZ ||
+		!bytes.Equal(buf[:n], noteData) {
+		t.Errorf("expected the string value to be restored as REG_SZ, got type %d %q (err %v)", valType, buf[:n], err)
+	}
+}
+
+// TestWithFlagsRace changes flags while injecting and cleaning up
+// concurrently.  It's meant to be run with the race detector.
+func TestWithFlagsRace(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	defer func() {
+		cryptoAPIStoresMu.Lock()
+		delete(cryptoAPIStores, "test-race")
+		cryptoAPIStoresMu.Unlock()
+	}()
+
+	if err := RegisterStore("test-race", testCryptoAPIStore); err != nil {
+		t.Fatalf("couldn't register store: %v", err)
+	}
+
+	if err := cryptoAPIFlagPhysicalStoreName.CfSetValue("test-race"); err != nil {
+		t.Fatalf("couldn't set physical store: %v", err)
+	}
+	defer cryptoAPIFlagPhysicalStoreName.CfSetValue("system") //nolint:errcheck
+
+	if err := allowLeafInRoot.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set allow-leaf-in-root: %v", err)
+	}
+	defer allowLeafInRoot.CfSetValue(false) //nolint:errcheck
+
+	names := []string{"Namecoin A", "Namecoin B"}
+
+	if err := friendlyName.CfSetValue(names[0]); err != nil {
+		t.Fatalf("couldn't set friendly name: %v", err)
+	}
+	defer friendlyName.CfSetValue("") //nolint:errcheck
+
+	// Log flags are read while the operations run, and with a timeout, the
+	// operations run in their own goroutines.
+	defer fingerprintFormat.CfSetValue("bare")                 //nolint:errcheck
+	defer progressInterval.CfSetValue(defaultProgressInterval) //nolint:errcheck
+
+	if err := timeout.CfSetValue("1m"); err != nil {
+		t.Fatalf("couldn't set timeout: %v", err)
+	}
+	defer timeout.CfSetValue("") //nolint:errcheck
+
+	formats := []string{"colon", "bare"}
+	derBytes := testCertDER(t)
+
+	var wg sync.WaitGroup
+
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			WithFlags(func() {
+				friendlyName.CfSetValue(names[i%len(names)])          //nolint:errcheck
+				fingerprintFormat.CfSetValue(formats[i%len(formats)]) //nolint:errcheck
+				progressInterval.CfSetValue(1 + i%2)                  //nolint:errcheck
+			})
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			if err := InjectCertCryptoAPI(derBytes); err != nil {
+				t.Errorf("injection failed: %v", err)
+
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			if err := CleanCertsCryptoAPI(); err != nil {
+				t.Errorf("cleanup failed: %v", err)
+
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpperCryptoAPI(derBytes), testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("expected cert to be injected (err %v)", err)
+	}
+	defer certKey.Close()
+
+	blob, err := readBlobValue(certKey, defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read blob: %v", err)
+	}
+
+	if blob[certblob.CertFriendlyNamePropID] == nil {
+		t.Errorf("expected a friendly name to be set")
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	rootDER, intermediateDER := testCertChain(t)
+	rootFingerprint := fingerprintHexUpperCryptoAPI(rootDER)
+	intermediateFingerprint := fingerprintHexUpperCryptoAPI(intermediateDER)
+
+	// The root ships with Windows (no magic tag), the intermediate is ours.
+	opts := testInjectOptions(t)
+
+	if err := injectSingleCertCryptoAPI(rootDER, rootFingerprint, registry.CURRENT_USER, testStoreKey,
+		opts); err != nil {
+		t.Fatalf("couldn't inject root: %v", err)
+	}
+
+	opts.MagicName = "Namecoin"
+	opts.MagicData = 1
+
+	if err := injectSingleCertCryptoAPI(intermediateDER, intermediateFingerprint, registry.CURRENT_USER,
+		testStoreKey, opts); err != nil {
+		t.Fatalf("couldn't inject intermediate: %v", err)
+	}
+
+	oldRootBlob := storedBlobBytes(testCryptoAPIStore, rootFingerprint, testStoreFlags(t))
+	oldIntermediateBlob := storedBlobBytes(testCryptoAPIStore, intermediateFingerprint, testStoreFlags(t))
+
+	opts.SkipExisting = true
+	opts.FriendlyName = "Namecoin"
+
+	for _, derBytes := range [][]byte{rootDER, intermediateDER} {
+		if err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpperCryptoAPI(derBytes),
+			registry.CURRENT_USER, testStoreKey, opts); err != nil {
+			t.Fatalf("injection failed: %v", err)
+		}
+	}
+
+	if !bytes.Equal(storedBlobBytes(testCryptoAPIStore, rootFingerprint, testStoreFlags(t)), oldRootBlob) {
+		t.Errorf("expected the OS-provided root to be skipped")
+	}
+
+	if bytes.Equal(storedBlobBytes(testCryptoAPIStore, intermediateFingerprint, testStoreFlags(t)), oldIntermediateBlob) {
+		t.Errorf("expected our own cert to be updated")
+	}
+
+	// Without a magic tag, nothing can be told apart, so every existing cert
+	// is skipped.
+	opts.MagicName = ""
+	opts.FriendlyName = "Namecoin 2"
+	oldIntermediateBlob = storedBlobBytes(testCryptoAPIStore, intermediateFingerprint, testStoreFlags(t))
+
+	if err := injectSingleCertCryptoAPI(intermediateDER, intermediateFingerprint, registry.CURRENT_USER,
+		testStoreKey, opts); err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	if !bytes.Equal(storedBlobBytes(testCryptoAPIStore, intermediateFingerprint, testStoreFlags(t)), oldIntermediateBlob) {
+		t.Errorf("expected existing certs to be skipped without a magic tag")
+	}
+}
+
+func TestSkipExistingForce(t *testing.T) {
+	if err := skipExisting.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set skip-existing: %v", err)
+	}
+	defer skipExisting.CfSetValue(false) //nolint:errcheck
+
+	opts := testInjectOptions(t)
+	if !opts.SkipExisting {
+		t.Errorf("expected skip-existing to be set")
+	}
+
+	if err := force.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set force: %v", err)
+	}
+	defer force.CfSetValue(false) //nolint:errcheck
+
+	opts = testInjectOptions(t)
+	if opts.SkipExisting {
+		t.Errorf("expected force to override skip-existing")
+	}
+}
+
+func TestInjectLogicalStoresConcurrently(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	for _, logical := range []string{"AuthRoot", "CA"} {
+		storeKey, _, err := reg.CreateKey(reg.Root(registry.CURRENT_USER, 0), testCryptoAPIStore.LogicalKey(logical),
+			registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create %s store: %v", logical, err)
+		}
+		storeKey.Close()
+	}
+
+	rootDER, _ := testCertChain(t)
+	opts := *testInjectOptions(t)
+	opts.Store = testCryptoAPIStore
+	opts.LogicalStores = []string{"Root", "AuthRoot", "Missing", "CA"}
+
+	// The Missing logical store doesn't exist, which mustn't stop the
+	// others.
+	err := InjectWithOptions(rootDER, opts)
+	if !errors.Is(err, ErrStoreOpen) || !strings.Contains(err.Error(), "logical store Missing") {
+		t.Errorf("expected only the Missing logical store to fail, got %v", err)
+	}
+
+	for _, logical := range []string{"Root", "AuthRoot", "CA"} {
+		certKey, ok, err := openCertKeyAt(registry.CURRENT_USER, 0,
+			testCryptoAPIStore.LogicalKey(logical)+`\`+fingerprintHexUpperCryptoAPI(rootDER))
+		if !ok || err != nil {
+			t.Errorf("expected cert in %s logical store (err %v)", logical, err)
+
+			continue
+		}
+
+		certKey.Close()
+	}
+}
+
+func TestForEachLogicalStore(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running       int
+		maxRunning    int
+		order         []string
+		rootFinished  bool
+		beforeRootRan bool
+	)
+
+	logicalStores := []string{"CA", "AuthRoot", "Root", "Trust", "My", "Disallowed", "TrustedPeople"}
+
+	err := forEachLogicalStore(logicalStores, func(logical string) error {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		order = append(order, logical)
+
+		if logical != "Root" && !rootFinished {
+			beforeRootRan = true
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+
+		if logical == "Root" {
+			rootFinished = true
+		}
+		mu.Unlock()
+
+		if logical == "Trust" {
+			return ErrRegistryWrite
+		}
+
+		return nil
+	})
+
+	if !errors.Is(err, ErrRegistryWrite) || !strings.Contains(err.Error(), "logical store Trust") {
+		t.Errorf("expected the Trust logical store's error, got %v", err)
+	}
+
+	if len(order) != len(logicalStores) {
+		t.Errorf("expected all %d logical stores to run, got %v", len(logicalStores), order)
+	}
+
+	if beforeRootRan {
+		t.Errorf("expected the Root logical store to finish first, got order %v", order)
+	}
+
+	if maxRunning > logicalStoreConcurrency {
+		t.Errorf("expected at most %d concurrent logical stores, got %d", logicalStoreConcurrency, maxRunning)
+	}
+}
+
+func TestInjectErrorReportsProgress(t *testing.T) {
+	mem, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	opts := testInjectOptions(t)
+	opts.FriendlyName = "Namecoin"
+
+	// Fingerprints in log messages are formatted, but not the one reported in
+	// the error.
+	if err := fingerprintFormat.CfSetValue("colon"); err != nil {
+		t.Fatalf("couldn't set fingerprint format: %v", err)
+	}
+
+	defer func() {
+		fingerprintFormat.CfSetValue("bare") //nolint:errcheck
+		snapshotLogFlagsLocked()             //nolint:errcheck
+	}()
+
+	if err := snapshotLogFlagsLocked(); err != nil {
+		t.Fatalf("couldn't snapshot log flags: %v", err)
+	}
+
+	// The properties are built, but the store can't be written.
+	mem.readOnly = true
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey, opts)
+	if !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		t.Fatalf("expected access denied, got %v", err)
+	}
+
+	var injectErr *InjectError
+	if !errors.As(err, &injectErr) {
+		t.Fatalf("expected InjectError, got %T: %v", err, err)
+	}
+
+	if injectErr.Fingerprint != fingerprintHexUpper {
+		t.Errorf("expected fingerprint %s, got %s", fingerprintHexUpper, injectErr.Fingerprint)
+	}
+
+	if injectErr.BlobWritten {
+		t.Error("expected blob not to be reported as written")
+	}
+
+	builtFriendlyName := false
+
+	for _, id := range injectErr.Properties {
+		builtFriendlyName = builtFriendlyName || id == certblob.CertFriendlyNamePropID
+	}
+
+	if !builtFriendlyName {
+		t.Errorf("expected friendly name property to be reported as built, got %v", injectErr.Properties)
+	}
+
+	if !strings.Contains(err.Error(), "blob written: false") {
+		t.Errorf("expected error message to report blob status, got %q", err)
+	}
+}
+
+func TestBlobValueName(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+	opts := testInjectOptions(t)
+	opts.BlobValueName = "TestBlob"
+	opts.FriendlyName = "Namecoin"
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey, opts)
+	if err != nil {
+		t.Fatalf("injection failed: %v", err)
+	}
+
+	// Re-injecting reads the existing properties from the same value.
+	opts.FriendlyName = ""
+
+	err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, registry.CURRENT_USER, testStoreKey, opts)
+	if err != nil {
+		t.Fatalf("re-injection failed: %v", err)
+	}
+
+	certKey, ok, err := openCertKey(testCryptoAPIStore, fingerprintHexUpper, testStoreFlags(t))
+	if !ok || err != nil {
+		t.Fatalf("couldn't open injected cert (err %v)", err)
+	}
+	defer certKey.Close()
+
+	if _, _, err := certKey.GetBinaryValue(blobValueName); !errors.Is(err, registry.ErrNotExist) {
+		t.Errorf("expected no %s value, got err %v", blobValueName, err)
+	}
+
+	blob, err := readNamedBlobValue(certKey, "TestBlob", defaultMaxBlobBytes)
+	if err != nil {
+		t.Fatalf("couldn't read TestBlob value: %v", err)
+	}
+
+	name, err := certblob.ParseFriendlyName(&certblob.Property{
+		ID:    certblob.CertFriendlyNamePropID,
+		Value: blob[certblob.CertFriendlyNamePropID],
+	})
+	if err != nil || name != "Namecoin" {
+		t.Errorf("expected friendly name to be kept, got %q (err %v)", name, err)
+	}
+}
+
+func TestCheckStoreKeys(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	if err := checkStoreKeys(testCryptoAPIStore, []string{"Root", "CA"}); err != nil {
+		t.Errorf("expected test store to be valid, got %v", err)
+	}
+
+	longLogical := strings.Repeat("L", 300)
+
+	err := InjectWithOptions(testCertDER(t), InjectOptions{
+		Store:         testCryptoAPIStore,
+		LogicalStores: []string{longLogical},
+	})
+	if !errors.Is(err, ErrInvalidStore) || !strings.Contains(err.Error(), "300 characters long") {
+		t.Errorf("expected clear ErrInvalidStore for a long logical store name, got %v", err)
+	}
+
+	deep := Store{registry.CURRENT_USER, strings.Repeat(`Nested\`, 5000) + "Store", `%s\Certificates`}
+
+	err = checkStoreKeys(deep, []string{"Root"})
+	if !errors.Is(err, ErrInvalidStore) || !strings.Contains(err.Error(), "over the limit of 32767") {
+		t.Errorf("expected clear ErrInvalidStore for a deeply nested store, got %v", err)
+	}
+}
+
+func TestInjectMethod(t *testing.T) {
+	_, restore := testStore(t)
+	defer restore()
+
+	for _, method := range []string{"", InjectMethodRegistry, InjectMethodWin32API} {
+		opts := InjectOptions{Method: method}
+		if err := opts.checkMethod(); err != nil {
+			t.Errorf("expected method %q to be valid, got %v", method, err)
+		}
+	}
+
+	for name, opts := range map[string]InjectOptions{
+		"unknown":         {Method: "certutil"},
+		"watch":           {Method: InjectMethodWin32API, watch: true},
+		"blob value name": {Method: InjectMethodWin32API, BlobValueName: "TestBlob"},
+	} {
+		if err := opts.checkMethod(); !errors.Is(err, ErrInvalidStore) {
+			t.Errorf("%s: expected ErrInvalidStore, got %v", name, err)
+		}
+	}
+
+	// An invalid method is rejected before anything is written.
+	derBytes := testCertDER(t)
+
+	err := InjectWithOptions(derBytes, InjectOptions{Store: testCryptoAPIStore, Method: "certutil"})
+	if !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore, got %v", err)
+	}
+
+	if _, ok, _ := openCertKey(testCryptoAPIStore, fingerprintHexUpperCryptoAPI(derBytes), testStoreFlags(t)); ok {
+		t.Error("expected nothing to be injected with an invalid method")
+	}
+
+	for name, expected := range win32StoreLocations {
+		store := cryptoAPIStores[name]
+
+		location, logical, err := win32StoreLocation(store.Base, store.LogicalKey("CA"))
+		if err != nil || location != expected || logical != "CA" {
+			t.Errorf("%s: expected location %#x in CA, got %#x in %s (err %v)", name, expected, location,
+				logical, err)
+		}
+	}
+
+	// Stores that the Win32 API can't open by name are rejected.
+	userStore := Store{registry.USERS, `S-1-5-21-1-2-3-1001\SOFTWARE\Microsoft\SystemCertificates`, `%s\Certificates`}
+
+	_, _, err = win32StoreLocation(userStore.Base, userStore.LogicalKey("Root"))
+	if !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for a user SID store, got %v", err)
+	}
+}
+
+func TestReadInjectedCertsAnyStore(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	setTestMagicName(t, "Namecoin")
+
+	userStore := cryptoAPIStores["current-user"]
+	systemStore := cryptoAPIStores["system"]
+
+	for _, store := range []Store{userStore, systemStore} {
+		storeKey, _, err := reg.CreateKey(reg.Root(store.Base, 0), store.LogicalKey("Root"), registry.ALL_ACCESS)
+		if err != nil {
+			t.Fatalf("couldn't create store %s: %v", store, err)
+		}
+		storeKey.Close()
+	}
+
+	derBytes := testCertDER(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(derBytes)
+
+	// The user's copy is untagged, so the system store's tagged copy, which
+	// Windows merges into the user's view, is the one listed.
+	opts := testInjectOptions(t)
+	opts.MagicName = ""
+
+	err := injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, userStore.Base, userStore.LogicalKey("Root"), opts)
+	if err != nil {
+		t.Fatalf("injection into user store failed: %v", err)
+	}
+
+	opts = testInjectOptions(t)
+	opts.FriendlyName = "System copy"
+
+	err = injectSingleCertCryptoAPI(derBytes, fingerprintHexUpper, systemStore.Base, systemStore.LogicalKey("Root"),
+		opts)
+	if err != nil {
+		t.Fatalf("injection into system store failed: %v", err)
+	}
+
+	certs, err := readInjectedCertsAnyStore(userStore, win32StoreLocations["current-user"], "Root",
+		[]string{fingerprintHexUpper, "0000000000000000000000000000000000000000"}, testStoreFlags(t))
+	if err != nil || len(certs) != 1 || certs[0].Fingerprint != fingerprintHexUpper {
+		t.Fatalf("expected only the tagged cert, got %v (err %v)", certs, err)
+	}
+
+	name, err := certblob.ParseFriendlyName(&certblob.Property{
+		ID:    certblob.CertFriendlyNamePropID,
+		Value: certs[0].Blob[certblob.CertFriendlyNamePropID],
+	})
+	if err != nil || name != "System copy" {
+		t.Errorf("expected the system store's copy, got friendly name %q (err %v)", name, err)
+	}
+
+	// Windows doesn't merge the current user's stores into the system
+	// store's view.
+	otherDER, _ := testCertChain(t)
+	otherFingerprint := fingerprintHexUpperCryptoAPI(otherDER)
+
+	err = injectSingleCertCryptoAPI(otherDER, otherFingerprint, userStore.Base, userStore.LogicalKey("Root"),
+		testInjectOptions(t))
+	if err != nil {
+		t.Fatalf("injection into user store failed: %v", err)
+	}
+
+	certs, err = readInjectedCertsAnyStore(systemStore, win32StoreLocations["system"], "Root",
+		[]string{otherFingerprint}, testStoreFlags(t))
+	if err != nil || len(certs) != 0 {
+		t.Errorf("expected the user store's cert not to be read for the system store, got %v (err %v)", certs, err)
+	}
+}
+
+func TestAddCertToStoreWin32API(t *testing.T) {
+	store, err := windows.CertOpenStore(windows.CERT_STORE_PROV_MEMORY, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("couldn't open memory store: %v", err)
+	}
+	defer windows.CertCloseStore(store, 0) //nolint:errcheck
+
+	derBytes := testCertDER(t)
+
+	blob, err := BuildBlob(derBytes, InjectOptions{Store: testCryptoAPIStore, FriendlyName: "Namecoin",
+		AllowLeafInRoot: true})
+	if err != nil {
+		t.Fatalf("couldn't build blob: %v", err)
+	}
+
+	// Adding the cert twice replaces the first copy.
+	for i := 0; i < 2; i++ {
+		if err := addCertToStoreWin32API(store, blob); err != nil {
+			t.Fatalf("couldn't add cert: %v", err)
+		}
+	}
+
+	fingerprints, err := enumFingerprintsInStoreWin32API(store)
+	if err != nil || len(fingerprints) != 1 || fingerprints[0] != fingerprintHexUpperCryptoAPI(derBytes) {
+		t.Errorf("expected only the added cert, got %v (err %v)", fingerprints, err)
+	}
+
+	if err := addCertToStoreWin32API(store, certblob.Blob{}); !errors.Is(err, ErrNoCert) {
+		t.Errorf("expected ErrNoCert for a blob without a cert, got %v", err)
+	}
+
+	badBlob := certblob.Blob{certblob.CertContentCertPropID: []byte("not a cert")}
+	if err := addCertToStoreWin32API(store, badBlob); !errors.Is(err, ErrBadCert) {
+		t.Errorf("expected ErrBadCert for an undecodable cert, got %v", err)
+	}
+}
+
+func TestWriteBlobWin32API(t *testing.T) {
+	_, restore := useMemReg()
+	defer restore()
+
+	userStore := cryptoAPIStores["current-user"]
+	errAdd := errors.New("add failed")
+
+	var (
+		added   []string
+		failAdd bool
+	)
+
+	// Windows writes the blob of an added cert to the store's registry key.
+	defer func(old func(certblob.Blob, uint32, string) error) { addCertWin32API = old }(addCertWin32API)
+	addCertWin32API = func(blob certblob.Blob, location uint32, logical string) error {
+		if failAdd {
+			return errAdd
+		}
+
+		added = append(added, fmt.Sprintf("%#x %s", location, logical))
+
+		blobBytes, err := blob.Marshal()
+		if err != nil {
+			return err
+		}
+
+		certKey, _, err := reg.CreateKey(reg.Root(userStore.Base, 0),
+			userStore.LogicalKey(logical)+`\`+fingerprintHexUpperCryptoAPI(blob[certblob.CertContentCertPropID]),
+			registry.ALL_ACCESS)
+		if err != nil {
+			return err
+		}
+		defer certKey.Close()
+
+		return certKey.SetBinaryValue(blobValueName, blobBytes)
+	}
+
+	rootDER, _ := testCertChain(t)
+	fingerprintHexUpper := fingerprintHexUpperCryptoAPI(rootDER)
+	blob := certblob.Blob{certblob.CertContentCertPropID: rootDER}
+	opts := &InjectOptions{MagicName: "Namecoin", MagicData: 1, SkipMagicName: "NamecoinSkip", SkipMagicData: 1,
+		SecureACL: true}
+
+	changed, err := writeBlobWin32API(blob, fingerprintHexUpper, userStore.Base, userStore.LogicalKey("Root"), opts)
+	if err != nil || !changed {
+		t.Fatalf("expected the cert to be added, got %t (err %v)", changed, err)
+	}
+
+	expected := fmt.Sprintf("%#x Root", uint32(windows.CERT_SYSTEM_STORE_CURRENT_USER))
+	if len(added) != 1 || added[0] != expected {
+		t.Errorf("expected the cert to be added to %s, got %v", expected, added)
+	}
+
+	certKey, ok, err := openCertKeyAt(userStore.Base, 0, userStore.LogicalKey("Root")+`\`+fingerprintHexUpper)
+	if err != nil || !ok {
+		t.Fatalf("couldn't open added cert (err %v)", err)
+	}
+
+	if !hasMagic(certKey, "Namecoin", 1) {
+		t.Error("expected the magic tag to be set")
+	}
+
+	if _, _, err := certKey.GetIntegerValue(notAfterValueName); err != nil {
+		t.Errorf("expected %s to be recorded, got %v", notAfterValueName, err)
+	}
+
+	if got := certKey.(memRegKey).node.dacl; got != secureACLSDDL {
+		t.Errorf("expected DACL %q, got %q", secureACLSDDL, got)
+	}
+
+	// Certs with the skip-magic tag aren't added again.
+	if err := certKey.SetDWordValue("NamecoinSkip", 1); err != nil {
+		t.Fatalf("couldn't set skip magic: %v", err)
+	}
+
+	certKey.Close()
+
+	changed, err = writeBlobWin32API(blob, fingerprintHexUpper, userStore.Base, userStore.LogicalKey("Root"), opts)
+	if err != nil || changed || len(added) != 1 {
+		t.Errorf("expected the skip-magic cert to be left alone, got %t, %d adds (err %v)", changed, len(added), err)
+	}
+
+	failAdd = true
+	opts.SkipMagicName = ""
+
+	changed, err = writeBlobWin32API(blob, fingerprintHexUpper, userStore.Base, userStore.LogicalKey("Root"), opts)
+	if !errors.Is(err, errAdd) || changed {
+		t.Errorf("expected the add error, got %t (err %v)", changed, err)
+	}
+
+	_, err = writeBlobWin32API(blob, fingerprintHexUpper, testCryptoAPIStore.Base, testStoreKey, opts)
+	if !errors.Is(err, ErrInvalidStore) {
+		t.Errorf("expected ErrInvalidStore for a store the Win32 API can't open, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the injection and cleanup functions.  Where a
+// lower-level error (e.g. from the registry) caused the failure, it is wrapped
+// as well, so errors.Is works on both.
+var (
+	ErrInjectCerts = errors.New("error injecting certs")
+	ErrNoCert      = fmt.Errorf("no cert specified: %w", ErrInjectCerts)
+	// ErrBadCert means the cert to inject couldn't be decoded.
+	ErrBadCert = fmt.Errorf("bad cert: %w", ErrInjectCerts)
+	// ErrCertRead means the file or stream holding the cert to inject
+	// couldn't be read.
+	ErrCertRead = fmt.Errorf("error reading cert: %w", ErrInjectCerts)
+	// ErrPKCS12Password means a PKCS#12 file couldn't be decrypted because
+	// the password is wrong.
+	ErrPKCS12Password = fmt.Errorf("incorrect PKCS#12 password: %w", ErrBadCert)
+	// ErrCertExpired means the cert to inject has already expired.
+	ErrCertExpired = fmt.Errorf("cert has expired: %w", ErrBadCert)
+	// ErrUnsuitableCert means the cert isn't suitable for the target store,
+	// e.g. a non-CA cert in the Root logical store.
+	ErrUnsuitableCert = fmt.Errorf("cert unsuitable for store: %w", ErrInjectCerts)
+	ErrEnumerateCerts = fmt.Errorf("error enumerating certs: %w", ErrInjectCerts)
+	// ErrInvalidStore means the store configuration is invalid; retrying
+	// won't help.
+	ErrInvalidStore         = fmt.Errorf("invalid store: %w", ErrEnumerateCerts)
+	ErrInvalidPhysicalStore = fmt.Errorf("invalid choice for physical store "+
+		"(consider current-user, current-user-group-policy, system, enterprise, "+
+		"group-policy, or a registered store): %w",
+		ErrInvalidStore)
+	// ErrInvalidOption means an option (a flag or an InjectOptions field)
+	// has an invalid value; retrying won't help.
+	ErrInvalidOption = fmt.Errorf("invalid option: %w", ErrInjectCerts)
+	// ErrStoreOpen means the store's registry key couldn't be opened.
+	ErrStoreOpen = fmt.Errorf("error opening store: %w", ErrInjectCerts)
+	// ErrStoreAccessDenied means the store exists but can't be opened for
+	// writing, e.g. because the process isn't elevated.
+	ErrStoreAccessDenied = fmt.Errorf("access denied: %w", ErrStoreOpen)
+	// ErrStoreNotFound means the store's registry key doesn't exist.
+	ErrStoreNotFound  = fmt.Errorf("store not found: %w", ErrStoreOpen)
+	ErrGetInitialBlob = fmt.Errorf("error getting initial blob: %w", ErrInjectCerts)
+	// ErrBlobRead means an existing blob couldn't be read or parsed.
+	ErrBlobRead = ErrGetInitialBlob
+	// ErrBlobTooLarge means an existing blob exceeds the size limit for
+	// reading it (see the -max-blob-bytes flag).
+	ErrBlobTooLarge = fmt.Errorf("blob value too large: %w", ErrBlobRead)
+	ErrEditBlob     = fmt.Errorf("error editing blob: %w", ErrInjectCerts)
+	// ErrPropertyMarshal means a property or blob couldn't be built.
+	ErrPropertyMarshal = fmt.Errorf("error marshaling property: %w", ErrEditBlob)
+	// ErrRegistryWrite means a registry key or value couldn't be written or
+	// deleted; this may be transient.
+	ErrRegistryWrite = fmt.Errorf("error writing registry: %w", ErrInjectCerts)
+	ErrSetMagic      = fmt.Errorf("error setting magic tag: %w", ErrRegistryWrite)
+	// ErrBlobTooLargeToWrite means a blob exceeds the size limit of a
+	// registry value, so it can't be written.
+	ErrBlobTooLargeToWrite = fmt.Errorf("blob too large for a registry value: %w", ErrRegistryWrite)
+	// ErrChainVerify means a cert doesn't chain to a trusted root.
+	ErrChainVerify = fmt.Errorf("chain verification failed: %w", ErrInjectCerts)
+	// ErrNoMagic means an operation needs a magic tag to recognize injected
+	// certs, but none is configured.
+	ErrNoMagic = fmt.Errorf("no magic tag configured: %w", ErrInjectCerts)
+	// ErrMagicMismatch means a cert was about to be deleted by cleanup, but
+	// doesn't carry the expirable magic tag.  This indicates a bug.
+	ErrMagicMismatch = fmt.Errorf("cert lacks the expirable magic tag: %w", ErrInjectCerts)
+	// ErrCertNotFound means the cert isn't present in the store.
+	ErrCertNotFound = fmt.Errorf("cert not found in store: %w", ErrInjectCerts)
+	// ErrCorruptCert means the cert's blob doesn't match its subkey name.
+	ErrCorruptCert = fmt.Errorf("cert blob doesn't match its fingerprint: %w", ErrInjectCerts)
+	// ErrNameConstraintsMismatch means the name constraints property read
+	// back from the registry doesn't contain the requested name constraints.
+	ErrNameConstraintsMismatch = fmt.Errorf("name constraints property doesn't match: %w", ErrInjectCerts)
+	// ErrSourceFetch means the source of certs passed to SyncWithSource
+	// failed.
+	ErrSourceFetch = fmt.Errorf("error fetching certs from source: %w", ErrInjectCerts)
+	// ErrTimeout means an operation didn't finish within the -timeout flag's
+	// duration.  It may still be running in the background.
+	ErrTimeout = fmt.Errorf("operation timed out: %w", ErrInjectCerts)
+	// ErrCleanExcludeFile means the cleanup exclusions file can't be read or
+	// is malformed.
+	ErrCleanExcludeFile = fmt.Errorf("error reading cleanup exclusions file: %w", ErrInjectCerts)
+	// ErrProfile means an injection profile can't be read or is invalid.
+	ErrProfile = fmt.Errorf("invalid injection profile: %w", ErrInjectCerts)
+	// ErrBackupWrite means a store backup couldn't be written.
+	ErrBackupWrite = fmt.Errorf("error writing store backup: %w", ErrInjectCerts)
+	// ErrBackupFormat means a store backup is truncated or corrupt.
+	ErrBackupFormat = fmt.Errorf("malformed store backup: %w", ErrInjectCerts)
+	// ErrSelfTest means a step of SelfTest failed.
+	ErrSelfTest = fmt.Errorf("self-test failed: %w", ErrInjectCerts)
+	// ErrUnsupportedPlatform means a CryptoAPI function was called on a
+	// platform other than Windows.
+	ErrUnsupportedPlatform = fmt.Errorf("CryptoAPI is only supported on Windows: %w", ErrInjectCerts)
+)
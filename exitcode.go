@@ -0,0 +1,42 @@
+package certinject
+
+import (
+	"errors"
+	"os"
+)
+
+// Process exit codes returned by ExitCode.  Installers (e.g. WiX/MSI custom
+// actions) can branch on these.
+//
+//	0  success
+//	1  any other error
+//	2  invalid store configuration or option, or store not found
+//	3  access denied (e.g. not elevated when writing the system store)
+//	4  registry write failed
+//	5  cert couldn't be decoded
+const (
+	ExitSuccess       = 0
+	ExitFailure       = 1
+	ExitInvalidStore  = 2
+	ExitAccessDenied  = 3
+	ExitRegistryWrite = 4
+	ExitBadCert       = 5
+)
+
+// ExitCode maps an error returned by this package to a process exit code.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitSuccess
+	case errors.Is(err, ErrBadCert):
+		return ExitBadCert
+	case errors.Is(err, ErrInvalidStore), errors.Is(err, ErrInvalidOption), errors.Is(err, ErrStoreNotFound):
+		return ExitInvalidStore
+	case errors.Is(err, os.ErrPermission), errors.Is(err, ErrStoreAccessDenied):
+		return ExitAccessDenied
+	case errors.Is(err, ErrRegistryWrite):
+		return ExitRegistryWrite
+	default:
+		return ExitFailure
+	}
+}
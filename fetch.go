@@ -0,0 +1,137 @@
+package certinject
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+const (
+	// fetchTimeout bounds InjectFromURL's request, in addition to the
+	// caller's context.
+	fetchTimeout = 30 * time.Second
+	// maxFetchBytes is larger than any sane cert bundle.
+	maxFetchBytes = 1024 * 1024
+	// maxFetchRedirects matches net/http's default limit.
+	maxFetchRedirects = 10
+)
+
+// fetchClient is used by InjectFromURL.  Unlike http.DefaultClient, it
+// applies the https restriction to redirects as well, so that an https URL
+// can't redirect to plain HTTP.
+var fetchClient = &http.Client{CheckRedirect: checkFetchRedirect}
+
+var (
+	allowInsecureFetch = cflag.Bool(flagGroup, "allow-insecure-fetch", false,
+		"Allow InjectFromURL to fetch certs over plain HTTP")
+
+	// ErrFetch means the certs couldn't be fetched.  Unlike the other
+	// errors, it doesn't wrap ErrInjectCerts, since nothing was injected.
+	ErrFetch = errors.New("error fetching certs")
+)
+
+// InjectFromURL fetches a cert (DER) or certs (PEM) from the given URL and
+// injects them into all configured trust stores.  Only https URLs (and
+// redirects to https URLs) are allowed unless the -allow-insecure-fetch flag
+// is set.
+//
+// Returned errors wrap ErrFetch if the URL is disallowed or the fetch fails,
+// and are otherwise returned from InjectPEMReader or InjectCertErr.
+func InjectFromURL(ctx context.Context, rawURL string) error {
+	data, err := fetchCerts(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Contains(data, pemBeginPrefix) {
+		return InjectCertErr(data)
+	}
+
+	n, err := InjectPEMReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("no CERTIFICATE blocks at %s: %w", rawURL, ErrNoCert)
+	}
+
+	return nil
+}
+
+// fetchCerts returns the body of a successful GET of rawURL, limited to
+// maxFetchBytes.
+func fetchCerts(ctx context.Context, rawURL string) ([]byte, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't parse URL: %w", err, ErrFetch)
+	}
+
+	err = checkFetchScheme(parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't build request: %w", err, ErrFetch)
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", err, ErrFetch)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s: %w", rawURL, resp.Status, ErrFetch)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't read response: %w", err, ErrFetch)
+	}
+
+	if len(data) > maxFetchBytes {
+		return nil, fmt.Errorf("%s: response exceeds %d bytes: %w", rawURL, maxFetchBytes, ErrFetch)
+	}
+
+	return data, nil
+}
+
+// checkFetchScheme returns ErrFetch unless u is an https URL, or an http URL
+// and the -allow-insecure-fetch flag is set.
+func checkFetchScheme(u *url.URL) error {
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && allowInsecureFetch.Value():
+	default:
+		return fmt.Errorf("scheme %q not allowed (consider https or -allow-insecure-fetch): %w", u.Scheme, ErrFetch)
+	}
+
+	return nil
+}
+
+// checkFetchRedirect is fetchClient's CheckRedirect.
+func checkFetchRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxFetchRedirects {
+		return fmt.Errorf("stopped after %d redirects: %w", maxFetchRedirects, ErrFetch)
+	}
+
+	err := checkFetchScheme(req.URL)
+	if err != nil {
+		return fmt.Errorf("redirect to %s: %w", req.URL.Redacted(), err)
+	}
+
+	return nil
+}
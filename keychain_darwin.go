@@ -0,0 +1,190 @@
+package certinject
+
+import (
+	// #nosec G505
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+// The security CLI doesn't let us attach our own label to a cert, so we tag
+// Namecoin certs by keeping a copy of each in keychainCertDir, named with
+// this prefix.  Cleanup only touches certs that have such a file.
+const keychainFilePrefix = "Namecoin-"
+
+var (
+	keychainFlag = cflag.Bool(flagGroup, "keychain", false,
+		"Synchronize TLS certs to the macOS Keychain trust store.")
+	keychainFlagGroup     = cflag.NewGroup(flagGroup, "kc")
+	keychainPhysicalStore = cflag.String(keychainFlagGroup, "physical-store", "login",
+		"Keychain to inject certificates into. Valid choices: login, system")
+	keychainCertDir = cflag.String(keychainFlagGroup, "certdir", "", "Directory "+
+		"to store certificate files.  Only use a directory that only ncdns "+
+		"can write to.  (Required if keychain is set.)")
+	keychainEKUFlagGroup = cflag.NewGroup(keychainFlagGroup, "eku")
+	keychainEKUAny       = cflag.Bool(keychainEKUFlagGroup, "any", false,
+		"Any purpose")
+	keychainEKUServer = cflag.Bool(keychainEKUFlagGroup, "server", false,
+		"Server authentication")
+	keychainEKUCode = cflag.Bool(keychainEKUFlagGroup, "code", false,
+		"Code signing")
+	keychainEKUEmail = cflag.Bool(keychainEKUFlagGroup, "email", false,
+		"Secure email")
+	keychainEKUIPSEC = cflag.Bool(keychainEKUFlagGroup, "ipsec", false,
+		"IP security")
+	keychainEKUTime = cflag.Bool(keychainEKUFlagGroup, "time", false,
+		"Time stamping")
+)
+
+// keychainPath returns the keychain to pass to the security CLI, and whether
+// it's the admin trust domain.
+func keychainPath() (string, bool) {
+	if keychainPhysicalStore.Value() == "system" {
+		return "/Library/Keychains/System.keychain", true
+	}
+
+	return "login.keychain", false
+}
+
+// keychainTrustPolicies maps the EKU flags to security CLI trust policies.
+// If none are set, the cert is trusted for all policies.
+func keychainTrustPolicies() []string {
+	policies := []string{}
+
+	appendKeychainPolicy(&policies, keychainEKUAny.Value(), "basic")
+	appendKeychainPolicy(&policies, keychainEKUServer.Value(), "ssl")
+	appendKeychainPolicy(&policies, keychainEKUCode.Value(), "codeSign")
+	appendKeychainPolicy(&policies, keychainEKUEmail.Value(), "smime")
+	appendKeychainPolicy(&policies, keychainEKUIPSEC.Value(), "IPSec")
+	appendKeychainPolicy(&policies, keychainEKUTime.Value(), "timestamping")
+
+	return policies
+}
+
+func appendKeychainPolicy(policies *[]string, enable bool, policy string) {
+	if enable {
+		*policies = append(*policies, policy)
+	}
+}
+
+func keychainFileName(derBytes []byte) string {
+	// The security CLI identifies certs by SHA-1 fingerprint.
+	fingerprint := sha1.Sum(derBytes) // #nosec G401
+
+	return keychainFilePrefix + strings.ToUpper(hex.EncodeToString(fingerprint[:])) + ".pem"
+}
+
+// securityCLI is runSecurityCLI, except in tests, which mustn't change the
+// real keychains.
+var securityCLI = runSecurityCLI
+
+// runSecurityCLI runs the security CLI and returns its combined output.
+func runSecurityCLI(args ...string) ([]byte, error) {
+	// #nosec G204
+	return exec.Command("security", args...).CombinedOutput()
+}
+
+func injectCertKeychain(derBytes []byte) {
+	if keychainCertDir.Value() == "" {
+		log.Fatal("Empty kc.certdir configuration.")
+	}
+
+	path := filepath.Join(keychainCertDir.Value(), keychainFileName(derBytes))
+
+	injectCertFile(derBytes, path)
+
+	keychain, admin := keychainPath()
+
+	args := []string{"add-trusted-cert"}
+	if admin {
+		args = append(args, "-d")
+	}
+
+	args = append(args, "-r", "trustRoot", "-k", keychain)
+
+	for _, policy := range keychainTrustPolicies() {
+		args = append(args, "-p", policy)
+	}
+
+	args = append(args, path)
+
+	stdoutStderr, err := securityCLI(args...)
+	if err != nil {
+		log.Errorf("Error injecting cert to Keychain: %s\n%s", err, stdoutStderr)
+	}
+}
+
+func cleanCertsKeychain() {
+	if keychainCertDir.Value() == "" {
+		log.Fatal("Empty kc.certdir configuration.")
+	}
+
+	certFiles, err := os.ReadDir(keychainCertDir.Value())
+	if err != nil {
+		log.Errorf("Error enumerating files in Keychain cert directory: %s", err)
+
+		return
+	}
+
+	for _, f := range certFiles {
+		if !strings.HasPrefix(f.Name(), keychainFilePrefix) {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			log.Errorf("Error reading Keychain cert file metadata: %s", err)
+
+			continue
+		}
+
+		expired, err := checkCertExpiredNSS(info)
+		if err != nil {
+			log.Errorf("Error checking if Keychain cert is expired: %s", err)
+
+			return
+		}
+
+		if !expired {
+			continue
+		}
+
+		removeCertKeychain(f.Name())
+	}
+}
+
+func removeCertKeychain(filename string) {
+	path := filepath.Join(keychainCertDir.Value(), filename)
+	fingerprintHexUpper := strings.TrimSuffix(strings.TrimPrefix(filename, keychainFilePrefix), ".pem")
+
+	keychain, admin := keychainPath()
+
+	args := []string{"remove-trusted-cert"}
+	if admin {
+		args = append(args, "-d")
+	}
+
+	args = append(args, path)
+
+	stdoutStderr, err := securityCLI(args...)
+	if err != nil {
+		log.Warnf("Error removing Keychain trust settings: %s\n%s", err, stdoutStderr)
+	}
+
+	stdoutStderr, err = securityCLI("delete-certificate", "-Z", fingerprintHexUpper, keychain)
+	if err != nil {
+		log.Errorf("Error deleting cert from Keychain: %s\n%s", err, stdoutStderr)
+
+		return
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		log.Errorf("Error deleting Keychain cert from filesystem: %s", err)
+	}
+}
@@ -0,0 +1,213 @@
+//go:build darwin
+// +build darwin
+
+package certinject
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSecurityCLI records the security CLI invocations instead of running
+// them, failing the ones whose first argument is in fail.
+func fakeSecurityCLI(t *testing.T, fail ...string) (*[][]string, func()) {
+	t.Helper()
+
+	calls := [][]string{}
+	oldSecurityCLI := securityCLI
+
+	securityCLI = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+
+		for _, command := range fail {
+			if args[0] == command {
+				return []byte("failed"), errors.New("exit status 1")
+			}
+		}
+
+		return nil, nil
+	}
+
+	return &calls, func() { securityCLI = oldSecurityCLI }
+}
+
+func setKeychainCertDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	if err := keychainCertDir.CfSetValue(dir); err != nil {
+		t.Fatalf("couldn't set certdir: %v", err)
+	}
+
+	t.Cleanup(func() { keychainCertDir.CfSetValue("") }) //nolint:errcheck
+
+	return dir
+}
+
+func readTestCertDER(t *testing.T) []byte {
+	t.Helper()
+
+	derBytes, err := os.ReadFile("testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read DER cert: %v", err)
+	}
+
+	return derBytes
+}
+
+func TestKeychainFileName(t *testing.T) {
+	name := keychainFileName([]byte("test"))
+
+	// SHA-1 of "test", which is what the security CLI's -Z option expects.
+	if want := "Namecoin-A94A8FE5CCB19BA61C4C0873D391E987982FBBD3.pem"; name != want {
+		t.Errorf("expected %s, got %s", want, name)
+	}
+}
+
+func TestInjectCertKeychain(t *testing.T) {
+	dir := setKeychainCertDir(t)
+	derBytes := readTestCertDER(t)
+
+	calls, restore := fakeSecurityCLI(t)
+	defer restore()
+
+	injectCertKeychain(derBytes)
+
+	path := filepath.Join(dir, keychainFileName(derBytes))
+
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected the cert to be written to the certdir: %v", err)
+	}
+
+	if block, _ := pem.Decode(pemBytes); block == nil || !bytes.Equal(block.Bytes, derBytes) {
+		t.Error("expected the written file to hold the cert")
+	}
+
+	want := [][]string{{"add-trusted-cert", "-r", "trustRoot", "-k", "login.keychain", path}}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("expected %q, got %q", want, *calls)
+	}
+}
+
+func TestInjectCertKeychainSystemPolicies(t *testing.T) {
+	dir := setKeychainCertDir(t)
+	derBytes := readTestCertDER(t)
+
+	if err := keychainPhysicalStore.CfSetValue("system"); err != nil {
+		t.Fatalf("couldn't set physical-store: %v", err)
+	}
+	defer keychainPhysicalStore.CfSetValue("login") //nolint:errcheck
+
+	if err := keychainEKUServer.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set eku.server: %v", err)
+	}
+	defer keychainEKUServer.CfSetValue(false) //nolint:errcheck
+
+	if err := keychainEKUTime.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set eku.time: %v", err)
+	}
+	defer keychainEKUTime.CfSetValue(false) //nolint:errcheck
+
+	calls, restore := fakeSecurityCLI(t)
+	defer restore()
+
+	injectCertKeychain(derBytes)
+
+	want := [][]string{{
+		"add-trusted-cert", "-d", "-r", "trustRoot", "-k", "/Library/Keychains/System.keychain",
+		"-p", "ssl", "-p", "timestamping", filepath.Join(dir, keychainFileName(derBytes)),
+	}}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("expected %q, got %q", want, *calls)
+	}
+}
+
+func TestCleanCertsKeychain(t *testing.T) {
+	dir := setKeychainCertDir(t)
+
+	if err := certExpirePeriod.CfSetValue("1h"); err != nil {
+		t.Fatalf("couldn't set expire: %v", err)
+	}
+	defer certExpirePeriod.CfSetValue("30m") //nolint:errcheck
+
+	const (
+		expiredFingerprint = "A94A8FE5CCB19BA61C4C0873D391E987982FBBD3"
+		freshFingerprint   = "0000000000000000000000000000000000000000"
+	)
+
+	expired := filepath.Join(dir, keychainFilePrefix+expiredFingerprint+".pem")
+	fresh := filepath.Join(dir, keychainFilePrefix+freshFingerprint+".pem")
+	unrelated := filepath.Join(dir, "other.pem")
+
+	for _, path := range []string{expired, fresh, unrelated} {
+		if err := os.WriteFile(path, []byte("cert"), 0o600); err != nil {
+			t.Fatalf("couldn't write %s: %v", path, err)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	for _, path := range []string{expired, unrelated} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("couldn't age %s: %v", path, err)
+		}
+	}
+
+	calls, restore := fakeSecurityCLI(t)
+	defer restore()
+
+	cleanCertsKeychain()
+
+	// Only the expired cert with our prefix is removed, from both the
+	// keychain and the certdir.
+	want := [][]string{
+		{"remove-trusted-cert", expired},
+		{"delete-certificate", "-Z", expiredFingerprint, "login.keychain"},
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("expected %q, got %q", want, *calls)
+	}
+
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expected the expired cert file to be deleted, got %v", err)
+	}
+
+	for _, path := range []string{fresh, unrelated} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+}
+
+func TestRemoveCertKeychainDeleteFails(t *testing.T) {
+	dir := setKeychainCertDir(t)
+	filename := keychainFilePrefix + "A94A8FE5CCB19BA61C4C0873D391E987982FBBD3.pem"
+	path := filepath.Join(dir, filename)
+
+	if err := os.WriteFile(path, []byte("cert"), 0o600); err != nil {
+		t.Fatalf("couldn't write cert file: %v", err)
+	}
+
+	// Failing to remove the trust settings is only a warning, but the file
+	// is kept if the cert couldn't be deleted, so that cleanup retries it.
+	calls, restore := fakeSecurityCLI(t, "remove-trusted-cert", "delete-certificate")
+	defer restore()
+
+	removeCertKeychain(filename)
+
+	if len(*calls) != 2 {
+		t.Errorf("expected both security commands to run, got %q", *calls)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the cert file to be kept: %v", err)
+	}
+}
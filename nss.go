@@ -4,7 +4,6 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io/ioutil"
-	"math"
 	"os"
 	"os/exec"
 	"strings"
@@ -118,14 +117,18 @@ func checkCertExpiredNSS(certFile os.FileInfo) (bool, error) {
 	// Get the last modified time
 	certFileModTime := certFile.ModTime()
 
+	maxAge, err := certExpireDuration()
+	if err != nil {
+		return false, err
+	}
+
 	age := time.Since(certFileModTime)
-	ageSeconds := age.Seconds()
 
 	// If the cert's last modified timestamp differs too much from the
 	// current time in either direction, consider it expired
-	expired := math.Abs(ageSeconds) > float64(certExpirePeriod.Value())
+	expired := age.Abs() > maxAge
 
-	log.Debugf("Age of certificate: %s = %f seconds; expired = %t", age, ageSeconds, expired)
+	log.Debugf("Age of certificate: %s; expired = %t", age, expired)
 
 	return expired, nil
 }
@@ -9,7 +9,7 @@ import (
 func TestCheckCertExpired(t *testing.T) {
 	testFilename := "test_cert_file.pem"
 
-	certExpirePeriod.SetValue(5.0)
+	certExpirePeriod.SetValue("5s")
 
 	bytesDummy := []byte(`TEST DATA`)
 
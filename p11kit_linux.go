@@ -0,0 +1,198 @@
+package certinject
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/hlandau/easyconfig.v1/cflag"
+)
+
+// Namecoin certs are identified by this filename prefix in the anchor
+// directory.  Cleanup only touches files that have it.
+const p11KitFilePrefix = "Namecoin-"
+
+var (
+	p11KitFlag = cflag.Bool(flagGroup, "p11kit", false,
+		"Synchronize TLS certs to the system-wide p11-kit / ca-certificates "+
+			"trust store.")
+	p11KitFlagGroup = cflag.NewGroup(flagGroup, "p11")
+	p11KitDistro    = cflag.String(p11KitFlagGroup, "distro", "fedora",
+		"Trust store layout.  fedora: /etc/pki/ca-trust/source/anchors and "+
+			"update-ca-trust (supports EKU restrictions).  debian: "+
+			"/usr/local/share/ca-certificates and update-ca-certificates "+
+			"(EKU restrictions are ignored).")
+	p11KitAnchorDir = cflag.String(p11KitFlagGroup, "anchordir", "",
+		"Override the anchor directory implied by p11.distro")
+	p11KitEKUFlagGroup = cflag.NewGroup(p11KitFlagGroup, "eku")
+	p11KitEKUServer    = cflag.Bool(p11KitEKUFlagGroup, "server", false,
+		"Server authentication")
+	p11KitEKUClient = cflag.Bool(p11KitEKUFlagGroup, "client", false,
+		"Client authentication")
+	p11KitEKUCode = cflag.Bool(p11KitEKUFlagGroup, "code", false,
+		"Code signing")
+	p11KitEKUEmail = cflag.Bool(p11KitEKUFlagGroup, "email", false,
+		"Secure email")
+	p11KitEKUTime = cflag.Bool(p11KitEKUFlagGroup, "time", false,
+		"Time stamping")
+)
+
+// p11KitTrustAux is the OpenSSL X509_CERT_AUX structure that follows the
+// certificate in a "TRUSTED CERTIFICATE" PEM block.  p11-kit maps its trust
+// OIDs to trust purposes.
+type p11KitTrustAux struct {
+	Trust []asn1.ObjectIdentifier `asn1:"optional"`
+}
+
+// p11KitLayout returns the anchor directory, file extension, and update
+// command for the configured distro.
+func p11KitLayout() (string, string, []string) {
+	anchorDir := p11KitAnchorDir.Value()
+
+	if p11KitDistro.Value() == "debian" {
+		if anchorDir == "" {
+			anchorDir = "/usr/local/share/ca-certificates"
+		}
+
+		// update-ca-certificates only picks up files ending in .crt.
+		return anchorDir, ".crt", []string{"update-ca-certificates"}
+	}
+
+	if anchorDir == "" {
+		anchorDir = "/etc/pki/ca-trust/source/anchors"
+	}
+
+	return anchorDir, ".pem", []string{"update-ca-trust", "extract"}
+}
+
+func p11KitTrustOIDs() []asn1.ObjectIdentifier {
+	oids := []asn1.ObjectIdentifier{}
+
+	appendP11KitOID(&oids, p11KitEKUServer.Value(), asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1})
+	appendP11KitOID(&oids, p11KitEKUClient.Value(), asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2})
+	appendP11KitOID(&oids, p11KitEKUCode.Value(), asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3})
+	appendP11KitOID(&oids, p11KitEKUEmail.Value(), asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4})
+	appendP11KitOID(&oids, p11KitEKUTime.Value(), asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8})
+
+	return oids
+}
+
+func appendP11KitOID(oids *[]asn1.ObjectIdentifier, enable bool, oid asn1.ObjectIdentifier) {
+	if enable {
+		*oids = append(*oids, oid)
+	}
+}
+
+// p11KitPEM encodes the cert, including trust purposes if any are
+// configured and the distro supports them.
+func p11KitPEM(derBytes []byte) ([]byte, error) {
+	oids := p11KitTrustOIDs()
+
+	if len(oids) == 0 || p11KitDistro.Value() == "debian" {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), nil
+	}
+
+	aux, err := asn1.Marshal(p11KitTrustAux{Trust: oids})
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := append(append([]byte{}, derBytes...), aux...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "TRUSTED CERTIFICATE", Bytes: trusted}), nil
+}
+
+func injectCertP11Kit(derBytes []byte) {
+	anchorDir, ext, updateCmd := p11KitLayout()
+
+	fingerprint := sha256.Sum256(derBytes)
+	path := filepath.Join(anchorDir, p11KitFilePrefix+hex.EncodeToString(fingerprint[:])+ext)
+
+	pemBytes, err := p11KitPEM(derBytes)
+	if err != nil {
+		log.Errorf("Error encoding cert for p11-kit: %s", err)
+
+		return
+	}
+
+	err = os.WriteFile(path, pemBytes, 0o644) // #nosec G306
+	if err != nil {
+		log.Errorf("Error writing cert to p11-kit anchor directory: %s", err)
+
+		return
+	}
+
+	runP11KitUpdate(updateCmd)
+}
+
+func cleanCertsP11Kit() {
+	anchorDir, _, updateCmd := p11KitLayout()
+
+	certFiles, err := os.ReadDir(anchorDir)
+	if err != nil {
+		log.Errorf("Error enumerating files in p11-kit anchor directory: %s", err)
+
+		return
+	}
+
+	removed := false
+
+	for _, f := range certFiles {
+		if !strings.HasPrefix(f.Name(), p11KitFilePrefix) {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			log.Errorf("Error reading p11-kit cert file metadata: %s", err)
+
+			continue
+		}
+
+		expired, err := checkCertExpiredNSS(info)
+		if err != nil {
+			log.Errorf("Error checking if p11-kit cert is expired: %s", err)
+
+			return
+		}
+
+		if !expired {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(anchorDir, f.Name()))
+		if err != nil {
+			log.Errorf("Error deleting p11-kit cert from filesystem: %s", err)
+
+			continue
+		}
+
+		removed = true
+	}
+
+	if removed {
+		runP11KitUpdate(updateCmd)
+	}
+}
+
+// p11KitCommand is runP11KitCommand, except in tests, which mustn't update
+// the real system trust store.
+var p11KitCommand = runP11KitCommand
+
+// runP11KitCommand runs the command and returns its combined output.
+func runP11KitCommand(name string, args ...string) ([]byte, error) {
+	// #nosec G204
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func runP11KitUpdate(updateCmd []string) {
+	stdoutStderr, err := p11KitCommand(updateCmd[0], updateCmd[1:]...)
+	if err != nil {
+		log.Errorf("Error updating system trust store: %s\n%s", err, stdoutStderr)
+	}
+}
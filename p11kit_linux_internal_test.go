@@ -0,0 +1,260 @@
+//go:build linux
+// +build linux
+
+package certinject
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeP11KitCommand records the commands that would be run instead of
+// running them.
+func fakeP11KitCommand() (*[][]string, func()) {
+	calls := [][]string{}
+	oldP11KitCommand := p11KitCommand
+
+	p11KitCommand = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{name}, args...))
+
+		return nil, nil
+	}
+
+	return &calls, func() { p11KitCommand = oldP11KitCommand }
+}
+
+func setP11KitAnchorDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	if err := p11KitAnchorDir.CfSetValue(dir); err != nil {
+		t.Fatalf("couldn't set anchordir: %v", err)
+	}
+
+	t.Cleanup(func() { p11KitAnchorDir.CfSetValue("") }) //nolint:errcheck
+
+	return dir
+}
+
+func setP11KitDistro(t *testing.T, distro string) {
+	t.Helper()
+
+	if err := p11KitDistro.CfSetValue(distro); err != nil {
+		t.Fatalf("couldn't set distro: %v", err)
+	}
+
+	t.Cleanup(func() { p11KitDistro.CfSetValue("fedora") }) //nolint:errcheck
+}
+
+func p11KitTestCert(t *testing.T) ([]byte, string) {
+	t.Helper()
+
+	derBytes, err := os.ReadFile("testdata/badssl.com.der.cert")
+	if err != nil {
+		t.Fatalf("couldn't read DER cert: %v", err)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+
+	return derBytes, p11KitFilePrefix + hex.EncodeToString(fingerprint[:])
+}
+
+func TestP11KitLayout(t *testing.T) {
+	defer p11KitAnchorDir.CfSetValue("") //nolint:errcheck
+
+	for _, testCase := range []struct {
+		Distro    string
+		AnchorDir string
+		WantDir   string
+		WantExt   string
+		WantCmd   []string
+	}{
+		{"fedora", "", "/etc/pki/ca-trust/source/anchors", ".pem", []string{"update-ca-trust", "extract"}},
+		{"debian", "", "/usr/local/share/ca-certificates", ".crt", []string{"update-ca-certificates"}},
+		{"debian", "/tmp/anchors", "/tmp/anchors", ".crt", []string{"update-ca-certificates"}},
+	} {
+		setP11KitDistro(t, testCase.Distro)
+
+		if err := p11KitAnchorDir.CfSetValue(testCase.AnchorDir); err != nil {
+			t.Fatalf("couldn't set anchordir: %v", err)
+		}
+
+		dir, ext, cmd := p11KitLayout()
+		if dir != testCase.WantDir || ext != testCase.WantExt || !reflect.DeepEqual(cmd, testCase.WantCmd) {
+			t.Errorf("%s %q: expected %s %s %q, got %s %s %q", testCase.Distro, testCase.AnchorDir,
+				testCase.WantDir, testCase.WantExt, testCase.WantCmd, dir, ext, cmd)
+		}
+	}
+}
+
+func TestInjectCertP11Kit(t *testing.T) {
+	dir := setP11KitAnchorDir(t)
+	derBytes, name := p11KitTestCert(t)
+
+	calls, restore := fakeP11KitCommand()
+	defer restore()
+
+	injectCertP11Kit(derBytes)
+
+	pemBytes, err := os.ReadFile(filepath.Join(dir, name+".pem"))
+	if err != nil {
+		t.Fatalf("expected the cert to be written to the anchor directory: %v", err)
+	}
+
+	// Without EKUs, the cert is trusted for all purposes.
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE" || !bytes.Equal(block.Bytes, derBytes) {
+		t.Errorf("expected a CERTIFICATE block holding the cert, got %q", pemBytes)
+	}
+
+	if want := [][]string{{"update-ca-trust", "extract"}}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("expected %q, got %q", want, *calls)
+	}
+}
+
+func TestInjectCertP11KitEKU(t *testing.T) {
+	dir := setP11KitAnchorDir(t)
+	derBytes, name := p11KitTestCert(t)
+
+	if err := p11KitEKUServer.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set eku.server: %v", err)
+	}
+	defer p11KitEKUServer.CfSetValue(false) //nolint:errcheck
+
+	_, restore := fakeP11KitCommand()
+	defer restore()
+
+	injectCertP11Kit(derBytes)
+
+	pemBytes, err := os.ReadFile(filepath.Join(dir, name+".pem"))
+	if err != nil {
+		t.Fatalf("expected the cert to be written to the anchor directory: %v", err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "TRUSTED CERTIFICATE" || !bytes.HasPrefix(block.Bytes, derBytes) {
+		t.Fatalf("expected a TRUSTED CERTIFICATE block starting with the cert, got %q", pemBytes)
+	}
+
+	var aux p11KitTrustAux
+
+	rest, err := asn1.Unmarshal(block.Bytes[len(derBytes):], &aux)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("couldn't parse trust aux: %v", err)
+	}
+
+	serverAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	if len(aux.Trust) != 1 || !aux.Trust[0].Equal(serverAuth) {
+		t.Errorf("expected only the server auth trust OID, got %v", aux.Trust)
+	}
+}
+
+func TestInjectCertP11KitDebian(t *testing.T) {
+	dir := setP11KitAnchorDir(t)
+	setP11KitDistro(t, "debian")
+	derBytes, name := p11KitTestCert(t)
+
+	// Debian's tooling doesn't support trust purposes, so EKUs are ignored.
+	if err := p11KitEKUServer.CfSetValue(true); err != nil {
+		t.Fatalf("couldn't set eku.server: %v", err)
+	}
+	defer p11KitEKUServer.CfSetValue(false) //nolint:errcheck
+
+	calls, restore := fakeP11KitCommand()
+	defer restore()
+
+	injectCertP11Kit(derBytes)
+
+	pemBytes, err := os.ReadFile(filepath.Join(dir, name+".crt"))
+	if err != nil {
+		t.Fatalf("expected the cert to be written with a .crt extension: %v", err)
+	}
+
+	if block, _ := pem.Decode(pemBytes); block == nil || block.Type != "CERTIFICATE" {
+		t.Errorf("expected a CERTIFICATE block, got %q", pemBytes)
+	}
+
+	if want := [][]string{{"update-ca-certificates"}}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("expected %q, got %q", want, *calls)
+	}
+}
+
+func TestInjectCertP11KitWriteFails(t *testing.T) {
+	if err := p11KitAnchorDir.CfSetValue(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatalf("couldn't set anchordir: %v", err)
+	}
+	defer p11KitAnchorDir.CfSetValue("") //nolint:errcheck
+
+	derBytes, _ := p11KitTestCert(t)
+
+	calls, restore := fakeP11KitCommand()
+	defer restore()
+
+	injectCertP11Kit(derBytes)
+
+	if len(*calls) != 0 {
+		t.Errorf("expected no update after a failed write, got %q", *calls)
+	}
+}
+
+func TestCleanCertsP11Kit(t *testing.T) {
+	dir := setP11KitAnchorDir(t)
+
+	if err := certExpirePeriod.CfSetValue("1h"); err != nil {
+		t.Fatalf("couldn't set expire: %v", err)
+	}
+	defer certExpirePeriod.CfSetValue("30m") //nolint:errcheck
+
+	expired := filepath.Join(dir, p11KitFilePrefix+"expired.pem")
+	fresh := filepath.Join(dir, p11KitFilePrefix+"fresh.pem")
+	unrelated := filepath.Join(dir, "other.pem")
+
+	for _, path := range []string{expired, fresh, unrelated} {
+		if err := os.WriteFile(path, []byte("cert"), 0o600); err != nil {
+			t.Fatalf("couldn't write %s: %v", path, err)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	for _, path := range []string{expired, unrelated} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("couldn't age %s: %v", path, err)
+		}
+	}
+
+	calls, restore := fakeP11KitCommand()
+	defer restore()
+
+	cleanCertsP11Kit()
+
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expected the expired cert file to be deleted, got %v", err)
+	}
+
+	for _, path := range []string{fresh, unrelated} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+
+	if want := [][]string{{"update-ca-trust", "extract"}}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("expected %q, got %q", want, *calls)
+	}
+
+	// Nothing else has expired, so the trust store isn't updated again.
+	cleanCertsP11Kit()
+
+	if len(*calls) != 1 {
+		t.Errorf("expected no update when nothing was removed, got %q", *calls)
+	}
+}
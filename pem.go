@@ -0,0 +1,173 @@
+package certinject
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	pemBeginPrefix = []byte("-----BEGIN ")
+	pemEndPrefix   = []byte("-----END ")
+)
+
+// InjectPEMReader reads PEM blocks from r and injects each CERTIFICATE block
+// into all configured trust stores, returning the number of certs injected.
+// Only one block is buffered at a time, so memory use stays bounded even for
+// bundles with thousands of certs.  Other block types are skipped.
+//
+// On error, n is the number of certs injected before the error.  Errors
+// wrap ErrCertRead if r can't be read, ErrBadCert if a block can't be
+// decoded, or are returned from InjectCertErr.
+func InjectPEMReader(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+
+	var block bytes.Buffer
+
+	inBlock := false
+	n := 0
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if !inBlock {
+			if !bytes.HasPrefix(line, pemBeginPrefix) {
+				continue
+			}
+
+			inBlock = true
+
+			block.Reset()
+		}
+
+		block.Write(line)
+		block.WriteByte('\n')
+
+		if !bytes.HasPrefix(line, pemEndPrefix) {
+			continue
+		}
+
+		inBlock = false
+
+		injected, err := injectPEMBlock(block.Bytes())
+		if err != nil {
+			return n, err
+		}
+
+		if injected {
+			n++
+		}
+	}
+
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return n, fmt.Errorf("%w: couldn't read PEM: %w", err, ErrBadCert)
+	}
+
+	if err != nil {
+		return n, fmt.Errorf("%w: couldn't read PEM: %w", err, ErrCertRead)
+	}
+
+	return n, nil
+}
+
+// injectPEMBlock decodes a single PEM block and injects it if it's a
+// certificate.  It returns whether a cert was injected.
+func injectPEMBlock(data []byte) (bool, error) {
+	certs, firstType := decodePEMCerts(data)
+	if firstType == "" {
+		return false, fmt.Errorf("couldn't decode PEM block: %w", ErrBadCert)
+	}
+
+	if len(certs) == 0 {
+		return false, nil
+	}
+
+	err := InjectCertErr(certs[0])
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DecodeCerts returns the DER of the certs in data, which is either DER or
+// PEM (sniffed by the presence of a PEM header).  PEM input may contain
+// several certs; other PEM block types are skipped.  DER input is returned
+// as is, without parsing it.  Returned errors wrap ErrBadCert if PEM input
+// contains no CERTIFICATE blocks.
+func DecodeCerts(data []byte) ([][]byte, error) {
+	if !bytes.Contains(data, pemBeginPrefix) {
+		return [][]byte{data}, nil
+	}
+
+	certs, firstType := decodePEMCerts(data)
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("PEM type was %q, expecting CERTIFICATE: %w", firstType, ErrBadCert)
+	}
+
+	return certs, nil
+}
+
+// decodePEMCerts returns the contents of the CERTIFICATE blocks in data, and
+// the type of the first block, or "" if data contains no PEM blocks.
+func decodePEMCerts(data []byte) ([][]byte, string) {
+	certs := [][]byte{}
+	firstType := ""
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, firstType
+		}
+
+		if firstType == "" {
+			firstType = block.Type
+		}
+
+		if block.Type != "CERTIFICATE" {
+			log.Debugf("Skipping PEM block of type %s", block.Type)
+
+			continue
+		}
+
+		certs = append(certs, block.Bytes)
+	}
+}
+
+// readCertFile reads a single cert from the file at path, which is either DER
+// or PEM (sniffed by the presence of a PEM header), and returns its DER.
+// Other PEM block types are skipped.  Returned errors wrap ErrCertRead if the
+// file can't be read, and ErrBadCert if it doesn't contain exactly one valid
+// cert.
+func readCertFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't read cert file: %w", err, ErrCertRead)
+	}
+
+	certs, err := DecodeCerts(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(certs) != 1 {
+		return nil, fmt.Errorf("%s contains more than one cert: %w", path, ErrBadCert)
+	}
+
+	derBytes := certs[0]
+
+	_, err = x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't parse cert in %s: %w", err, path, ErrBadCert)
+	}
+
+	return derBytes, nil
+}
@@ -0,0 +1,87 @@
+package certinject
+
+import (
+	"errors"
+	"time"
+)
+
+// The registry backend is declared here rather than in a Windows-only file,
+// so that the in-memory backend used by tests builds on every platform.  The
+// platform-specific parts (the root key type and the errors) are declared in
+// regbackend_windows.go and regbackend_other.go.
+
+// regWriteDAC is windows.WRITE_DAC, since golang.org/x/sys/windows only
+// builds on Windows.
+const regWriteDAC = 0x40000
+
+// defaultACLSDDL is an empty, unprotected DACL, which restores the ACL
+// inherited from the store.
+const defaultACLSDDL = "D:"
+
+// regKey is the subset of registry.Key operations used by this package.
+type regKey interface {
+	Close() error
+	// ReadSubKeyNamesAt returns up to n subkey names, starting at the given
+	// enumeration index.  It returns io.EOF if fewer than n names remain.
+	ReadSubKeyNamesAt(start uint32, n int) ([]string, error)
+	// ReadValueNames returns the names of the key's values; if n <= 0, all
+	// of them.
+	ReadValueNames(n int) ([]string, error)
+	GetValue(name string, buf []byte) (int, uint32, error)
+	GetBinaryValue(name string) ([]byte, uint32, error)
+	GetIntegerValue(name string) (uint64, uint32, error)
+	SetBinaryValue(name string, value []byte) error
+	SetDWordValue(name string, value uint32) error
+	SetQWordValue(name string, value uint64) error
+	// SetValue sets a value of any registry type from its raw data, as
+	// returned by GetValue.
+	SetValue(name string, valType uint32, data []byte) error
+	DeleteValue(name string) error
+	Stat() (regKeyInfo, error)
+	// SetDACL replaces the key's DACL with the one in the given SDDL
+	// string.  If the DACL isn't protected (no P flag), inherited ACEs
+	// from the parent key are kept.
+	SetDACL(sddl string) error
+}
+
+// regKeyInfo is the subset of registry.KeyInfo used by this package.
+type regKeyInfo interface {
+	ModTime() time.Time
+}
+
+// regBackend opens, creates, and deletes registry keys.  It exists so that
+// tests can substitute an in-memory registry for the real one.
+type regBackend interface {
+	// Root returns one of the predefined root keys, e.g.
+	// registry.CURRENT_USER.  Keys opened, created, and deleted below it use
+	// the registry view selected by view, an access flag as returned by
+	// registryViewAccess (0 for the native view).
+	Root(base regRootKey, view uint32) regKey
+	OpenKey(k regKey, path string, access uint32) (regKey, error)
+	CreateKey(k regKey, path string, access uint32) (regKey, bool, error)
+	DeleteKey(k regKey, path string) error
+}
+
+// deleteKeyResettingDACL deletes the key at path with deleteKey.  If access
+// is denied, it restores the key's default ACL via b and tries again; the
+// original error is returned if that fails.
+func deleteKeyResettingDACL(b regBackend, k regKey, path string, deleteKey func(regKey, string) error) error {
+	err := deleteKey(k, path)
+	if !errors.Is(err, errRegAccessDenied) {
+		return err
+	}
+
+	key, openErr := b.OpenKey(k, path, regWriteDAC)
+	if openErr != nil {
+		return err
+	}
+
+	aclErr := key.SetDACL(defaultACLSDDL)
+	key.Close()
+
+	if aclErr != nil {
+		return err
+	}
+
+	return deleteKey(k, path)
+}
@@ -0,0 +1,499 @@
+package certinject
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Registry access rights and value types, as in
+// golang.org/x/sys/windows/registry, which only builds on Windows.
+const (
+	regRead = 0x20019 // regRead
+
+	regBinary = 3  // regBinary
+	regDWord  = 4  // regDWord
+	regQWord  = 11 // regQWord
+)
+
+// memRegBackend is an in-memory registry for tests, which builds on every
+// platform.  Like the real registry, key names are case-insensitive but
+// preserve their original case, and it's safe for concurrent use.  There's
+// only one registry view, so the view passed to Root is ignored.
+type memRegBackend struct {
+	roots map[regRootKey]*memRegNode
+	// readOnly simulates an unprivileged user: opening a key for anything
+	// beyond regRead, creating a key, or deleting one is denied.
+	readOnly bool
+	// readOnlyRoots is like readOnly, but only for the keys under the given
+	// roots, e.g. to simulate an unelevated process that can't write
+	// HKEY_LOCAL_MACHINE.
+	readOnlyRoots map[regRootKey]bool
+	// denyDeleteDACL simulates an owner that isn't an administrator:
+	// deleting a key whose DACL is this SDDL string (e.g. secureACLSDDL) is
+	// denied.
+	denyDeleteDACL string
+}
+
+// memRegMu guards all memRegBackend state.
+var memRegMu sync.Mutex
+
+type memRegValue struct {
+	valType uint32
+	data    []byte
+}
+
+type memRegNode struct {
+	name    string
+	parent  *memRegNode
+	subKeys map[string]*memRegNode // keyed by lowercase name
+	values  map[string]memRegValue
+	modTime time.Time
+	// dacl is the SDDL string last passed to SetDACL, if any.
+	dacl string
+}
+
+type memRegKey struct {
+	node *memRegNode
+}
+
+type memRegKeyInfo struct {
+	modTime time.Time
+}
+
+func newMemRegBackend() *memRegBackend {
+	return &memRegBackend{roots: map[regRootKey]*memRegNode{}, readOnlyRoots: map[regRootKey]bool{}}
+}
+
+// isReadOnly returns true if writes to node are denied.  memRegMu must be
+// held.
+func (b *memRegBackend) isReadOnly(node *memRegNode) bool {
+	if b.readOnly {
+		return true
+	}
+
+	for node.parent != nil {
+		node = node.parent
+	}
+
+	for base, root := range b.roots {
+		if root == node {
+			return b.readOnlyRoots[base]
+		}
+	}
+
+	return false
+}
+
+func newMemRegNode(name string, parent *memRegNode) *memRegNode {
+	return &memRegNode{
+		name:    name,
+		parent:  parent,
+		subKeys: map[string]*memRegNode{},
+		values:  map[string]memRegValue{},
+		modTime: time.Now(),
+	}
+}
+
+func (b *memRegBackend) Root(base regRootKey, _ uint32) regKey {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	node, ok := b.roots[base]
+	if !ok {
+		node = newMemRegNode("", nil)
+		b.roots[base] = node
+	}
+
+	return memRegKey{node}
+}
+
+func (b *memRegBackend) OpenKey(k regKey, path string, access uint32) (regKey, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	node := k.(memRegKey).node
+
+	if b.isReadOnly(node) && access&^regRead != 0 {
+		return nil, errRegAccessDenied
+	}
+
+	for _, name := range strings.Split(path, `\`) {
+		child, ok := node.subKeys[strings.ToLower(name)]
+		if !ok {
+			return nil, errRegNotExist
+		}
+
+		node = child
+	}
+
+	return memRegKey{node}, nil
+}
+
+func (b *memRegBackend) CreateKey(k regKey, path string, _ uint32) (regKey, bool, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	node := k.(memRegKey).node
+
+	if b.isReadOnly(node) {
+		return nil, false, errRegAccessDenied
+	}
+
+	openedExisting := true
+
+	for _, name := range strings.Split(path, `\`) {
+		child, ok := node.subKeys[strings.ToLower(name)]
+		if !ok {
+			child = newMemRegNode(name, node)
+			node.subKeys[strings.ToLower(name)] = child
+			node.modTime = time.Now()
+			openedExisting = false
+		}
+
+		node = child
+	}
+
+	return memRegKey{node}, openedExisting, nil
+}
+
+func (b *memRegBackend) DeleteKey(k regKey, path string) error {
+	return deleteKeyResettingDACL(b, k, path, b.deleteKey)
+}
+
+func (b *memRegBackend) deleteKey(k regKey, path string) error {
+	key, err := b.OpenKey(k, path, 0)
+	if err != nil {
+		return err
+	}
+
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	// The real registry refuses to delete keys that have subkeys.
+	node := key.(memRegKey).node
+	if b.isReadOnly(node) || len(node.subKeys) != 0 || node.parent == nil {
+		return errRegAccessDenied
+	}
+
+	if b.denyDeleteDACL != "" && node.dacl == b.denyDeleteDACL {
+		return errRegAccessDenied
+	}
+
+	delete(node.parent.subKeys, strings.ToLower(node.name))
+	node.parent.modTime = time.Now()
+
+	return nil
+}
+
+func (k memRegKey) Close() error {
+	return nil
+}
+
+// ReadSubKeyNamesAt enumerates subkeys in case-insensitive order, like the
+// real registry.
+func (k memRegKey) ReadSubKeyNamesAt(start uint32, n int) ([]string, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	names := make([]string, 0, len(k.node.subKeys))
+	for _, child := range k.node.subKeys {
+		names = append(names, child.name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	if int(start) >= len(names) {
+		return []string{}, io.EOF
+	}
+
+	names = names[start:]
+	if len(names) < n {
+		return names, io.EOF
+	}
+
+	return names[:n], nil
+}
+
+func (k memRegKey) ReadValueNames(n int) ([]string, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	names := make([]string, 0, len(k.node.values))
+	for name := range k.node.values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	if n > 0 && len(names) > n {
+		return names[:n], nil
+	}
+
+	return names, nil
+}
+
+func (k memRegKey) GetValue(name string, buf []byte) (int, uint32, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	val, ok := k.node.values[name]
+	if !ok {
+		return 0, 0, errRegNotExist
+	}
+
+	if buf == nil {
+		return len(val.data), val.valType, nil
+	}
+
+	if len(buf) < len(val.data) {
+		return len(val.data), val.valType, errRegShortBuffer
+	}
+
+	return copy(buf, val.data), val.valType, nil
+}
+
+func (k memRegKey) GetBinaryValue(name string) ([]byte, uint32, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	val, ok := k.node.values[name]
+	if !ok {
+		return nil, 0, errRegNotExist
+	}
+
+	if val.valType != regBinary {
+		return nil, val.valType, errRegUnexpectedType
+	}
+
+	return append([]byte(nil), val.data...), val.valType, nil
+}
+
+func (k memRegKey) GetIntegerValue(name string) (uint64, uint32, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	val, ok := k.node.values[name]
+	if !ok {
+		return 0, 0, errRegNotExist
+	}
+
+	switch val.valType {
+	case regDWord:
+		return uint64(binary.LittleEndian.Uint32(val.data)), val.valType, nil
+	case regQWord:
+		return binary.LittleEndian.Uint64(val.data), val.valType, nil
+	default:
+		return 0, val.valType, errRegUnexpectedType
+	}
+}
+
+func (k memRegKey) SetBinaryValue(name string, value []byte) error {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	k.node.values[name] = memRegValue{regBinary, append([]byte(nil), value...)}
+	k.node.modTime = time.Now()
+
+	return nil
+}
+
+func (k memRegKey) SetDWordValue(name string, value uint32) error {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	k.node.values[name] = memRegValue{
+		regDWord,
+		[]byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)},
+	}
+	k.node.modTime = time.Now()
+
+	return nil
+}
+
+func (k memRegKey) SetQWordValue(name string, value uint64) error {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+
+	k.node.values[name] = memRegValue{regQWord, data}
+	k.node.modTime = time.Now()
+
+	return nil
+}
+
+func (k memRegKey) SetValue(name string, valType uint32, data []byte) error {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	k.node.values[name] = memRegValue{valType, append([]byte(nil), data...)}
+	k.node.modTime = time.Now()
+
+	return nil
+}
+
+func (k memRegKey) DeleteValue(name string) error {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	if _, ok := k.node.values[name]; !ok {
+		return errRegNotExist
+	}
+
+	delete(k.node.values, name)
+	k.node.modTime = time.Now()
+
+	return nil
+}
+
+func (k memRegKey) SetDACL(sddl string) error {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	k.node.dacl = sddl
+
+	return nil
+}
+
+func (k memRegKey) Stat() (regKeyInfo, error) {
+	memRegMu.Lock()
+	defer memRegMu.Unlock()
+
+	return memRegKeyInfo{k.node.modTime}, nil
+}
+
+func (i memRegKeyInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func TestMemRegBackend(t *testing.T) {
+	const root regRootKey = 1
+
+	mem := newMemRegBackend()
+
+	key, openedExisting, err := mem.CreateKey(mem.Root(root, 0), `Store\Certificates\AA`, 0)
+	if err != nil || openedExisting {
+		t.Fatalf("expected a new key, got %t (err %v)", openedExisting, err)
+	}
+
+	if err := key.SetDWordValue("Magic", 7); err != nil {
+		t.Fatalf("couldn't set DWORD: %v", err)
+	}
+
+	if err := key.SetValue("Raw", 1, []byte{'x', 0, 0, 0}); err != nil {
+		t.Fatalf("couldn't set raw value: %v", err)
+	}
+
+	for _, name := range []string{"cc", "Bb"} {
+		if _, _, err := mem.CreateKey(mem.Root(root, 0), `Store\Certificates\`+name, 0); err != nil {
+			t.Fatalf("couldn't create %s: %v", name, err)
+		}
+	}
+
+	// Names are case-insensitive, and enumerated in case-insensitive order.
+	certsKey, err := mem.OpenKey(mem.Root(root, 0), `store\CERTIFICATES`, regRead)
+	if err != nil {
+		t.Fatalf("couldn't open key: %v", err)
+	}
+
+	names, err := certsKey.ReadSubKeyNamesAt(1, 5)
+	if !errors.Is(err, io.EOF) || strings.Join(names, ",") != "Bb,cc" {
+		t.Errorf("expected Bb,cc and EOF, got %v (err %v)", names, err)
+	}
+
+	key, err = mem.OpenKey(certsKey, "aa", regRead)
+	if err != nil {
+		t.Fatalf("couldn't open key: %v", err)
+	}
+
+	if magic, valType, err := key.GetIntegerValue("Magic"); err != nil || magic != 7 || valType != regDWord {
+		t.Errorf("expected DWORD 7, got %d of type %d (err %v)", magic, valType, err)
+	}
+
+	if _, _, err := key.GetBinaryValue("Magic"); !errors.Is(err, errRegUnexpectedType) {
+		t.Errorf("expected errRegUnexpectedType, got %v", err)
+	}
+
+	if _, _, err := key.GetValue("Raw", make([]byte, 1)); !errors.Is(err, errRegShortBuffer) {
+		t.Errorf("expected errRegShortBuffer, got %v", err)
+	}
+
+	if _, _, err := key.GetValue("Missing", nil); !errors.Is(err, errRegNotExist) {
+		t.Errorf("expected errRegNotExist, got %v", err)
+	}
+
+	// Keys with subkeys can't be deleted, like in the real registry.
+	if err := mem.DeleteKey(mem.Root(root, 0), `Store\Certificates`); !errors.Is(err, errRegAccessDenied) {
+		t.Errorf("expected errRegAccessDenied, got %v", err)
+	}
+
+	mem.readOnly = true
+
+	if _, err := mem.OpenKey(mem.Root(root, 0), "Store", regRead|regWriteDAC); !errors.Is(err, errRegAccessDenied) {
+		t.Errorf("expected errRegAccessDenied for a read-only backend, got %v", err)
+	}
+
+	mem.readOnly = false
+	mem.readOnlyRoots[root] = true
+
+	if _, _, err := mem.CreateKey(certsKey, "dd", 0); !errors.Is(err, errRegAccessDenied) {
+		t.Errorf("expected errRegAccessDenied for a read-only root, got %v", err)
+	}
+
+	if _, _, err := mem.CreateKey(mem.Root(root+1, 0), "Store", 0); err != nil {
+		t.Errorf("expected other roots to stay writable, got %v", err)
+	}
+}
+
+func TestDeleteKeyResettingDACL(t *testing.T) {
+	const root regRootKey = 1
+
+	mem := newMemRegBackend()
+	mem.denyDeleteDACL = "D:P(A;;KA;;;SY)"
+
+	for _, name := range []string{"AA", "BB"} {
+		key, _, err := mem.CreateKey(mem.Root(root, 0), name, 0)
+		if err != nil {
+			t.Fatalf("couldn't create %s: %v", name, err)
+		}
+
+		if err := key.SetDACL(mem.denyDeleteDACL); err != nil {
+			t.Fatalf("couldn't set DACL: %v", err)
+		}
+	}
+
+	// Deleting is denied until the default ACL is restored.
+	if err := mem.deleteKey(mem.Root(root, 0), "AA"); !errors.Is(err, errRegAccessDenied) {
+		t.Fatalf("expected errRegAccessDenied, got %v", err)
+	}
+
+	if err := mem.DeleteKey(mem.Root(root, 0), "AA"); err != nil {
+		t.Errorf("expected the ACL to be reset and the key deleted, got %v", err)
+	}
+
+	if _, err := mem.OpenKey(mem.Root(root, 0), "AA", 0); !errors.Is(err, errRegNotExist) {
+		t.Errorf("expected AA to be deleted, got %v", err)
+	}
+
+	// If the ACL can't be reset, the original error is returned.
+	mem.readOnly = true
+
+	if err := mem.DeleteKey(mem.Root(root, 0), "BB"); !errors.Is(err, errRegAccessDenied) {
+		t.Errorf("expected errRegAccessDenied, got %v", err)
+	}
+
+	mem.readOnly = false
+
+	if _, err := mem.OpenKey(mem.Root(root, 0), "BB", 0); err != nil {
+		t.Errorf("expected BB to be kept, got %v", err)
+	}
+}
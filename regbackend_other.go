@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package certinject
+
+import "errors"
+
+// regRootKey is a predefined root key of the registry.  There's no registry
+// outside Windows, so only the in-memory backend used by tests has any.
+type regRootKey uintptr
+
+// The errors that regKey and regBackend implementations return, standing in
+// for those of the registry package on Windows.
+var (
+	errRegNotExist       = errors.New("registry key or value doesn't exist")
+	errRegShortBuffer    = errors.New("registry value buffer too small")
+	errRegUnexpectedType = errors.New("unexpected registry value type")
+	errRegAccessDenied   = errors.New("registry access denied")
+)
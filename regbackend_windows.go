@@ -0,0 +1,277 @@
+package certinject
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/namecoin/certinject/regwait"
+)
+
+// regRootKey is a predefined root key of the registry.
+type regRootKey = registry.Key
+
+// The errors that regKey and regBackend implementations return, which are
+// those of the registry package on Windows.
+var (
+	errRegNotExist       = registry.ErrNotExist
+	errRegShortBuffer    = registry.ErrShortBuffer
+	errRegUnexpectedType = registry.ErrUnexpectedType
+	errRegAccessDenied   = windows.ERROR_ACCESS_DENIED
+)
+
+// reg is the registry used by all CryptoAPI operations.
+var reg regBackend = windowsRegBackend{}
+
+// windowsRegBackend is the real Windows registry.
+type windowsRegBackend struct{}
+
+type windowsRegKey struct {
+	registry.Key
+	// path is the key's full path, for trace logs.
+	path string
+	// view is the registry view that keys below it are opened in; see
+	// registryViewAccess.
+	view uint32
+}
+
+// rootKeyNames names the predefined root keys in log messages.
+var rootKeyNames = map[registry.Key]string{
+	registry.CLASSES_ROOT:   "HKEY_CLASSES_ROOT",
+	registry.CURRENT_USER:   "HKEY_CURRENT_USER",
+	registry.LOCAL_MACHINE:  "HKEY_LOCAL_MACHINE",
+	registry.USERS:          "HKEY_USERS",
+	registry.CURRENT_CONFIG: "HKEY_CURRENT_CONFIG",
+}
+
+// The registry operations that modify keys are logged at trace level, so
+// that -verbose shows everything certinject does to the registry.
+
+func (k windowsRegKey) SetBinaryValue(name string, value []byte) error {
+	log.Tracef("Setting registry value %s\\%s (%d bytes)", k.path, name, len(value))
+
+	return k.Key.SetBinaryValue(name, value)
+}
+
+func (k windowsRegKey) SetDWordValue(name string, value uint32) error {
+	log.Tracef("Setting registry value %s\\%s to DWORD %d", k.path, name, value)
+
+	return k.Key.SetDWordValue(name, value)
+}
+
+func (k windowsRegKey) SetQWordValue(name string, value uint64) error {
+	log.Tracef("Setting registry value %s\\%s to QWORD %d", k.path, name, value)
+
+	return k.Key.SetQWordValue(name, value)
+}
+
+// procRegSetValueExW sets values of any type; registry.Key only has setters
+// for specific types.
+var procRegSetValueExW = windows.NewLazySystemDLL("advapi32.dll").NewProc("RegSetValueExW")
+
+func (k windowsRegKey) SetValue(name string, valType uint32, data []byte) error {
+	log.Tracef("Setting registry value %s\\%s (type %d, %d bytes)", k.path, name, valType, len(data))
+
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	var dataPtr *byte
+	if len(data) != 0 {
+		dataPtr = &data[0]
+	}
+
+	ret, _, _ := procRegSetValueExW.Call(uintptr(k.Key), uintptr(unsafe.Pointer(namePtr)), 0, uintptr(valType),
+		uintptr(unsafe.Pointer(dataPtr)), uintptr(len(data)))
+	if ret != 0 {
+		return windows.Errno(ret)
+	}
+
+	return nil
+}
+
+func (k windowsRegKey) DeleteValue(name string) error {
+	log.Tracef("Deleting registry value %s\\%s", k.path, name)
+
+	return k.Key.DeleteValue(name)
+}
+
+func (k windowsRegKey) Stat() (regKeyInfo, error) {
+	info, err := k.Key.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (k windowsRegKey) SetDACL(sddl string) error {
+	log.Tracef("Setting ACL of registry key %s to %s", k.path, sddl)
+
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return err
+	}
+
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+
+	control, _, err := sd.Control()
+	if err != nil {
+		return err
+	}
+
+	info := windows.SECURITY_INFORMATION(windows.DACL_SECURITY_INFORMATION)
+	if control&windows.SE_DACL_PROTECTED != 0 {
+		info |= windows.PROTECTED_DACL_SECURITY_INFORMATION
+	} else {
+		info |= windows.UNPROTECTED_DACL_SECURITY_INFORMATION
+	}
+
+	return windows.SetSecurityInfo(windows.Handle(k.Key), windows.SE_REGISTRY_KEY, info, nil, nil, dacl, nil)
+}
+
+// maxKeyNameLen is the maximum length of a registry key name, in UTF-16 code
+// units, including the terminating null.
+const maxKeyNameLen = 256
+
+// ReadSubKeyNamesAt is implemented with RegEnumKeyEx, because
+// registry.Key.ReadSubKeyNames always starts enumerating at index 0.
+func (k windowsRegKey) ReadSubKeyNamesAt(start uint32, n int) ([]string, error) {
+	// Like registry.Key.ReadSubKeyNames, stay on one OS thread while
+	// enumerating, since RegEnumKeyEx is affected by the thread's
+	// impersonation token.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	names := make([]string, 0, n)
+	buf := make([]uint16, maxKeyNameLen)
+
+	for index := start; len(names) < n; index++ {
+		nameLen := uint32(len(buf))
+
+		err := windows.RegEnumKeyEx(windows.Handle(k.Key), index, &buf[0], &nameLen, nil, nil, nil, nil)
+		if errors.Is(err, windows.ERROR_NO_MORE_ITEMS) {
+			return names, io.EOF
+		}
+
+		if err != nil {
+			return names, err
+		}
+
+		names = append(names, windows.UTF16ToString(buf[:nameLen]))
+	}
+
+	return names, nil
+}
+
+func (windowsRegBackend) Root(base registry.Key, view uint32) regKey {
+	return windowsRegKey{base, rootKeyName(base), view}
+}
+
+// rootKeyName returns the name of a predefined root key, e.g.
+// HKEY_CURRENT_USER, or its handle for other keys.
+func rootKeyName(base registry.Key) string {
+	name, ok := rootKeyNames[base]
+	if !ok {
+		name = fmt.Sprint(base)
+	}
+
+	return name
+}
+
+// waitRegChange waits for a subkey or value of the key, or of its subkeys, to
+// change.  Only keys of the real registry can be watched.
+func waitRegChange(k regKey) error {
+	key, ok := k.(windowsRegKey)
+	if !ok {
+		return fmt.Errorf("can't watch registry key of type %T: %w", k, ErrStoreOpen)
+	}
+
+	return regwait.WaitChange(key.Key, true, regwait.Subkey|regwait.Value)
+}
+
+// registryViewAccess returns the access flag that selects the registry view
+// configured by the -registry-view flag, or 0 for the native view, for callers
+// that hold flagMu.  Operations snapshot it when they start and pass it to
+// regBackend.Root, rather than reading the flag for every key they open.
+func registryViewAccess() (uint32, error) {
+	switch registryView.Value() {
+	case "", "native":
+		return 0, nil
+	case "32":
+		return registry.WOW64_32KEY, nil
+	case "64":
+		return registry.WOW64_64KEY, nil
+	default:
+		return 0, fmt.Errorf("invalid registry view %q (consider native, 32, or 64): %w",
+			registryView.Value(), ErrInvalidStore)
+	}
+}
+
+func (windowsRegBackend) OpenKey(k regKey, path string, access uint32) (regKey, error) {
+	parent := k.(windowsRegKey)
+	fullPath := parent.path + `\` + path
+	log.Tracef("Opening registry key %s (access %#x)", fullPath, access|parent.view)
+
+	key, err := registry.OpenKey(parent.Key, path, access|parent.view)
+	if err != nil {
+		return nil, err
+	}
+
+	return windowsRegKey{key, fullPath, parent.view}, nil
+}
+
+func (windowsRegBackend) CreateKey(k regKey, path string, access uint32) (regKey, bool, error) {
+	parent := k.(windowsRegKey)
+	fullPath := parent.path + `\` + path
+	log.Tracef("Creating registry key %s (access %#x)", fullPath, access|parent.view)
+
+	key, openedExisting, err := registry.CreateKey(parent.Key, path, access|parent.view)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return windowsRegKey{key, fullPath, parent.view}, openedExisting, nil
+}
+
+// procRegDeleteKeyEx is needed to delete keys in a non-native registry view;
+// registry.DeleteKey always uses the native view.
+var procRegDeleteKeyEx = windows.NewLazySystemDLL("advapi32.dll").NewProc("RegDeleteKeyExW")
+
+// DeleteKey deletes the key at path.  If access is denied, e.g. because the
+// key was injected with -secure-acl, its default ACL is restored first, which
+// the key's owner can always do.
+func (b windowsRegBackend) DeleteKey(k regKey, path string) error {
+	return deleteKeyResettingDACL(b, k, path, b.deleteKey)
+}
+
+func (windowsRegBackend) deleteKey(k regKey, path string) error {
+	parent := k.(windowsRegKey)
+	log.Tracef("Deleting registry key %s\\%s", parent.path, path)
+
+	if parent.view == 0 {
+		return registry.DeleteKey(parent.Key, path)
+	}
+
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	ret, _, _ := procRegDeleteKeyEx.Call(uintptr(parent.Key), uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(parent.view), 0)
+	if ret != 0 {
+		return windows.Errno(ret)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package certinject
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// GenerateTestRoot generates a self-signed ECDSA P-256 CA cert with the given
+// common name, valid from a minute ago (to allow for clock skew) until ttl
+// from now, e.g. to try injection end-to-end without supplying a cert.  It
+// returns the cert's DER and its private key, with which leaf certs can be
+// issued for testing.  The cert isn't name-constrained; since it's trusted
+// for any name once injected, inject it with name constraints (see the nc.*
+// flags), keep the key private, and remove it when done.
+func GenerateTestRoot(cn string, ttl time.Duration) ([]byte, crypto.PrivateKey, error) {
+	return generateTestRoot(cn, ttl, nil)
+}
+
+// generateTestRoot is like GenerateTestRoot, and additionally constrains the
+// cert to the permitted DNS domains, if any.
+func generateTestRoot(cn string, ttl time.Duration, permittedDNS []string) ([]byte, crypto.PrivateKey, error) {
+	if ttl <= 0 {
+		return nil, nil, fmt.Errorf("test root TTL must be positive, got %s", ttl)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:                serial,
+		Subject:                     pkix.Name{CommonName: cn},
+		NotBefore:                   now.Add(-time.Minute),
+		NotAfter:                    now.Add(ttl),
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		PermittedDNSDomainsCritical: len(permittedDNS) != 0,
+		PermittedDNSDomains:         permittedDNS,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create cert: %w", err)
+	}
+
+	return derBytes, key, nil
+}
@@ -22,7 +22,11 @@ func publicKey(priv interface{}) interface{} {
 	}
 }
 
-func buildExtension(template *x509.Certificate, oid []int) ([]byte, error) {
+var ErrExtensionParse = errors.New("error parsing X.509 extension")
+
+// createCertificate signs the template with a throwaway key and parses the
+// result.
+func createCertificate(template *x509.Certificate) (*x509.Certificate, error) {
 	// Fill in dummy values to the template so that CreateCertificate doesn't
 	// complain.
 	template.SerialNumber = big.NewInt(1)
@@ -46,6 +50,15 @@ func buildExtension(template *x509.Certificate, oid []int) ([]byte, error) {
 		return nil, fmt.Errorf("%s: failed to parse certificate: %w", err, ErrExtensionMarshal)
 	}
 
+	return parsedCert, nil
+}
+
+func buildExtension(template *x509.Certificate, oid []int) ([]byte, error) {
+	parsedCert, err := createCertificate(template)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, ext := range parsedCert.Extensions {
 		if ext.Id.Equal(oid) {
 			return ext.Value, nil
@@ -55,14 +68,53 @@ func buildExtension(template *x509.Certificate, oid []int) ([]byte, error) {
 	return nil, fmt.Errorf("extension not found: %w", ErrExtensionMarshal)
 }
 
+// parseExtension is the inverse of buildExtension: it wraps the extension
+// value in a dummy certificate, so that the standard library parses it into
+// the corresponding fields of the returned certificate.
+func parseExtension(value []byte, oid []int) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:    oid,
+				Value: value,
+			},
+		},
+	}
+
+	parsedCert, err := createCertificate(template)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", err, ErrExtensionParse)
+	}
+
+	return parsedCert, nil
+}
+
 func BuildExtKeyUsage(template *x509.Certificate) ([]byte, error) {
 	oidExtensionExtKeyUsage := []int{2, 5, 29, 37}
 
 	return buildExtension(template, oidExtensionExtKeyUsage)
 }
 
+// ParseExtKeyUsage parses an extended key usage extension value (as returned
+// by BuildExtKeyUsage) into the ExtKeyUsage and UnknownExtKeyUsage fields of
+// the returned certificate.
+func ParseExtKeyUsage(value []byte) (*x509.Certificate, error) {
+	oidExtensionExtKeyUsage := []int{2, 5, 29, 37}
+
+	return parseExtension(value, oidExtensionExtKeyUsage)
+}
+
 func BuildNameConstraints(template *x509.Certificate) ([]byte, error) {
 	oidExtensionNameConstraints := []int{2, 5, 29, 30}
 
 	return buildExtension(template, oidExtensionNameConstraints)
 }
+
+// ParseNameConstraints parses a name constraints extension value (as returned
+// by BuildNameConstraints) into the name constraints fields of the returned
+// certificate.
+func ParseNameConstraints(value []byte) (*x509.Certificate, error) {
+	oidExtensionNameConstraints := []int{2, 5, 29, 30}
+
+	return parseExtension(value, oidExtensionNameConstraints)
+}